@@ -13,6 +13,7 @@ import (
     "netsage/internal/db"
     "netsage/internal/jobs"
     "netsage/internal/observability"
+    "netsage/internal/pcap"
 )
 
 func main() {
@@ -55,16 +56,23 @@ func main() {
             continue
         }
 
-        if err := processJob(ctx, store, claimed); err != nil {
+        if err := processJob(ctx, store, cfg, claimed); err != nil {
             logger.Error("job failed", "job_id", claimed.Job.ID, "err", err)
             _ = jobs.MarkError(ctx, store.DB, claimed.Job.ID, err.Error())
         }
     }
 }
 
-func processJob(ctx context.Context, store *db.Store, claimed *jobs.ClaimedJob) error {
+func processJob(ctx context.Context, store *db.Store, cfg config.Config, claimed *jobs.ClaimedJob) error {
     lastProgress := float64(-1)
-    err := analysis.ProcessJob(ctx, store.DB, claimed.Job, claimed.Pcap, claimed.User, func(progress float64) {
+    opts := pcap.Options{
+        TCPIdleTimeout: time.Duration(cfg.TCPIdleTimeoutSec) * time.Second,
+        UDPIdleTimeout: time.Duration(cfg.UDPIdleTimeoutSec) * time.Second,
+        FlowExpiry:     time.Duration(cfg.FlowExpirySec) * time.Second,
+        MemoryBudget:   cfg.AnalysisMemoryMB << 20,
+        Workers:        cfg.AnalysisWorkers,
+    }
+    err := analysis.ProcessJob(ctx, store.DB, claimed.Job, claimed.Pcap, claimed.User, opts, func(progress float64) {
         if progress-lastProgress >= 1.0 || progress == 100 {
             _ = jobs.UpdateProgress(ctx, store.DB, claimed.Job.ID, progress)
             lastProgress = progress
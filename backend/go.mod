@@ -16,7 +16,10 @@ require (
 
 replace github.com/rogpeppe/go-internal v1.14.1 => github.com/rogpeppe/go-internal v1.12.0
 
-require golang.org/x/crypto v0.28.0
+require (
+	golang.org/x/crypto v0.28.0
+	golang.org/x/net v0.30.0
+)
 
 require (
 	github.com/jackc/pgpassfile v1.0.0 // indirect
@@ -29,7 +32,6 @@ require (
 	github.com/rogpeppe/go-internal v1.14.1 // indirect
 	github.com/sethvargo/go-retry v0.2.4 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
-	golang.org/x/net v0.30.0 // indirect
 	golang.org/x/sync v0.8.0 // indirect
 	golang.org/x/sys v0.26.0 // indirect
 	golang.org/x/text v0.19.0 // indirect
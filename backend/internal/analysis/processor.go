@@ -1,12 +1,14 @@
 package analysis
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
-	"sort"
+	"fmt"
+	"slices"
+
 	"strings"
 	"sync"
-	"time"
 
 	"netsage/internal/db"
 	"netsage/internal/flows"
@@ -31,72 +33,47 @@ func loadRules() ([]triage.Rule, error) {
 	return rulesCache, rulesErr
 }
 
-type tcpStreamEntry struct {
-	key        flows.FlowKey
-	clientIP   string
-	clientPort int
-	serverIP   string
-	serverPort int
-	start      time.Time
-}
-
-func assignTCPStreams(flowsMap map[flows.FlowKey]*flows.FlowAgg) map[flows.FlowKey]int {
-	entries := make([]tcpStreamEntry, 0)
-	for key, flow := range flowsMap {
-		if flow.Key.Proto != "TCP" {
-			continue
-		}
-		clientIP, clientPort, serverIP, serverPort := flow.ClientServer()
-		entries = append(entries, tcpStreamEntry{
-			key:        key,
-			clientIP:   clientIP,
-			clientPort: clientPort,
-			serverIP:   serverIP,
-			serverPort: serverPort,
-			start:      flow.FirstSeen,
-		})
-	}
-
-	sort.Slice(entries, func(i, j int) bool {
-		if !entries[i].start.Equal(entries[j].start) {
-			return entries[i].start.Before(entries[j].start)
-		}
-		if entries[i].clientIP != entries[j].clientIP {
-			return strings.Compare(entries[i].clientIP, entries[j].clientIP) < 0
-		}
-		if entries[i].clientPort != entries[j].clientPort {
-			return entries[i].clientPort < entries[j].clientPort
-		}
-		if entries[i].serverIP != entries[j].serverIP {
-			return strings.Compare(entries[i].serverIP, entries[j].serverIP) < 0
-		}
-		if entries[i].serverPort != entries[j].serverPort {
-			return entries[i].serverPort < entries[j].serverPort
-		}
-		return entries[i].key.SrcIP < entries[j].key.SrcIP
-	})
-
-	streamMap := make(map[flows.FlowKey]int, len(entries))
-	for idx, entry := range entries {
-		streamID := idx
-		streamMap[entry.key] = streamID
-		if flow, ok := flowsMap[entry.key]; ok {
-			flow.TCPStreamID = &streamID
-		}
-	}
-	return streamMap
-}
-
-func ProcessJob(ctx context.Context, gdb *gorm.DB, job db.Job, pcapRecord db.Pcap, user db.User, onProgress ProgressFunc) error {
+// ProcessJob analyzes a capture and stores its flows and findings. opts
+// carries the analysis settings; the capture's key log is added to it.
+// Flows are stored in batches as the analysis finalizes them, so a large
+// capture never holds all of them at once.
+func ProcessJob(ctx context.Context, gdb *gorm.DB, job db.Job, pcapRecord db.Pcap, user db.User, opts pcap.Options, onProgress ProgressFunc) error {
 	if err := gdb.WithContext(ctx).Where("pcap_id = ?", pcapRecord.ID).Delete(&db.Flow{}).Error; err != nil {
 		return err
 	}
 	if err := gdb.WithContext(ctx).Where("pcap_id = ?", pcapRecord.ID).Delete(&db.PcapStats{}).Error; err != nil {
 		return err
 	}
+	if err := gdb.WithContext(ctx).Where("job_id = ?", job.ID).Delete(&db.Issue{}).Error; err != nil {
+		return err
+	}
+
+	rules, err := loadRules()
+	if err != nil {
+		return err
+	}
+	writer := &flowWriter{
+		ctx:   ctx,
+		gdb:   gdb,
+		job:   job,
+		pcap:  pcapRecord,
+		user:  user,
+		rules: rules,
+		stats: pcap.NewStatsBuilder(),
+		rows:  make(map[flows.FlowKey]uint),
+	}
+	opts.OnFlows = writer.write
+	opts.OnForget = writer.forget
+	opts.IndexPath = fmt.Sprintf("%s.job%d.idx", pcapRecord.StoragePath, job.ID)
 
 	lastProgress := float64(-1)
-	result, err := pcap.AnalyzeFile(ctx, pcapRecord.StoragePath, func(bytesRead, total int64) {
+	if pcapRecord.KeyLogPath != nil {
+		opts.KeyLogPath = *pcapRecord.KeyLogPath
+	}
+	if pcapRecord.CaptureFilter != nil {
+		opts.CaptureFilter = *pcapRecord.CaptureFilter
+	}
+	result, err := pcap.AnalyzeFile(ctx, pcapRecord.StoragePath, opts, func(bytesRead, total int64) {
 		if total == 0 {
 			return
 		}
@@ -112,100 +89,237 @@ func ProcessJob(ctx context.Context, gdb *gorm.DB, job db.Job, pcapRecord db.Pca
 		return err
 	}
 
-	streamMap := assignTCPStreams(result.Flows)
-
-	flowRecords := make([]db.Flow, 0, len(result.Flows))
-	flowIndex := make(map[flows.FlowKey]*db.Flow)
-
-	for _, agg := range result.Flows {
-		clientIP, clientPort, serverIP, serverPort := agg.ClientServer()
-		record := db.Flow{
-			PcapID:              pcapRecord.ID,
-			UserID:              user.ID,
-			Proto:               agg.Key.Proto,
-			SrcIP:               agg.Key.SrcIP,
-			DstIP:               agg.Key.DstIP,
-			SrcPort:             agg.Key.SrcPort,
-			DstPort:             agg.Key.DstPort,
-			ClientIP:            clientIP,
-			ClientPort:          clientPort,
-			ServerIP:            serverIP,
-			ServerPort:          serverPort,
-			StartTS:             agg.FirstSeen,
-			EndTS:               agg.LastSeen,
-			SynTime:             agg.SynTime,
-			SynAckTime:          agg.SynAckTime,
-			AckTime:             agg.AckTime,
-			RTTMs:               agg.RTTMs,
-			BytesSent:           agg.BytesSent,
-			BytesRecv:           agg.BytesRecv,
-			BytesClientToServer: agg.BytesClientToServer,
-			BytesServerToClient: agg.BytesServerToClient,
-			PacketCount:         agg.PacketCount,
-			Retransmits:         agg.Retransmits,
-			SynRetransmits:      agg.SynRetransmits,
-			OutOfOrder:          agg.OutOfOrder,
-			DupAcks:             agg.DupAcks,
-			FirstPayloadTime:    agg.FirstPayloadTime,
-			LastPayloadTime:     agg.LastPayloadTime,
-			DurationMs:          agg.DurationMs,
-			AppBytes:            agg.AppBytes,
-			MSS:                 agg.MSS,
-			TLSVersion:          agg.TLSVersion,
-			TLSSNI:              agg.TLSSNI,
-			ALPN:                agg.ALPN,
-			TLSClientHello:      agg.SawClientHello,
-			TLSServerHello:      agg.SawServerHello,
-			TLSAlert:            agg.TLSAlert,
-			TLSAlertCode:        agg.TLSAlertCode,
-			RSTCount:            agg.RSTCount,
-			FragmentCount:       agg.FragmentCount,
-			ThroughputBps:       agg.ThroughputBps,
-			HTTPMethod:          agg.HTTPMethod,
-			HTTPHost:            agg.HTTPHost,
-			HTTPTime:            agg.HTTPTime,
+	stats := writer.stats.Build(result.RTTHistogram)
+	talkersJSON, flowsJSON, histJSON := stats.JSON()
+
+	statsRecord := db.PcapStats{
+		PcapID:           pcapRecord.ID,
+		UserID:           user.ID,
+		TopTalkersJSON:   talkersJSON,
+		TopFlowsJSON:     flowsJSON,
+		RTTHistogramJSON: histJSON,
+	}
+
+	if err := gdb.WithContext(ctx).Create(&statsRecord).Error; err != nil {
+		return err
+	}
+
+	if result.Indexed {
+		if err := gdb.WithContext(ctx).Model(&db.Job{}).Where("id = ?", job.ID).Update("index_path", opts.IndexPath).Error; err != nil {
+			return err
 		}
-		if streamID, ok := streamMap[agg.Key]; ok {
-			id := streamID
-			record.TCPStream = &id
+	}
+
+	return nil
+}
+
+// flowWriter stores each batch of finalized flows with their HTTP
+// transactions and triage findings, and adds them to the capture stats.
+type flowWriter struct {
+	ctx   context.Context
+	gdb   *gorm.DB
+	job   db.Job
+	pcap  db.Pcap
+	user  db.User
+	rules []triage.Rule
+	stats *pcap.StatsBuilder
+	// rows are the IDs of the rows flows were stored in, until no later
+	// flow can carry their connections on.
+	rows map[flows.FlowKey]uint
+}
+
+func (w *flowWriter) write(batch []*flows.FlowAgg) error {
+	ctx, gdb := w.ctx, w.gdb
+	// A flow that carries on a connection finalized early is merged into
+	// the stored flow of the connection, which may be in this batch, so
+	// the others are stored first.
+	var continued []*flows.FlowAgg
+	fresh := make([]*flows.FlowAgg, 0, len(batch))
+	for _, agg := range batch {
+		if agg.ContinuedFrom != nil {
+			continued = append(continued, agg)
+		} else {
+			w.stats.Add(agg)
+			fresh = append(fresh, agg)
 		}
-		flowRecords = append(flowRecords, record)
-		flowIndex[agg.Key] = &flowRecords[len(flowRecords)-1]
 	}
 
+	flowRecords := make([]db.Flow, 0, len(fresh))
+	flowMap := make(map[flows.FlowKey]*flows.FlowAgg, len(fresh))
+	for _, agg := range fresh {
+		flowRecords = append(flowRecords, flowAggRecord(agg, w.pcap, w.user))
+		flowMap[agg.Key] = agg
+	}
 	if len(flowRecords) > 0 {
 		if err := gdb.WithContext(ctx).CreateInBatches(&flowRecords, 200).Error; err != nil {
 			return err
 		}
 	}
-
-	rules, err := loadRules()
-	if err != nil {
+	stored := make([]storedFlow, len(fresh))
+	for i, agg := range fresh {
+		stored[i] = storedFlow{record: &flowRecords[i]}
+		w.rows[agg.Key] = flowRecords[i].ID
+	}
+	if err := w.storeFlows(fresh, stored, flowMap); err != nil {
 		return err
 	}
-	findings, err := triage.Evaluate(result.Flows, rules)
+
+	// Parts of one connection are handed off in the order they were seen.
+	for _, agg := range continued {
+		merged, part, err := w.mergeFlow(agg)
+		if err != nil {
+			return err
+		}
+		if err := w.storeFlows([]*flows.FlowAgg{merged}, []storedFlow{part}, map[flows.FlowKey]*flows.FlowAgg{agg.Key: merged}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forget drops the rows of flows whose connections will not be carried on.
+func (w *flowWriter) forget(keys []flows.FlowKey) {
+	for _, key := range keys {
+		delete(w.rows, key)
+	}
+}
+
+// storedFlow is the row a flow was stored in, with the number of packets
+// stored in it before the flow's, as HTTP transactions index packets from
+// the start of the row, and the packets the evidence of the findings
+// stored for the row before spanned, by issue type.
+type storedFlow struct {
+	record  *db.Flow
+	offset  int
+	earlier map[string]packetSpan
+}
+
+// packetSpan is the first and last packet of a piece of evidence.
+type packetSpan struct {
+	start, end int
+}
+
+// mergeFlow adds a flow that carries on a connection finalized early to the
+// stored flow of the connection and drops the findings stored for it so
+// far. It returns the flow to evaluate in their place, as carryOn does.
+func (w *flowWriter) mergeFlow(agg *flows.FlowAgg) (*flows.FlowAgg, storedFlow, error) {
+	id, ok := w.rows[agg.Key]
+	if !ok {
+		return nil, storedFlow{}, fmt.Errorf("no stored flow for the connection continued by %s:%d -> %s:%d", agg.Key.SrcIP, agg.Key.SrcPort, agg.Key.DstIP, agg.Key.DstPort)
+	}
+	var record db.Flow
+	if err := w.gdb.WithContext(w.ctx).First(&record, id).Error; err != nil {
+		return nil, storedFlow{}, fmt.Errorf("find the stored flow continued by %s:%d -> %s:%d: %w", agg.Key.SrcIP, agg.Key.SrcPort, agg.Key.DstIP, agg.Key.DstPort, err)
+	}
+	merged, offset := w.carryOn(&record, agg)
+	if err := w.gdb.WithContext(w.ctx).Save(&record).Error; err != nil {
+		return nil, storedFlow{}, err
+	}
+	earlier, err := w.dropFindings(record.ID)
 	if err != nil {
-		return err
+		return nil, storedFlow{}, err
 	}
+	return merged, storedFlow{record: &record, offset: offset, earlier: earlier}, nil
+}
 
-	tx := gdb.WithContext(ctx).Begin()
-	if err := tx.Where("job_id = ?", job.ID).Delete(&db.Issue{}).Error; err != nil {
-		tx.Rollback()
+// carryOn merges agg, which carries on the connection stored in record, into
+// record and adds it to the stats. It returns the flow triage evaluates for
+// the connection, agg with the metrics of the merged record and its packet
+// indexes counted from the start of the row, and the packets the row held
+// before.
+func (w *flowWriter) carryOn(record *db.Flow, agg *flows.FlowAgg) (*flows.FlowAgg, int) {
+	offset := int(record.PacketCount)
+	w.stats.AddContinued(agg, record.BytesSent+record.BytesRecv)
+	mergeFlowRecord(record, flowAggRecord(agg, w.pcap, w.user))
+	return mergedFlowAgg(agg.WithOffset(offset), *record), offset
+}
+
+// dropFindings deletes the findings stored for the row with id and returns
+// the packets their evidence spanned, by issue type.
+func (w *flowWriter) dropFindings(id uint) (map[string]packetSpan, error) {
+	gdb := w.gdb.WithContext(w.ctx)
+	var issues []db.Issue
+	if err := gdb.Where("job_id = ? AND primary_flow_id = ?", w.job.ID, id).Find(&issues).Error; err != nil {
+		return nil, err
+	}
+	if len(issues) == 0 {
+		return nil, nil
+	}
+	ids := make([]uint, len(issues))
+	issueTypes := make(map[uint]string, len(issues))
+	for i, issue := range issues {
+		ids[i] = issue.ID
+		issueTypes[issue.ID] = issue.IssueType
+	}
+	var evidence []db.IssueEvidence
+	if err := gdb.Where("issue_id IN ? AND flow_id = ?", ids, id).Find(&evidence).Error; err != nil {
+		return nil, err
+	}
+	spans := make(map[string]packetSpan)
+	for _, ev := range evidence {
+		if ev.PacketStartIndex <= 0 {
+			continue
+		}
+		span, ok := spans[issueTypes[ev.IssueID]]
+		if ok {
+			span = packetSpan{start: min(span.start, ev.PacketStartIndex), end: max(span.end, ev.PacketEndIndex)}
+		} else {
+			span = packetSpan{start: ev.PacketStartIndex, end: ev.PacketEndIndex}
+		}
+		spans[issueTypes[ev.IssueID]] = span
+	}
+	if err := gdb.Where("id IN ?", ids).Delete(&db.Issue{}).Error; err != nil {
+		return nil, err
+	}
+	return spans, nil
+}
+
+// storeFlows stores the HTTP transactions and triage findings of flows
+// already stored as stored; flowMap holds the same flows by key. A finding
+// replacing one stored for the row before spans its evidence too.
+func (w *flowWriter) storeFlows(batch []*flows.FlowAgg, stored []storedFlow, flowMap map[flows.FlowKey]*flows.FlowAgg) error {
+	ctx, gdb := w.ctx, w.gdb
+	flowIndex := make(map[flows.FlowKey]storedFlow, len(batch))
+	for i, agg := range batch {
+		flowIndex[agg.Key] = stored[i]
+	}
+
+	transactions := make([]db.HTTPTransaction, 0)
+	for i, agg := range batch {
+		for _, tx := range agg.HTTPTransactions {
+			record := httpTransactionRecord(tx, stored[i].record)
+			record.PacketStartIndex += stored[i].offset
+			record.PacketEndIndex += stored[i].offset
+			transactions = append(transactions, record)
+		}
+	}
+	if len(transactions) > 0 {
+		if err := gdb.WithContext(ctx).CreateInBatches(&transactions, 500).Error; err != nil {
+			return err
+		}
+	}
+
+	findings, err := triage.Evaluate(flowMap, w.rules)
+	if err != nil {
 		return err
 	}
+	if len(findings) == 0 {
+		return nil
+	}
 
+	tx := gdb.WithContext(ctx).Begin()
 	for _, finding := range findings {
 		var primaryFlowID *uint
 		if finding.PrimaryFlow != nil {
 			if flowRecord, ok := flowIndex[finding.PrimaryFlow.Key]; ok {
-				primaryFlowID = &flowRecord.ID
+				primaryFlowID = &flowRecord.record.ID
 			}
 		}
 
 		issue := db.Issue{
-			PcapID:        pcapRecord.ID,
-			JobID:         &job.ID,
-			UserID:        user.ID,
+			PcapID:        w.pcap.ID,
+			JobID:         &w.job.ID,
+			UserID:        w.user.ID,
 			PrimaryFlowID: primaryFlowID,
 			Severity:      finding.Severity,
 			IssueType:     string(finding.IssueType),
@@ -225,6 +339,10 @@ func ProcessJob(ctx context.Context, gdb *gorm.DB, job db.Job, pcapRecord db.Pca
 			if !ok {
 				continue
 			}
+			start, end := evidence.PacketStartIndex, evidence.PacketEndIndex
+			if span, ok := flowRecord.earlier[string(finding.IssueType)]; ok && start > 0 {
+				start, end = min(start, span.start), max(end, span.end)
+			}
 			metricsJSON, err := json.Marshal(evidence.Metrics)
 			if err != nil {
 				tx.Rollback()
@@ -232,9 +350,9 @@ func ProcessJob(ctx context.Context, gdb *gorm.DB, job db.Job, pcapRecord db.Pca
 			}
 			ev := db.IssueEvidence{
 				IssueID:          issue.ID,
-				FlowID:           flowRecord.ID,
-				PacketStartIndex: evidence.PacketStartIndex,
-				PacketEndIndex:   evidence.PacketEndIndex,
+				FlowID:           flowRecord.record.ID,
+				PacketStartIndex: start,
+				PacketEndIndex:   end,
 				MetricsJSON:      string(metricsJSON),
 			}
 			if err := tx.Create(&ev).Error; err != nil {
@@ -243,24 +361,478 @@ func ProcessJob(ctx context.Context, gdb *gorm.DB, job db.Job, pcapRecord db.Pca
 			}
 		}
 	}
-	if err := tx.Commit().Error; err != nil {
-		return err
+	return tx.Commit().Error
+}
+
+func flowAggRecord(agg *flows.FlowAgg, pcapRecord db.Pcap, user db.User) db.Flow {
+	clientIP, clientPort, serverIP, serverPort := agg.ClientServer()
+	var tunnelType *string
+	var tunnelID *int64
+	if agg.Key.Tunnel.Type != "" {
+		kind := agg.Key.Tunnel.Type
+		id := int64(agg.Key.Tunnel.ID)
+		tunnelType = &kind
+		tunnelID = &id
 	}
+	record := db.Flow{
+		PcapID:                 pcapRecord.ID,
+		UserID:                 user.ID,
+		Proto:                  agg.Key.Proto,
+		SrcIP:                  agg.Key.SrcIP,
+		DstIP:                  agg.Key.DstIP,
+		SrcPort:                agg.Key.SrcPort,
+		DstPort:                agg.Key.DstPort,
+		ClientIP:               clientIP,
+		ClientPort:             clientPort,
+		ServerIP:               serverIP,
+		ServerPort:             serverPort,
+		TunnelType:             tunnelType,
+		TunnelID:               tunnelID,
+		StartTS:                agg.FirstSeen,
+		EndTS:                  agg.LastSeen,
+		SynTime:                agg.SynTime,
+		SynAckTime:             agg.SynAckTime,
+		AckTime:                agg.AckTime,
+		RTTMs:                  agg.RTTMs,
+		RTTMinMs:               agg.RTTMinMs,
+		RTTAvgMs:               agg.RTTAvgMs,
+		RTTP95Ms:               agg.RTTP95Ms,
+		RTTMaxMs:               agg.RTTMaxMs,
+		RTTSamples:             agg.RTTSampleCount,
+		BytesSent:              agg.BytesSent,
+		BytesRecv:              agg.BytesRecv,
+		BytesClientToServer:    agg.BytesClientToServer,
+		BytesServerToClient:    agg.BytesServerToClient,
+		PacketCount:            agg.PacketCount,
+		Retransmits:            agg.Retransmits,
+		SynRetransmits:         agg.SynRetransmits,
+		OutOfOrder:             agg.OutOfOrder,
+		DupAcks:                agg.DupAcks,
+		FirstPayloadTime:       agg.FirstPayloadTime,
+		LastPayloadTime:        agg.LastPayloadTime,
+		DurationMs:             agg.DurationMs,
+		AppBytes:               agg.AppBytes,
+		MSS:                    agg.MSS,
+		ClientMSS:              agg.ClientMSS,
+		ServerMSS:              agg.ServerMSS,
+		ClientWindowScale:      agg.ClientWindowScale,
+		ServerWindowScale:      agg.ServerWindowScale,
+		ClientRwndMin:          agg.ClientRwndMin,
+		ClientRwndMax:          agg.ClientRwndMax,
+		ServerRwndMin:          agg.ServerRwndMin,
+		ServerRwndMax:          agg.ServerRwndMax,
+		SACKPermitted:          agg.SACKPermitted,
+		TCPTimestamps:          agg.TCPTimestamps,
+		SACKLossEvents:         agg.SACKLossEvents,
+		RetransRTO:             agg.RetransRTO,
+		RetransFast:            agg.RetransFast,
+		RetransTLP:             agg.RetransTLP,
+		RetransSpurious:        agg.RetransSpurious,
+		RetransPartial:         agg.RetransPartial,
+		RTOMinMs:               agg.RTOMinMs,
+		RTOAvgMs:               agg.RTOAvgMs,
+		RTOMaxMs:               agg.RTOMaxMs,
+		ZeroWindows:            agg.ZeroWindows,
+		ZeroWindowProbes:       agg.ZeroWindowProbes,
+		WindowUpdates:          agg.WindowUpdates,
+		WindowFull:             agg.WindowFull,
+		ClientStallMs:          agg.ClientStallMs,
+		ServerStallMs:          agg.ServerStallMs,
+		TLSVersion:             agg.TLSVersion,
+		TLSSNI:                 agg.TLSSNI,
+		ALPN:                   agg.ALPN,
+		JA3:                    agg.JA3,
+		JA3S:                   agg.JA3S,
+		JA4:                    agg.JA4,
+		TLSClientHello:         agg.SawClientHello,
+		TLSServerHello:         agg.SawServerHello,
+		TLSAlert:               agg.TLSAlert,
+		TLSAlertCode:           agg.TLSAlertCode,
+		RSTCount:               agg.RSTCount,
+		TCPState:               agg.TCPState,
+		CloseInitiator:         agg.CloseInitiator,
+		Handshake:              agg.Handshake,
+		MidConnection:          agg.MidConnection,
+		FragmentCount:          agg.FragmentCount,
+		FragmentsReassembled:   agg.Defragmented,
+		FragmentTimeouts:       agg.FragmentTimeouts,
+		FragmentIncomplete:     agg.FragmentIncomplete,
+		ThroughputBps:          agg.ThroughputBps,
+		HTTPMethod:             agg.HTTPMethod,
+		HTTPHost:               agg.HTTPHost,
+		HTTPTime:               agg.HTTPTime,
+		HTTPPath:               agg.HTTPPath,
+		HTTPStatus:             agg.HTTPStatus,
+		HTTPResponseMs:         agg.HTTPResponseMs,
+		TLSDecrypted:           agg.TLSDecrypted,
+		HTTPRequests:           agg.HTTPRequests,
+		HTTPResponses:          agg.HTTPResponses,
+		HTTP4xx:                agg.HTTP4xx,
+		HTTP5xx:                agg.HTTP5xx,
+		HTTPTTFBP50Ms:          agg.HTTPTTFBP50Ms,
+		HTTPTTFBP95Ms:          agg.HTTPTTFBP95Ms,
+		HTTPTTFBMaxMs:          agg.HTTPTTFBMaxMs,
+		DNSQueries:             agg.DNSQueries,
+		DNSResponses:           agg.DNSResponses,
+		DNSNXDomain:            agg.DNSNXDomain,
+		DNSServFail:            agg.DNSServFail,
+		DNSUnanswered:          agg.DNSUnanswered,
+		DNSLatencyAvgMs:        agg.DNSLatencyAvgMs,
+		DNSLatencyMaxMs:        agg.DNSLatencyMaxMs,
+		DNSQueryName:           agg.DNSQueryName,
+		DNSQueryType:           agg.DNSQueryType,
+		QUICVersion:            agg.QUICVersion,
+		QUICDCID:               agg.QUICDCID,
+		QUICSCID:               agg.QUICSCID,
+		QUICClientInitials:     agg.QUICClientInitials,
+		QUICServerPackets:      agg.QUICServerPackets,
+		QUICVersionNegotiation: agg.QUICVersionNegotiation,
+		QUICRetry:              agg.QUICRetry,
+		QUICHandshakeFailed:    agg.QUICHandshakeFailed,
+		ICMPErrors:             agg.ICMPErrors,
+		ICMPUnreachable:        agg.ICMPUnreachable,
+		ICMPFragNeeded:         agg.ICMPFragNeeded,
+		ICMPTimeExceeded:       agg.ICMPTimeExceeded,
+		ICMPNextHopMTU:         agg.ICMPNextHopMTU,
+		ICMPUnreachableCode:    agg.ICMPUnreachableCode,
+		TCPStream:              agg.TCPStreamID,
+	}
+	if len(agg.Interfaces) > 0 {
+		interfaces := strings.Join(agg.Interfaces, ",")
+		record.Interfaces = &interfaces
+	}
+	if agg.CertReport != nil {
+		if raw, err := json.Marshal(agg.CertReport); err == nil {
+			certJSON := string(raw)
+			record.CertReportJSON = &certJSON
+		}
+	}
+	return record
+}
 
-	stats := pcap.BuildStats(result.Flows, result.RTTHistogram)
-	talkersJSON, flowsJSON, histJSON := stats.JSON()
+// mergedFlowAgg sets the metrics of flow, which carries on the connection
+// stored in record, to those of record, the whole connection, as
+// flowAggRecord stores them.
+func mergedFlowAgg(flow *flows.FlowAgg, record db.Flow) *flows.FlowAgg {
+	flow.FirstSeen = record.StartTS
+	flow.LastSeen = record.EndTS
+	flow.SynTime = record.SynTime
+	flow.SynAckTime = record.SynAckTime
+	flow.AckTime = record.AckTime
+	flow.RTTMs = record.RTTMs
+	flow.RTTMinMs = record.RTTMinMs
+	flow.RTTAvgMs = record.RTTAvgMs
+	flow.RTTP95Ms = record.RTTP95Ms
+	flow.RTTMaxMs = record.RTTMaxMs
+	flow.RTTSampleCount = record.RTTSamples
+	flow.BytesSent = record.BytesSent
+	flow.BytesRecv = record.BytesRecv
+	flow.BytesClientToServer = record.BytesClientToServer
+	flow.BytesServerToClient = record.BytesServerToClient
+	flow.PacketCount = record.PacketCount
+	flow.Retransmits = record.Retransmits
+	flow.SynRetransmits = record.SynRetransmits
+	flow.OutOfOrder = record.OutOfOrder
+	flow.DupAcks = record.DupAcks
+	flow.FirstPayloadTime = record.FirstPayloadTime
+	flow.LastPayloadTime = record.LastPayloadTime
+	flow.DurationMs = record.DurationMs
+	flow.AppBytes = record.AppBytes
+	flow.MSS = record.MSS
+	flow.ClientMSS = record.ClientMSS
+	flow.ServerMSS = record.ServerMSS
+	flow.ClientWindowScale = record.ClientWindowScale
+	flow.ServerWindowScale = record.ServerWindowScale
+	flow.ClientRwndMin = record.ClientRwndMin
+	flow.ClientRwndMax = record.ClientRwndMax
+	flow.ServerRwndMin = record.ServerRwndMin
+	flow.ServerRwndMax = record.ServerRwndMax
+	flow.SACKPermitted = record.SACKPermitted
+	flow.TCPTimestamps = record.TCPTimestamps
+	flow.SACKLossEvents = record.SACKLossEvents
+	flow.RetransRTO = record.RetransRTO
+	flow.RetransFast = record.RetransFast
+	flow.RetransTLP = record.RetransTLP
+	flow.RetransSpurious = record.RetransSpurious
+	flow.RetransPartial = record.RetransPartial
+	flow.RTOMinMs = record.RTOMinMs
+	flow.RTOAvgMs = record.RTOAvgMs
+	flow.RTOMaxMs = record.RTOMaxMs
+	flow.ZeroWindows = record.ZeroWindows
+	flow.ZeroWindowProbes = record.ZeroWindowProbes
+	flow.WindowUpdates = record.WindowUpdates
+	flow.WindowFull = record.WindowFull
+	flow.ClientStallMs = record.ClientStallMs
+	flow.ServerStallMs = record.ServerStallMs
+	flow.TLSVersion = record.TLSVersion
+	flow.TLSSNI = record.TLSSNI
+	flow.ALPN = record.ALPN
+	flow.JA3 = record.JA3
+	flow.JA3S = record.JA3S
+	flow.JA4 = record.JA4
+	flow.SawClientHello = record.TLSClientHello
+	flow.SawServerHello = record.TLSServerHello
+	flow.TLSAlert = record.TLSAlert
+	flow.TLSAlertCode = record.TLSAlertCode
+	flow.RSTCount = record.RSTCount
+	flow.TCPState = record.TCPState
+	flow.CloseInitiator = record.CloseInitiator
+	flow.Handshake = record.Handshake
+	flow.MidConnection = record.MidConnection
+	flow.FragmentCount = record.FragmentCount
+	flow.Defragmented = record.FragmentsReassembled
+	flow.FragmentTimeouts = record.FragmentTimeouts
+	flow.FragmentIncomplete = record.FragmentIncomplete
+	flow.ThroughputBps = record.ThroughputBps
+	flow.HTTPMethod = record.HTTPMethod
+	flow.HTTPHost = record.HTTPHost
+	flow.HTTPTime = record.HTTPTime
+	flow.HTTPPath = record.HTTPPath
+	flow.HTTPStatus = record.HTTPStatus
+	flow.HTTPResponseMs = record.HTTPResponseMs
+	flow.TLSDecrypted = record.TLSDecrypted
+	flow.HTTPRequests = record.HTTPRequests
+	flow.HTTPResponses = record.HTTPResponses
+	flow.HTTP4xx = record.HTTP4xx
+	flow.HTTP5xx = record.HTTP5xx
+	flow.HTTPTTFBP50Ms = record.HTTPTTFBP50Ms
+	flow.HTTPTTFBP95Ms = record.HTTPTTFBP95Ms
+	flow.HTTPTTFBMaxMs = record.HTTPTTFBMaxMs
+	flow.DNSQueries = record.DNSQueries
+	flow.DNSResponses = record.DNSResponses
+	flow.DNSNXDomain = record.DNSNXDomain
+	flow.DNSServFail = record.DNSServFail
+	flow.DNSUnanswered = record.DNSUnanswered
+	flow.DNSLatencyAvgMs = record.DNSLatencyAvgMs
+	flow.DNSLatencyMaxMs = record.DNSLatencyMaxMs
+	flow.DNSQueryName = record.DNSQueryName
+	flow.DNSQueryType = record.DNSQueryType
+	flow.QUICVersion = record.QUICVersion
+	flow.QUICDCID = record.QUICDCID
+	flow.QUICSCID = record.QUICSCID
+	flow.QUICClientInitials = record.QUICClientInitials
+	flow.QUICServerPackets = record.QUICServerPackets
+	flow.QUICVersionNegotiation = record.QUICVersionNegotiation
+	flow.QUICRetry = record.QUICRetry
+	flow.QUICHandshakeFailed = record.QUICHandshakeFailed
+	flow.ICMPErrors = record.ICMPErrors
+	flow.ICMPUnreachable = record.ICMPUnreachable
+	flow.ICMPFragNeeded = record.ICMPFragNeeded
+	flow.ICMPTimeExceeded = record.ICMPTimeExceeded
+	flow.ICMPNextHopMTU = record.ICMPNextHopMTU
+	flow.ICMPUnreachableCode = record.ICMPUnreachableCode
+	flow.TCPStreamID = record.TCPStream
+	flow.Interfaces = nil
+	if record.Interfaces != nil {
+		flow.Interfaces = strings.Split(*record.Interfaces, ",")
+	}
+	if record.CertReportJSON != nil {
+		var report flows.CertReport
+		if err := json.Unmarshal([]byte(*record.CertReportJSON), &report); err == nil {
+			flow.CertReport = &report
+		}
+	}
+	return flow
+}
 
-	statsRecord := db.PcapStats{
-		PcapID:           pcapRecord.ID,
-		UserID:           user.ID,
-		TopTalkersJSON:   talkersJSON,
-		TopFlowsJSON:     flowsJSON,
-		RTTHistogramJSON: histJSON,
+// mergeFlowRecord adds next, the record of a later part of the connection
+// stored in into, to into. Counts add up and the connection keeps the first
+// value seen of what describes it, while its state and end come from next.
+// Percentiles cannot be combined from two parts, so the larger is kept.
+func mergeFlowRecord(into *db.Flow, next db.Flow) {
+	into.EndTS = next.EndTS
+	into.LastPayloadTime = lastSet(into.LastPayloadTime, next.LastPayloadTime)
+	into.FirstPayloadTime = firstSet(into.FirstPayloadTime, next.FirstPayloadTime)
+	into.TCPState = lastSet(into.TCPState, next.TCPState)
+	into.CloseInitiator = lastSet(into.CloseInitiator, next.CloseInitiator)
+	into.Handshake = lastSet(into.Handshake, next.Handshake)
+	into.MidConnection = next.MidConnection
+
+	into.RTTAvgMs = weightedAverage(into.RTTAvgMs, into.RTTSamples, next.RTTAvgMs, next.RTTSamples)
+	into.RTOAvgMs = weightedAverage(into.RTOAvgMs, into.RetransRTO, next.RTOAvgMs, next.RetransRTO)
+	into.DNSLatencyAvgMs = weightedAverage(into.DNSLatencyAvgMs, into.DNSResponses, next.DNSLatencyAvgMs, next.DNSResponses)
+	into.RTTMinMs = minSet(into.RTTMinMs, next.RTTMinMs)
+	into.RTTP95Ms = maxSet(into.RTTP95Ms, next.RTTP95Ms)
+	into.RTTMaxMs = maxSet(into.RTTMaxMs, next.RTTMaxMs)
+	into.RTOMinMs = minSet(into.RTOMinMs, next.RTOMinMs)
+	into.RTOMaxMs = maxSet(into.RTOMaxMs, next.RTOMaxMs)
+	into.ClientRwndMin = minSet(into.ClientRwndMin, next.ClientRwndMin)
+	into.ClientRwndMax = maxSet(into.ClientRwndMax, next.ClientRwndMax)
+	into.ServerRwndMin = minSet(into.ServerRwndMin, next.ServerRwndMin)
+	into.ServerRwndMax = maxSet(into.ServerRwndMax, next.ServerRwndMax)
+	into.HTTPTTFBP50Ms = maxSet(into.HTTPTTFBP50Ms, next.HTTPTTFBP50Ms)
+	into.HTTPTTFBP95Ms = maxSet(into.HTTPTTFBP95Ms, next.HTTPTTFBP95Ms)
+	into.HTTPTTFBMaxMs = maxSet(into.HTTPTTFBMaxMs, next.HTTPTTFBMaxMs)
+	into.DNSLatencyMaxMs = maxSet(into.DNSLatencyMaxMs, next.DNSLatencyMaxMs)
+	into.ICMPNextHopMTU = minSet(into.ICMPNextHopMTU, next.ICMPNextHopMTU)
+
+	into.RTTSamples += next.RTTSamples
+	into.BytesSent += next.BytesSent
+	into.BytesRecv += next.BytesRecv
+	into.BytesClientToServer += next.BytesClientToServer
+	into.BytesServerToClient += next.BytesServerToClient
+	into.PacketCount += next.PacketCount
+	into.Retransmits += next.Retransmits
+	into.SynRetransmits += next.SynRetransmits
+	into.OutOfOrder += next.OutOfOrder
+	into.DupAcks += next.DupAcks
+	into.AppBytes += next.AppBytes
+	into.SACKLossEvents += next.SACKLossEvents
+	into.RetransRTO += next.RetransRTO
+	into.RetransFast += next.RetransFast
+	into.RetransTLP += next.RetransTLP
+	into.RetransSpurious += next.RetransSpurious
+	into.RetransPartial += next.RetransPartial
+	into.ZeroWindows += next.ZeroWindows
+	into.ZeroWindowProbes += next.ZeroWindowProbes
+	into.WindowUpdates += next.WindowUpdates
+	into.WindowFull += next.WindowFull
+	into.ClientStallMs += next.ClientStallMs
+	into.ServerStallMs += next.ServerStallMs
+	into.RSTCount += next.RSTCount
+	into.FragmentCount += next.FragmentCount
+	into.FragmentsReassembled += next.FragmentsReassembled
+	into.FragmentTimeouts += next.FragmentTimeouts
+	into.FragmentIncomplete += next.FragmentIncomplete
+	into.HTTPRequests += next.HTTPRequests
+	into.HTTPResponses += next.HTTPResponses
+	into.HTTP4xx += next.HTTP4xx
+	into.HTTP5xx += next.HTTP5xx
+	into.DNSQueries += next.DNSQueries
+	into.DNSResponses += next.DNSResponses
+	into.DNSNXDomain += next.DNSNXDomain
+	into.DNSServFail += next.DNSServFail
+	into.DNSUnanswered += next.DNSUnanswered
+	into.QUICClientInitials += next.QUICClientInitials
+	into.QUICServerPackets += next.QUICServerPackets
+	into.ICMPErrors += next.ICMPErrors
+	into.ICMPUnreachable += next.ICMPUnreachable
+	into.ICMPFragNeeded += next.ICMPFragNeeded
+	into.ICMPTimeExceeded += next.ICMPTimeExceeded
+
+	into.SACKPermitted = into.SACKPermitted || next.SACKPermitted
+	into.TCPTimestamps = into.TCPTimestamps || next.TCPTimestamps
+	into.TLSClientHello = into.TLSClientHello || next.TLSClientHello
+	into.TLSServerHello = into.TLSServerHello || next.TLSServerHello
+	into.TLSAlert = into.TLSAlert || next.TLSAlert
+	into.TLSDecrypted = into.TLSDecrypted || next.TLSDecrypted
+	into.QUICVersionNegotiation = into.QUICVersionNegotiation || next.QUICVersionNegotiation
+	into.QUICRetry = into.QUICRetry || next.QUICRetry
+	into.QUICHandshakeFailed = into.QUICHandshakeFailed || next.QUICHandshakeFailed
+
+	into.SynTime = firstSet(into.SynTime, next.SynTime)
+	into.SynAckTime = firstSet(into.SynAckTime, next.SynAckTime)
+	into.AckTime = firstSet(into.AckTime, next.AckTime)
+	into.RTTMs = firstSet(into.RTTMs, next.RTTMs)
+	into.MSS = firstSet(into.MSS, next.MSS)
+	into.ClientMSS = firstSet(into.ClientMSS, next.ClientMSS)
+	into.ServerMSS = firstSet(into.ServerMSS, next.ServerMSS)
+	into.ClientWindowScale = firstSet(into.ClientWindowScale, next.ClientWindowScale)
+	into.ServerWindowScale = firstSet(into.ServerWindowScale, next.ServerWindowScale)
+	into.TLSVersion = firstSet(into.TLSVersion, next.TLSVersion)
+	into.TLSSNI = firstSet(into.TLSSNI, next.TLSSNI)
+	into.ALPN = firstSet(into.ALPN, next.ALPN)
+	into.JA3 = firstSet(into.JA3, next.JA3)
+	into.JA3S = firstSet(into.JA3S, next.JA3S)
+	into.JA4 = firstSet(into.JA4, next.JA4)
+	into.TLSAlertCode = firstSet(into.TLSAlertCode, next.TLSAlertCode)
+	into.DNSQueryName = firstSet(into.DNSQueryName, next.DNSQueryName)
+	into.DNSQueryType = firstSet(into.DNSQueryType, next.DNSQueryType)
+	into.QUICVersion = firstSet(into.QUICVersion, next.QUICVersion)
+	into.QUICDCID = firstSet(into.QUICDCID, next.QUICDCID)
+	into.QUICSCID = firstSet(into.QUICSCID, next.QUICSCID)
+	into.ICMPUnreachableCode = firstSet(into.ICMPUnreachableCode, next.ICMPUnreachableCode)
+	into.CertReportJSON = firstSet(into.CertReportJSON, next.CertReportJSON)
+	into.HTTPHost = firstSet(into.HTTPHost, next.HTTPHost)
+	if into.HTTPMethod == nil {
+		// The first transaction's fields go together.
+		into.HTTPMethod, into.HTTPPath, into.HTTPTime = next.HTTPMethod, next.HTTPPath, next.HTTPTime
+		into.HTTPStatus, into.HTTPResponseMs = next.HTTPStatus, next.HTTPResponseMs
+	}
+	if next.Interfaces != nil {
+		if into.Interfaces == nil {
+			into.Interfaces = next.Interfaces
+		} else {
+			seen := strings.Split(*into.Interfaces, ",")
+			for _, name := range strings.Split(*next.Interfaces, ",") {
+				if !slices.Contains(seen, name) {
+					seen = append(seen, name)
+				}
+			}
+			interfaces := strings.Join(seen, ",")
+			into.Interfaces = &interfaces
+		}
 	}
 
-	if err := gdb.WithContext(ctx).Create(&statsRecord).Error; err != nil {
-		return err
+	into.DurationMs, into.ThroughputBps = nil, nil
+	if duration := into.EndTS.Sub(into.StartTS).Seconds(); duration > 0 {
+		bps := float64(into.BytesSent+into.BytesRecv) / duration
+		ms := duration * 1000
+		into.ThroughputBps, into.DurationMs = &bps, &ms
 	}
+}
 
-	return nil
+func firstSet[T any](a, b *T) *T {
+	if a != nil {
+		return a
+	}
+	return b
+}
+
+func lastSet[T any](a, b *T) *T {
+	if b != nil {
+		return b
+	}
+	return a
+}
+
+func minSet[T cmp.Ordered](a, b *T) *T {
+	if a == nil || (b != nil && *b < *a) {
+		return b
+	}
+	return a
+}
+
+func maxSet[T cmp.Ordered](a, b *T) *T {
+	if a == nil || (b != nil && *b > *a) {
+		return b
+	}
+	return a
+}
+
+// weightedAverage combines two averages of a and b samples.
+func weightedAverage(avgA *float64, a int64, avgB *float64, b int64) *float64 {
+	if avgA == nil || a <= 0 {
+		return firstSet(avgB, avgA)
+	}
+	if avgB == nil || b <= 0 {
+		return avgA
+	}
+	avg := (*avgA*float64(a) + *avgB*float64(b)) / float64(a+b)
+	return &avg
+}
+
+func httpTransactionRecord(tx flows.HTTPTransaction, flowRecord *db.Flow) db.HTTPTransaction {
+	record := db.HTTPTransaction{
+		PcapID:           flowRecord.PcapID,
+		FlowID:           flowRecord.ID,
+		UserID:           flowRecord.UserID,
+		Method:           tx.Method,
+		Path:             tx.Path,
+		Status:           tx.Status,
+		ContentLength:    tx.ContentLength,
+		RequestTS:        tx.RequestTime,
+		ResponseTS:       tx.ResponseTime,
+		TTFBMs:           tx.TTFBMs,
+		PacketStartIndex: tx.RequestIndex,
+		PacketEndIndex:   tx.RequestIndex,
+	}
+	if tx.Host != "" {
+		host := tx.Host
+		record.Host = &host
+	}
+	if tx.ResponseIndex != nil {
+		record.PacketEndIndex = *tx.ResponseIndex
+	}
+	return record
 }
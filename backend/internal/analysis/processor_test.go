@@ -0,0 +1,95 @@
+package analysis
+
+import (
+	"testing"
+	"time"
+
+	"netsage/internal/flows"
+	"netsage/internal/pcap"
+	"netsage/internal/triage"
+)
+
+// A connection that crosses the flow expiry is stored as one row: it ranks
+// once among the top flows, by the bytes of both parts, and triage sees the
+// merged record, where retransmissions too few in either part add up.
+func TestCarryOnMergesConnectionAcrossExpiry(t *testing.T) {
+	rules, err := loadRules()
+	if err != nil {
+		t.Fatalf("load rules: %v", err)
+	}
+	key := flows.FlowKey{Proto: "TCP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: 40000, DstPort: 443}
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	send := func(flow *flows.FlowAgg, ms int, forward bool, flags flows.TCPFlags, seq uint32, payload int) {
+		info := flows.PacketInfo{Timestamp: start.Add(time.Duration(ms) * time.Millisecond), Proto: "TCP", SrcIP: key.SrcIP, DstIP: key.DstIP, SrcPort: key.SrcPort, DstPort: key.DstPort, Seq: seq, PayloadLen: payload, TCPFlags: flags}
+		if !forward {
+			info.SrcIP, info.DstIP, info.SrcPort, info.DstPort = info.DstIP, info.SrcIP, info.DstPort, info.SrcPort
+		}
+		flow.Update(info, forward)
+	}
+
+	first := flows.NewFlowAgg(key, start)
+	send(first, 0, true, flows.TCPFlags{SYN: true}, 0, 0)
+	send(first, 10, false, flows.TCPFlags{SYN: true, ACK: true}, 0, 0)
+	send(first, 20, true, flows.TCPFlags{ACK: true}, 1, 0)
+	send(first, 30, true, flows.TCPFlags{ACK: true, PSH: true}, 1, 1000)
+	send(first, 400, true, flows.TCPFlags{ACK: true, PSH: true}, 1, 1000)
+	send(first, 1200, true, flows.TCPFlags{ACK: true, PSH: true}, 1, 1000)
+	first.Finalize()
+
+	second := flows.ContinueFlowAgg(key, start.Add(10*time.Minute), first.Continuation())
+	send(second, 600000, true, flows.TCPFlags{ACK: true, PSH: true}, 1001, 1000)
+	send(second, 600400, true, flows.TCPFlags{ACK: true, PSH: true}, 1001, 1000)
+	send(second, 601200, true, flows.TCPFlags{ACK: true, PSH: true}, 1001, 1000)
+	second.Finalize()
+	if first.Retransmits != 2 || second.Retransmits != 2 {
+		t.Fatalf("expected two retransmissions in each part, got %d and %d", first.Retransmits, second.Retransmits)
+	}
+
+	other := flows.FlowKey{Proto: "TCP", SrcIP: "10.0.0.3", DstIP: "10.0.0.2", SrcPort: 40001, DstPort: 443}
+	busy := flows.NewFlowAgg(other, start)
+	busy.BytesSent = 4000
+
+	w := &flowWriter{rules: rules, stats: pcap.NewStatsBuilder()}
+	w.stats.Add(first)
+	w.stats.Add(busy)
+	record := flowAggRecord(first, w.pcap, w.user)
+	for _, flow := range []*flows.FlowAgg{first, second} {
+		findings, err := triage.Evaluate(map[flows.FlowKey]*flows.FlowAgg{key: flow}, rules)
+		if err != nil {
+			t.Fatalf("evaluate: %v", err)
+		}
+		if retransmissionFinding(findings) != nil {
+			t.Fatalf("expected no part alone to show retransmissions")
+		}
+	}
+
+	merged, offset := w.carryOn(&record, second)
+	if offset != int(first.PacketCount) || record.PacketCount != first.PacketCount+second.PacketCount {
+		t.Fatalf("expected the second part after the first's %d packets, got offset %d of %d", first.PacketCount, offset, record.PacketCount)
+	}
+	findings, err := triage.Evaluate(map[flows.FlowKey]*flows.FlowAgg{key: merged}, rules)
+	if err != nil {
+		t.Fatalf("evaluate: %v", err)
+	}
+	finding := retransmissionFinding(findings)
+	if finding == nil || merged.Retransmits != 4 {
+		t.Fatalf("expected the merged connection's four retransmissions to be found, got %d", merged.Retransmits)
+	}
+	if ev := finding.EvidenceList[0]; ev.PacketStartIndex != offset+2 || ev.PacketEndIndex != offset+3 {
+		t.Fatalf("expected evidence on packets %d-%d of the row, got %d-%d", offset+2, offset+3, ev.PacketStartIndex, ev.PacketEndIndex)
+	}
+
+	top := w.stats.Build(flows.NewRTTHistogram()).TopFlows
+	if len(top) != 2 || top[0].Key != "10.0.0.1:40000 -> 10.0.0.2:443 (TCP)" || top[0].Value != 6000 {
+		t.Fatalf("expected the connection to rank first once with all its bytes, got %+v", top)
+	}
+}
+
+func retransmissionFinding(findings []triage.Finding) *triage.Finding {
+	for i := range findings {
+		if findings[i].IssueType == triage.IssueRetransmission {
+			return &findings[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,429 @@
+package capturefilter
+
+import (
+	"fmt"
+
+	"golang.org/x/net/bpf"
+)
+
+// Link is the framing of the frames a program is compiled for.
+type Link int
+
+const (
+	LinkEthernet Link = iota
+	// LinkLinuxSLL and LinkLinuxSLL2 are Linux cooked captures, v1 and v2.
+	LinkLinuxSLL
+	LinkLinuxSLL2
+	// LinkRaw is raw IP, v4 or v6 told apart by the version.
+	LinkRaw
+	LinkIPv4
+	LinkIPv6
+	// LinkNull is BSD loopback: a four-byte address family, in whichever
+	// byte order the capturing host used, before the IP header.
+	LinkNull
+)
+
+// snapLen is what a program returns for an accepted packet: all of it.
+const snapLen = 262144
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeARP  = 0x0806
+	etherTypeIPv6 = 0x86dd
+)
+
+// Compile compiles the filter for frames of link.
+func (f *Filter) Compile(link Link) ([]bpf.Instruction, error) {
+	if link < LinkEthernet || link > LinkNull {
+		return nil, fmt.Errorf("capture filter: unsupported link %d", link)
+	}
+	e := &emitter{}
+	accept, reject := e.label(), e.label()
+	e.emit(expand(f.root, link), accept, reject)
+	e.place(accept)
+	e.code = append(e.code, instr{ins: bpf.RetConstant{Val: snapLen}})
+	e.place(reject)
+	e.code = append(e.code, instr{ins: bpf.RetConstant{Val: 0}})
+	return e.assemble(), nil
+}
+
+// cond is a filter lowered to tests of packet data: an allOf, anyOf,
+// negate, check or always.
+type cond interface{}
+
+type allOf []cond
+
+type anyOf []cond
+
+type negate struct{ c cond }
+
+type always bool
+
+// check loads a value into A, masks it when mask is not zero and tests it
+// against value.
+type check struct {
+	load  []bpf.Instruction
+	mask  uint32
+	test  bpf.JumpTest
+	value uint32
+}
+
+func loadWord(off, size uint32) []bpf.Instruction {
+	return []bpf.Instruction{bpf.LoadAbsolute{Off: off, Size: int(size)}}
+}
+
+func equals(off, size, value uint32) check {
+	return check{load: loadWord(off, size), test: bpf.JumpEqual, value: value}
+}
+
+// expand lowers a parsed filter for link.
+func expand(n node, link Link) cond {
+	switch n := n.(type) {
+	case *andNode:
+		return allOf{expand(n.x, link), expand(n.y, link)}
+	case *orNode:
+		return anyOf{expand(n.x, link), expand(n.y, link)}
+	case *notNode:
+		return negate{expand(n.x, link)}
+	case *primitive:
+		return expandPrimitive(n, link)
+	}
+	return always(false)
+}
+
+// carries tests that a frame of link carries etherType.
+func carries(link Link, etherType uint16) cond {
+	switch link {
+	case LinkEthernet:
+		return equals(12, 2, uint32(etherType))
+	case LinkLinuxSLL:
+		return equals(14, 2, uint32(etherType))
+	case LinkLinuxSLL2:
+		return equals(0, 2, uint32(etherType))
+	case LinkRaw:
+		version := map[uint16]uint32{etherTypeIPv4: 0x40, etherTypeIPv6: 0x60}[etherType]
+		if version == 0 {
+			return always(false)
+		}
+		return check{load: loadWord(0, 1), mask: 0xf0, test: bpf.JumpEqual, value: version}
+	case LinkIPv4:
+		return always(etherType == etherTypeIPv4)
+	case LinkIPv6:
+		return always(etherType == etherTypeIPv6)
+	case LinkNull:
+		// AF_INET6 differs between the BSDs, Darwin and Linux.
+		families := map[uint16][]uint32{etherTypeIPv4: {2}, etherTypeIPv6: {24, 28, 30, 10}}[etherType]
+		var alts anyOf
+		for _, family := range families {
+			swapped := family>>24 | family>>8&0xff00 | family<<8&0xff0000 | family<<24
+			alts = append(alts, equals(0, 4, family), equals(0, 4, swapped))
+		}
+		return alts
+	}
+	return always(false)
+}
+
+// networkOffset is where the network header starts in frames of link.
+func networkOffset(link Link) uint32 {
+	switch link {
+	case LinkEthernet:
+		return 14
+	case LinkLinuxSLL:
+		return 16
+	case LinkLinuxSLL2:
+		return 20
+	case LinkNull:
+		return 4
+	}
+	return 0
+}
+
+func expandPrimitive(prim *primitive, link Link) cond {
+	nh := networkOffset(link)
+	v4 := prim.proto != "ip6"
+	v6 := prim.proto != "ip" && prim.proto != "arp"
+
+	switch prim.kind {
+	case primProto:
+		switch prim.proto {
+		case "ip":
+			return carries(link, etherTypeIPv4)
+		case "ip6":
+			return carries(link, etherTypeIPv6)
+		case "arp":
+			return carries(link, etherTypeARP)
+		case "icmp":
+			return allOf{carries(link, etherTypeIPv4), ipv4Proto(nh, 1)}
+		case "icmp6":
+			return allOf{carries(link, etherTypeIPv6), ipv6Next(nh, 58)}
+		}
+		number := protocolNumbers[prim.proto]
+		return anyOf{
+			allOf{carries(link, etherTypeIPv4), ipv4Proto(nh, number)},
+			allOf{carries(link, etherTypeIPv6), ipv6Next(nh, number)},
+		}
+
+	case primIPProto:
+		var alts anyOf
+		if v4 {
+			alts = append(alts, allOf{carries(link, etherTypeIPv4), ipv4Proto(nh, prim.lo)})
+		}
+		if v6 {
+			alts = append(alts, allOf{carries(link, etherTypeIPv6), ipv6Next(nh, prim.lo)})
+		}
+		return alts
+
+	case primHost, primNet:
+		if prim.prefix.Addr().Is6() {
+			return allOf{
+				carries(link, etherTypeIPv6),
+				byDirection(prim.dir, ipv6Prefix(nh+8, prim), ipv6Prefix(nh+24, prim)),
+			}
+		}
+		var alts anyOf
+		if prim.proto != "arp" {
+			alts = append(alts, allOf{
+				carries(link, etherTypeIPv4),
+				byDirection(prim.dir, ipv4Prefix(nh+12, prim), ipv4Prefix(nh+16, prim)),
+			})
+		}
+		if prim.proto != "ip" {
+			// The sender and target protocol addresses of Ethernet ARP.
+			alts = append(alts, allOf{
+				carries(link, etherTypeARP),
+				byDirection(prim.dir, ipv4Prefix(nh+14, prim), ipv4Prefix(nh+24, prim)),
+			})
+		}
+		return alts
+
+	case primPort, primPortRange:
+		transports := []uint32{6, 17, 132}
+		if number, ok := protocolNumbers[prim.proto]; ok {
+			transports = []uint32{number}
+		}
+		var alts anyOf
+		if v4 {
+			var protos anyOf
+			for _, number := range transports {
+				protos = append(protos, ipv4Proto(nh, number))
+			}
+			// Only the first fragment carries the ports, after the header
+			// whose length is read into X.
+			port := func(off uint32) []bpf.Instruction {
+				return []bpf.Instruction{bpf.LoadMemShift{Off: nh}, bpf.LoadIndirect{Off: nh + off, Size: 2}}
+			}
+			alts = append(alts, allOf{
+				carries(link, etherTypeIPv4),
+				protos,
+				negate{check{load: loadWord(nh+6, 2), test: bpf.JumpBitsSet, value: 0x1fff}},
+				byDirection(prim.dir, portRange(port(0), prim), portRange(port(2), prim)),
+			})
+		}
+		if v6 {
+			var protos anyOf
+			for _, number := range transports {
+				protos = append(protos, ipv6Next(nh, number))
+			}
+			alts = append(alts, allOf{
+				carries(link, etherTypeIPv6),
+				protos,
+				byDirection(prim.dir, portRange(loadWord(nh+40, 2), prim), portRange(loadWord(nh+42, 2), prim)),
+			})
+		}
+		return alts
+
+	case primLess:
+		return check{load: []bpf.Instruction{bpf.LoadExtension{Num: bpf.ExtLen}}, test: bpf.JumpLessOrEqual, value: prim.lo}
+	case primGreater:
+		return check{load: []bpf.Instruction{bpf.LoadExtension{Num: bpf.ExtLen}}, test: bpf.JumpGreaterOrEqual, value: prim.lo}
+	}
+	return always(false)
+}
+
+func byDirection(dir direction, src, dst cond) cond {
+	switch dir {
+	case dirSrc:
+		return src
+	case dirDst:
+		return dst
+	case dirSrcAndDst:
+		return allOf{src, dst}
+	}
+	return anyOf{src, dst}
+}
+
+// ipv4Proto tests the protocol of an IPv4 header at nh.
+func ipv4Proto(nh, number uint32) cond {
+	return equals(nh+9, 1, number)
+}
+
+// ipv6Next tests the next header of an IPv6 header at nh. Extension headers
+// are not followed.
+func ipv6Next(nh, number uint32) cond {
+	return equals(nh+6, 1, number)
+}
+
+func ipv4Prefix(off uint32, prim *primitive) cond {
+	bits := prim.prefix.Bits()
+	if bits == 0 {
+		return always(true)
+	}
+	addr := prim.prefix.Addr().As4()
+	value := uint32(addr[0])<<24 | uint32(addr[1])<<16 | uint32(addr[2])<<8 | uint32(addr[3])
+	c := equals(off, 4, value)
+	if bits < 32 {
+		c.mask = ^uint32(0) << (32 - bits)
+	}
+	return c
+}
+
+// ipv6Prefix tests the 16-byte address at off a word at a time.
+func ipv6Prefix(off uint32, prim *primitive) cond {
+	addr := prim.prefix.Addr().As16()
+	all := allOf{}
+	for word := 0; word < 4; word++ {
+		bits := prim.prefix.Bits() - 32*word
+		if bits <= 0 {
+			break
+		}
+		b := addr[4*word : 4*word+4]
+		c := equals(off+uint32(4*word), 4, uint32(b[0])<<24|uint32(b[1])<<16|uint32(b[2])<<8|uint32(b[3]))
+		if bits < 32 {
+			c.mask = ^uint32(0) << (32 - bits)
+		}
+		all = append(all, c)
+	}
+	return all
+}
+
+func portRange(load []bpf.Instruction, prim *primitive) cond {
+	if prim.lo == prim.hi {
+		return check{load: load, test: bpf.JumpEqual, value: prim.lo}
+	}
+	return allOf{
+		check{load: load, test: bpf.JumpGreaterOrEqual, value: prim.lo},
+		check{load: load, test: bpf.JumpLessOrEqual, value: prim.hi},
+	}
+}
+
+// instr is an instruction, a jump to labels or, when isLabel, the place of
+// label t.
+type instr struct {
+	ins     bpf.Instruction
+	isLabel bool
+	isGoto  bool
+	isJump  bool
+	test    bpf.JumpTest
+	value   uint32
+	t, f    int
+	// long jumps go through unconditional jumps, whose offsets are not
+	// limited to a byte.
+	long bool
+}
+
+// emitter lays out conditions as code with forward jumps to labels.
+type emitter struct {
+	code   []instr
+	labels int
+}
+
+func (e *emitter) label() int {
+	e.labels++
+	return e.labels - 1
+}
+
+func (e *emitter) place(label int) {
+	e.code = append(e.code, instr{isLabel: true, t: label})
+}
+
+// emit emits code that continues at label t when c holds and at f when it
+// does not.
+func (e *emitter) emit(c cond, t, f int) {
+	switch c := c.(type) {
+	case always:
+		target := f
+		if c {
+			target = t
+		}
+		e.code = append(e.code, instr{isGoto: true, t: target})
+	case negate:
+		e.emit(c.c, f, t)
+	case allOf:
+		if len(c) == 0 {
+			e.emit(always(true), t, f)
+			return
+		}
+		for _, x := range c[:len(c)-1] {
+			next := e.label()
+			e.emit(x, next, f)
+			e.place(next)
+		}
+		e.emit(c[len(c)-1], t, f)
+	case anyOf:
+		if len(c) == 0 {
+			e.emit(always(false), t, f)
+			return
+		}
+		for _, x := range c[:len(c)-1] {
+			next := e.label()
+			e.emit(x, t, next)
+			e.place(next)
+		}
+		e.emit(c[len(c)-1], t, f)
+	case check:
+		for _, ins := range c.load {
+			e.code = append(e.code, instr{ins: ins})
+		}
+		if c.mask != 0 {
+			e.code = append(e.code, instr{ins: bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: c.mask}})
+		}
+		e.code = append(e.code, instr{isJump: true, test: c.test, value: c.value, t: t, f: f})
+	}
+}
+
+// assemble resolves labels to offsets. Conditional jumps too far for their
+// byte offsets are made long and the code laid out again until all fit.
+func (e *emitter) assemble() []bpf.Instruction {
+	for {
+		at := make([]int, e.labels)
+		n := 0
+		for _, in := range e.code {
+			switch {
+			case in.isLabel:
+				at[in.t] = n
+			case in.long:
+				n += 3
+			default:
+				n++
+			}
+		}
+
+		out := make([]bpf.Instruction, 0, n)
+		grew := false
+		for i := range e.code {
+			in := &e.code[i]
+			pc := len(out)
+			switch {
+			case in.isLabel:
+			case in.isGoto:
+				out = append(out, bpf.Jump{Skip: uint32(at[in.t] - pc - 1)})
+			case in.long:
+				out = append(out,
+					bpf.JumpIf{Cond: in.test, Val: in.value, SkipTrue: 0, SkipFalse: 1},
+					bpf.Jump{Skip: uint32(at[in.t] - pc - 2)},
+					bpf.Jump{Skip: uint32(at[in.f] - pc - 3)})
+			case in.isJump:
+				skipTrue, skipFalse := at[in.t]-pc-1, at[in.f]-pc-1
+				if skipTrue > 255 || skipFalse > 255 {
+					in.long, grew = true, true
+				}
+				out = append(out, bpf.JumpIf{Cond: in.test, Val: in.value, SkipTrue: uint8(skipTrue), SkipFalse: uint8(skipFalse)})
+			default:
+				out = append(out, in.ins)
+			}
+		}
+		if !grew {
+			return out
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package capturefilter
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+func serialize(t *testing.T, stack ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, stack...); err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func ethernet(etherType layers.EthernetType) *layers.Ethernet {
+	return &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+		EthernetType: etherType,
+	}
+}
+
+func ipv4(src, dst string, proto layers.IPProtocol) *layers.IPv4 {
+	return &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: proto, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+}
+
+func TestCompiledPrograms(t *testing.T) {
+	tcp4 := ipv4("10.1.2.3", "192.0.2.10", layers.IPProtocolTCP)
+	tcp := &layers.TCP{SrcPort: 51000, DstPort: 443, SYN: true}
+	tcp.SetNetworkLayerForChecksum(tcp4)
+	https := serialize(t, ethernet(layers.EthernetTypeIPv4), tcp4, tcp, gopacket.Payload(make([]byte, 100)))
+
+	// An IPv4 header with options moves the ports.
+	optioned := ipv4("10.1.2.3", "192.0.2.10", layers.IPProtocolTCP)
+	optioned.Options = []layers.IPv4Option{{OptionType: 1}, {OptionType: 1}, {OptionType: 1}, {OptionType: 0}}
+	tcpOpt := &layers.TCP{SrcPort: 51000, DstPort: 8443, ACK: true}
+	tcpOpt.SetNetworkLayerForChecksum(optioned)
+	alt := serialize(t, ethernet(layers.EthernetTypeIPv4), optioned, tcpOpt)
+
+	// A later fragment has no ports, whatever its payload starts with.
+	fragment := ipv4("10.1.2.3", "192.0.2.10", layers.IPProtocolTCP)
+	fragment.FragOffset = 100
+	later := serialize(t, ethernet(layers.EthernetTypeIPv4), fragment, gopacket.Payload{0x01, 0xbb, 0x01, 0xbb})
+
+	udp6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP,
+		SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8:1::53")}
+	udp := &layers.UDP{SrcPort: 5353, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(udp6)
+	dns6 := serialize(t, ethernet(layers.EthernetTypeIPv6), udp6, udp, gopacket.Payload("q"))
+
+	arp := serialize(t, ethernet(layers.EthernetTypeARP), &layers.ARP{
+		AddrType: layers.LinkTypeEthernet, Protocol: layers.EthernetTypeIPv4, HwAddressSize: 6, ProtAddressSize: 4,
+		Operation: layers.ARPRequest, SourceHwAddress: []byte{0, 1, 2, 3, 4, 5}, SourceProtAddress: []byte{10, 1, 2, 3},
+		DstHwAddress: make([]byte, 6), DstProtAddress: []byte{10, 1, 2, 1},
+	})
+
+	// Ethernet pads alt, later and arp to 60 bytes.
+	frames := []string{"https", "alt", "later", "dns6", "arp"}
+	data := map[string][]byte{"https": https, "alt": alt, "later": later, "dns6": dns6, "arp": arp}
+	cases := map[string]string{
+		"tcp port 443 and host 10.1.2.3":        "https",
+		"tcp":                                   "https alt later",
+		"port 443":                              "https",
+		"portrange 8000-9000":                   "alt",
+		"dst port 51000":                        "",
+		"src port 51000":                        "https alt",
+		"host 10.1.2.3":                         "https alt later arp",
+		"ip host 10.1.2.3":                      "https alt later",
+		"arp":                                   "arp",
+		"net 10.0.0.0/8 and not arp":            "https alt later",
+		"dst net 10.1.2.0 mask 255.255.255.0":   "arp",
+		"src and dst net 10.0.0.0/8":            "arp",
+		"ip6":                                   "dns6",
+		"udp port 53 and src net 2001:db8::/48": "dns6",
+		"dst host 2001:db8:1::53":               "dns6",
+		"ip6 net 2001:db8:1::/48 or port 443":   "https dns6",
+		"ip proto 6 and not port 443":           "alt later",
+		"less 60":                               "alt later arp",
+		"greater 61 and not ip6":                "https",
+		"icmp or icmp6":                         "",
+	}
+	for raw, want := range cases {
+		filter, err := Parse(raw)
+		if err != nil {
+			t.Fatalf("%q: %v", raw, err)
+		}
+		program, err := filter.Compile(LinkEthernet)
+		if err != nil {
+			t.Fatalf("%q: compile: %v", raw, err)
+		}
+		vm, err := bpf.NewVM(program)
+		if err != nil {
+			t.Fatalf("%q: %v", raw, err)
+		}
+		var matched []string
+		for _, name := range frames {
+			if n, err := vm.Run(data[name]); err != nil {
+				t.Fatalf("%q on %s: %v", raw, name, err)
+			} else if n > 0 {
+				matched = append(matched, name)
+			}
+		}
+		if got := strings.Join(matched, " "); got != want {
+			t.Fatalf("%q: expected %q to match, got %q", raw, want, got)
+		}
+	}
+}
+
+func TestCompiledProgramsForLinks(t *testing.T) {
+	tcp4 := ipv4("10.1.2.3", "192.0.2.10", layers.IPProtocolTCP)
+	tcp := &layers.TCP{SrcPort: 51000, DstPort: 443, SYN: true}
+	tcp.SetNetworkLayerForChecksum(tcp4)
+	packet := serialize(t, tcp4, tcp)
+
+	sll2 := make([]byte, 20)
+	binary.BigEndian.PutUint16(sll2[0:2], 0x0800)
+	sll := make([]byte, 16)
+	binary.BigEndian.PutUint16(sll[14:16], 0x0800)
+	null := make([]byte, 4)
+	binary.LittleEndian.PutUint32(null, 2)
+
+	frames := map[Link][]byte{
+		LinkRaw:       packet,
+		LinkIPv4:      packet,
+		LinkLinuxSLL:  append(sll, packet...),
+		LinkLinuxSLL2: append(sll2, packet...),
+		LinkNull:      append(null, packet...),
+	}
+	cases := map[string]bool{
+		"tcp dst port 443 and src host 10.1.2.3": true,
+		"ip and not ip6":                         true,
+		"udp or arp or ip6":                      false,
+	}
+	for link, frame := range frames {
+		for raw, want := range cases {
+			filter, err := Parse(raw)
+			if err != nil {
+				t.Fatalf("%q: %v", raw, err)
+			}
+			program, err := filter.Compile(link)
+			if err != nil {
+				t.Fatalf("%q: compile: %v", raw, err)
+			}
+			vm, err := bpf.NewVM(program)
+			if err != nil {
+				t.Fatalf("%q: %v", raw, err)
+			}
+			n, err := vm.Run(frame)
+			if err != nil {
+				t.Fatalf("%q on link %d: %v", raw, link, err)
+			}
+			if (n > 0) != want {
+				t.Fatalf("%q on link %d: expected match %v", raw, link, want)
+			}
+		}
+	}
+}
+
+// A long filter needs jumps further than a conditional jump can reach.
+func TestCompileLongJumps(t *testing.T) {
+	terms := make([]string, 0, 120)
+	for i := 0; i < 120; i++ {
+		terms = append(terms, "host 10.9.0."+strings.Repeat("1", 1+i%3))
+	}
+	terms = append(terms, "port 443")
+	filter, err := Parse(strings.Join(terms, " or "))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	program, err := filter.Compile(LinkEthernet)
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	if len(program) < 256 {
+		t.Fatalf("expected a program longer than a conditional jump, got %d instructions", len(program))
+	}
+	if _, err := bpf.Assemble(program); err != nil {
+		t.Fatalf("assemble: %v", err)
+	}
+	vm, err := bpf.NewVM(program)
+	if err != nil {
+		t.Fatalf("vm: %v", err)
+	}
+
+	tcp4 := ipv4("10.1.2.3", "192.0.2.10", layers.IPProtocolTCP)
+	tcp := &layers.TCP{SrcPort: 51000, DstPort: 443}
+	tcp.SetNetworkLayerForChecksum(tcp4)
+	if n, _ := vm.Run(serialize(t, ethernet(layers.EthernetTypeIPv4), tcp4, tcp)); n == 0 {
+		t.Fatalf("expected the last term to match")
+	}
+	tcp.DstPort = 80
+	if n, _ := vm.Run(serialize(t, ethernet(layers.EthernetTypeIPv4), tcp4, tcp)); n != 0 {
+		t.Fatalf("expected no term to match")
+	}
+}
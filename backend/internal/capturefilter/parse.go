@@ -0,0 +1,552 @@
+// Package capturefilter compiles capture filters, the classic tcpdump
+// expressions such as
+//
+//	tcp port 443 and host 10.1.2.3
+//
+// into BPF programs that run against raw frames, so packets can be dropped
+// before they are decoded. It needs no libpcap: programs are generated here
+// and run with golang.org/x/net/bpf.
+//
+// The supported primitives are [proto] [dir] [type] id, where proto is ip,
+// ip6, arp, tcp, udp, sctp, icmp or icmp6, dir is src, dst, src or dst, or
+// src and dst, and type is host, net (a CIDR, a dotted prefix such as 10.1
+// or an address with mask), port or portrange lo-hi. A protocol on its own,
+// ip proto n, ip6 proto n, proto n, less n and greater n are primitives too,
+// and an id on its own takes the qualifiers of the one before it, as in
+// port 80 or 443. Primitives combine with and (&&), or (||), not (!) and
+// parentheses; as in tcpdump, not binds tightest and and and or are of equal
+// precedence, associating left to right. Host and service names are not
+// resolved and packet data expressions such as tcp[13] are not supported.
+package capturefilter
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Error is a syntax error in a filter. Pos is the 1-based byte offset of the
+// text it is about.
+type Error struct {
+	Pos int
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Msg, e.Pos)
+}
+
+// Filter is a parsed capture filter.
+type Filter struct {
+	text string
+	root node
+}
+
+// String returns the filter as it was written.
+func (f *Filter) String() string {
+	return f.text
+}
+
+// Parse parses a capture filter. A blank filter parses to nil.
+func Parse(raw string) (*Filter, error) {
+	tokens, err := lex(raw)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	if p.peek().kind == tokEOF {
+		return nil, nil
+	}
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, tok.errorf("unexpected %s", tok)
+	}
+	return &Filter{text: strings.TrimSpace(raw), root: root}, nil
+}
+
+// node is a parsed filter: an *andNode, *orNode, *notNode or *primitive.
+type node interface{}
+
+type andNode struct{ x, y node }
+
+type orNode struct{ x, y node }
+
+type notNode struct{ x node }
+
+type direction int
+
+const (
+	dirSrcOrDst direction = iota
+	dirSrc
+	dirDst
+	dirSrcAndDst
+)
+
+type primitiveKind int
+
+const (
+	primProto primitiveKind = iota
+	primHost
+	primNet
+	primPort
+	primPortRange
+	primIPProto
+	primLess
+	primGreater
+)
+
+// primitive is one test. proto is "" when the primitive is not qualified
+// with a protocol.
+type primitive struct {
+	kind   primitiveKind
+	proto  string
+	dir    direction
+	prefix netip.Prefix // primHost and primNet; a host is a full-length prefix
+	lo, hi uint32       // ports, the protocol number or the length
+}
+
+// qualifiers are what comes before the id of a primitive, kept so an id on
+// its own can take them from the primitive before it.
+type qualifiers struct {
+	proto string
+	dir   direction
+	kind  primitiveKind
+}
+
+var protocols = map[string]bool{
+	"ip": true, "ip6": true, "arp": true, "tcp": true, "udp": true, "sctp": true, "icmp": true, "icmp6": true,
+}
+
+// protocolNumbers are the names ip proto accepts in place of a number.
+var protocolNumbers = map[string]uint32{
+	"icmp": 1, "tcp": 6, "udp": 17, "icmp6": 58, "sctp": 132,
+}
+
+// unsupported are tcpdump keywords outside the supported subset.
+var unsupported = map[string]bool{
+	"ether": true, "vlan": true, "mpls": true, "pppoed": true, "pppoes": true, "geneve": true,
+	"gateway": true, "broadcast": true, "multicast": true, "inbound": true, "outbound": true,
+	"rarp": true, "decnet": true, "atalk": true, "ipx": true, "iso": true, "wlan": true,
+	"type": true, "subtype": true, "ifname": true, "on": true, "rnr": true, "rulenum": true,
+	"reason": true, "action": true, "len": true,
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokLParen
+	tokRParen
+	tokAnd
+	tokOr
+	tokNot
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int // 0-based byte offset
+}
+
+func (t token) errorf(format string, args ...interface{}) *Error {
+	return &Error{Pos: t.pos + 1, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of filter"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+func (t token) is(keyword string) bool {
+	return t.kind == tokWord && strings.EqualFold(t.text, keyword)
+}
+
+// keyword reports whether t is one of the words the grammar gives a meaning,
+// which cannot be an id.
+func (t token) keyword() bool {
+	if t.kind != tokWord {
+		return false
+	}
+	word := strings.ToLower(t.text)
+	switch word {
+	case "and", "or", "not", "src", "dst", "host", "net", "port", "portrange", "proto", "less", "greater", "mask":
+		return true
+	}
+	return protocols[word]
+}
+
+// special are the characters that end a word.
+const special = "()!&|[]<>=+*"
+
+func lex(raw string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(raw) {
+		c := raw[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')':
+			kind := tokLParen
+			if c == ')' {
+				kind = tokRParen
+			}
+			i++
+			tokens = append(tokens, token{kind: kind, text: raw[start:i], pos: start})
+		case c == '!' && (i+1 >= len(raw) || raw[i+1] != '='):
+			i++
+			tokens = append(tokens, token{kind: tokNot, text: "!", pos: start})
+		case (c == '&' || c == '|') && i+1 < len(raw) && raw[i+1] == c:
+			i += 2
+			kind := tokAnd
+			if c == '|' {
+				kind = tokOr
+			}
+			tokens = append(tokens, token{kind: kind, text: raw[start:i], pos: start})
+		case c == '&' || c == '|':
+			return nil, &Error{Pos: start + 1, Msg: fmt.Sprintf("unexpected %q, use %q", string(c), string([]byte{c, c}))}
+		case strings.IndexByte(special, c) >= 0:
+			return nil, &Error{Pos: start + 1, Msg: fmt.Sprintf("unexpected %q: packet data expressions are not supported", string(c))}
+		default:
+			for i < len(raw) && !strings.ContainsRune(" \t\n\r"+special, rune(raw[i])) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokWord, text: raw[start:i], pos: start})
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(raw)}), nil
+}
+
+type parser struct {
+	tokens []token
+	i      int
+	// last are the qualifiers of the primitive parsed last.
+	last *qualifiers
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.i]
+	if tok.kind != tokEOF {
+		p.i++
+	}
+	return tok
+}
+
+// parseExpr parses primitives joined by and and or, which bind equally and
+// associate left to right.
+func (p *parser) parseExpr() (node, error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		and := tok.kind == tokAnd || tok.is("and")
+		if !and && tok.kind != tokOr && !tok.is("or") {
+			return x, nil
+		}
+		p.next()
+		y, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if and {
+			x = &andNode{x: x, y: y}
+		} else {
+			x = &orNode{x: x, y: y}
+		}
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	tok := p.next()
+	switch {
+	case tok.kind == tokNot || tok.is("not"):
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{x: x}, nil
+	case tok.kind == tokLParen:
+		x, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().kind != tokRParen {
+			if p.peek().kind == tokEOF {
+				return nil, tok.errorf("unclosed %q", "(")
+			}
+			return nil, p.peek().errorf("expected %q, found %s", ")", p.peek())
+		}
+		p.next()
+		return x, nil
+	case tok.kind == tokWord && !tok.is("and") && !tok.is("or"):
+		return p.parsePrimitive(tok)
+	case tok.kind == tokEOF:
+		return nil, tok.errorf("expected a primitive")
+	default:
+		return nil, tok.errorf("expected a primitive, found %s", tok)
+	}
+}
+
+func (p *parser) parsePrimitive(tok token) (node, error) {
+	if unsupported[strings.ToLower(tok.text)] {
+		return nil, tok.errorf("%q is not supported", tok.text)
+	}
+	switch {
+	case tok.is("less") || tok.is("greater"):
+		n, err := p.number(p.next(), 1<<31)
+		if err != nil {
+			return nil, err
+		}
+		if tok.is("less") {
+			return &primitive{kind: primLess, lo: n}, nil
+		}
+		return &primitive{kind: primGreater, lo: n}, nil
+	case tok.is("proto"):
+		return p.parseIPProto("")
+	}
+
+	var q qualifiers
+	qualified := false
+	if word := strings.ToLower(tok.text); protocols[word] {
+		q.proto, qualified = word, true
+		if (word == "ip" || word == "ip6") && p.peek().is("proto") {
+			p.next()
+			return p.parseIPProto(word)
+		}
+		if next := p.peek(); !isDirection(next) && !isType(next) {
+			return &primitive{kind: primProto, proto: word}, nil
+		}
+		tok = p.next()
+	}
+	if isDirection(tok) {
+		q.dir, qualified = dirSrc, true
+		if tok.is("dst") {
+			q.dir = dirDst
+		}
+		if join := p.peek(); join.is("or") || join.is("and") {
+			if other := p.tokens[p.i+1]; isDirection(other) && !strings.EqualFold(other.text, tok.text) {
+				p.next()
+				p.next()
+				q.dir = dirSrcOrDst
+				if join.is("and") {
+					q.dir = dirSrcAndDst
+				}
+			}
+		}
+		tok = p.next()
+	}
+	switch {
+	case tok.is("host"):
+		q.kind, qualified = primHost, true
+		tok = p.next()
+	case tok.is("net"):
+		q.kind, qualified = primNet, true
+		tok = p.next()
+	case tok.is("port"):
+		q.kind, qualified = primPort, true
+		tok = p.next()
+	case tok.is("portrange"):
+		q.kind, qualified = primPortRange, true
+		tok = p.next()
+	case qualified:
+		q.kind = primHost
+	case p.last != nil:
+		q = *p.last
+	default:
+		q.kind = primHost
+	}
+
+	if tok.kind != tokWord || tok.keyword() {
+		return nil, tok.errorf("expected an address, network or port, found %s", tok)
+	}
+	if unsupported[strings.ToLower(tok.text)] {
+		return nil, tok.errorf("%q is not supported", tok.text)
+	}
+	prim, err := p.primitive(q, tok)
+	if err != nil {
+		return nil, err
+	}
+	p.last = &q
+	return prim, nil
+}
+
+func isDirection(tok token) bool {
+	return tok.is("src") || tok.is("dst")
+}
+
+func isType(tok token) bool {
+	return tok.is("host") || tok.is("net") || tok.is("port") || tok.is("portrange")
+}
+
+// primitive builds the primitive for qualifiers q and the id in tok.
+func (p *parser) primitive(q qualifiers, tok token) (*primitive, error) {
+	prim := &primitive{kind: q.kind, proto: q.proto, dir: q.dir}
+	switch q.kind {
+	case primHost, primNet:
+		if q.proto != "" && q.proto != "ip" && q.proto != "ip6" && q.proto != "arp" {
+			return nil, tok.errorf("%q cannot qualify an address", q.proto)
+		}
+		var err error
+		if q.kind == primHost {
+			prim.prefix, err = parseHost(tok)
+		} else {
+			prim.prefix, err = p.parseNet(tok)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if v4 := prim.prefix.Addr().Is4(); (v4 && q.proto == "ip6") || (!v4 && (q.proto == "ip" || q.proto == "arp")) {
+			return nil, tok.errorf("%q is not an %s address", tok.text, q.proto)
+		}
+	case primPort, primPortRange:
+		if q.proto != "" && q.proto != "ip" && q.proto != "ip6" && q.proto != "tcp" && q.proto != "udp" && q.proto != "sctp" {
+			return nil, tok.errorf("%q cannot qualify a port", q.proto)
+		}
+		lo, hi := tok.text, tok.text
+		if q.kind == primPortRange {
+			dash := strings.IndexByte(tok.text, '-')
+			if dash < 0 {
+				return nil, tok.errorf("invalid port range %q, expected lo-hi", tok.text)
+			}
+			lo, hi = tok.text[:dash], tok.text[dash+1:]
+		}
+		var err error
+		if prim.lo, err = parsePort(tok, lo); err != nil {
+			return nil, err
+		}
+		if prim.hi, err = parsePort(tok, hi); err != nil {
+			return nil, err
+		}
+		if prim.lo > prim.hi {
+			prim.lo, prim.hi = prim.hi, prim.lo
+		}
+	}
+	return prim, nil
+}
+
+func (p *parser) parseIPProto(proto string) (node, error) {
+	tok := p.next()
+	if n, ok := protocolNumbers[strings.ToLower(strings.TrimPrefix(tok.text, `\`))]; ok && tok.kind == tokWord {
+		return &primitive{kind: primIPProto, proto: proto, lo: n}, nil
+	}
+	n, err := p.number(tok, 255)
+	if err != nil {
+		return nil, err
+	}
+	return &primitive{kind: primIPProto, proto: proto, lo: n}, nil
+}
+
+func (p *parser) number(tok token, max uint32) (uint32, error) {
+	if tok.kind != tokWord {
+		return 0, tok.errorf("expected a number, found %s", tok)
+	}
+	n, err := strconv.ParseUint(tok.text, 0, 32)
+	if err != nil || n > uint64(max) {
+		return 0, tok.errorf("invalid number %q", tok.text)
+	}
+	return uint32(n), nil
+}
+
+func parsePort(tok token, text string) (uint32, error) {
+	n, err := strconv.ParseUint(text, 10, 16)
+	if err != nil {
+		if text != "" && strings.Trim(text, "0123456789") != "" {
+			return 0, tok.errorf("%q is not a port number; service names are not resolved", text)
+		}
+		return 0, tok.errorf("invalid port %q", text)
+	}
+	return uint32(n), nil
+}
+
+func parseHost(tok token) (netip.Prefix, error) {
+	addr, err := netip.ParseAddr(tok.text)
+	if err != nil || addr.Zone() != "" {
+		if strings.Trim(tok.text, "0123456789.:abcdefABCDEF/") != "" {
+			return netip.Prefix{}, tok.errorf("%q is not an IP address; host names are not resolved", tok.text)
+		}
+		return netip.Prefix{}, tok.errorf("invalid address %q", tok.text)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// parseNet parses a network: a CIDR, an address followed by mask and a
+// netmask, or one to four dotted IPv4 octets, each a byte of prefix.
+func (p *parser) parseNet(tok token) (netip.Prefix, error) {
+	var prefix netip.Prefix
+	switch {
+	case strings.Contains(tok.text, "/"):
+		parsed, err := netip.ParsePrefix(tok.text)
+		if err != nil {
+			return netip.Prefix{}, tok.errorf("invalid network %q", tok.text)
+		}
+		prefix = parsed
+	case p.peek().is("mask"):
+		p.next()
+		addr, err := parseHost(tok)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		maskTok := p.next()
+		mask, err := netip.ParseAddr(maskTok.text)
+		if err != nil || maskTok.kind != tokWord || mask.BitLen() != addr.Addr().BitLen() {
+			return netip.Prefix{}, maskTok.errorf("invalid netmask %s", maskTok)
+		}
+		bits, ok := maskBits(mask)
+		if !ok {
+			return netip.Prefix{}, maskTok.errorf("netmask %q is not contiguous", maskTok.text)
+		}
+		prefix = netip.PrefixFrom(addr.Addr(), bits)
+	case strings.Contains(tok.text, ":"):
+		host, err := parseHost(tok)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		prefix = host
+	default:
+		octets := strings.Split(tok.text, ".")
+		if len(octets) > 4 {
+			return netip.Prefix{}, tok.errorf("invalid network %q", tok.text)
+		}
+		var addr [4]byte
+		for i, octet := range octets {
+			n, err := strconv.ParseUint(octet, 10, 8)
+			if err != nil {
+				return parseHost(tok)
+			}
+			addr[i] = byte(n)
+		}
+		prefix = netip.PrefixFrom(netip.AddrFrom4(addr), 8*len(octets))
+	}
+	if prefix.Masked() != prefix {
+		return netip.Prefix{}, tok.errorf("non-network bits set in %q", tok.text)
+	}
+	return prefix, nil
+}
+
+// maskBits returns the prefix length of a contiguous netmask.
+func maskBits(mask netip.Addr) (int, bool) {
+	bits := 0
+	for _, b := range mask.AsSlice() {
+		for i := 7; i >= 0; i-- {
+			if b&(1<<i) == 0 {
+				return bits, netip.PrefixFrom(mask, bits).Masked().Addr() == mask
+			}
+			bits++
+		}
+	}
+	return bits, true
+}
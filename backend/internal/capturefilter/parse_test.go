@@ -0,0 +1,107 @@
+package capturefilter
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestParseErrorPositions(t *testing.T) {
+	cases := []struct {
+		raw string
+		pos int
+		msg string
+	}{
+		{raw: "tcp port", pos: 9, msg: "expected an address, network or port, found end of filter"},
+		{raw: "(tcp", pos: 1, msg: `unclosed "("`},
+		{raw: "tcp )", pos: 5, msg: `unexpected ")"`},
+		{raw: "host example.com", pos: 6, msg: `"example.com" is not an IP address; host names are not resolved`},
+		{raw: "port https", pos: 6, msg: `"https" is not a port number; service names are not resolved`},
+		{raw: "tcp[13] & 2 != 0", pos: 4, msg: `unexpected "[": packet data expressions are not supported`},
+		{raw: "ether host 00:11:22:33:44:55", pos: 1, msg: `"ether" is not supported`},
+		{raw: "tcp host 10.0.0.1", pos: 10, msg: `"tcp" cannot qualify an address`},
+		{raw: "icmp port 80", pos: 11, msg: `"icmp" cannot qualify a port`},
+		{raw: "ip6 host 10.0.0.1", pos: 10, msg: `"10.0.0.1" is not an ip6 address`},
+		{raw: "net 10.1.2.3/8", pos: 5, msg: `non-network bits set in "10.1.2.3/8"`},
+		{raw: "net 10.0.0.0 mask 255.0.255.0", pos: 19, msg: `netmask "255.0.255.0" is not contiguous`},
+		{raw: "portrange 80", pos: 11, msg: `invalid port range "80", expected lo-hi`},
+		{raw: "port 70000", pos: 6, msg: `invalid port "70000"`},
+		{raw: "ip proto 300", pos: 10, msg: `invalid number "300"`},
+		{raw: "tcp & udp", pos: 5, msg: `unexpected "&", use "&&"`},
+		{raw: "tcp or", pos: 7, msg: "expected a primitive"},
+		{raw: "tcp 443", pos: 5, msg: `unexpected "443"`},
+	}
+	for _, tc := range cases {
+		_, err := Parse(tc.raw)
+		var syntaxErr *Error
+		if !errors.As(err, &syntaxErr) {
+			t.Fatalf("%q: expected a syntax error, got %v", tc.raw, err)
+		}
+		if syntaxErr.Pos != tc.pos || syntaxErr.Msg != tc.msg {
+			t.Fatalf("%q: expected %q at %d, got %q at %d", tc.raw, tc.msg, tc.pos, syntaxErr.Msg, syntaxErr.Pos)
+		}
+	}
+}
+
+func TestParseStructure(t *testing.T) {
+	cases := map[string]string{
+		"tcp port 443 and host 10.1.2.3":               "(tcp port 443 and host 10.1.2.3/32)",
+		"port 80 or 443":                               "(port 80 or port 443)",
+		"src or dst net 10.1 and not 10.1.2.3":         "(net 10.1.0.0/16 and not net 10.1.2.3/32)",
+		"tcp or udp and dst port 53":                   "((tcp or udp) and dst port 53)",
+		"not (icmp || arp) && less 100":                "(not (icmp or arp) and less 100)",
+		"src and dst net 192.168.0.0 mask 255.255.0.0": "src and dst net 192.168.0.0/16",
+		"ip6 proto 58 or ip proto \\tcp":               "(ip6 proto 58 or ip proto 6)",
+		"udp portrange 2000-1000":                      "udp portrange 1000-2000",
+	}
+	for raw, want := range cases {
+		filter, err := Parse(raw)
+		if err != nil {
+			t.Fatalf("%q: %v", raw, err)
+		}
+		if got := describe(filter.root); got != want {
+			t.Fatalf("%q: expected %s, got %s", raw, want, got)
+		}
+	}
+
+	if filter, err := Parse("  "); filter != nil || err != nil {
+		t.Fatalf("expected a blank filter to parse to nothing, got %v %v", filter, err)
+	}
+}
+
+// describe prints a parsed filter with its structure made explicit.
+func describe(n node) string {
+	switch n := n.(type) {
+	case *andNode:
+		return "(" + describe(n.x) + " and " + describe(n.y) + ")"
+	case *orNode:
+		return "(" + describe(n.x) + " or " + describe(n.y) + ")"
+	case *notNode:
+		return "not " + describe(n.x)
+	case *primitive:
+		out := ""
+		if n.proto != "" {
+			out = n.proto + " "
+		}
+		out += []string{"", "src ", "dst ", "src and dst "}[n.dir]
+		switch n.kind {
+		case primProto:
+			return n.proto
+		case primHost:
+			return out + "host " + n.prefix.String()
+		case primNet:
+			return out + "net " + n.prefix.String()
+		case primPort:
+			return out + fmt.Sprintf("port %d", n.lo)
+		case primPortRange:
+			return out + fmt.Sprintf("portrange %d-%d", n.lo, n.hi)
+		case primIPProto:
+			return out + fmt.Sprintf("proto %d", n.lo)
+		case primLess:
+			return fmt.Sprintf("less %d", n.lo)
+		case primGreater:
+			return fmt.Sprintf("greater %d", n.lo)
+		}
+	}
+	return "?"
+}
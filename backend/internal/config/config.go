@@ -2,6 +2,7 @@ package config
 
 import (
 	"os"
+	"runtime"
 	"strconv"
 	"time"
 )
@@ -19,6 +20,21 @@ type Config struct {
 	AIAPIKey     string
 	AIModel      string
 	AITimeoutSec int
+	// Idle gaps after which a reused 5-tuple starts a new flow; 0 disables
+	// the split. TCP defaults to off so stream numbers match Wireshark.
+	TCPIdleTimeoutSec int
+	UDPIdleTimeoutSec int
+	// Flows idle for FlowExpirySec are stored before the capture ends, and
+	// the least recently seen are stored early once open flows are
+	// estimated to use more than AnalysisMemoryMB; 0 disables either.
+	FlowExpirySec    int
+	AnalysisMemoryMB int64
+	// AnalysisWorkers is how many cores a job decodes and aggregates on.
+	AnalysisWorkers int
+	// ExposePayload lets the API return packet payload bytes, at most
+	// PayloadPreviewBytes of each.
+	ExposePayload       bool
+	PayloadPreviewBytes int
 }
 
 func Load() Config {
@@ -35,6 +51,15 @@ func Load() Config {
 		AIAPIKey:     getEnv("NETSAGE_AI_API_KEY", ""),
 		AIModel:      getEnv("NETSAGE_AI_MODEL", "gpt-4o-mini"),
 		AITimeoutSec: getEnvInt("NETSAGE_AI_TIMEOUT_SEC", 25),
+
+		TCPIdleTimeoutSec: getEnvInt("NETSAGE_TCP_IDLE_TIMEOUT_SEC", 0),
+		UDPIdleTimeoutSec: getEnvInt("NETSAGE_UDP_IDLE_TIMEOUT_SEC", 120),
+		FlowExpirySec:     getEnvInt("NETSAGE_FLOW_EXPIRY_SEC", 600),
+		AnalysisMemoryMB:  getEnvInt64("NETSAGE_ANALYSIS_MEMORY_MB", 512),
+		AnalysisWorkers:   getEnvInt("NETSAGE_ANALYSIS_WORKERS", runtime.NumCPU()),
+
+		ExposePayload:       getEnvBool("NETSAGE_EXPOSE_PAYLOAD", false),
+		PayloadPreviewBytes: getEnvInt("NETSAGE_PAYLOAD_PREVIEW_BYTES", 512),
 	}
 }
 
@@ -10,11 +10,13 @@ type User struct {
 }
 
 type Pcap struct {
-	ID          uint      `gorm:"primaryKey" json:"id"`
-	UserID      uint      `gorm:"index;not null" json:"user_id"`
-	Filename    string    `gorm:"not null" json:"filename"`
-	StoragePath string    `gorm:"not null" json:"storage_path"`
-	UploadedAt  time.Time `gorm:"not null;autoCreateTime" json:"uploaded_at"`
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	UserID        uint      `gorm:"index;not null" json:"user_id"`
+	Filename      string    `gorm:"not null" json:"filename"`
+	StoragePath   string    `gorm:"not null" json:"storage_path"`
+	KeyLogPath    *string   `gorm:"column:keylog_path" json:"keylog_path,omitempty"`
+	CaptureFilter *string   `gorm:"column:capture_filter" json:"capture_filter,omitempty"`
+	UploadedAt    time.Time `gorm:"not null;autoCreateTime" json:"uploaded_at"`
 }
 
 type Job struct {
@@ -26,56 +28,154 @@ type Job struct {
 	StartedAt  *time.Time `json:"started_at"`
 	FinishedAt *time.Time `json:"finished_at"`
 	Error      *string    `json:"error"`
-	CreatedAt  time.Time  `gorm:"not null;autoCreateTime" json:"created_at"`
+	// IndexPath is the packet index the job wrote next to the capture, if
+	// it wrote one.
+	IndexPath *string   `gorm:"column:index_path" json:"-"`
+	CreatedAt time.Time `gorm:"not null;autoCreateTime" json:"created_at"`
 }
 
 type Flow struct {
-	ID                  uint       `gorm:"primaryKey" json:"id"`
-	PcapID              uint       `gorm:"index;not null" json:"pcap_id"`
-	UserID              uint       `gorm:"index;not null" json:"user_id"`
-	Proto               string     `gorm:"index;not null" json:"protocol"`
-	SrcIP               string     `gorm:"index;not null" json:"src_ip"`
-	DstIP               string     `gorm:"index;not null" json:"dst_ip"`
-	SrcPort             int        `gorm:"index;not null" json:"src_port"`
-	DstPort             int        `gorm:"index;not null" json:"dst_port"`
-	ClientIP            string     `gorm:"index;not null" json:"client_ip"`
-	ClientPort          int        `gorm:"index;not null" json:"client_port"`
-	ServerIP            string     `gorm:"index;not null" json:"server_ip"`
-	ServerPort          int        `gorm:"index;not null" json:"server_port"`
-	StartTS             time.Time  `gorm:"column:first_seen;not null" json:"start_ts"`
-	EndTS               time.Time  `gorm:"column:last_seen;not null" json:"end_ts"`
-	SynTime             *time.Time `json:"syn_time"`
-	SynAckTime          *time.Time `json:"syn_ack_time"`
-	AckTime             *time.Time `json:"ack_time"`
-	RTTMs               *float64   `json:"handshake_rtt_ms_estimate"`
-	BytesSent           int64      `gorm:"not null;default:0" json:"bytes_sent"`
-	BytesRecv           int64      `gorm:"not null;default:0" json:"bytes_recv"`
-	BytesClientToServer int64      `gorm:"not null;default:0" json:"bytes_client_to_server"`
-	BytesServerToClient int64      `gorm:"not null;default:0" json:"bytes_server_to_client"`
-	PacketCount         int64      `gorm:"not null;default:0" json:"packet_count"`
-	Retransmits         int64      `gorm:"not null;default:0" json:"tcp_retransmissions"`
-	SynRetransmits      int64      `gorm:"column:tcp_syn_retransmissions;not null;default:0" json:"tcp_syn_retransmissions"`
-	OutOfOrder          int64      `gorm:"not null;default:0" json:"out_of_order"`
-	DupAcks             int64      `gorm:"not null;default:0" json:"dup_acks"`
-	FirstPayloadTime    *time.Time `gorm:"column:first_payload_ts" json:"first_payload_ts"`
-	LastPayloadTime     *time.Time `gorm:"column:last_payload_ts" json:"last_payload_ts"`
-	DurationMs          *float64   `json:"duration_ms"`
-	AppBytes            int64      `gorm:"not null;default:0" json:"app_bytes"`
-	TCPStream           *int       `gorm:"index" json:"tcp_stream"`
-	MSS                 *int       `json:"mss"`
-	TLSVersion          *string    `json:"tls_version"`
-	TLSSNI              *string    `json:"tls_sni"`
-	ALPN                *string    `json:"alpn"`
-	TLSClientHello      bool       `gorm:"not null;default:false" json:"tls_client_hello"`
-	TLSServerHello      bool       `gorm:"not null;default:false" json:"tls_server_hello"`
-	TLSAlert            bool       `gorm:"not null;default:false" json:"tls_alert"`
-	TLSAlertCode        *int       `json:"tls_alert_code"`
-	RSTCount            int64      `gorm:"not null;default:0" json:"rst_count"`
-	FragmentCount       int64      `gorm:"not null;default:0" json:"fragment_count"`
-	ThroughputBps       *float64   `json:"throughput_bps"`
-	HTTPMethod          *string    `json:"http_method"`
-	HTTPHost            *string    `json:"http_host"`
-	HTTPTime            *time.Time `json:"http_time"`
+	ID                     uint       `gorm:"primaryKey" json:"id"`
+	PcapID                 uint       `gorm:"index;not null" json:"pcap_id"`
+	UserID                 uint       `gorm:"index;not null" json:"user_id"`
+	Proto                  string     `gorm:"index;not null" json:"protocol"`
+	SrcIP                  string     `gorm:"index;not null" json:"src_ip"`
+	DstIP                  string     `gorm:"index;not null" json:"dst_ip"`
+	SrcPort                int        `gorm:"index;not null" json:"src_port"`
+	DstPort                int        `gorm:"index;not null" json:"dst_port"`
+	ClientIP               string     `gorm:"index;not null" json:"client_ip"`
+	ClientPort             int        `gorm:"index;not null" json:"client_port"`
+	ServerIP               string     `gorm:"index;not null" json:"server_ip"`
+	ServerPort             int        `gorm:"index;not null" json:"server_port"`
+	TunnelType             *string    `gorm:"column:tunnel_type" json:"tunnel_type"`
+	TunnelID               *int64     `gorm:"column:tunnel_id" json:"tunnel_id"`
+	Interfaces             *string    `gorm:"column:interfaces" json:"interfaces"`
+	StartTS                time.Time  `gorm:"column:first_seen;not null" json:"start_ts"`
+	EndTS                  time.Time  `gorm:"column:last_seen;not null" json:"end_ts"`
+	SynTime                *time.Time `json:"syn_time"`
+	SynAckTime             *time.Time `json:"syn_ack_time"`
+	AckTime                *time.Time `json:"ack_time"`
+	RTTMs                  *float64   `json:"handshake_rtt_ms_estimate"`
+	RTTMinMs               *float64   `gorm:"column:rtt_min_ms" json:"rtt_min_ms"`
+	RTTAvgMs               *float64   `gorm:"column:rtt_avg_ms" json:"rtt_avg_ms"`
+	RTTP95Ms               *float64   `gorm:"column:rtt_p95_ms" json:"rtt_p95_ms"`
+	RTTMaxMs               *float64   `gorm:"column:rtt_max_ms" json:"rtt_max_ms"`
+	RTTSamples             int64      `gorm:"column:rtt_samples;not null;default:0" json:"rtt_samples"`
+	BytesSent              int64      `gorm:"not null;default:0" json:"bytes_sent"`
+	BytesRecv              int64      `gorm:"not null;default:0" json:"bytes_recv"`
+	BytesClientToServer    int64      `gorm:"not null;default:0" json:"bytes_client_to_server"`
+	BytesServerToClient    int64      `gorm:"not null;default:0" json:"bytes_server_to_client"`
+	PacketCount            int64      `gorm:"not null;default:0" json:"packet_count"`
+	Retransmits            int64      `gorm:"not null;default:0" json:"tcp_retransmissions"`
+	SynRetransmits         int64      `gorm:"column:tcp_syn_retransmissions;not null;default:0" json:"tcp_syn_retransmissions"`
+	OutOfOrder             int64      `gorm:"not null;default:0" json:"out_of_order"`
+	DupAcks                int64      `gorm:"not null;default:0" json:"dup_acks"`
+	FirstPayloadTime       *time.Time `gorm:"column:first_payload_ts" json:"first_payload_ts"`
+	LastPayloadTime        *time.Time `gorm:"column:last_payload_ts" json:"last_payload_ts"`
+	DurationMs             *float64   `json:"duration_ms"`
+	AppBytes               int64      `gorm:"not null;default:0" json:"app_bytes"`
+	TCPStream              *int       `gorm:"index" json:"tcp_stream"`
+	MSS                    *int       `json:"mss"`
+	ClientMSS              *int       `gorm:"column:client_mss" json:"client_mss"`
+	ServerMSS              *int       `gorm:"column:server_mss" json:"server_mss"`
+	ClientWindowScale      *int       `gorm:"column:client_wscale" json:"client_wscale"`
+	ServerWindowScale      *int       `gorm:"column:server_wscale" json:"server_wscale"`
+	ClientRwndMin          *int64     `gorm:"column:client_rwnd_min" json:"client_rwnd_min"`
+	ClientRwndMax          *int64     `gorm:"column:client_rwnd_max" json:"client_rwnd_max"`
+	ServerRwndMin          *int64     `gorm:"column:server_rwnd_min" json:"server_rwnd_min"`
+	ServerRwndMax          *int64     `gorm:"column:server_rwnd_max" json:"server_rwnd_max"`
+	SACKPermitted          bool       `gorm:"column:sack_permitted;not null;default:false" json:"sack_permitted"`
+	TCPTimestamps          bool       `gorm:"column:tcp_timestamps;not null;default:false" json:"tcp_timestamps"`
+	SACKLossEvents         int64      `gorm:"column:sack_loss_events;not null;default:0" json:"sack_loss_events"`
+	RetransRTO             int64      `gorm:"column:tcp_retrans_rto;not null;default:0" json:"tcp_retrans_rto"`
+	RetransFast            int64      `gorm:"column:tcp_retrans_fast;not null;default:0" json:"tcp_retrans_fast"`
+	RetransTLP             int64      `gorm:"column:tcp_retrans_tlp;not null;default:0" json:"tcp_retrans_tlp"`
+	RetransSpurious        int64      `gorm:"column:tcp_retrans_spurious;not null;default:0" json:"tcp_retrans_spurious"`
+	RetransPartial         int64      `gorm:"column:tcp_retrans_partial;not null;default:0" json:"tcp_retrans_partial"`
+	RTOMinMs               *float64   `gorm:"column:rto_min_ms" json:"rto_min_ms"`
+	RTOAvgMs               *float64   `gorm:"column:rto_avg_ms" json:"rto_avg_ms"`
+	RTOMaxMs               *float64   `gorm:"column:rto_max_ms" json:"rto_max_ms"`
+	ZeroWindows            int64      `gorm:"column:zero_windows;not null;default:0" json:"zero_windows"`
+	ZeroWindowProbes       int64      `gorm:"column:zero_window_probes;not null;default:0" json:"zero_window_probes"`
+	WindowUpdates          int64      `gorm:"column:window_updates;not null;default:0" json:"window_updates"`
+	WindowFull             int64      `gorm:"column:window_full;not null;default:0" json:"window_full"`
+	ClientStallMs          float64    `gorm:"column:client_stall_ms;not null;default:0" json:"client_stall_ms"`
+	ServerStallMs          float64    `gorm:"column:server_stall_ms;not null;default:0" json:"server_stall_ms"`
+	TLSVersion             *string    `json:"tls_version"`
+	TLSSNI                 *string    `json:"tls_sni"`
+	ALPN                   *string    `json:"alpn"`
+	JA3                    *string    `gorm:"column:ja3" json:"ja3"`
+	JA3S                   *string    `gorm:"column:ja3s" json:"ja3s"`
+	JA4                    *string    `gorm:"column:ja4" json:"ja4"`
+	TLSClientHello         bool       `gorm:"not null;default:false" json:"tls_client_hello"`
+	TLSServerHello         bool       `gorm:"not null;default:false" json:"tls_server_hello"`
+	TLSAlert               bool       `gorm:"not null;default:false" json:"tls_alert"`
+	TLSAlertCode           *int       `json:"tls_alert_code"`
+	RSTCount               int64      `gorm:"not null;default:0" json:"rst_count"`
+	TCPState               *string    `gorm:"column:tcp_state" json:"tcp_state"`
+	CloseInitiator         *string    `gorm:"column:close_initiator" json:"close_initiator"`
+	Handshake              *string    `gorm:"column:tcp_handshake" json:"tcp_handshake"`
+	MidConnection          bool       `gorm:"column:mid_connection;not null;default:false" json:"mid_connection"`
+	FragmentCount          int64      `gorm:"not null;default:0" json:"fragment_count"`
+	FragmentsReassembled   int64      `gorm:"column:fragments_reassembled;not null;default:0" json:"fragments_reassembled"`
+	FragmentTimeouts       int64      `gorm:"column:fragment_timeouts;not null;default:0" json:"fragment_timeouts"`
+	FragmentIncomplete     int64      `gorm:"column:fragment_incomplete;not null;default:0" json:"fragment_incomplete"`
+	ThroughputBps          *float64   `json:"throughput_bps"`
+	HTTPMethod             *string    `json:"http_method"`
+	HTTPHost               *string    `json:"http_host"`
+	HTTPTime               *time.Time `json:"http_time"`
+	HTTPPath               *string    `json:"http_path"`
+	HTTPStatus             *int       `json:"http_status"`
+	HTTPResponseMs         *float64   `json:"http_response_ms"`
+	TLSDecrypted           bool       `gorm:"not null;default:false" json:"tls_decrypted"`
+	HTTPRequests           int64      `gorm:"not null;default:0" json:"http_requests"`
+	HTTPResponses          int64      `gorm:"not null;default:0" json:"http_responses"`
+	HTTP4xx                int64      `gorm:"column:http_4xx;not null;default:0" json:"http_4xx"`
+	HTTP5xx                int64      `gorm:"column:http_5xx;not null;default:0" json:"http_5xx"`
+	HTTPTTFBP50Ms          *float64   `gorm:"column:http_ttfb_p50_ms" json:"http_ttfb_p50_ms"`
+	HTTPTTFBP95Ms          *float64   `gorm:"column:http_ttfb_p95_ms" json:"http_ttfb_p95_ms"`
+	HTTPTTFBMaxMs          *float64   `json:"http_ttfb_max_ms"`
+	DNSQueries             int64      `gorm:"not null;default:0" json:"dns_queries"`
+	DNSResponses           int64      `gorm:"not null;default:0" json:"dns_responses"`
+	DNSNXDomain            int64      `gorm:"column:dns_nxdomain;not null;default:0" json:"dns_nxdomain"`
+	DNSServFail            int64      `gorm:"column:dns_servfail;not null;default:0" json:"dns_servfail"`
+	DNSUnanswered          int64      `gorm:"not null;default:0" json:"dns_unanswered"`
+	DNSLatencyAvgMs        *float64   `json:"dns_latency_avg_ms"`
+	DNSLatencyMaxMs        *float64   `json:"dns_latency_max_ms"`
+	DNSQueryName           *string    `json:"dns_query_name"`
+	DNSQueryType           *string    `json:"dns_query_type"`
+	QUICVersion            *string    `gorm:"column:quic_version" json:"quic_version"`
+	QUICDCID               *string    `gorm:"column:quic_dcid" json:"quic_dcid"`
+	QUICSCID               *string    `gorm:"column:quic_scid" json:"quic_scid"`
+	QUICClientInitials     int64      `gorm:"column:quic_client_initials;not null;default:0" json:"quic_client_initials"`
+	QUICServerPackets      int64      `gorm:"column:quic_server_packets;not null;default:0" json:"quic_server_packets"`
+	QUICVersionNegotiation bool       `gorm:"column:quic_version_negotiation;not null;default:false" json:"quic_version_negotiation"`
+	QUICRetry              bool       `gorm:"column:quic_retry;not null;default:false" json:"quic_retry"`
+	QUICHandshakeFailed    bool       `gorm:"column:quic_handshake_failed;not null;default:false" json:"quic_handshake_failed"`
+	ICMPErrors             int64      `gorm:"not null;default:0" json:"icmp_errors"`
+	ICMPUnreachable        int64      `gorm:"not null;default:0" json:"icmp_unreachable"`
+	ICMPFragNeeded         int64      `gorm:"not null;default:0" json:"icmp_frag_needed"`
+	ICMPTimeExceeded       int64      `gorm:"not null;default:0" json:"icmp_time_exceeded"`
+	ICMPNextHopMTU         *int       `json:"icmp_next_hop_mtu"`
+	ICMPUnreachableCode    *int       `json:"icmp_unreachable_code"`
+	CertReportJSON         *string    `gorm:"column:cert_report_json;type:jsonb" json:"cert_report_json,omitempty"`
+}
+
+type HTTPTransaction struct {
+	ID               uint       `gorm:"primaryKey" json:"id"`
+	PcapID           uint       `gorm:"index;not null" json:"pcap_id"`
+	FlowID           uint       `gorm:"index;not null" json:"flow_id"`
+	UserID           uint       `gorm:"index;not null" json:"user_id"`
+	Method           string     `gorm:"not null" json:"method"`
+	Path             string     `gorm:"not null" json:"path"`
+	Host             *string    `json:"host"`
+	Status           *int       `json:"status"`
+	ContentLength    *int64     `json:"content_length"`
+	RequestTS        time.Time  `gorm:"column:request_ts;not null" json:"request_ts"`
+	ResponseTS       *time.Time `gorm:"column:response_ts" json:"response_ts"`
+	TTFBMs           *float64   `gorm:"column:ttfb_ms" json:"ttfb_ms"`
+	PacketStartIndex int        `gorm:"not null" json:"packet_start_index"`
+	PacketEndIndex   int        `gorm:"not null" json:"packet_end_index"`
 }
 
 type Issue struct {
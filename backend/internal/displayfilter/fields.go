@@ -0,0 +1,119 @@
+package displayfilter
+
+import "strings"
+
+// Target is what a filter is evaluated against.
+type Target int
+
+const (
+	Packets Target = iota
+	Flows
+)
+
+func (t Target) String() string {
+	if t == Flows {
+		return "flows"
+	}
+	return "packets"
+}
+
+// Kind is the type of a field's values, which decides the operators and
+// values a comparison on it takes.
+type Kind int
+
+const (
+	KindIP Kind = iota
+	KindNumber
+	KindString
+	KindFlags
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindIP:
+		return "an address"
+	case KindNumber:
+		return "a number"
+	case KindFlags:
+		return "TCP flags"
+	default:
+		return "text"
+	}
+}
+
+// Field is a name a filter term can compare.
+type Field struct {
+	Name string
+	Kind Kind
+	// Packet reports whether packet filters can use the field.
+	Packet bool
+	// Columns are the flow columns, or SQL expressions over them, that hold
+	// the field. A comparison holds when it holds for any of them. Flow
+	// filters cannot use a field without columns.
+	Columns []string
+	// Substring makes field:value match values containing the text, as the
+	// key:value filters always did for the field, rather than equal to it.
+	Substring bool
+	// Fractional lets a number field take values with a fractional part.
+	// The other number fields are integer columns, which would compare
+	// against a truncated value in SQL but not in the packet predicate.
+	Fractional bool
+}
+
+func (f Field) applies(target Target) bool {
+	if target == Flows {
+		return len(f.Columns) > 0
+	}
+	return f.Packet
+}
+
+var fields = map[string]Field{
+	"ip":        {Name: "ip", Kind: KindIP, Packet: true, Columns: []string{"src_ip", "dst_ip"}},
+	"src":       {Name: "src", Kind: KindIP, Packet: true, Columns: []string{"src_ip"}},
+	"dst":       {Name: "dst", Kind: KindIP, Packet: true, Columns: []string{"dst_ip"}},
+	"port":      {Name: "port", Kind: KindNumber, Packet: true, Columns: []string{"src_port", "dst_port"}},
+	"src_port":  {Name: "src_port", Kind: KindNumber, Packet: true, Columns: []string{"src_port"}},
+	"dst_port":  {Name: "dst_port", Kind: KindNumber, Packet: true, Columns: []string{"dst_port"}},
+	"proto":     {Name: "proto", Kind: KindString, Packet: true, Columns: []string{"proto"}},
+	"sni":       {Name: "sni", Kind: KindString, Packet: true, Columns: []string{"tls_sni"}, Substring: true},
+	"stream":    {Name: "stream", Kind: KindNumber, Packet: true, Columns: []string{"tcp_stream"}},
+	"flags":     {Name: "flags", Kind: KindFlags, Packet: true},
+	"len":       {Name: "len", Kind: KindNumber, Packet: true},
+	"ja3":       {Name: "ja3", Kind: KindString, Packet: true, Columns: []string{"ja3"}},
+	"ja3s":      {Name: "ja3s", Kind: KindString, Packet: true, Columns: []string{"ja3s"}},
+	"ja4":       {Name: "ja4", Kind: KindString, Packet: true, Columns: []string{"ja4"}},
+	"tunnel":    {Name: "tunnel", Kind: KindString, Packet: true, Columns: []string{"tunnel_type"}},
+	"tunnel_id": {Name: "tunnel_id", Kind: KindNumber, Packet: true, Columns: []string{"tunnel_id"}},
+
+	"bytes":           {Name: "bytes", Kind: KindNumber, Columns: []string{"(bytes_sent + bytes_recv)"}},
+	"packets":         {Name: "packets", Kind: KindNumber, Columns: []string{"packet_count"}},
+	"rtt":             {Name: "rtt", Kind: KindNumber, Columns: []string{"rtt_ms"}, Fractional: true},
+	"retrans":         {Name: "retrans", Kind: KindNumber, Columns: []string{"retransmits"}},
+	"rst":             {Name: "rst", Kind: KindNumber, Columns: []string{"rst_count"}},
+	"tcp_state":       {Name: "tcp_state", Kind: KindString, Columns: []string{"tcp_state"}},
+	"tcp_handshake":   {Name: "tcp_handshake", Kind: KindString, Columns: []string{"tcp_handshake"}},
+	"close_initiator": {Name: "close_initiator", Kind: KindString, Columns: []string{"close_initiator"}},
+	"http_host":       {Name: "http_host", Kind: KindString, Columns: []string{"http_host"}, Substring: true},
+}
+
+// aliases are the other names the flow and packet query parameters use for
+// the same fields.
+var aliases = map[string]string{
+	"src_ip":      "src",
+	"dst_ip":      "dst",
+	"protocol":    "proto",
+	"tcp_stream":  "stream",
+	"tunnel_type": "tunnel",
+}
+
+func lookupField(name string) (Field, bool) {
+	name = strings.ToLower(name)
+	if canonical, ok := aliases[name]; ok {
+		name = canonical
+	}
+	field, ok := fields[name]
+	return field, ok
+}
+
+// tcpFlags are the flag names a flags term accepts.
+var tcpFlags = map[string]bool{"SYN": true, "ACK": true, "FIN": true, "RST": true, "PSH": true, "URG": true}
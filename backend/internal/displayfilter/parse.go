@@ -0,0 +1,494 @@
+// Package displayfilter parses the boolean filter expressions used to narrow
+// the packet and flow lists, such as
+//
+//	(ip in 10.0.0.0/8 or sni ~ "api") and not flags:RST and len > 1000
+//
+// A term compares a field with a value. field:value is the match the field
+// has always had in key:value filters: a substring for sni and http_host,
+// equality otherwise. ==, !=, <, <=, >, >= and ~ (contains) compare
+// explicitly, and in takes a CIDR, a range lo..hi or a set in braces such as
+// {80 443 8000..8080}. Text compares without regard to case. Terms combine
+// with and (&&), or (||), not (!) and parentheses; terms side by side are
+// anded, so the older space-separated filters keep their meaning.
+package displayfilter
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Error is a syntax error in a filter. Pos is the 1-based byte offset of the
+// text it is about.
+type Error struct {
+	Pos int
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Msg, e.Pos)
+}
+
+// Expr is a parsed filter: an *And, *Or, *Not or *Compare.
+type Expr interface {
+	expr()
+}
+
+type And struct{ X, Y Expr }
+
+type Or struct{ X, Y Expr }
+
+type Not struct{ X Expr }
+
+// Op is a comparison operator. Parse folds field:value into OpEq or
+// OpContains and in into OpEq with several values.
+type Op int
+
+const (
+	OpEq Op = iota
+	OpNe
+	OpLt
+	OpLe
+	OpGt
+	OpGe
+	OpContains
+)
+
+// Compare is a term comparing a field with values of its kind. OpEq and
+// OpNe compare against every value and hold when any matches (OpNe when
+// none does); a multi-valued field such as ip matches when any of its
+// values does.
+type Compare struct {
+	Field    Field
+	Op       Op
+	Prefixes []netip.Prefix // KindIP; an address is a full-length prefix
+	Ranges   []Range        // KindNumber; a number is a range of one
+	Strings  []string       // KindString, lower-cased
+	Flags    []string       // KindFlags, all of which must be set
+	Pos      int
+}
+
+// Range is an inclusive range of numbers.
+type Range struct {
+	Lo, Hi float64
+}
+
+func (*And) expr()     {}
+func (*Or) expr()      {}
+func (*Not) expr()     {}
+func (*Compare) expr() {}
+
+// Parse parses a filter for target. A blank filter parses to nil.
+func Parse(raw string, target Target) (Expr, error) {
+	tokens, err := lex(raw)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens, target: target}
+	if p.peek().kind == tokEOF {
+		return nil, nil
+	}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, tok.errorf("unexpected %s", tok)
+	}
+	return expr, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokLParen
+	tokRParen
+	tokLBrace
+	tokRBrace
+	tokOp
+	tokAnd
+	tokOr
+	tokNot
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int // 0-based byte offset
+	end  int
+}
+
+func (t token) errorf(format string, args ...interface{}) *Error {
+	return &Error{Pos: t.pos + 1, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of filter"
+	case tokString:
+		return strconv.Quote(t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+func (t token) is(keyword string) bool {
+	return t.kind == tokWord && strings.EqualFold(t.text, keyword)
+}
+
+// special are the characters that end a word.
+const special = "()\"{}=!<>~&|"
+
+func lex(raw string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(raw) {
+		c := raw[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case c == '(' || c == ')' || c == '{' || c == '}':
+			kind := map[byte]tokenKind{'(': tokLParen, ')': tokRParen, '{': tokLBrace, '}': tokRBrace}[c]
+			i++
+			tokens = append(tokens, token{kind: kind, text: raw[start:i], pos: start, end: i})
+		case c == '"':
+			var text strings.Builder
+			i++
+			for {
+				if i >= len(raw) {
+					return nil, &Error{Pos: start + 1, Msg: "unterminated string"}
+				}
+				if raw[i] == '"' {
+					i++
+					break
+				}
+				if raw[i] == '\\' && i+1 < len(raw) {
+					i++
+				}
+				text.WriteByte(raw[i])
+				i++
+			}
+			tokens = append(tokens, token{kind: tokString, text: text.String(), pos: start, end: i})
+		case c == '=' || c == '!' || c == '<' || c == '>':
+			i++
+			if i < len(raw) && raw[i] == '=' {
+				i++
+			}
+			text := raw[start:i]
+			switch text {
+			case "!":
+				tokens = append(tokens, token{kind: tokNot, text: text, pos: start, end: i})
+				continue
+			case "=":
+				text = "=="
+			}
+			tokens = append(tokens, token{kind: tokOp, text: text, pos: start, end: i})
+		case c == '~':
+			i++
+			tokens = append(tokens, token{kind: tokOp, text: "~", pos: start, end: i})
+		case c == '&' || c == '|':
+			if i+1 >= len(raw) || raw[i+1] != c {
+				return nil, &Error{Pos: start + 1, Msg: fmt.Sprintf("unexpected %q, use %q", string(c), string([]byte{c, c}))}
+			}
+			i += 2
+			kind := tokAnd
+			if c == '|' {
+				kind = tokOr
+			}
+			tokens = append(tokens, token{kind: kind, text: raw[start:i], pos: start, end: i})
+		default:
+			for i < len(raw) && !strings.ContainsRune(" \t\n\r"+special, rune(raw[i])) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokWord, text: raw[start:i], pos: start, end: i})
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(raw), end: len(raw)}), nil
+}
+
+type parser struct {
+	tokens []token
+	i      int
+	target Target
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.i]
+	if tok.kind != tokEOF {
+		p.i++
+	}
+	return tok
+}
+
+func (p *parser) parseOr() (Expr, error) {
+	x, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for tok := p.peek(); tok.kind == tokOr || tok.is("or"); tok = p.peek() {
+		p.next()
+		y, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		x = &Or{X: x, Y: y}
+	}
+	return x, nil
+}
+
+func (p *parser) parseAnd() (Expr, error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		if tok.kind == tokAnd || tok.is("and") {
+			p.next()
+		} else if !startsTerm(tok) {
+			return x, nil
+		}
+		y, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		x = &And{X: x, Y: y}
+	}
+}
+
+// startsTerm reports whether tok can begin a term anded with the one before.
+func startsTerm(tok token) bool {
+	switch tok.kind {
+	case tokLParen, tokNot:
+		return true
+	case tokWord:
+		return !tok.is("or") && !tok.is("and")
+	}
+	return false
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	tok := p.next()
+	switch {
+	case tok.kind == tokNot || tok.is("not"):
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &Not{X: x}, nil
+	case tok.kind == tokLParen:
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().kind != tokRParen {
+			if p.peek().kind == tokEOF {
+				return nil, tok.errorf("unclosed %q", "(")
+			}
+			return nil, p.peek().errorf("expected %q, found %s", ")", p.peek())
+		}
+		p.next()
+		return x, nil
+	case tok.kind == tokWord && !tok.is("and") && !tok.is("or"):
+		return p.parseTerm(tok)
+	case tok.kind == tokEOF:
+		return nil, tok.errorf("expected a filter term")
+	default:
+		return nil, tok.errorf("expected a filter term, found %s", tok)
+	}
+}
+
+func (p *parser) parseTerm(tok token) (Expr, error) {
+	name := tok.text
+	colon := strings.IndexByte(tok.text, ':')
+	if colon >= 0 {
+		name = tok.text[:colon]
+	}
+	field, ok := lookupField(name)
+	if !ok {
+		return nil, tok.errorf("unknown field %q", name)
+	}
+	if !field.applies(p.target) {
+		return nil, tok.errorf("field %q cannot filter %s", field.Name, p.target)
+	}
+	cmp := &Compare{Field: field, Pos: tok.pos + 1}
+
+	if colon >= 0 {
+		value := token{kind: tokWord, text: tok.text[colon+1:], pos: tok.pos + colon + 1, end: tok.end}
+		if value.text == "" {
+			if next := p.peek(); next.kind == tokString && next.pos == tok.end {
+				value = p.next()
+			} else {
+				return nil, value.errorf("missing value after %q", tok.text)
+			}
+		}
+		op := OpEq
+		if field.Substring {
+			op = OpContains
+		}
+		return cmp, p.bind(cmp, op, []token{value})
+	}
+
+	opTok := p.next()
+	var op Op
+	in := false
+	switch {
+	case opTok.kind == tokOp:
+		op = map[string]Op{"==": OpEq, "!=": OpNe, "<": OpLt, "<=": OpLe, ">": OpGt, ">=": OpGe, "~": OpContains}[opTok.text]
+	case opTok.is("in"):
+		op, in = OpEq, true
+	case opTok.is("contains"):
+		op = OpContains
+	default:
+		return nil, opTok.errorf("expected an operator after %q, found %s", tok.text, opTok)
+	}
+	if !allowed(field.Kind, op) || (in && field.Kind == KindFlags) {
+		return nil, opTok.errorf("%q cannot compare %s", opTok.text, field.Name)
+	}
+
+	var values []token
+	if in && p.peek().kind == tokLBrace {
+		open := p.next()
+		for p.peek().kind == tokWord || p.peek().kind == tokString {
+			values = append(values, splitSet(p.next())...)
+		}
+		switch close := p.next(); close.kind {
+		case tokRBrace:
+		case tokEOF:
+			return nil, open.errorf("unclosed %q", "{")
+		default:
+			return nil, close.errorf("expected a value or %q, found %s", "}", close)
+		}
+		if len(values) == 0 {
+			return nil, open.errorf("empty set")
+		}
+	} else {
+		value := p.next()
+		if value.kind != tokWord && value.kind != tokString {
+			return nil, value.errorf("expected a value after %q, found %s", opTok.text, value)
+		}
+		values = []token{value}
+	}
+	if len(values) > 1 && !in {
+		return nil, values[1].errorf("only in takes several values")
+	}
+	return cmp, p.bind(cmp, op, values)
+}
+
+// splitSet splits a word in a set on commas, so {80,443} reads as {80 443}.
+func splitSet(tok token) []token {
+	if tok.kind != tokWord || !strings.Contains(tok.text, ",") {
+		return []token{tok}
+	}
+	var out []token
+	pos := tok.pos
+	for _, part := range strings.Split(tok.text, ",") {
+		if part != "" {
+			out = append(out, token{kind: tokWord, text: part, pos: pos, end: pos + len(part)})
+		}
+		pos += len(part) + 1
+	}
+	return out
+}
+
+func allowed(kind Kind, op Op) bool {
+	switch kind {
+	case KindIP:
+		return op == OpEq || op == OpNe
+	case KindNumber:
+		return op != OpContains
+	case KindString:
+		return op == OpEq || op == OpNe || op == OpContains
+	default:
+		return op == OpEq
+	}
+}
+
+// bind checks values against the field's kind and stores them in cmp.
+func (p *parser) bind(cmp *Compare, op Op, values []token) error {
+	cmp.Op = op
+	ordered := op == OpLt || op == OpLe || op == OpGt || op == OpGe
+	for _, value := range values {
+		switch cmp.Field.Kind {
+		case KindIP:
+			prefix, err := parsePrefix(value.text)
+			if err != nil {
+				return value.errorf("invalid address %q", value.text)
+			}
+			cmp.Prefixes = append(cmp.Prefixes, prefix)
+		case KindNumber:
+			lo, hi, isRange := strings.Cut(value.text, "..")
+			if isRange && ordered {
+				return value.errorf("%q takes a single number", opText(op))
+			}
+			if !isRange {
+				hi = lo
+			}
+			r, err := parseRange(lo, hi)
+			if err != nil {
+				return value.errorf("invalid number %q", value.text)
+			}
+			if !cmp.Field.Fractional && (r.Lo != math.Trunc(r.Lo) || r.Hi != math.Trunc(r.Hi)) {
+				return value.errorf("%q is not a whole number", value.text)
+			}
+			cmp.Ranges = append(cmp.Ranges, r)
+		case KindString:
+			cmp.Strings = append(cmp.Strings, strings.ToLower(value.text))
+		case KindFlags:
+			for _, flag := range strings.FieldsFunc(value.text, func(r rune) bool { return r == ',' || r == '|' }) {
+				flag = strings.ToUpper(flag)
+				if !tcpFlags[flag] {
+					return value.errorf("unknown TCP flag %q", flag)
+				}
+				cmp.Flags = append(cmp.Flags, flag)
+			}
+			if len(cmp.Flags) == 0 {
+				return value.errorf("expected TCP flags")
+			}
+		}
+	}
+	return nil
+}
+
+func opText(op Op) string {
+	return map[Op]string{OpEq: "==", OpNe: "!=", OpLt: "<", OpLe: "<=", OpGt: ">", OpGe: ">=", OpContains: "~"}[op]
+}
+
+func parsePrefix(text string) (netip.Prefix, error) {
+	if strings.Contains(text, "/") {
+		prefix, err := netip.ParsePrefix(text)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(text)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func parseRange(lo, hi string) (Range, error) {
+	l, err := strconv.ParseFloat(lo, 64)
+	if err != nil {
+		return Range{}, err
+	}
+	h, err := strconv.ParseFloat(hi, 64)
+	if err != nil {
+		return Range{}, err
+	}
+	if h < l {
+		l, h = h, l
+	}
+	return Range{Lo: l, Hi: h}, nil
+}
@@ -0,0 +1,146 @@
+package displayfilter
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParseErrorPositions(t *testing.T) {
+	cases := []struct {
+		raw    string
+		target Target
+		pos    int
+		msg    string
+	}{
+		{raw: "ip ==", pos: 6, msg: `expected a value after "==", found end of filter`},
+		{raw: "(port:80", pos: 1, msg: `unclosed "("`},
+		{raw: "port:80 )", pos: 9, msg: `unexpected ")"`},
+		{raw: "foo:1", pos: 1, msg: `unknown field "foo"`},
+		{raw: "port > abc", pos: 8, msg: `invalid number "abc"`},
+		{raw: "ip in 10.0.0.0/33", pos: 7, msg: `invalid address "10.0.0.0/33"`},
+		{raw: `sni ~ "api`, pos: 7, msg: "unterminated string"},
+		{raw: "ip < 10.0.0.1", pos: 4, msg: `"<" cannot compare ip`},
+		{raw: "port:80 or", pos: 11, msg: "expected a filter term"},
+		{raw: "port in {80 443", pos: 9, msg: `unclosed "{"`},
+		{raw: "port >= 80.5", pos: 9, msg: `"80.5" is not a whole number`},
+		{raw: "packets in {1..2.5}", target: Flows, pos: 13, msg: `"1..2.5" is not a whole number`},
+		{raw: "port > 1..5", pos: 8, msg: `">" takes a single number`},
+		{raw: "flags:SYN,XMAS", pos: 7, msg: `unknown TCP flag "XMAS"`},
+		{raw: "sni: proto:TCP", pos: 5, msg: `missing value after "sni:"`},
+		{raw: "port 80", pos: 6, msg: `expected an operator after "port", found "80"`},
+		{raw: "ip == 10.0.0.1 & port:80", pos: 16, msg: `unexpected "&", use "&&"`},
+		{raw: "bytes > 10", target: Packets, pos: 1, msg: `field "bytes" cannot filter packets`},
+		{raw: "port:443 and len > 1000", target: Flows, pos: 14, msg: `field "len" cannot filter flows`},
+	}
+	for _, tc := range cases {
+		_, err := Parse(tc.raw, tc.target)
+		var syntaxErr *Error
+		if !errors.As(err, &syntaxErr) {
+			t.Fatalf("%q: expected a syntax error, got %v", tc.raw, err)
+		}
+		if syntaxErr.Pos != tc.pos || syntaxErr.Msg != tc.msg {
+			t.Fatalf("%q: expected %q at %d, got %q at %d", tc.raw, tc.msg, tc.pos, syntaxErr.Msg, syntaxErr.Pos)
+		}
+	}
+}
+
+func TestParsePrecedence(t *testing.T) {
+	cases := map[string]string{
+		"proto:TCP port:443":                        "(proto == tcp and port == 443)",
+		"src:10.0.0.1 or dst:10.0.0.2 port:80":      "(src == 10.0.0.1/32 or (dst == 10.0.0.2/32 and port == 80))",
+		"not port:80 and !(proto == udp || len<60)": "(not port == 80 and not (proto == udp or len < 60))",
+		`sni:"api" && tunnel_type = VXLAN`:          "(sni ~ api and tunnel == vxlan)",
+		"port in {80,443 8000..8080}":               "port == 80,443,8000..8080",
+		"ip in 10.1.2.3/8":                          "ip == 10.0.0.0/8",
+	}
+	for raw, want := range cases {
+		expr, err := Parse(raw, Packets)
+		if err != nil {
+			t.Fatalf("%q: %v", raw, err)
+		}
+		if got := describe(expr); got != want {
+			t.Fatalf("%q: expected %s, got %s", raw, want, got)
+		}
+	}
+
+	if expr, err := Parse("  ", Flows); expr != nil || err != nil {
+		t.Fatalf("expected a blank filter to parse to nothing, got %v %v", expr, err)
+	}
+}
+
+func TestSQL(t *testing.T) {
+	expr, err := Parse(`(ip in 10.0.0.0/8 or sni ~ "a_pi") and not port in {80 8000..8080} and bytes >= 1000`, Flows)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	where, args := SQL(expr)
+	wantWhere := "(((COALESCE(CASE WHEN src_ip <> '' THEN CAST(src_ip AS inet) <<= CAST(? AS inet) END OR " +
+		"CASE WHEN dst_ip <> '' THEN CAST(dst_ip AS inet) <<= CAST(? AS inet) END, FALSE) OR " +
+		"COALESCE(tls_sni ILIKE ?, FALSE)) AND " +
+		"NOT COALESCE((src_port = ? OR src_port BETWEEN ? AND ?) OR (dst_port = ? OR dst_port BETWEEN ? AND ?), FALSE)) AND " +
+		"COALESCE((bytes_sent + bytes_recv) >= ?, FALSE))"
+	wantArgs := []interface{}{"10.0.0.0/8", "10.0.0.0/8", `%a\_pi%`, 80.0, 8000.0, 8080.0, 80.0, 8000.0, 8080.0, 1000.0}
+	if where != wantWhere {
+		t.Fatalf("unexpected where clause:\n got %s\nwant %s", where, wantWhere)
+	}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Fatalf("unexpected args: got %v, want %v", args, wantArgs)
+	}
+
+	expr, err = Parse("src_ip != 10.0.0.1 and tcp_state:RESET", Flows)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	where, args = SQL(expr)
+	if want := "(NOT COALESCE(src_ip = ?, FALSE) AND COALESCE(LOWER(tcp_state) = ?, FALSE))"; where != want {
+		t.Fatalf("unexpected where clause:\n got %s\nwant %s", where, want)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"10.0.0.1", "reset"}) {
+		t.Fatalf("unexpected args: %v", args)
+	}
+
+	expr, err = Parse("rtt > 12.5", Flows)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if where, args = SQL(expr); where != "COALESCE(rtt_ms > ?, FALSE)" || !reflect.DeepEqual(args, []interface{}{12.5}) {
+		t.Fatalf("unexpected rtt clause %s with %v", where, args)
+	}
+}
+
+// describe prints an expression with its structure made explicit.
+func describe(expr Expr) string {
+	switch e := expr.(type) {
+	case *And:
+		return "(" + describe(e.X) + " and " + describe(e.Y) + ")"
+	case *Or:
+		return "(" + describe(e.X) + " or " + describe(e.Y) + ")"
+	case *Not:
+		return "not " + describe(e.X)
+	case *Compare:
+		var values []string
+		for _, prefix := range e.Prefixes {
+			values = append(values, prefix.String())
+		}
+		for _, r := range e.Ranges {
+			if r.Lo == r.Hi {
+				values = append(values, fmt.Sprint(r.Lo))
+			} else {
+				values = append(values, fmt.Sprintf("%v..%v", r.Lo, r.Hi))
+			}
+		}
+		values = append(values, e.Strings...)
+		values = append(values, e.Flags...)
+		out := e.Field.Name + " " + opText(e.Op) + " "
+		for i, value := range values {
+			if i > 0 {
+				out += ","
+			}
+			out += value
+		}
+		return out
+	}
+	return "?"
+}
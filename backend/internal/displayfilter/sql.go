@@ -0,0 +1,101 @@
+package displayfilter
+
+import "strings"
+
+// SQL compiles a filter parsed for Flows to a WHERE clause over the flows
+// table and the arguments for its placeholders. Missing values never match,
+// so a negated term holds for them.
+func SQL(expr Expr) (string, []interface{}) {
+	b := &sqlBuilder{}
+	return b.expr(expr), b.args
+}
+
+type sqlBuilder struct {
+	args []interface{}
+}
+
+func (b *sqlBuilder) expr(expr Expr) string {
+	switch e := expr.(type) {
+	case *And:
+		return "(" + b.expr(e.X) + " AND " + b.expr(e.Y) + ")"
+	case *Or:
+		return "(" + b.expr(e.X) + " OR " + b.expr(e.Y) + ")"
+	case *Not:
+		return "NOT " + b.expr(e.X)
+	case *Compare:
+		return b.compare(e)
+	}
+	return "FALSE"
+}
+
+func (b *sqlBuilder) compare(c *Compare) string {
+	if len(c.Field.Columns) == 0 {
+		return "FALSE"
+	}
+	conds := make([]string, 0, len(c.Field.Columns))
+	for _, column := range c.Field.Columns {
+		conds = append(conds, b.column(column, c))
+	}
+	// A NULL column would otherwise make the term, and any NOT over it,
+	// unknown rather than false.
+	cond := "COALESCE(" + strings.Join(conds, " OR ") + ", FALSE)"
+	if c.Op == OpNe {
+		return "NOT " + cond
+	}
+	return cond
+}
+
+func (b *sqlBuilder) column(column string, c *Compare) string {
+	var conds []string
+	switch c.Field.Kind {
+	case KindIP:
+		for _, prefix := range c.Prefixes {
+			if prefix.IsSingleIP() {
+				conds = append(conds, column+" = ?")
+				b.args = append(b.args, prefix.Addr().String())
+				continue
+			}
+			conds = append(conds, "CASE WHEN "+column+" <> '' THEN CAST("+column+" AS inet) <<= CAST(? AS inet) END")
+			b.args = append(b.args, prefix.String())
+		}
+	case KindNumber:
+		switch c.Op {
+		case OpLt, OpLe, OpGt, OpGe:
+			conds = append(conds, column+" "+opText(c.Op)+" ?")
+			b.args = append(b.args, c.Ranges[0].Lo)
+		default:
+			for _, r := range c.Ranges {
+				if r.Lo == r.Hi {
+					conds = append(conds, column+" = ?")
+					b.args = append(b.args, r.Lo)
+				} else {
+					conds = append(conds, column+" BETWEEN ? AND ?")
+					b.args = append(b.args, r.Lo, r.Hi)
+				}
+			}
+		}
+	case KindString:
+		for _, s := range c.Strings {
+			if c.Op == OpContains {
+				conds = append(conds, column+" ILIKE ?")
+				b.args = append(b.args, "%"+escapeLike(s)+"%")
+			} else {
+				conds = append(conds, "LOWER("+column+") = ?")
+				b.args = append(b.args, s)
+			}
+		}
+	}
+	if len(conds) == 0 {
+		return "FALSE"
+	}
+	if len(conds) == 1 {
+		return conds[0]
+	}
+	return "(" + strings.Join(conds, " OR ") + ")"
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
@@ -0,0 +1,105 @@
+package flows
+
+import (
+	"crypto/x509"
+	"time"
+)
+
+const certExpiringSoonDays = 14
+
+type CertReport struct {
+	Host              string    `json:"host"`
+	Port              int       `json:"port"`
+	Source            string    `json:"source"`
+	Subject           string    `json:"subject"`
+	Issuer            string    `json:"issuer"`
+	SANs              []string  `json:"sans"`
+	NotBefore         time.Time `json:"not_before"`
+	NotAfter          time.Time `json:"not_after"`
+	ObservedAt        time.Time `json:"observed_at"`
+	DaysRemaining     int       `json:"days_remaining"`
+	SignatureAlg      string    `json:"signature_algorithm"`
+	ChainLength       int       `json:"chain_length"`
+	Issues            []string  `json:"issues"`
+	HostnameChecked   bool      `json:"hostname_checked"`
+	HostnameValid     bool      `json:"hostname_valid"`
+	SelfSigned        bool      `json:"self_signed"`
+	Expired           bool      `json:"expired"`
+	WeakSignatureAlgo bool      `json:"weak_signature"`
+}
+
+// BuildCertReport evaluates a server certificate chain as of ref, which is
+// the capture timestamp for passively extracted chains. The hostname check is
+// skipped when host is empty.
+func BuildCertReport(chain []*x509.Certificate, host string, port int, ref time.Time) CertReport {
+	report := CertReport{Host: host, Port: port, ObservedAt: ref, Issues: []string{}}
+	if len(chain) == 0 {
+		report.Issues = append(report.Issues, "no certificates presented")
+		return report
+	}
+
+	leaf := chain[0]
+	report.Subject = leaf.Subject.String()
+	report.Issuer = leaf.Issuer.String()
+	report.SANs = leaf.DNSNames
+	report.NotBefore = leaf.NotBefore
+	report.NotAfter = leaf.NotAfter
+	report.SignatureAlg = leaf.SignatureAlgorithm.String()
+	report.ChainLength = len(chain)
+	report.DaysRemaining = int(leaf.NotAfter.Sub(ref).Hours() / 24)
+
+	if ref.After(leaf.NotAfter) || ref.Before(leaf.NotBefore) {
+		report.Expired = true
+		report.Issues = append(report.Issues, "certificate is expired or not yet valid")
+	} else if report.DaysRemaining < certExpiringSoonDays {
+		report.Issues = append(report.Issues, "certificate expires soon")
+	}
+
+	if host != "" {
+		report.HostnameChecked = true
+		if err := leaf.VerifyHostname(host); err != nil {
+			report.Issues = append(report.Issues, "hostname mismatch")
+		} else {
+			report.HostnameValid = true
+		}
+	}
+
+	if leaf.Subject.String() == leaf.Issuer.String() {
+		report.SelfSigned = true
+		report.Issues = append(report.Issues, "self-signed certificate")
+	}
+
+	if report.ChainLength < 2 {
+		report.Issues = append(report.Issues, "incomplete certificate chain")
+	}
+
+	if isWeakSignature(leaf.SignatureAlgorithm) {
+		report.WeakSignatureAlgo = true
+		report.Issues = append(report.Issues, "weak signature algorithm")
+	}
+
+	return report
+}
+
+func (f *FlowAgg) SetCertReport(report CertReport) {
+	if f.CertReport != nil {
+		return
+	}
+	f.CertReport = &report
+	if f.PacketCount > 0 {
+		f.certIndexes = appendIndex(f.certIndexes, int(f.PacketCount))
+	}
+}
+
+func (f *FlowAgg) CertIndexes() []int {
+	return append([]int(nil), f.certIndexes...)
+}
+
+func isWeakSignature(alg x509.SignatureAlgorithm) bool {
+	switch alg {
+	case x509.MD2WithRSA, x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,114 @@
+package flows
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	DNSRCodeNoError  = 0
+	DNSRCodeServFail = 2
+	DNSRCodeNXDomain = 3
+
+	maxPendingDNSQueries = 4096
+)
+
+type DNSMessage struct {
+	ID          uint16
+	Response    bool
+	QueryName   string
+	QueryType   string
+	RCode       int
+	AnswerCount int
+}
+
+type dnsQueryKey struct {
+	ID   uint16
+	Name string
+}
+
+type dnsPendingQuery struct {
+	ts          time.Time
+	packetIndex int
+}
+
+func (f *FlowAgg) updateDNS(messages []DNSMessage, ts time.Time, packetIndex int) {
+	for _, msg := range messages {
+		if f.DNSQueryName == nil && msg.QueryName != "" {
+			name := msg.QueryName
+			f.DNSQueryName = &name
+		}
+		if f.DNSQueryType == nil && msg.QueryType != "" {
+			qtype := msg.QueryType
+			f.DNSQueryType = &qtype
+		}
+
+		key := dnsQueryKey{ID: msg.ID, Name: strings.ToLower(msg.QueryName)}
+		if !msg.Response {
+			f.DNSQueries++
+			if _, ok := f.dnsPending[key]; ok {
+				continue
+			}
+			if len(f.dnsPending) >= maxPendingDNSQueries {
+				f.dnsOverflow++
+				continue
+			}
+			if f.dnsPending == nil {
+				f.dnsPending = make(map[dnsQueryKey]dnsPendingQuery)
+			}
+			f.dnsPending[key] = dnsPendingQuery{ts: ts, packetIndex: packetIndex}
+			continue
+		}
+
+		f.DNSResponses++
+		switch msg.RCode {
+		case DNSRCodeNXDomain:
+			f.DNSNXDomain++
+			f.dnsErrorIndexes = appendIndex(f.dnsErrorIndexes, packetIndex)
+		case DNSRCodeServFail:
+			f.DNSServFail++
+			f.dnsErrorIndexes = appendIndex(f.dnsErrorIndexes, packetIndex)
+		}
+
+		query, ok := f.dnsPending[key]
+		if !ok && msg.QueryName == "" {
+			key, query, ok = f.findPendingDNSByID(msg.ID)
+		}
+		if !ok {
+			continue
+		}
+		delete(f.dnsPending, key)
+
+		latency := ts.Sub(query.ts).Seconds() * 1000
+		f.dnsLatencySum += latency
+		f.dnsLatencyCount++
+		if f.DNSLatencyMaxMs == nil || latency > *f.DNSLatencyMaxMs {
+			maxMs := latency
+			f.DNSLatencyMaxMs = &maxMs
+		}
+	}
+}
+
+func (f *FlowAgg) findPendingDNSByID(id uint16) (dnsQueryKey, dnsPendingQuery, bool) {
+	for key, query := range f.dnsPending {
+		if key.ID == id {
+			return key, query, true
+		}
+	}
+	return dnsQueryKey{}, dnsPendingQuery{}, false
+}
+
+func (f *FlowAgg) finalizeDNS() {
+	f.DNSUnanswered = int64(len(f.dnsPending)) + f.dnsOverflow
+	for _, query := range f.dnsPending {
+		f.dnsErrorIndexes = appendIndex(f.dnsErrorIndexes, query.packetIndex)
+	}
+	if f.dnsLatencyCount > 0 {
+		avg := f.dnsLatencySum / float64(f.dnsLatencyCount)
+		f.DNSLatencyAvgMs = &avg
+	}
+}
+
+func (f *FlowAgg) DNSErrorIndexes() []int {
+	return append([]int(nil), f.dnsErrorIndexes...)
+}
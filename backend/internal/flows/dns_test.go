@@ -0,0 +1,58 @@
+package flows
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDNSQueryResponseMatching(t *testing.T) {
+	key := FlowKey{Proto: "UDP", SrcIP: "10.0.0.5", DstIP: "10.0.0.53", SrcPort: 40000, DstPort: 53}
+	ts := time.Now()
+	flow := NewFlowAgg(key, ts)
+
+	flow.Update(PacketInfo{
+		Timestamp: ts,
+		Proto:     "UDP",
+		DNS:       []DNSMessage{{ID: 1, QueryName: "api.example.com", QueryType: "A"}},
+	}, true)
+	flow.Update(PacketInfo{
+		Timestamp: ts.Add(1 * time.Millisecond),
+		Proto:     "UDP",
+		DNS:       []DNSMessage{{ID: 2, QueryName: "missing.example.com", QueryType: "AAAA"}},
+	}, true)
+	flow.Update(PacketInfo{
+		Timestamp: ts.Add(2 * time.Millisecond),
+		Proto:     "UDP",
+		DNS:       []DNSMessage{{ID: 3, QueryName: "lost.example.com", QueryType: "A"}},
+	}, true)
+	flow.Update(PacketInfo{
+		Timestamp: ts.Add(40 * time.Millisecond),
+		Proto:     "UDP",
+		DNS:       []DNSMessage{{ID: 1, Response: true, QueryName: "API.example.com", QueryType: "A", AnswerCount: 1}},
+	}, false)
+	flow.Update(PacketInfo{
+		Timestamp: ts.Add(81 * time.Millisecond),
+		Proto:     "UDP",
+		DNS:       []DNSMessage{{ID: 2, Response: true, QueryName: "missing.example.com", QueryType: "AAAA", RCode: DNSRCodeNXDomain}},
+	}, false)
+	flow.Finalize()
+
+	if flow.DNSQueries != 3 || flow.DNSResponses != 2 {
+		t.Fatalf("expected 3 queries and 2 responses, got %d and %d", flow.DNSQueries, flow.DNSResponses)
+	}
+	if flow.DNSNXDomain != 1 {
+		t.Fatalf("expected 1 NXDOMAIN, got %d", flow.DNSNXDomain)
+	}
+	if flow.DNSUnanswered != 1 {
+		t.Fatalf("expected 1 unanswered query, got %d", flow.DNSUnanswered)
+	}
+	if flow.DNSLatencyAvgMs == nil || *flow.DNSLatencyAvgMs != 60 {
+		t.Fatalf("expected avg latency 60ms, got %v", flow.DNSLatencyAvgMs)
+	}
+	if flow.DNSLatencyMaxMs == nil || *flow.DNSLatencyMaxMs != 80 {
+		t.Fatalf("expected max latency 80ms, got %v", flow.DNSLatencyMaxMs)
+	}
+	if flow.DNSQueryName == nil || *flow.DNSQueryName != "api.example.com" {
+		t.Fatalf("expected first query name, got %v", flow.DNSQueryName)
+	}
+}
@@ -10,6 +10,22 @@ type FlowKey struct {
 	DstIP   string
 	SrcPort int
 	DstPort int
+	Tunnel  Tunnel
+	// Generation tells apart connections on the same 5-tuple: it is one
+	// past that of the connection the flow table last knew of on the
+	// 5-tuple, or 0 when it knew of none. It keeps keys held at the same
+	// time distinct; it is not a count over the whole capture, as the
+	// table forgets 5-tuples some time after their flows are handed off.
+	// A flow carrying on a connection finalized early keeps its key.
+	Generation int
+}
+
+// Tunnel identifies the encapsulation closest to a flow's inner IP header: a
+// VXLAN or Geneve VNI, a GRE key, an 802.1Q VLAN ID or an MPLS label. The
+// zero value means the packets were not encapsulated.
+type Tunnel struct {
+	Type string
+	ID   uint32
 }
 
 func (k FlowKey) Reverse() FlowKey {
@@ -19,6 +35,32 @@ func (k FlowKey) Reverse() FlowKey {
 		DstIP:   k.SrcIP,
 		SrcPort: k.DstPort,
 		DstPort: k.SrcPort,
+		Tunnel:  k.Tunnel,
+
+		Generation: k.Generation,
+	}
+}
+
+// KeyLess orders flow keys by 5-tuple, then tunnel, then generation, so
+// anything walked in key order does not depend on map order.
+func KeyLess(a, b FlowKey) bool {
+	switch {
+	case a.Proto != b.Proto:
+		return a.Proto < b.Proto
+	case a.SrcIP != b.SrcIP:
+		return a.SrcIP < b.SrcIP
+	case a.DstIP != b.DstIP:
+		return a.DstIP < b.DstIP
+	case a.SrcPort != b.SrcPort:
+		return a.SrcPort < b.SrcPort
+	case a.DstPort != b.DstPort:
+		return a.DstPort < b.DstPort
+	case a.Tunnel.Type != b.Tunnel.Type:
+		return a.Tunnel.Type < b.Tunnel.Type
+	case a.Tunnel.ID != b.Tunnel.ID:
+		return a.Tunnel.ID < b.Tunnel.ID
+	default:
+		return a.Generation < b.Generation
 	}
 }
 
@@ -29,14 +71,22 @@ type PacketInfo struct {
 	DstIP          string
 	SrcPort        int
 	DstPort        int
+	Tunnel         Tunnel
+	Interface      string
 	Length         int
 	PayloadLen     int
+	Payload        []byte
 	Seq            uint32
 	Ack            uint32
 	Window         uint16
 	TCPFlags       TCPFlags
 	MSS            *int
+	WindowScale    *int
+	SACKPermitted  bool
+	SACKBlocks     []SACKBlock
+	TCPTimestamp   *TCPTimestamp
 	IsFragment     bool
+	Fragments      int
 	TLSSNI         *string
 	TLSVersion     *string
 	ALPN           *string
@@ -44,8 +94,16 @@ type PacketInfo struct {
 	TLSServerHello bool
 	TLSAlert       bool
 	TLSAlertCode   *int
+	JA3            *string
+	JA3S           *string
+	JA4            *string
 	HTTPMethod     *string
 	HTTPHost       *string
+	HTTPPath       *string
+	HTTPStatus     *int
+	DNS            []DNSMessage
+	QUIC           *QUICPacket
+	ICMP           *ICMPMessage
 }
 
 type TCPFlags struct {
@@ -57,6 +115,20 @@ type TCPFlags struct {
 	URG bool
 }
 
+// maxEvidenceIndexes bounds the packet indexes a flow keeps for each kind of
+// event. They only point issue evidence at example packets; the counters
+// still cover every event.
+const maxEvidenceIndexes = 64
+
+// appendIndex records a packet index unless maxEvidenceIndexes are already
+// kept.
+func appendIndex(indexes []int, index int) []int {
+	if len(indexes) >= maxEvidenceIndexes {
+		return indexes
+	}
+	return append(indexes, index)
+}
+
 type SeqState struct {
 	ExpectedSeq uint32
 	Initialized bool
@@ -66,10 +138,16 @@ type FlowAgg struct {
 	Key                 FlowKey
 	FirstSeen           time.Time
 	LastSeen            time.Time
+	ContinuedFrom       *time.Time
 	SynTime             *time.Time
 	SynAckTime          *time.Time
 	AckTime             *time.Time
 	RTTMs               *float64
+	RTTMinMs            *float64
+	RTTAvgMs            *float64
+	RTTP95Ms            *float64
+	RTTMaxMs            *float64
+	RTTSampleCount      int64
 	BytesSent           int64
 	BytesRecv           int64
 	BytesClientToServer int64
@@ -84,28 +162,101 @@ type FlowAgg struct {
 	OutOfOrder          int64
 	DupAcks             int64
 	MSS                 *int
+	ClientMSS           *int
+	ServerMSS           *int
+	ClientWindowScale   *int
+	ServerWindowScale   *int
+	ClientRwndMin       *int64
+	ClientRwndMax       *int64
+	ServerRwndMin       *int64
+	ServerRwndMax       *int64
+	SACKLossEvents      int64
+	RetransRTO          int64
+	RetransFast         int64
+	RetransTLP          int64
+	RetransSpurious     int64
+	RetransPartial      int64
+	RTOMinMs            *float64
+	RTOAvgMs            *float64
+	RTOMaxMs            *float64
+	ZeroWindows         int64
+	ZeroWindowProbes    int64
+	WindowUpdates       int64
+	WindowFull          int64
+	ClientStallMs       float64
+	ServerStallMs       float64
 	TLSVersion          *string
 	TLSSNI              *string
 	ALPN                *string
+	JA3                 *string
+	JA3S                *string
+	JA4                 *string
 	RSTCount            int64
+	TCPState            *string
+	CloseInitiator      *string
+	Handshake           *string
 	FragmentCount       int64
+	Defragmented        int64
+	FragmentTimeouts    int64
+	FragmentIncomplete  int64
+	Interfaces          []string
 	HTTPMethod          *string
 	HTTPHost            *string
 	HTTPTime            *time.Time
+	HTTPPath            *string
+	HTTPStatus          *int
+	HTTPResponseMs      *float64
+	HTTPRequests        int64
+	HTTPResponses       int64
+	HTTP4xx             int64
+	HTTP5xx             int64
+	HTTPTTFBP50Ms       *float64
+	HTTPTTFBP95Ms       *float64
+	HTTPTTFBMaxMs       *float64
+	HTTPTransactions    []HTTPTransaction
 	ThroughputBps       *float64
 	TLSAlertCode        *int
 	TCPStreamID         *int
+	DNSQueries          int64
+	DNSResponses        int64
+	DNSNXDomain         int64
+	DNSServFail         int64
+	DNSUnanswered       int64
+	DNSLatencyAvgMs     *float64
+	DNSLatencyMaxMs     *float64
+	DNSQueryName        *string
+	DNSQueryType        *string
+	QUICVersion         *string
+	QUICDCID            *string
+	QUICSCID            *string
+	QUICClientInitials  int64
+	QUICServerPackets   int64
+	ICMPErrors          int64
+	ICMPUnreachable     int64
+	ICMPFragNeeded      int64
+	ICMPTimeExceeded    int64
+	ICMPNextHopMTU      *int
+	ICMPUnreachableCode *int
+	CertReport          *CertReport
+
+	QUICVersionNegotiation bool
+	QUICRetry              bool
+	QUICHandshakeFailed    bool
 
 	SawClientHello bool
 	SawServerHello bool
 	TLSAlert       bool
+	TLSDecrypted   bool
+	SACKPermitted  bool
+	TCPTimestamps  bool
+	MidConnection  bool
 
 	RetransSizeCount map[int]int
 
-	seqCache              *SeqCache
 	seqStates             [2]SeqState
 	lastAck               [2]uint32
 	lastAckSet            [2]bool
+	synCounts             [2]int64
 	synIndexes            [2][]int
 	synRetransIndexes     []int
 	retransIndexes        []int
@@ -115,6 +266,25 @@ type FlowAgg struct {
 	tlsAlertIndexes       []int
 	clientDir             int
 	clientDirKnown        bool
+	tcpOptions            [2]tcpOptionState
+	rtt                   [2]rttDirection
+	rttSamples            []float64
+	retrans               RetransTracker
+	lifecycle             tcpLifecycle
+	windows               WindowTracker
+	zeroWindowIndexes     []int
+	dnsPending            map[dnsQueryKey]dnsPendingQuery
+	dnsOverflow           int64
+	dnsLatencySum         float64
+	dnsLatencyCount       int64
+	dnsErrorIndexes       []int
+	quicInitialIndexes    []int
+	quicCloseIndexes      []int
+	icmpErrorFrames       []int
+	certIndexes           []int
+	httpErrorIndexes      []int
+	httpSlowestIndexes    []int
+	httpTTFBs             []float64
 }
 
 func NewFlowAgg(key FlowKey, ts time.Time) *FlowAgg {
@@ -122,7 +292,6 @@ func NewFlowAgg(key FlowKey, ts time.Time) *FlowAgg {
 		Key:              key,
 		FirstSeen:        ts,
 		LastSeen:         ts,
-		seqCache:         NewSeqCache(2048, 3*time.Second),
 		RetransSizeCount: make(map[int]int),
 	}
 }
@@ -132,9 +301,15 @@ func (f *FlowAgg) Update(pkt PacketInfo, forward bool) {
 	f.PacketCount++
 	packetIndex := int(f.PacketCount)
 
-	if pkt.IsFragment {
+	if pkt.Fragments > 0 {
+		f.FragmentCount += int64(pkt.Fragments)
+		f.Defragmented++
+	} else if pkt.IsFragment {
 		f.FragmentCount++
 	}
+	if pkt.Interface != "" {
+		f.addInterface(pkt.Interface)
+	}
 
 	if pkt.TCPFlags.RST {
 		f.RSTCount++
@@ -153,30 +328,33 @@ func (f *FlowAgg) Update(pkt PacketInfo, forward bool) {
 	if pkt.ALPN != nil && f.ALPN == nil {
 		f.ALPN = pkt.ALPN
 	}
+	if pkt.JA3 != nil && f.JA3 == nil {
+		f.JA3 = pkt.JA3
+	}
+	if pkt.JA3S != nil && f.JA3S == nil {
+		f.JA3S = pkt.JA3S
+	}
+	if pkt.JA4 != nil && f.JA4 == nil {
+		f.JA4 = pkt.JA4
+	}
 	if pkt.TLSClientHello {
 		f.SawClientHello = true
-		f.tlsClientHelloIndexes = append(f.tlsClientHelloIndexes, packetIndex)
+		f.tlsClientHelloIndexes = appendIndex(f.tlsClientHelloIndexes, packetIndex)
 	}
 	if pkt.TLSServerHello {
 		f.SawServerHello = true
-		f.tlsServerHelloIndexes = append(f.tlsServerHelloIndexes, packetIndex)
+		f.tlsServerHelloIndexes = appendIndex(f.tlsServerHelloIndexes, packetIndex)
 	}
 	if pkt.TLSAlert {
 		f.TLSAlert = true
 		if pkt.TLSAlertCode != nil && f.TLSAlertCode == nil {
 			f.TLSAlertCode = pkt.TLSAlertCode
 		}
-		f.tlsAlertIndexes = append(f.tlsAlertIndexes, packetIndex)
+		f.tlsAlertIndexes = appendIndex(f.tlsAlertIndexes, packetIndex)
 	}
 
-	if pkt.HTTPMethod != nil && f.HTTPMethod == nil {
-		f.HTTPMethod = pkt.HTTPMethod
-	}
-	if pkt.HTTPHost != nil && f.HTTPHost == nil {
-		f.HTTPHost = pkt.HTTPHost
-	}
-	if pkt.HTTPMethod != nil && f.HTTPTime == nil {
-		f.HTTPTime = &pkt.Timestamp
+	if len(pkt.DNS) > 0 {
+		f.updateDNS(pkt.DNS, pkt.Timestamp, packetIndex)
 	}
 
 	dirIndex := 0
@@ -188,6 +366,18 @@ func (f *FlowAgg) Update(pkt PacketInfo, forward bool) {
 		f.clientDirKnown = true
 	}
 
+	if pkt.QUIC != nil {
+		f.updateQUIC(pkt.QUIC, dirIndex, packetIndex)
+	}
+	var retrans RetransEvent
+	if pkt.Proto == "TCP" {
+		retrans = f.retrans.Observe(pkt, dirIndex)
+		f.lifecycle.update(pkt, dirIndex)
+		f.updateTCPOptions(pkt, dirIndex)
+		f.sampleRTT(pkt, dirIndex)
+		f.updateWindow(pkt, dirIndex, packetIndex)
+	}
+
 	if pkt.PayloadLen > 0 {
 		f.AppBytes += int64(pkt.PayloadLen)
 		if f.FirstPayloadTime == nil {
@@ -203,18 +393,20 @@ func (f *FlowAgg) Update(pkt PacketInfo, forward bool) {
 			f.BytesRecv += int64(pkt.PayloadLen)
 		}
 
-		seqKey := SeqKey{Direction: dirIndex, Seq: pkt.Seq, Length: pkt.PayloadLen}
-		if f.seqCache.Seen(seqKey, pkt.Timestamp) {
-			f.Retransmits++
-			f.RetransSizeCount[pkt.PayloadLen]++
-			f.retransIndexes = append(f.retransIndexes, packetIndex)
-		} else {
-			f.trackSequence(dirIndex, pkt.Seq, pkt.PayloadLen)
+		if pkt.Proto == "TCP" {
+			if retrans.Kind != RetransNone {
+				f.Retransmits++
+				f.RetransSizeCount[pkt.PayloadLen]++
+				f.retransIndexes = appendIndex(f.retransIndexes, packetIndex)
+			} else {
+				f.trackSequence(dirIndex, pkt.Seq, pkt.PayloadLen)
+			}
 		}
 	}
 
 	if pkt.TCPFlags.SYN && !pkt.TCPFlags.ACK {
-		f.synIndexes[dirIndex] = append(f.synIndexes[dirIndex], packetIndex)
+		f.synCounts[dirIndex]++
+		f.synIndexes[dirIndex] = appendIndex(f.synIndexes[dirIndex], packetIndex)
 		if f.SynTime == nil {
 			f.clientDir = dirIndex
 			f.clientDirKnown = true
@@ -241,7 +433,7 @@ func (f *FlowAgg) Update(pkt PacketInfo, forward bool) {
 	if pkt.TCPFlags.ACK && pkt.PayloadLen == 0 && !pkt.TCPFlags.SYN {
 		if f.lastAckSet[dirIndex] && pkt.Ack == f.lastAck[dirIndex] {
 			f.DupAcks++
-			f.dupAckIndexes = append(f.dupAckIndexes, packetIndex)
+			f.dupAckIndexes = appendIndex(f.dupAckIndexes, packetIndex)
 		}
 		f.lastAck[dirIndex] = pkt.Ack
 		f.lastAckSet[dirIndex] = true
@@ -291,10 +483,18 @@ func (f *FlowAgg) Finalize() {
 		f.BytesClientToServer = f.BytesRecv
 		f.BytesServerToClient = f.BytesSent
 	}
-	if synCount := len(f.synIndexes[f.clientDir]); synCount > 1 {
-		f.SynRetransmits = int64(synCount - 1)
+	if synCount := f.synCounts[f.clientDir]; synCount > 1 {
+		f.SynRetransmits = synCount - 1
 		f.synRetransIndexes = append(f.synRetransIndexes, f.synIndexes[f.clientDir][1:]...)
 	}
+	f.finalizeState()
+	f.finalizeTCPOptions()
+	f.finalizeRTT()
+	f.finalizeRetrans()
+	f.finalizeWindow()
+	f.finalizeDNS()
+	f.finalizeQUIC()
+	f.finalizeHTTP()
 }
 
 func (f *FlowAgg) ClientServer() (string, int, string, int) {
@@ -330,3 +530,30 @@ func (f *FlowAgg) TLSServerHelloIndexes() []int {
 func (f *FlowAgg) TLSAlertIndexes() []int {
 	return append([]int(nil), f.tlsAlertIndexes...)
 }
+
+// RecordFragmentLoss counts a datagram on the flow whose fragments never all
+// arrived, either because the reassembly timeout passed or because it was
+// still incomplete when it had to be given up.
+func (f *FlowAgg) RecordFragmentLoss(frames int, timedOut bool) {
+	f.FragmentCount += int64(frames)
+	if timedOut {
+		f.FragmentTimeouts++
+	} else {
+		f.FragmentIncomplete++
+	}
+}
+
+// maxFlowInterfaces bounds the interfaces recorded per flow; a flow seen on
+// more than a handful of capture points is already unusual.
+const maxFlowInterfaces = 8
+
+func (f *FlowAgg) addInterface(name string) {
+	for _, existing := range f.Interfaces {
+		if existing == name {
+			return
+		}
+	}
+	if len(f.Interfaces) < maxFlowInterfaces {
+		f.Interfaces = append(f.Interfaces, name)
+	}
+}
@@ -74,3 +74,29 @@ func TestSynRetransmissions(t *testing.T) {
 		t.Fatalf("expected 1 syn retransmit, got %d", flow.SynRetransmits)
 	}
 }
+
+func TestEvidenceIndexesAreCapped(t *testing.T) {
+	key := FlowKey{Proto: "TCP", SrcIP: "192.168.0.1", DstIP: "192.168.0.2", SrcPort: 5000, DstPort: 443}
+	ts := time.Now()
+	flow := NewFlowAgg(key, ts)
+	for i := 0; i < 100; i++ {
+		flow.Update(PacketInfo{
+			Timestamp: ts.Add(time.Duration(i) * time.Second),
+			Proto:     "TCP",
+			SrcIP:     key.SrcIP,
+			DstIP:     key.DstIP,
+			SrcPort:   key.SrcPort,
+			DstPort:   key.DstPort,
+			Seq:       100,
+			TCPFlags:  TCPFlags{SYN: true},
+		}, true)
+	}
+	flow.Finalize()
+
+	if flow.SynRetransmits != 99 {
+		t.Fatalf("expected every syn retransmit counted, got %d", flow.SynRetransmits)
+	}
+	if got := len(flow.SynRetransmissionIndexes()); got != maxEvidenceIndexes-1 {
+		t.Fatalf("expected %d evidence indexes, got %d", maxEvidenceIndexes-1, got)
+	}
+}
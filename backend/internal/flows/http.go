@@ -0,0 +1,107 @@
+package flows
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// maxHTTPTransactions bounds the per-flow transaction list; aggregate counters
+// and response time percentiles still cover every transaction.
+const maxHTTPTransactions = 1000
+
+// HTTPTransaction is one HTTP/1.x request and, when seen, its response. The
+// path has its query string stripped; bodies are never kept.
+type HTTPTransaction struct {
+	Method        string
+	Path          string
+	Host          string
+	Status        *int
+	ContentLength *int64
+	RequestTime   time.Time
+	ResponseTime  *time.Time
+	TTFBMs        *float64
+	RequestIndex  int
+	ResponseIndex *int
+}
+
+// AddHTTPTransaction records a request/response pair, or an unanswered
+// request, in the order requests were sent on the connection.
+func (f *FlowAgg) AddHTTPTransaction(tx HTTPTransaction) {
+	f.HTTPRequests++
+	if len(f.HTTPTransactions) < maxHTTPTransactions {
+		f.HTTPTransactions = append(f.HTTPTransactions, tx)
+	}
+
+	if f.HTTPMethod == nil {
+		method := tx.Method
+		f.HTTPMethod = &method
+		if tx.Path != "" {
+			path := tx.Path
+			f.HTTPPath = &path
+		}
+		if tx.Host != "" && f.HTTPHost == nil {
+			host := tx.Host
+			f.HTTPHost = &host
+		}
+		requestTime := tx.RequestTime
+		f.HTTPTime = &requestTime
+		f.HTTPStatus = tx.Status
+		f.HTTPResponseMs = tx.TTFBMs
+	}
+
+	if tx.Status == nil {
+		return
+	}
+	f.HTTPResponses++
+	responseIndex := tx.RequestIndex
+	if tx.ResponseIndex != nil {
+		responseIndex = *tx.ResponseIndex
+	}
+	switch {
+	case *tx.Status >= 500:
+		f.HTTP5xx++
+		f.httpErrorIndexes = appendIndex(f.httpErrorIndexes, responseIndex)
+	case *tx.Status >= 400:
+		f.HTTP4xx++
+		f.httpErrorIndexes = appendIndex(f.httpErrorIndexes, responseIndex)
+	}
+
+	if tx.TTFBMs != nil {
+		f.httpTTFBs = append(f.httpTTFBs, *tx.TTFBMs)
+		if f.HTTPTTFBMaxMs == nil || *tx.TTFBMs > *f.HTTPTTFBMaxMs {
+			maxMs := *tx.TTFBMs
+			f.HTTPTTFBMaxMs = &maxMs
+			f.httpSlowestIndexes = []int{tx.RequestIndex, responseIndex}
+		}
+	}
+}
+
+func (f *FlowAgg) finalizeHTTP() {
+	if len(f.httpTTFBs) == 0 {
+		return
+	}
+	samples := append([]float64(nil), f.httpTTFBs...)
+	sort.Float64s(samples)
+	p50 := nearestRank(samples, 0.50)
+	p95 := nearestRank(samples, 0.95)
+	f.HTTPTTFBP50Ms = &p50
+	f.HTTPTTFBP95Ms = &p95
+}
+
+// nearestRank returns the q-th percentile of sorted samples.
+func nearestRank(sorted []float64, q float64) float64 {
+	rank := int(math.Ceil(q * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func (f *FlowAgg) HTTPErrorIndexes() []int {
+	return append([]int(nil), f.httpErrorIndexes...)
+}
+
+func (f *FlowAgg) HTTPSlowestIndexes() []int {
+	return append([]int(nil), f.httpSlowestIndexes...)
+}
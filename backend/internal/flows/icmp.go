@@ -0,0 +1,54 @@
+package flows
+
+type ICMPMessage struct {
+	Type         int
+	Code         int
+	V6           bool
+	Unreachable  bool
+	FragNeeded   bool
+	TimeExceeded bool
+	NextHopMTU   *int
+	Original     *FlowKey
+}
+
+// IsError reports whether the message is an error that quotes the header of
+// the packet that triggered it.
+func (m ICMPMessage) IsError() bool {
+	return m.Unreachable || m.FragNeeded || m.TimeExceeded
+}
+
+// RecordICMPError attributes an ICMP error to the flow whose packet triggered
+// it. frame is the capture frame of the ICMP packet itself, numbered from one
+// as the packet list numbers frames; the error travels on a flow of its own,
+// so it has no place among the flow's packets.
+func (f *FlowAgg) RecordICMPError(msg ICMPMessage, frame int) {
+	if !msg.IsError() {
+		return
+	}
+	f.ICMPErrors++
+	switch {
+	case msg.FragNeeded:
+		f.ICMPFragNeeded++
+		if msg.NextHopMTU != nil && (f.ICMPNextHopMTU == nil || *msg.NextHopMTU < *f.ICMPNextHopMTU) {
+			mtu := *msg.NextHopMTU
+			f.ICMPNextHopMTU = &mtu
+		}
+	case msg.Unreachable:
+		f.ICMPUnreachable++
+		if f.ICMPUnreachableCode == nil {
+			code := msg.Code
+			f.ICMPUnreachableCode = &code
+		}
+	case msg.TimeExceeded:
+		f.ICMPTimeExceeded++
+	}
+	if frame > 0 {
+		f.icmpErrorFrames = appendIndex(f.icmpErrorFrames, frame)
+	}
+}
+
+// ICMPErrorFrames returns the capture frames of the ICMP errors attributed
+// to the flow.
+func (f *FlowAgg) ICMPErrorFrames() []int {
+	return append([]int(nil), f.icmpErrorFrames...)
+}
@@ -0,0 +1,45 @@
+package flows
+
+const (
+	// flowBaseBytes approximates a flow before it buffers anything: the
+	// struct itself, its key and its empty maps.
+	flowBaseBytes = 4096
+	// certReportBytes approximates a parsed certificate report.
+	certReportBytes = 2048
+	mapEntryBytes   = 48
+)
+
+// Footprint estimates the bytes a flow holds. It is used to bound memory
+// while analyzing large captures, so it counts the buffers that grow with
+// traffic rather than every field exactly.
+func (f *FlowAgg) Footprint() int64 {
+	n := int64(flowBaseBytes)
+	for dir := 0; dir < 2; dir++ {
+		rtt := &f.rtt[dir]
+		n += int64(cap(rtt.segments))*40 + int64(cap(rtt.tsvals))*32 + int64(cap(rtt.samples))*8
+		seq := &f.retrans.dirs[dir]
+		n += int64(cap(seq.ranges))*32 + int64(cap(seq.recent))*16
+		n += int64(cap(f.synIndexes[dir])) * 8
+	}
+	n += int64(cap(f.rttSamples)+cap(f.httpTTFBs)+cap(f.retrans.rtos)) * 8
+
+	indexes := [][]int{
+		f.synRetransIndexes, f.retransIndexes, f.dupAckIndexes,
+		f.tlsClientHelloIndexes, f.tlsServerHelloIndexes, f.tlsAlertIndexes,
+		f.zeroWindowIndexes, f.dnsErrorIndexes, f.quicInitialIndexes,
+		f.quicCloseIndexes, f.icmpErrorFrames, f.certIndexes,
+		f.httpErrorIndexes, f.httpSlowestIndexes,
+	}
+	for _, list := range indexes {
+		n += int64(cap(list)) * 8
+	}
+
+	n += int64(len(f.RetransSizeCount)+len(f.dnsPending)) * mapEntryBytes
+	for _, tx := range f.HTTPTransactions {
+		n += 120 + int64(len(tx.Method)+len(tx.Path)+len(tx.Host))
+	}
+	if f.CertReport != nil {
+		n += certReportBytes
+	}
+	return n
+}
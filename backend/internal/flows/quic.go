@@ -0,0 +1,84 @@
+package flows
+
+const (
+	QUICPacketInitial            = "Initial"
+	QUICPacket0RTT               = "0-RTT"
+	QUICPacketHandshake          = "Handshake"
+	QUICPacketRetry              = "Retry"
+	QUICPacketVersionNegotiation = "VersionNegotiation"
+	QUICPacket1RTT               = "1-RTT"
+)
+
+type QUICPacket struct {
+	Version     string
+	PacketType  string
+	LongHeader  bool
+	DCID        string
+	SCID        string
+	ClientHello bool
+	// ClientInitial is set when the datagram holds an Initial packet that
+	// decrypts with the client's initial keys, whether or not it completes
+	// the ClientHello.
+	ClientInitial   bool
+	ConnectionClose bool
+}
+
+func (f *FlowAgg) updateQUIC(pkt *QUICPacket, dirIndex int, packetIndex int) {
+	if pkt.Version != "" && f.QUICVersion == nil {
+		version := pkt.Version
+		f.QUICVersion = &version
+	}
+
+	if f.QUICClientInitials == 0 {
+		// Counting starts at the client's first Initial, which may carry
+		// only the start of a ClientHello spread over several datagrams.
+		if !pkt.ClientInitial && !pkt.ClientHello {
+			return
+		}
+		f.clientDir = dirIndex
+		f.clientDirKnown = true
+		dcid := pkt.DCID
+		scid := pkt.SCID
+		f.QUICDCID = &dcid
+		f.QUICSCID = &scid
+	}
+
+	if dirIndex == f.clientDir {
+		if pkt.PacketType == QUICPacketInitial {
+			f.QUICClientInitials++
+			f.quicInitialIndexes = appendIndex(f.quicInitialIndexes, packetIndex)
+		}
+		if pkt.ConnectionClose {
+			f.quicCloseIndexes = appendIndex(f.quicCloseIndexes, packetIndex)
+		}
+		return
+	}
+
+	switch pkt.PacketType {
+	case QUICPacketVersionNegotiation:
+		f.QUICVersionNegotiation = true
+		f.quicInitialIndexes = appendIndex(f.quicInitialIndexes, packetIndex)
+	case QUICPacketRetry:
+		f.QUICRetry = true
+	default:
+		f.QUICServerPackets++
+	}
+}
+
+// finalizeQUIC flags flows where the client sent Initial packets but the
+// server never progressed the handshake, or the client aborted it with a
+// CONNECTION_CLOSE carried in an Initial packet.
+func (f *FlowAgg) finalizeQUIC() {
+	if f.QUICClientInitials == 0 {
+		return
+	}
+	f.QUICHandshakeFailed = f.QUICServerPackets == 0 || len(f.quicCloseIndexes) > 0
+}
+
+func (f *FlowAgg) QUICInitialIndexes() []int {
+	return append([]int(nil), f.quicInitialIndexes...)
+}
+
+func (f *FlowAgg) QUICCloseIndexes() []int {
+	return append([]int(nil), f.quicCloseIndexes...)
+}
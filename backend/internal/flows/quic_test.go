@@ -0,0 +1,32 @@
+package flows
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQUICHandshakeFailure(t *testing.T) {
+	key := FlowKey{Proto: "UDP", SrcIP: "10.0.0.5", DstIP: "203.0.113.10", SrcPort: 51000, DstPort: 443}
+	ts := time.Now()
+	initial := &QUICPacket{Version: "QUICv1", PacketType: QUICPacketInitial, LongHeader: true, DCID: "8394c8f03e515708", ClientHello: true}
+
+	failed := NewFlowAgg(key, ts)
+	failed.Update(PacketInfo{Timestamp: ts, Proto: "UDP", QUIC: initial}, true)
+	failed.Update(PacketInfo{Timestamp: ts.Add(300 * time.Millisecond), Proto: "UDP", QUIC: initial}, true)
+	failed.Finalize()
+	if failed.QUICClientInitials != 2 || !failed.QUICHandshakeFailed {
+		t.Fatalf("expected failed handshake with 2 initials, got %d failed=%v", failed.QUICClientInitials, failed.QUICHandshakeFailed)
+	}
+	if failed.QUICDCID == nil || *failed.QUICDCID != "8394c8f03e515708" {
+		t.Fatalf("expected DCID from first client Initial, got %v", failed.QUICDCID)
+	}
+
+	ok := NewFlowAgg(key, ts)
+	ok.Update(PacketInfo{Timestamp: ts, Proto: "UDP", QUIC: initial}, true)
+	ok.Update(PacketInfo{Timestamp: ts.Add(20 * time.Millisecond), Proto: "UDP", QUIC: &QUICPacket{Version: "QUICv1", PacketType: QUICPacketHandshake, LongHeader: true}}, false)
+	ok.Update(PacketInfo{Timestamp: ts.Add(21 * time.Millisecond), Proto: "UDP", QUIC: &QUICPacket{PacketType: QUICPacket1RTT}}, false)
+	ok.Finalize()
+	if ok.QUICHandshakeFailed || ok.QUICServerPackets != 2 {
+		t.Fatalf("expected completed handshake, got failed=%v server_packets=%d", ok.QUICHandshakeFailed, ok.QUICServerPackets)
+	}
+}
@@ -1,62 +1,374 @@
 package flows
 
-import (
-    "container/list"
-    "time"
+import "time"
+
+// RetransKind is why a TCP segment was sent again.
+type RetransKind int
+
+const (
+	RetransNone RetransKind = iota
+	// RetransRTO is a retransmission after the retransmission timer fired.
+	RetransRTO
+	// RetransFast follows three duplicate ACKs, or a duplicate ACK reporting
+	// SACKed data, and covers later holes until recovery completes.
+	RetransFast
+	// RetransTLP is a tail loss probe: the last segment in flight resent
+	// while earlier ones are still unacknowledged.
+	RetransTLP
+	// RetransSpurious resends data the receiver already had, either already
+	// acknowledged when it was resent or reported later by a D-SACK.
+	RetransSpurious
+	numRetransKinds
+)
+
+const (
+	// fastRetransDupAcks is the duplicate ACK threshold of RFC 5681.
+	fastRetransDupAcks = 3
+	// maxRecentRetrans bounds the retransmissions remembered per direction
+	// for matching later D-SACKs.
+	maxRecentRetrans = 64
+	// maxRTOSamples bounds the RTO durations kept per flow.
+	maxRTOSamples = 64
 )
 
-type SeqKey struct {
-    Direction int
-    Seq       uint32
-    Length    int
-}
-
-type seqEntry struct {
-    key      SeqKey
-    lastSeen time.Time
-}
-
-type SeqCache struct {
-    capacity int
-    ttl      time.Duration
-    items    map[SeqKey]*list.Element
-    order    *list.List
-}
-
-func NewSeqCache(capacity int, ttl time.Duration) *SeqCache {
-    return &SeqCache{
-        capacity: capacity,
-        ttl:      ttl,
-        items:    make(map[SeqKey]*list.Element),
-        order:    list.New(),
-    }
-}
-
-func (c *SeqCache) Seen(key SeqKey, ts time.Time) bool {
-    if elem, ok := c.items[key]; ok {
-        entry := elem.Value.(seqEntry)
-        if ts.Sub(entry.lastSeen) <= c.ttl {
-            entry.lastSeen = ts
-            elem.Value = entry
-            c.order.MoveToFront(elem)
-            return true
-        }
-        entry.lastSeen = ts
-        elem.Value = entry
-        c.order.MoveToFront(elem)
-        return false
-    }
-
-    elem := c.order.PushFront(seqEntry{key: key, lastSeen: ts})
-    c.items[key] = elem
-
-    if c.order.Len() > c.capacity {
-        last := c.order.Back()
-        if last != nil {
-            c.order.Remove(last)
-            old := last.Value.(seqEntry)
-            delete(c.items, old.key)
-        }
-    }
-    return false
+// RetransEvent describes what a TCP segment showed about retransmission.
+type RetransEvent struct {
+	Kind RetransKind
+	// Partial is set when the retransmission does not line up with a
+	// segment sent earlier: it was re-segmented or carries new data too.
+	Partial bool
+	// RTO is how long after the previous transmission an RTO retransmission
+	// was sent.
+	RTO time.Duration
+	// DSACK is set on an ACK whose D-SACK showed one of the peer's
+	// retransmissions to be spurious.
+	DSACK bool
+}
+
+// RetransTracker follows each direction's sequence space to find
+// retransmissions and classify them. It is shared by flow aggregation and
+// the packet list so both label the same packets.
+type RetransTracker struct {
+	dirs     [2]seqSpace
+	counts   [numRetransKinds]int64
+	partial  int64
+	rtoCount int64
+	rtoSum   float64
+	rtoMin   float64
+	rtoMax   float64
+	rtos     []float64
+}
+
+type sentRange struct {
+	seq    uint32
+	end    uint32
+	sentAt time.Time
+}
+
+type retransRecord struct {
+	seq  uint32
+	end  uint32
+	kind RetransKind
+	// rto is the RTO duration the retransmission was timed at, if timed,
+	// and sample its place in the tracker's samples, or -1 when not kept.
+	timed  bool
+	rto    float64
+	sample int
+}
+
+// seqSpace is one sender's data and the ACKs its peer returned for it.
+type seqSpace struct {
+	started bool
+	highEnd uint32
+	// floor is the edge below which all data was sent: acknowledged, or
+	// forgotten once more than maxOutstandingSegments were in flight.
+	floor  uint32
+	ranges []sentRange
+	recent []retransRecord
+
+	// Cumulative ACK state reported by the peer for this sender's data.
+	ackSet      bool
+	ack         uint32
+	dupAcks     int
+	sackAbove   bool
+	recovering  bool
+	recoveryEnd uint32
+}
+
+// Observe records a TCP segment sent by dir and classifies it.
+func (t *RetransTracker) Observe(pkt PacketInfo, dir int) RetransEvent {
+	var ev RetransEvent
+	sender, receiver := &t.dirs[dir], &t.dirs[1-dir]
+
+	if pkt.TCPFlags.ACK && !pkt.TCPFlags.RST {
+		ev.DSACK = t.acknowledge(receiver, pkt)
+	}
+	if pkt.TCPFlags.SYN {
+		sender.started = true
+		sender.highEnd, sender.floor = pkt.Seq+1, pkt.Seq+1
+		return ev
+	}
+	if pkt.PayloadLen == 0 {
+		return ev
+	}
+
+	seq, end := pkt.Seq, pkt.Seq+uint32(pkt.PayloadLen)
+	if !sender.started {
+		sender.started = true
+		sender.highEnd, sender.floor = end, seq
+		sender.insert(sentRange{seq: seq, end: end, sentAt: pkt.Timestamp})
+		return ev
+	}
+	if int32(seq-sender.highEnd) >= 0 {
+		sender.insert(sentRange{seq: seq, end: end, sentAt: pkt.Timestamp})
+		sender.highEnd = end
+		return ev
+	}
+	// A keep-alive resends the byte below the cumulative ACK.
+	if pkt.PayloadLen == 1 && sender.ackSet && seq == sender.ack-1 {
+		return ev
+	}
+
+	covered, exact, previous := sender.overlap(seq, end)
+	if !covered {
+		// Fills a hole nothing was seen in: reordering, not a resend.
+		sender.insert(sentRange{seq: seq, end: end, sentAt: pkt.Timestamp})
+		return ev
+	}
+
+	tail := end == sender.highEnd
+	ev.Partial = !exact
+	record := retransRecord{seq: seq, end: end, sample: -1}
+	switch {
+	case sender.ackSet && int32(end-sender.ack) <= 0:
+		ev.Kind = RetransSpurious
+	case sender.recovering || sender.dupAcks >= fastRetransDupAcks || (sender.dupAcks > 0 && sender.sackAbove):
+		ev.Kind = RetransFast
+		if !sender.recovering {
+			sender.recovering, sender.recoveryEnd = true, sender.highEnd
+		}
+	case tail && sender.ackSet && seq != sender.ack:
+		ev.Kind = RetransTLP
+	default:
+		ev.Kind = RetransRTO
+		if !previous.IsZero() {
+			ev.RTO = pkt.Timestamp.Sub(previous)
+			record.timed, record.rto = true, ev.RTO.Seconds()*1000
+			record.sample = t.addRTO(record.rto)
+		}
+	}
+
+	if int32(end-sender.highEnd) > 0 {
+		ev.Partial = true
+		sender.insert(sentRange{seq: sender.highEnd, end: end, sentAt: pkt.Timestamp})
+		sender.highEnd = end
+	}
+	sender.resent(seq, end, pkt.Timestamp)
+	if len(sender.recent) >= maxRecentRetrans {
+		sender.recent = append(sender.recent[:0], sender.recent[1:]...)
+	}
+	record.kind = ev.Kind
+	sender.recent = append(sender.recent, record)
+	t.counts[ev.Kind]++
+	if ev.Partial {
+		t.partial++
+	}
+	return ev
+}
+
+// acknowledge applies an ACK for the receiver's peer's data and reports
+// whether a D-SACK in it turned a retransmission spurious.
+func (t *RetransTracker) acknowledge(d *seqSpace, pkt PacketInfo) bool {
+	ack := pkt.Ack
+	aboveHole := false
+	for _, block := range pkt.SACKBlocks {
+		if int32(block.Right-ack) > 0 && int32(block.Left-ack) > 0 {
+			aboveHole = true
+			break
+		}
+	}
+
+	pure := pkt.PayloadLen == 0 && !pkt.TCPFlags.SYN && !pkt.TCPFlags.FIN
+	switch {
+	case !d.ackSet || int32(ack-d.ack) > 0:
+		d.ack, d.ackSet = ack, true
+		d.dupAcks = 0
+		d.prune(ack)
+		if d.recovering && int32(ack-d.recoveryEnd) >= 0 {
+			d.recovering = false
+		}
+	case ack == d.ack && pure:
+		d.dupAcks++
+	}
+	d.sackAbove = aboveHole
+
+	// RFC 2883: the first block is a D-SACK when it lies below the
+	// cumulative ACK or inside the second block.
+	if len(pkt.SACKBlocks) == 0 {
+		return false
+	}
+	first := pkt.SACKBlocks[0]
+	isDSACK := int32(first.Right-ack) <= 0
+	if !isDSACK && len(pkt.SACKBlocks) > 1 {
+		second := pkt.SACKBlocks[1]
+		isDSACK = int32(first.Left-second.Left) >= 0 && int32(first.Right-second.Right) <= 0
+	}
+	if !isDSACK {
+		return false
+	}
+	for i := len(d.recent) - 1; i >= 0; i-- {
+		record := &d.recent[i]
+		if int32(record.seq-first.Right) >= 0 || int32(record.end-first.Left) <= 0 {
+			continue
+		}
+		if record.kind == RetransSpurious {
+			return false
+		}
+		t.counts[record.kind]--
+		t.counts[RetransSpurious]++
+		record.kind = RetransSpurious
+		t.dropRTO(record)
+		return true
+	}
+	return false
+}
+
+// addRTO records an RTO duration in milliseconds and returns its place in
+// the samples, or -1 when too many are kept already.
+func (t *RetransTracker) addRTO(ms float64) int {
+	if t.rtoCount == 0 || ms < t.rtoMin {
+		t.rtoMin = ms
+	}
+	if ms > t.rtoMax {
+		t.rtoMax = ms
+	}
+	t.rtoCount++
+	t.rtoSum += ms
+	if len(t.rtos) >= maxRTOSamples {
+		return -1
+	}
+	t.rtos = append(t.rtos, ms)
+	return len(t.rtos) - 1
+}
+
+// dropRTO takes back the RTO duration of a retransmission a D-SACK showed
+// to be spurious: the timer fired too early, so it is no sample of the
+// sender's RTO. The extremes are recomputed while every sample is kept.
+func (t *RetransTracker) dropRTO(record *retransRecord) {
+	if !record.timed {
+		return
+	}
+	t.rtoCount--
+	t.rtoSum -= record.rto
+	if record.sample >= 0 {
+		t.rtos = append(t.rtos[:record.sample], t.rtos[record.sample+1:]...)
+		for d := range t.dirs {
+			for i := range t.dirs[d].recent {
+				if other := &t.dirs[d].recent[i]; other.sample > record.sample {
+					other.sample--
+				}
+			}
+		}
+	}
+	record.timed, record.sample = false, -1
+	if int64(len(t.rtos)) == t.rtoCount {
+		t.rtoMin, t.rtoMax = 0, 0
+		for i, ms := range t.rtos {
+			if i == 0 || ms < t.rtoMin {
+				t.rtoMin = ms
+			}
+			t.rtoMax = max(t.rtoMax, ms)
+		}
+	}
+}
+
+// Count returns how many retransmissions of a kind were seen, with D-SACKs
+// already applied.
+func (t *RetransTracker) Count(kind RetransKind) int64 {
+	return t.counts[kind]
+}
+
+// insert keeps ranges ordered by sequence number, forgetting the oldest once
+// too many are outstanding.
+func (d *seqSpace) insert(r sentRange) {
+	i := len(d.ranges)
+	for i > 0 && int32(d.ranges[i-1].seq-r.seq) > 0 {
+		i--
+	}
+	d.ranges = append(d.ranges, sentRange{})
+	copy(d.ranges[i+1:], d.ranges[i:])
+	d.ranges[i] = r
+	if len(d.ranges) > maxOutstandingSegments {
+		if int32(d.ranges[0].end-d.floor) > 0 {
+			d.floor = d.ranges[0].end
+		}
+		d.ranges = append(d.ranges[:0], d.ranges[1:]...)
+	}
+}
+
+// overlap reports whether [seq, end) was sent before, whether it matches a
+// sent segment exactly, and when the data at seq was last sent. Data wholly
+// below the floor is no longer tracked and is not reported as re-segmented.
+func (d *seqSpace) overlap(seq, end uint32) (bool, bool, time.Time) {
+	if int32(end-d.floor) <= 0 {
+		return true, true, time.Time{}
+	}
+	covered := int32(seq-d.floor) < 0
+	exact := false
+	var previous time.Time
+	for _, r := range d.ranges {
+		if int32(r.seq-end) >= 0 || int32(r.end-seq) <= 0 {
+			continue
+		}
+		if previous.IsZero() {
+			previous = r.sentAt
+		}
+		covered = true
+		if r.seq == seq && r.end == end {
+			exact = true
+		}
+	}
+	return covered, exact, previous
+}
+
+func (d *seqSpace) resent(seq, end uint32, ts time.Time) {
+	for i := range d.ranges {
+		r := &d.ranges[i]
+		if int32(r.seq-end) < 0 && int32(r.end-seq) > 0 {
+			r.sentAt = ts
+		}
+	}
+}
+
+// prune drops ranges the cumulative ACK covers.
+func (d *seqSpace) prune(ack uint32) {
+	kept := d.ranges[:0]
+	for _, r := range d.ranges {
+		if int32(r.end-ack) > 0 {
+			kept = append(kept, r)
+		}
+	}
+	d.ranges = kept
+	if d.started && int32(ack-d.floor) > 0 && int32(ack-d.highEnd) <= 0 {
+		d.floor = ack
+	}
+}
+
+func (f *FlowAgg) finalizeRetrans() {
+	t := &f.retrans
+	f.RetransRTO = t.Count(RetransRTO)
+	f.RetransFast = t.Count(RetransFast)
+	f.RetransTLP = t.Count(RetransTLP)
+	f.RetransSpurious = t.Count(RetransSpurious)
+	f.RetransPartial = t.partial
+	if t.rtoCount > 0 {
+		minRTO, maxRTO := t.rtoMin, t.rtoMax
+		avg := t.rtoSum / float64(t.rtoCount)
+		f.RTOMinMs, f.RTOAvgMs, f.RTOMaxMs = &minRTO, &avg, &maxRTO
+	}
+}
+
+// RTODurations returns the first RTO durations observed, in milliseconds.
+func (f *FlowAgg) RTODurations() []float64 {
+	return append([]float64(nil), f.retrans.rtos...)
 }
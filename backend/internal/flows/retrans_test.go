@@ -31,3 +31,134 @@ func TestRetransmissionDetection(t *testing.T) {
         t.Fatalf("expected retrans count for 200 to be 1, got %d", flow.RetransSizeCount[200])
     }
 }
+
+func TestRetransmissionClasses(t *testing.T) {
+    start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+    at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+    data := func(ms int, seq uint32, length int) PacketInfo {
+        return PacketInfo{Timestamp: at(ms), Proto: "TCP", Seq: seq, Ack: 1, PayloadLen: length, TCPFlags: TCPFlags{ACK: true}}
+    }
+    ack := func(ms int, ack uint32, sack ...SACKBlock) PacketInfo {
+        return PacketInfo{Timestamp: at(ms), Proto: "TCP", Seq: 1, Ack: ack, TCPFlags: TCPFlags{ACK: true}, SACKBlocks: sack}
+    }
+
+    cases := []struct {
+        name    string
+        packets []PacketInfo
+        dirs    []int
+        want    RetransKind
+        partial bool
+    }{
+        {
+            name:    "rto",
+            packets: []PacketInfo{data(0, 1000, 100), data(1, 1100, 100), data(300, 1000, 100)},
+            dirs:    []int{0, 0, 0},
+            want:    RetransRTO,
+        },
+        {
+            name:    "fast after three dup acks",
+            packets: []PacketInfo{data(0, 1000, 100), data(1, 1100, 100), data(2, 1200, 100), ack(40, 1100), ack(41, 1100, SACKBlock{Left: 1200, Right: 1300}), ack(42, 1100), ack(43, 1100), data(44, 1100, 100)},
+            dirs:    []int{0, 0, 0, 1, 1, 1, 1, 0},
+            want:    RetransFast,
+        },
+        {
+            name:    "tail loss probe",
+            packets: []PacketInfo{data(0, 1000, 100), data(1, 1100, 100), data(2, 1200, 100), ack(40, 1100), data(90, 1200, 100)},
+            dirs:    []int{0, 0, 0, 1, 0},
+            want:    RetransTLP,
+        },
+        {
+            name:    "already acknowledged",
+            packets: []PacketInfo{data(0, 1000, 100), ack(40, 1100), data(300, 1000, 100)},
+            dirs:    []int{0, 1, 0},
+            want:    RetransSpurious,
+        },
+        {
+            name:    "re-segmented",
+            packets: []PacketInfo{data(0, 1000, 100), data(1, 1100, 100), data(300, 1000, 200)},
+            dirs:    []int{0, 0, 0},
+            want:    RetransRTO,
+            partial: true,
+        },
+        {
+            name:    "reordered before the capture point",
+            packets: []PacketInfo{{Timestamp: at(0), Proto: "TCP", Seq: 999, TCPFlags: TCPFlags{SYN: true}}, data(1, 1100, 100), data(2, 1000, 100)},
+            dirs:    []int{0, 0, 0},
+            want:    RetransNone,
+        },
+    }
+    for _, tc := range cases {
+        var tracker RetransTracker
+        var last RetransEvent
+        for i, pkt := range tc.packets {
+            last = tracker.Observe(pkt, tc.dirs[i])
+        }
+        if last.Kind != tc.want || last.Partial != tc.partial {
+            t.Fatalf("%s: expected %v (partial=%v), got %+v", tc.name, tc.want, tc.partial, last)
+        }
+    }
+}
+
+func TestRTODurationsAndDSACK(t *testing.T) {
+    key := FlowKey{Proto: "TCP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: 40000, DstPort: 443}
+    start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+    at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+    flow := NewFlowAgg(key, start)
+
+    flow.Update(PacketInfo{Timestamp: at(0), Proto: "TCP", Seq: 1000, PayloadLen: 100, TCPFlags: TCPFlags{ACK: true}, Ack: 1}, true)
+    flow.Update(PacketInfo{Timestamp: at(200), Proto: "TCP", Seq: 1000, PayloadLen: 100, TCPFlags: TCPFlags{ACK: true}, Ack: 1}, true)
+    flow.Update(PacketInfo{Timestamp: at(600), Proto: "TCP", Seq: 1000, PayloadLen: 100, TCPFlags: TCPFlags{ACK: true}, Ack: 1}, true)
+    // The receiver reports the last copy as a duplicate.
+    flow.Update(PacketInfo{Timestamp: at(640), Proto: "TCP", Seq: 1, Ack: 1100, TCPFlags: TCPFlags{ACK: true}, SACKBlocks: []SACKBlock{{Left: 1000, Right: 1100}}}, false)
+    flow.Finalize()
+
+    if flow.Retransmits != 2 || flow.RetransRTO != 1 || flow.RetransSpurious != 1 {
+        t.Fatalf("expected one RTO and one spurious retransmission, got %d total, %d RTO, %d spurious", flow.Retransmits, flow.RetransRTO, flow.RetransSpurious)
+    }
+    // The spurious copy's 400 ms is no sample of the sender's RTO.
+    if flow.RTOMinMs == nil || *flow.RTOMinMs != 200 || *flow.RTOMaxMs != 200 || *flow.RTOAvgMs != 200 {
+        t.Fatalf("unexpected RTO durations %v-%v", flow.RTOMinMs, flow.RTOMaxMs)
+    }
+    if rtos := flow.RTODurations(); len(rtos) != 1 || rtos[0] != 200 {
+        t.Fatalf("expected only the first RTO duration, got %v", rtos)
+    }
+}
+
+func TestDSACKDropsRTOSamples(t *testing.T) {
+    start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+    at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+    data := func(ms int, seq uint32) PacketInfo {
+        return PacketInfo{Timestamp: at(ms), Proto: "TCP", Seq: seq, Ack: 1, PayloadLen: 100, TCPFlags: TCPFlags{ACK: true}}
+    }
+    dsack := func(ms int, ack, left uint32) PacketInfo {
+        return PacketInfo{Timestamp: at(ms), Proto: "TCP", Seq: 1, Ack: ack, TCPFlags: TCPFlags{ACK: true}, SACKBlocks: []SACKBlock{{Left: left, Right: left + 100}}}
+    }
+
+    var tracker RetransTracker
+    for _, step := range []struct {
+        pkt PacketInfo
+        dir int
+    }{
+        {data(0, 1000), 0},
+        {data(0, 1100), 0},
+        {data(100, 1000), 0},
+        {data(300, 1100), 0},
+        // The first resend, the smallest sample, was not needed.
+        {dsack(340, 1100, 1000), 1},
+        {data(900, 1100), 0},
+        // Neither was the last one, whose sample comes after the dropped one.
+        {dsack(940, 1200, 1100), 1},
+    } {
+        tracker.Observe(step.pkt, step.dir)
+    }
+
+    if tracker.Count(RetransRTO) != 1 || tracker.Count(RetransSpurious) != 2 {
+        t.Fatalf("expected one RTO and two spurious retransmissions, got %d and %d", tracker.Count(RetransRTO), tracker.Count(RetransSpurious))
+    }
+    if tracker.rtoCount != 1 || tracker.rtoMin != 300 || tracker.rtoMax != 300 || tracker.rtoSum != 300 {
+        t.Fatalf("expected only the 300 ms sample, got %d samples %v-%v", tracker.rtoCount, tracker.rtoMin, tracker.rtoMax)
+    }
+    if len(tracker.rtos) != 1 || tracker.rtos[0] != 300 {
+        t.Fatalf("expected the 300 ms sample to be kept, got %v", tracker.rtos)
+    }
+}
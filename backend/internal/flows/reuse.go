@@ -0,0 +1,125 @@
+package flows
+
+import "time"
+
+// ReuseTracker follows the part of a flow that decides whether a packet on
+// its 5-tuple starts a new connection. The flow table keeps one per flow so
+// it can place packets in capture order while the flows themselves are
+// updated elsewhere; it must observe the same packets as the flow.
+type ReuseTracker struct {
+	lastSeen  time.Time
+	lifecycle tcpLifecycle
+}
+
+// NewReuseTracker starts tracking a flow created at ts.
+func NewReuseTracker(ts time.Time) *ReuseTracker {
+	return &ReuseTracker{lastSeen: ts}
+}
+
+// Observe records a packet of the flow, as FlowAgg.Update does.
+func (r *ReuseTracker) Observe(pkt PacketInfo, forward bool) {
+	r.lastSeen = pkt.Timestamp
+	if pkt.Proto != "TCP" {
+		return
+	}
+	dir := 0
+	if !forward {
+		dir = 1
+	}
+	r.lifecycle.update(pkt, dir)
+}
+
+// StartsNewConnection reports whether pkt, although it carries the flow's
+// 5-tuple, belongs to a new connection. As Wireshark splits TCP streams, that
+// is the case for a SYN after the flow was closed by FIN or RST, or whose
+// initial sequence number is not the flow's own; a retransmitted SYN stays
+// on the flow. After the flow was idle for longer than idle, a SYN also
+// starts a new connection, as does any packet of a flow that is not TCP; a
+// TCP segment without SYN can only carry on the connection it belongs to.
+// An idle of zero never splits.
+func (r *ReuseTracker) StartsNewConnection(pkt PacketInfo, idle time.Duration) bool {
+	idled := idle > 0 && pkt.Timestamp.Sub(r.lastSeen) > idle
+	if pkt.Proto != "TCP" {
+		return idled
+	}
+	if !pkt.TCPFlags.SYN || pkt.TCPFlags.ACK {
+		return false
+	}
+	if idled {
+		return true
+	}
+	s := r.lifecycle
+	if s.state == TCPStateReset || s.finSeen[0] || s.finSeen[1] {
+		return true
+	}
+	return !s.synSeen || pkt.Seq != s.synSeq
+}
+
+// Continuation is what a flow finalized before its connection ended passes
+// on to the flow that carries the connection on: when the connection started,
+// its TCP stream, which side is the client and how far the TCP lifecycle got.
+type Continuation struct {
+	Start          time.Time
+	stream         *int
+	clientDir      int
+	clientDirKnown bool
+	lifecycle      tcpLifecycle
+}
+
+// Continuation returns what a later flow needs to carry on the flow's
+// connection.
+func (f *FlowAgg) Continuation() Continuation {
+	start := f.FirstSeen
+	if f.ContinuedFrom != nil {
+		start = *f.ContinuedFrom
+	}
+	return Continuation{
+		Start:          start,
+		stream:         f.TCPStreamID,
+		clientDir:      f.clientDir,
+		clientDirKnown: f.clientDirKnown,
+		lifecycle:      f.lifecycle,
+	}
+}
+
+// ContinueFlowAgg starts a flow at ts that carries on the connection of an
+// earlier one, under the same key. ContinuedFrom is set to when the
+// connection started, so the two can be stored as one flow.
+func ContinueFlowAgg(key FlowKey, ts time.Time, from Continuation) *FlowAgg {
+	f := NewFlowAgg(key, ts)
+	start := from.Start
+	f.ContinuedFrom = &start
+	f.TCPStreamID = from.stream
+	f.clientDir, f.clientDirKnown = from.clientDir, from.clientDirKnown
+	f.lifecycle = from.lifecycle
+	return f
+}
+
+// WithOffset returns a copy of a flow that carries on a connection, with the
+// packet indexes it keeps for evidence counted after the offset packets of
+// the connection's earlier flows. Capture frame numbers stay as they are.
+func (f *FlowAgg) WithOffset(offset int) *FlowAgg {
+	shift := func(indexes []int) []int {
+		shifted := make([]int, len(indexes))
+		for i, index := range indexes {
+			shifted[i] = index + offset
+		}
+		return shifted
+	}
+	c := *f
+	c.synIndexes = [2][]int{shift(f.synIndexes[0]), shift(f.synIndexes[1])}
+	c.synRetransIndexes = shift(f.synRetransIndexes)
+	c.retransIndexes = shift(f.retransIndexes)
+	c.dupAckIndexes = shift(f.dupAckIndexes)
+	c.tlsClientHelloIndexes = shift(f.tlsClientHelloIndexes)
+	c.tlsServerHelloIndexes = shift(f.tlsServerHelloIndexes)
+	c.tlsAlertIndexes = shift(f.tlsAlertIndexes)
+	c.zeroWindowIndexes = shift(f.zeroWindowIndexes)
+	c.dnsErrorIndexes = shift(f.dnsErrorIndexes)
+	c.quicInitialIndexes = shift(f.quicInitialIndexes)
+	c.quicCloseIndexes = shift(f.quicCloseIndexes)
+	c.certIndexes = shift(f.certIndexes)
+	c.httpErrorIndexes = shift(f.httpErrorIndexes)
+	c.httpSlowestIndexes = shift(f.httpSlowestIndexes)
+	return &c
+}
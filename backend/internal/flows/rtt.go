@@ -0,0 +1,216 @@
+package flows
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// Bounds on the per-direction state used to sample RTT. When a sender has
+	// more segments in flight than this the oldest are forgotten and their
+	// ACKs simply yield no sample.
+	maxOutstandingSegments = 256
+	maxTrackedTSVals       = 64
+	// maxRTTSamples bounds the samples kept per direction for percentiles and
+	// the capture histogram. Past it every other sample is dropped and only
+	// every second one after that is kept, so the retained set still spans
+	// the whole flow. Min, max and average cover every sample.
+	maxRTTSamples = 256
+)
+
+type sentSegment struct {
+	end           uint32
+	sentAt        time.Time
+	retransmitted bool
+}
+
+type sentTSVal struct {
+	val    uint32
+	sentAt time.Time
+}
+
+// rttDirection samples the round trip from the capture point to the receiver
+// of one direction's segments and back.
+type rttDirection struct {
+	segments []sentSegment
+	highEnd  uint32
+	highSet  bool
+	tsvals   []sentTSVal
+
+	samples []float64
+	stride  int
+	skip    int
+	count   int64
+	sum     float64
+	min     float64
+	max     float64
+}
+
+// sampleRTT records the segment pkt sends and, when it acknowledges the
+// other direction, takes at most one RTT sample for that direction: from the
+// timestamp echo when there is one, else from the newest segment the ACK
+// covers unless that segment was retransmitted (Karn's algorithm).
+func (f *FlowAgg) sampleRTT(pkt PacketInfo, dir int) {
+	sender, peer := &f.rtt[dir], &f.rtt[1-dir]
+
+	if pkt.TCPFlags.ACK {
+		sentAt, ok := time.Time{}, false
+		if ts := pkt.TCPTimestamp; ts != nil && ts.Ecr != 0 {
+			sentAt, ok = peer.echo(ts.Ecr)
+		}
+		if acked, ackOK := peer.ack(pkt.Ack); !ok {
+			sentAt, ok = acked, ackOK
+		}
+		if ok {
+			peer.add(pkt.Timestamp.Sub(sentAt))
+		}
+	}
+
+	length := pkt.PayloadLen
+	if pkt.TCPFlags.SYN || pkt.TCPFlags.FIN {
+		length++
+	}
+	if length > 0 {
+		sender.send(pkt.Seq, length, pkt.Timestamp)
+	}
+	if ts := pkt.TCPTimestamp; ts != nil {
+		sender.stamp(ts.Val, pkt.Timestamp)
+	}
+}
+
+func (d *rttDirection) send(seq uint32, length int, ts time.Time) {
+	end := seq + uint32(length)
+	if d.highSet && int32(end-d.highEnd) <= 0 {
+		// Retransmission: whatever it overlaps can no longer be timed.
+		for i := range d.segments {
+			if int32(d.segments[i].end-seq) > 0 {
+				d.segments[i].retransmitted = true
+			}
+		}
+		return
+	}
+	overlaps := d.highSet && int32(seq-d.highEnd) < 0
+	if len(d.segments) >= maxOutstandingSegments {
+		d.segments = append(d.segments[:0], d.segments[1:]...)
+	}
+	d.segments = append(d.segments, sentSegment{end: end, sentAt: ts, retransmitted: overlaps})
+	d.highEnd = end
+	d.highSet = true
+}
+
+// ack releases the segments covered by a cumulative ACK and returns when the
+// newest of them was sent, unless it is ambiguous.
+func (d *rttDirection) ack(ack uint32) (time.Time, bool) {
+	covered := 0
+	for covered < len(d.segments) && int32(d.segments[covered].end-ack) <= 0 {
+		covered++
+	}
+	if covered == 0 {
+		return time.Time{}, false
+	}
+	newest := d.segments[covered-1]
+	d.segments = append(d.segments[:0], d.segments[covered:]...)
+	return newest.sentAt, !newest.retransmitted
+}
+
+func (d *rttDirection) stamp(val uint32, ts time.Time) {
+	if n := len(d.tsvals); n > 0 && int32(val-d.tsvals[n-1].val) <= 0 {
+		return
+	}
+	if len(d.tsvals) >= maxTrackedTSVals {
+		d.tsvals = append(d.tsvals[:0], d.tsvals[1:]...)
+	}
+	d.tsvals = append(d.tsvals, sentTSVal{val: val, sentAt: ts})
+}
+
+// echo returns when a TSval was first sent, the first time it is echoed.
+func (d *rttDirection) echo(ecr uint32) (time.Time, bool) {
+	for i, sent := range d.tsvals {
+		if sent.val == ecr {
+			d.tsvals = append(d.tsvals[:0], d.tsvals[i+1:]...)
+			return sent.sentAt, true
+		}
+		if int32(sent.val-ecr) > 0 {
+			break
+		}
+	}
+	return time.Time{}, false
+}
+
+func (d *rttDirection) add(rtt time.Duration) {
+	ms := rtt.Seconds() * 1000
+	if ms < 0 {
+		return
+	}
+	if d.count == 0 || ms < d.min {
+		d.min = ms
+	}
+	if ms > d.max {
+		d.max = ms
+	}
+	d.count++
+	d.sum += ms
+
+	if d.skip > 0 {
+		d.skip--
+		return
+	}
+	d.samples = append(d.samples, ms)
+	if d.stride == 0 {
+		d.stride = 1
+	}
+	d.skip = d.stride - 1
+	if len(d.samples) >= maxRTTSamples {
+		kept := d.samples[:0]
+		for i := 0; i < len(d.samples); i += 2 {
+			kept = append(kept, d.samples[i])
+		}
+		d.samples = kept
+		d.stride *= 2
+		d.skip = d.stride - 1
+	}
+}
+
+// finalizeRTT combines both directions. Each only measures the half of the
+// path between the capture point and one endpoint, so the smallest sample of
+// the other half is added to make them end-to-end round trips wherever the
+// capture was taken.
+func (f *FlowAgg) finalizeRTT() {
+	total := f.rtt[0].count + f.rtt[1].count
+	if total == 0 {
+		return
+	}
+	var sum float64
+	minRTT, maxRTT := -1.0, 0.0
+	f.rttSamples = f.rttSamples[:0]
+	for dir := range f.rtt {
+		d, other := f.rtt[dir], f.rtt[1-dir]
+		if d.count == 0 {
+			continue
+		}
+		offset := 0.0
+		if other.count > 0 {
+			offset = other.min
+		}
+		sum += d.sum + float64(d.count)*offset
+		if minRTT < 0 || d.min+offset < minRTT {
+			minRTT = d.min + offset
+		}
+		maxRTT = max(maxRTT, d.max+offset)
+		for _, sample := range d.samples {
+			f.rttSamples = append(f.rttSamples, sample+offset)
+		}
+	}
+
+	avg := sum / float64(total)
+	sorted := append([]float64(nil), f.rttSamples...)
+	sort.Float64s(sorted)
+	p95 := nearestRank(sorted, 0.95)
+	f.RTTMinMs, f.RTTAvgMs, f.RTTP95Ms, f.RTTMaxMs = &minRTT, &avg, &p95, &maxRTT
+	f.RTTSampleCount = total
+}
+
+// RTTSamples returns the retained end-to-end RTT samples in milliseconds.
+func (f *FlowAgg) RTTSamples() []float64 {
+	return append([]float64(nil), f.rttSamples...)
+}
@@ -0,0 +1,73 @@
+package flows
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRTTSampledWithoutHandshake(t *testing.T) {
+	key := FlowKey{Proto: "TCP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: 40000, DstPort: 443}
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	flow := NewFlowAgg(key, start)
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+
+	// Captured next to the client: its data takes 40 ms to be acknowledged,
+	// the server's data is acknowledged locally after 1 ms.
+	flow.Update(PacketInfo{Timestamp: at(0), Proto: "TCP", Seq: 1000, PayloadLen: 100, TCPFlags: TCPFlags{ACK: true}, Ack: 5000}, true)
+	flow.Update(PacketInfo{Timestamp: at(40), Proto: "TCP", Seq: 5000, Ack: 1100, TCPFlags: TCPFlags{ACK: true}}, false)
+	flow.Update(PacketInfo{Timestamp: at(50), Proto: "TCP", Seq: 5000, PayloadLen: 200, Ack: 1100, TCPFlags: TCPFlags{ACK: true}}, false)
+	flow.Update(PacketInfo{Timestamp: at(51), Proto: "TCP", Seq: 1100, Ack: 5200, TCPFlags: TCPFlags{ACK: true}}, true)
+
+	// A retransmitted segment is ambiguous and yields no sample (Karn).
+	flow.Update(PacketInfo{Timestamp: at(100), Proto: "TCP", Seq: 1100, PayloadLen: 100, Ack: 5200, TCPFlags: TCPFlags{ACK: true}}, true)
+	flow.Update(PacketInfo{Timestamp: at(300), Proto: "TCP", Seq: 1100, PayloadLen: 100, Ack: 5200, TCPFlags: TCPFlags{ACK: true}}, true)
+	flow.Update(PacketInfo{Timestamp: at(340), Proto: "TCP", Seq: 5200, Ack: 1200, TCPFlags: TCPFlags{ACK: true}}, false)
+	flow.Finalize()
+
+	if flow.RTTMs != nil {
+		t.Fatalf("expected no handshake RTT")
+	}
+	if flow.RTTSampleCount != 2 {
+		t.Fatalf("expected 2 samples, got %d", flow.RTTSampleCount)
+	}
+	for name, value := range map[string]*float64{"min": flow.RTTMinMs, "avg": flow.RTTAvgMs, "p95": flow.RTTP95Ms, "max": flow.RTTMaxMs} {
+		if value == nil || math.Abs(*value-41) > 0.001 {
+			t.Fatalf("expected %s RTT of 41 ms end to end, got %v", name, value)
+		}
+	}
+	if samples := flow.RTTSamples(); len(samples) != 2 {
+		t.Fatalf("expected samples for the histogram, got %v", samples)
+	}
+}
+
+func TestRTTFromTimestampEcho(t *testing.T) {
+	key := FlowKey{Proto: "TCP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: 40000, DstPort: 443}
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	flow := NewFlowAgg(key, start)
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+
+	// The timestamp echo tells the retransmission's ACK apart from the
+	// original's, so it can still be timed.
+	flow.Update(PacketInfo{Timestamp: at(0), Proto: "TCP", Seq: 1, PayloadLen: 10, TCPFlags: TCPFlags{ACK: true}, TCPTimestamp: &TCPTimestamp{Val: 100}}, true)
+	flow.Update(PacketInfo{Timestamp: at(200), Proto: "TCP", Seq: 1, PayloadLen: 10, TCPFlags: TCPFlags{ACK: true}, TCPTimestamp: &TCPTimestamp{Val: 300}}, true)
+	flow.Update(PacketInfo{Timestamp: at(230), Proto: "TCP", Seq: 9, Ack: 11, TCPFlags: TCPFlags{ACK: true}, TCPTimestamp: &TCPTimestamp{Val: 7, Ecr: 300}}, false)
+	flow.Finalize()
+
+	if flow.RTTSampleCount != 1 || flow.RTTMinMs == nil || math.Abs(*flow.RTTMinMs-30) > 0.001 {
+		t.Fatalf("expected one 30 ms sample from the echo, got %d %v", flow.RTTSampleCount, flow.RTTMinMs)
+	}
+}
+
+func TestRTTSamplesStayBounded(t *testing.T) {
+	var d rttDirection
+	for i := 0; i < 10*maxRTTSamples; i++ {
+		d.add(time.Duration(i) * time.Millisecond)
+	}
+	if len(d.samples) >= maxRTTSamples || d.count != 10*maxRTTSamples {
+		t.Fatalf("expected bounded samples over every count, got %d of %d", len(d.samples), d.count)
+	}
+	if last := d.samples[len(d.samples)-1]; last < float64(9*maxRTTSamples) {
+		t.Fatalf("expected retained samples to span the flow, last is %v", last)
+	}
+}
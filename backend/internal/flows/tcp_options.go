@@ -0,0 +1,104 @@
+package flows
+
+// maxWindowScale is the largest shift RFC 7323 allows; larger values are
+// treated as 14.
+const maxWindowScale = 14
+
+// SACKBlock is one left/right edge pair from a SACK option.
+type SACKBlock struct {
+	Left  uint32
+	Right uint32
+}
+
+// TCPTimestamp is the RFC 7323 timestamps option.
+type TCPTimestamp struct {
+	Val uint32
+	Ecr uint32
+}
+
+// tcpOptionState is what one side of a connection announced in its SYN and
+// the receive windows it has advertised since.
+type tcpOptionState struct {
+	synSeen    bool
+	mss        *int
+	wscale     *int
+	sackOK     bool
+	timestamps bool
+	rwndSet    bool
+	rwndMin    int64
+	rwndMax    int64
+	inSACKLoss bool
+}
+
+func (f *FlowAgg) updateTCPOptions(pkt PacketInfo, dir int) {
+	state := &f.tcpOptions[dir]
+	if pkt.TCPFlags.SYN {
+		state.synSeen = true
+		if pkt.MSS != nil {
+			mss := *pkt.MSS
+			state.mss = &mss
+		}
+		if pkt.WindowScale != nil {
+			shift := min(*pkt.WindowScale, maxWindowScale)
+			state.wscale = &shift
+		}
+		state.sackOK = pkt.SACKPermitted
+		state.timestamps = pkt.TCPTimestamp != nil
+		// The window in a SYN is never scaled, so it says nothing about the
+		// receive buffer once the connection is up.
+		return
+	}
+	if !pkt.TCPFlags.ACK {
+		return
+	}
+
+	rwnd := f.receiveWindow(dir, pkt.Window)
+	if !state.rwndSet || rwnd < state.rwndMin {
+		state.rwndMin = rwnd
+	}
+	if !state.rwndSet || rwnd > state.rwndMax {
+		state.rwndMax = rwnd
+	}
+	state.rwndSet = true
+
+	// A SACK block above the cumulative ACK means the receiver holds data
+	// past a hole. Count each run of such ACKs once; the run ends when an
+	// ACK no longer reports data above a hole. Blocks at or below the ACK
+	// are D-SACKs for spurious retransmissions, not loss.
+	aboveHole := false
+	for _, block := range pkt.SACKBlocks {
+		if int32(block.Right-pkt.Ack) > 0 {
+			aboveHole = true
+			break
+		}
+	}
+	if aboveHole && !state.inSACKLoss {
+		f.SACKLossEvents++
+	}
+	state.inSACKLoss = aboveHole
+}
+
+// receiveWindow scales a window advertised by the given direction. Scaling
+// only applies once both SYNs offered the window scale option; without the
+// handshake the raw value is returned.
+func (f *FlowAgg) receiveWindow(dir int, window uint16) int64 {
+	local, peer := f.tcpOptions[dir].wscale, f.tcpOptions[1-dir].wscale
+	if local == nil || peer == nil {
+		return int64(window)
+	}
+	return int64(window) << *local
+}
+
+func (f *FlowAgg) finalizeTCPOptions() {
+	client, server := f.tcpOptions[f.clientDir], f.tcpOptions[1-f.clientDir]
+	f.ClientMSS, f.ServerMSS = client.mss, server.mss
+	f.ClientWindowScale, f.ServerWindowScale = client.wscale, server.wscale
+	f.SACKPermitted = client.synSeen && server.synSeen && client.sackOK && server.sackOK
+	f.TCPTimestamps = client.synSeen && server.synSeen && client.timestamps && server.timestamps
+	if client.rwndSet {
+		f.ClientRwndMin, f.ClientRwndMax = &client.rwndMin, &client.rwndMax
+	}
+	if server.rwndSet {
+		f.ServerRwndMin, f.ServerRwndMax = &server.rwndMin, &server.rwndMax
+	}
+}
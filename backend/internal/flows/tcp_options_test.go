@@ -0,0 +1,65 @@
+package flows
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTCPOptionsPerDirection(t *testing.T) {
+	key := FlowKey{Proto: "TCP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: 40000, DstPort: 443}
+	ts := time.Now()
+	flow := NewFlowAgg(key, ts)
+	intp := func(v int) *int { return &v }
+
+	packets := []struct {
+		forward bool
+		pkt     PacketInfo
+	}{
+		{true, PacketInfo{TCPFlags: TCPFlags{SYN: true}, Window: 64240, MSS: intp(1460), WindowScale: intp(7), SACKPermitted: true, TCPTimestamp: &TCPTimestamp{Val: 1}}},
+		{false, PacketInfo{TCPFlags: TCPFlags{SYN: true, ACK: true}, Window: 65160, MSS: intp(1400), WindowScale: intp(9), SACKPermitted: true, TCPTimestamp: &TCPTimestamp{Val: 5, Ecr: 1}}},
+		{true, PacketInfo{TCPFlags: TCPFlags{ACK: true}, Window: 502, Ack: 1}},
+		{false, PacketInfo{TCPFlags: TCPFlags{ACK: true}, Window: 100, Ack: 1000}},
+		// Two ACKs reporting data above the same hole are one loss event.
+		{false, PacketInfo{TCPFlags: TCPFlags{ACK: true}, Window: 100, Ack: 1000, SACKBlocks: []SACKBlock{{2000, 3000}}}},
+		{false, PacketInfo{TCPFlags: TCPFlags{ACK: true}, Window: 100, Ack: 1000, SACKBlocks: []SACKBlock{{2000, 4000}}}},
+		{false, PacketInfo{TCPFlags: TCPFlags{ACK: true}, Window: 100, Ack: 4000}},
+		// A D-SACK below the cumulative ACK is not loss.
+		{false, PacketInfo{TCPFlags: TCPFlags{ACK: true}, Window: 100, Ack: 4000, SACKBlocks: []SACKBlock{{1000, 2000}}}},
+		{false, PacketInfo{TCPFlags: TCPFlags{ACK: true}, Window: 80, Ack: 4000, SACKBlocks: []SACKBlock{{5000, 6000}}}},
+	}
+	for i, p := range packets {
+		p.pkt.Proto = "TCP"
+		p.pkt.Timestamp = ts.Add(time.Duration(i) * time.Millisecond)
+		flow.Update(p.pkt, p.forward)
+	}
+	flow.Finalize()
+
+	if flow.ClientMSS == nil || *flow.ClientMSS != 1460 || flow.ServerMSS == nil || *flow.ServerMSS != 1400 {
+		t.Fatalf("unexpected MSS client=%v server=%v", flow.ClientMSS, flow.ServerMSS)
+	}
+	if flow.ClientWindowScale == nil || *flow.ClientWindowScale != 7 || flow.ServerWindowScale == nil || *flow.ServerWindowScale != 9 {
+		t.Fatalf("unexpected window scale client=%v server=%v", flow.ClientWindowScale, flow.ServerWindowScale)
+	}
+	if !flow.SACKPermitted || !flow.TCPTimestamps {
+		t.Fatalf("expected SACK and timestamps to be negotiated")
+	}
+	if flow.ClientRwndMax == nil || *flow.ClientRwndMax != 502<<7 {
+		t.Fatalf("expected client window scaled by 7, got %v", flow.ClientRwndMax)
+	}
+	if flow.ServerRwndMin == nil || *flow.ServerRwndMin != 80<<9 || *flow.ServerRwndMax != 100<<9 {
+		t.Fatalf("expected server window scaled by 9, got %v-%v", flow.ServerRwndMin, flow.ServerRwndMax)
+	}
+	if flow.SACKLossEvents != 2 {
+		t.Fatalf("expected 2 SACK loss events, got %d", flow.SACKLossEvents)
+	}
+}
+
+func TestReceiveWindowUnscaledWithoutHandshake(t *testing.T) {
+	key := FlowKey{Proto: "TCP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: 40000, DstPort: 443}
+	flow := NewFlowAgg(key, time.Now())
+	flow.Update(PacketInfo{Proto: "TCP", TCPFlags: TCPFlags{ACK: true}, Window: 512}, true)
+	flow.Finalize()
+	if flow.ClientRwndMin == nil || *flow.ClientRwndMin != 512 || flow.ClientWindowScale != nil {
+		t.Fatalf("expected the raw window without a handshake, got %v", flow.ClientRwndMin)
+	}
+}
@@ -0,0 +1,142 @@
+package flows
+
+// Final TCP connection states reported in TCPState.
+const (
+	TCPStateSynSent     = "syn_sent"
+	TCPStateSynReceived = "syn_received"
+	TCPStateEstablished = "established"
+	TCPStateHalfClosed  = "half_closed"
+	TCPStateClosed      = "closed"
+	TCPStateReset       = "reset"
+)
+
+// Handshake outcomes reported in Handshake when the capture saw a SYN.
+const (
+	HandshakeCompleted  = "completed"
+	HandshakeRefused    = "refused"
+	HandshakeNoSynAck   = "no_syn_ack"
+	HandshakeIncomplete = "incomplete"
+)
+
+// Sides reported in CloseInitiator.
+const (
+	SideClient = "client"
+	SideServer = "server"
+)
+
+// tcpLifecycle follows the connection through the handshake and close.
+// Directions are packet directions; they become client and server sides
+// once the flow is finalized.
+type tcpLifecycle struct {
+	started       bool
+	midConnection bool
+	state         string
+	synSeen       bool
+	synSeq        uint32
+	synAckDir     int
+	synAckSeen    bool
+	handshakeDone bool
+	refused       bool
+	finSeen       [2]bool
+	closer        int
+	closerSet     bool
+}
+
+func (s *tcpLifecycle) update(pkt PacketInfo, dir int) {
+	flags := pkt.TCPFlags
+	if !s.started {
+		s.started = true
+		s.midConnection = !flags.SYN
+		if s.midConnection {
+			s.state = TCPStateEstablished
+		}
+	}
+	if s.state == TCPStateReset || s.state == TCPStateClosed {
+		return
+	}
+
+	switch {
+	case flags.RST:
+		if s.synSeen && !s.synAckSeen && !s.midConnection {
+			s.refused = true
+		}
+		s.state = TCPStateReset
+		s.closeBy(dir)
+		return
+	case flags.SYN && !flags.ACK:
+		if !s.synSeen {
+			s.synSeen, s.synSeq = true, pkt.Seq
+		}
+		if s.state == "" {
+			s.state = TCPStateSynSent
+		}
+	case flags.SYN && flags.ACK:
+		if !s.synAckSeen {
+			s.synAckSeen, s.synAckDir = true, dir
+		}
+		if s.state == "" || s.state == TCPStateSynSent {
+			s.state = TCPStateSynReceived
+		}
+	case flags.ACK && s.synAckSeen && !s.handshakeDone && dir != s.synAckDir:
+		s.handshakeDone = true
+		if s.state == TCPStateSynReceived {
+			s.state = TCPStateEstablished
+		}
+	}
+
+	if flags.FIN {
+		s.finSeen[dir] = true
+		s.closeBy(dir)
+		if s.finSeen[0] && s.finSeen[1] {
+			s.state = TCPStateClosed
+		} else {
+			s.state = TCPStateHalfClosed
+		}
+	}
+}
+
+// closeBy records the first side to send a FIN or RST.
+func (s *tcpLifecycle) closeBy(dir int) {
+	if !s.closerSet {
+		s.closer, s.closerSet = dir, true
+	}
+}
+
+func (f *FlowAgg) finalizeState() {
+	s := f.lifecycle
+	if !s.started {
+		return
+	}
+	state := s.state
+	f.TCPState = &state
+	f.MidConnection = s.midConnection
+	if s.closerSet {
+		side := SideServer
+		if s.closer == f.clientDir {
+			side = SideClient
+		}
+		f.CloseInitiator = &side
+	}
+	if !s.synSeen && !s.synAckSeen {
+		return
+	}
+	var outcome string
+	switch {
+	case s.handshakeDone:
+		outcome = HandshakeCompleted
+	case s.refused:
+		outcome = HandshakeRefused
+	case !s.synAckSeen:
+		outcome = HandshakeNoSynAck
+	default:
+		outcome = HandshakeIncomplete
+	}
+	f.Handshake = &outcome
+}
+
+// Closed reports whether the TCP connection was reset or closed by both
+// sides.
+func (f *FlowAgg) Closed() bool {
+	state := f.lifecycle.state
+	return state == TCPStateClosed || state == TCPStateReset
+}
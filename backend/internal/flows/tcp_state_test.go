@@ -0,0 +1,74 @@
+package flows
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTCPLifecycle(t *testing.T) {
+	syn := TCPFlags{SYN: true}
+	synAck := TCPFlags{SYN: true, ACK: true}
+	ack := TCPFlags{ACK: true}
+	fin := TCPFlags{FIN: true, ACK: true}
+	rst := TCPFlags{RST: true}
+
+	type step struct {
+		forward bool
+		flags   TCPFlags
+	}
+	cases := []struct {
+		name      string
+		steps     []step
+		state     string
+		initiator string
+		handshake string
+		mid       bool
+	}{
+		{"graceful", []step{{true, syn}, {false, synAck}, {true, ack}, {false, fin}, {true, fin}, {false, ack}}, TCPStateClosed, SideServer, HandshakeCompleted, false},
+		{"client reset", []step{{true, syn}, {false, synAck}, {true, ack}, {true, rst}}, TCPStateReset, SideClient, HandshakeCompleted, false},
+		{"refused", []step{{true, syn}, {false, rst}}, TCPStateReset, SideServer, HandshakeRefused, false},
+		{"no syn-ack", []step{{true, syn}, {true, syn}}, TCPStateSynSent, "", HandshakeNoSynAck, false},
+		{"syn-ack not acknowledged", []step{{true, syn}, {false, synAck}, {false, synAck}}, TCPStateSynReceived, "", HandshakeIncomplete, false},
+		{"half closed", []step{{true, syn}, {false, synAck}, {true, ack}, {true, fin}, {false, ack}}, TCPStateHalfClosed, SideClient, HandshakeCompleted, false},
+		{"open mid-connection", []step{{true, ack}, {false, ack}}, TCPStateEstablished, "", "", true},
+	}
+	for _, tc := range cases {
+		key := FlowKey{Proto: "TCP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: 40000, DstPort: 443}
+		start := time.Now()
+		flow := NewFlowAgg(key, start)
+		for i, s := range tc.steps {
+			flow.Update(PacketInfo{Timestamp: start.Add(time.Duration(i) * time.Millisecond), Proto: "TCP", TCPFlags: s.flags}, s.forward)
+		}
+		flow.Finalize()
+
+		if flow.TCPState == nil || *flow.TCPState != tc.state {
+			t.Fatalf("%s: expected state %s, got %v", tc.name, tc.state, flow.TCPState)
+		}
+		if got := stringOrEmpty(flow.CloseInitiator); got != tc.initiator {
+			t.Fatalf("%s: expected close initiator %q, got %q", tc.name, tc.initiator, got)
+		}
+		if got := stringOrEmpty(flow.Handshake); got != tc.handshake {
+			t.Fatalf("%s: expected handshake %q, got %q", tc.name, tc.handshake, got)
+		}
+		if flow.MidConnection != tc.mid {
+			t.Fatalf("%s: expected mid_connection=%v", tc.name, tc.mid)
+		}
+	}
+}
+
+func TestNoTCPStateForUDP(t *testing.T) {
+	key := FlowKey{Proto: "UDP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: 5353, DstPort: 53}
+	flow := NewFlowAgg(key, time.Now())
+	flow.Update(PacketInfo{Timestamp: time.Now(), Proto: "UDP", PayloadLen: 40}, true)
+	flow.Finalize()
+	if flow.TCPState != nil || flow.Handshake != nil {
+		t.Fatalf("expected no TCP state for UDP, got %v %v", flow.TCPState, flow.Handshake)
+	}
+}
+
+func stringOrEmpty(v *string) string {
+	if v == nil {
+		return ""
+	}
+	return *v
+}
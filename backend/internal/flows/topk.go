@@ -53,6 +53,19 @@ func (t *TopK) Add(item TopKItem) {
     }
 }
 
+// Update replaces prev, an item added before, with item, as when the same
+// key has counted more, or adds item when prev was not kept.
+func (t *TopK) Update(prev, item TopKItem) {
+    for i := range t.heap {
+        if t.heap[i] == prev {
+            t.heap[i] = item
+            heap.Fix(&t.heap, i)
+            return
+        }
+    }
+    t.Add(item)
+}
+
 func (t *TopK) ItemsDesc() []TopKItem {
     items := make([]TopKItem, len(t.heap))
     copy(items, t.heap)
@@ -0,0 +1,142 @@
+package flows
+
+import "time"
+
+// WindowEvents are the flow-control conditions a single TCP segment shows.
+type WindowEvents struct {
+	ZeroWindow      bool
+	ZeroWindowProbe bool
+	WindowUpdate    bool
+	WindowFull      bool
+}
+
+// WindowTracker follows the receive window each side advertises. It is shared
+// by flow aggregation and the packet list so both label the same packets.
+type WindowTracker struct {
+	dirs [2]windowDirection
+}
+
+type windowDirection struct {
+	wscale *int
+
+	windowSet bool
+	window    int64
+	ack       uint32
+	nextSet   bool
+	nextSeq   uint32
+
+	zeroOpen  bool
+	zeroSince time.Time
+	stalled   time.Duration
+}
+
+// Observe classifies a TCP segment sent by dir and updates the window state.
+//
+//   - ZeroWindow: an ACK advertising a zero receive window.
+//   - ZeroWindowProbe: one byte of data, or an empty segment one below the
+//     next sequence number as Linux sends, while the peer's window is zero.
+//   - WindowUpdate: a pure ACK that only changes the advertised window.
+//   - WindowFull: data that reaches the right edge of the peer's window.
+func (w *WindowTracker) Observe(pkt PacketInfo, dir int) WindowEvents {
+	var ev WindowEvents
+	if pkt.TCPFlags.RST {
+		return ev
+	}
+	d, peer := &w.dirs[dir], &w.dirs[1-dir]
+
+	if pkt.TCPFlags.SYN {
+		if pkt.WindowScale != nil {
+			shift := min(*pkt.WindowScale, maxWindowScale)
+			d.wscale = &shift
+		}
+		// The window in a SYN is never scaled, so tracking starts with the
+		// first ACK after it.
+		d.nextSeq, d.nextSet = pkt.Seq+1, true
+		return ev
+	}
+
+	if peer.windowSet {
+		switch {
+		case peer.window == 0 && pkt.PayloadLen == 1:
+			ev.ZeroWindowProbe = true
+		case peer.window == 0 && pkt.PayloadLen == 0 && d.nextSet && pkt.Seq == d.nextSeq-1:
+			ev.ZeroWindowProbe = true
+		case peer.window > 0 && pkt.PayloadLen > 0:
+			edge := peer.ack + uint32(peer.window)
+			if int32(pkt.Seq+uint32(pkt.PayloadLen)-edge) >= 0 {
+				ev.WindowFull = true
+			}
+		}
+	}
+	if end := pkt.Seq + uint32(pkt.PayloadLen); pkt.PayloadLen > 0 && (!d.nextSet || int32(end-d.nextSeq) > 0) {
+		d.nextSeq, d.nextSet = end, true
+	}
+
+	if !pkt.TCPFlags.ACK {
+		return ev
+	}
+	window := w.scaled(dir, pkt.Window)
+	if window == 0 && !pkt.TCPFlags.FIN {
+		ev.ZeroWindow = true
+		if !d.zeroOpen {
+			d.zeroOpen, d.zeroSince = true, pkt.Timestamp
+		}
+	} else if d.windowSet && pkt.PayloadLen == 0 && !pkt.TCPFlags.FIN && pkt.Ack == d.ack && window != d.window {
+		ev.WindowUpdate = true
+	}
+	if window > 0 && d.zeroOpen {
+		d.stalled += pkt.Timestamp.Sub(d.zeroSince)
+		d.zeroOpen = false
+	}
+	d.window, d.ack, d.windowSet = window, pkt.Ack, true
+	return ev
+}
+
+// Stalled returns how long dir kept its receive window closed, counting a
+// window still closed at until.
+func (w *WindowTracker) Stalled(dir int, until time.Time) time.Duration {
+	d := w.dirs[dir]
+	if d.zeroOpen && until.After(d.zeroSince) {
+		return d.stalled + until.Sub(d.zeroSince)
+	}
+	return d.stalled
+}
+
+// scaled applies dir's window scale once both SYNs offered the option.
+func (w *WindowTracker) scaled(dir int, window uint16) int64 {
+	local, peer := w.dirs[dir].wscale, w.dirs[1-dir].wscale
+	if local == nil || peer == nil {
+		return int64(window)
+	}
+	return int64(window) << *local
+}
+
+func (f *FlowAgg) updateWindow(pkt PacketInfo, dir int, packetIndex int) {
+	ev := f.windows.Observe(pkt, dir)
+	if ev.ZeroWindow {
+		f.ZeroWindows++
+		f.zeroWindowIndexes = appendIndex(f.zeroWindowIndexes, packetIndex)
+	}
+	if ev.ZeroWindowProbe {
+		f.ZeroWindowProbes++
+		f.zeroWindowIndexes = appendIndex(f.zeroWindowIndexes, packetIndex)
+	}
+	if ev.WindowUpdate {
+		f.WindowUpdates++
+	}
+	if ev.WindowFull {
+		f.WindowFull++
+	}
+}
+
+func (f *FlowAgg) finalizeWindow() {
+	client := f.windows.Stalled(f.clientDir, f.LastSeen)
+	server := f.windows.Stalled(1-f.clientDir, f.LastSeen)
+	f.ClientStallMs = client.Seconds() * 1000
+	f.ServerStallMs = server.Seconds() * 1000
+}
+
+// ZeroWindowIndexes returns the packets advertising or probing a zero window.
+func (f *FlowAgg) ZeroWindowIndexes() []int {
+	return append([]int(nil), f.zeroWindowIndexes...)
+}
@@ -0,0 +1,65 @@
+package flows
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestReceiverStall(t *testing.T) {
+	key := FlowKey{Proto: "TCP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: 40000, DstPort: 443}
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	flow := NewFlowAgg(key, start)
+	intp := func(v int) *int { return &v }
+
+	packets := []struct {
+		ms      int
+		forward bool
+		pkt     PacketInfo
+	}{
+		{0, true, PacketInfo{Seq: 999, TCPFlags: TCPFlags{SYN: true}, Window: 64240, WindowScale: intp(2)}},
+		{1, false, PacketInfo{Seq: 4999, Ack: 1000, TCPFlags: TCPFlags{SYN: true, ACK: true}, Window: 65160, WindowScale: intp(2)}},
+		{2, true, PacketInfo{Seq: 1000, Ack: 5000, TCPFlags: TCPFlags{ACK: true}, Window: 500}},
+		// The server's window is 250<<2 bytes, so a 1000 byte segment fills it.
+		{3, false, PacketInfo{Seq: 5000, Ack: 1000, TCPFlags: TCPFlags{ACK: true}, Window: 250}},
+		{4, true, PacketInfo{Seq: 1000, Ack: 5000, PayloadLen: 1000, TCPFlags: TCPFlags{ACK: true}, Window: 500}},
+		{10, false, PacketInfo{Seq: 5000, Ack: 2000, TCPFlags: TCPFlags{ACK: true}, Window: 0}},
+		{210, true, PacketInfo{Seq: 2000, Ack: 5000, PayloadLen: 1, TCPFlags: TCPFlags{ACK: true}, Window: 500}},
+		{211, false, PacketInfo{Seq: 5000, Ack: 2000, TCPFlags: TCPFlags{ACK: true}, Window: 0}},
+		// Linux probes with an empty segment one below the next sequence number.
+		{610, true, PacketInfo{Seq: 2000, Ack: 5000, TCPFlags: TCPFlags{ACK: true}, Window: 500}},
+		{1010, false, PacketInfo{Seq: 5000, Ack: 2000, TCPFlags: TCPFlags{ACK: true}, Window: 300}},
+		{1011, true, PacketInfo{Seq: 2000, Ack: 5000, PayloadLen: 100, TCPFlags: TCPFlags{ACK: true}, Window: 500}},
+	}
+	for _, p := range packets {
+		p.pkt.Proto = "TCP"
+		p.pkt.Timestamp = start.Add(time.Duration(p.ms) * time.Millisecond)
+		flow.Update(p.pkt, p.forward)
+	}
+	flow.Finalize()
+
+	if flow.ZeroWindows != 2 || flow.ZeroWindowProbes != 2 {
+		t.Fatalf("expected 2 zero windows and 2 probes, got %d and %d", flow.ZeroWindows, flow.ZeroWindowProbes)
+	}
+	if flow.WindowUpdates != 1 || flow.WindowFull != 1 {
+		t.Fatalf("expected 1 window update and 1 window full, got %d and %d", flow.WindowUpdates, flow.WindowFull)
+	}
+	if math.Abs(flow.ServerStallMs-1000) > 0.001 || flow.ClientStallMs != 0 {
+		t.Fatalf("expected the server to stall the client for 1000 ms, got client=%v server=%v", flow.ClientStallMs, flow.ServerStallMs)
+	}
+	if indexes := flow.ZeroWindowIndexes(); len(indexes) != 4 || indexes[0] != 6 {
+		t.Fatalf("unexpected zero window evidence %v", indexes)
+	}
+}
+
+func TestStallOpenAtEndOfCapture(t *testing.T) {
+	var w WindowTracker
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	ev := w.Observe(PacketInfo{Timestamp: start, Proto: "TCP", Ack: 1, TCPFlags: TCPFlags{ACK: true}}, 1)
+	if !ev.ZeroWindow {
+		t.Fatalf("expected a zero window advertisement")
+	}
+	if stalled := w.Stalled(1, start.Add(3*time.Second)); stalled != 3*time.Second {
+		t.Fatalf("expected the open stall to count until the end, got %v", stalled)
+	}
+}
@@ -1,6 +1,19 @@
 package httpapi
 
-import "netsage/internal/db"
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"netsage/internal/capturefilter"
+	"netsage/internal/db"
+	"netsage/internal/displayfilter"
+	"netsage/internal/flows"
+
+	"gorm.io/gorm"
+)
 
 func normalizeFlowEndpoints(flow *db.Flow) {
 	if flow.ClientIP == "" {
@@ -16,3 +29,115 @@ func normalizeFlowEndpoints(flow *db.Flow) {
 		flow.ServerPort = flow.DstPort
 	}
 }
+
+func applyFingerprintFilters(q *gorm.DB, query url.Values) *gorm.DB {
+	if ja3 := strings.TrimSpace(query.Get("ja3")); ja3 != "" {
+		q = q.Where("ja3 = ?", strings.ToLower(ja3))
+	}
+	if ja3s := strings.TrimSpace(query.Get("ja3s")); ja3s != "" {
+		q = q.Where("ja3s = ?", strings.ToLower(ja3s))
+	}
+	if ja4 := strings.TrimSpace(query.Get("ja4")); ja4 != "" {
+		q = q.Where("ja4 = ?", strings.ToLower(ja4))
+	}
+	return q
+}
+
+func applyTunnelFilters(q *gorm.DB, query url.Values) *gorm.DB {
+	if tunnel := strings.TrimSpace(query.Get("tunnel_type")); tunnel != "" {
+		q = q.Where("tunnel_type = ?", strings.ToLower(tunnel))
+	}
+	if tunnelID := query.Get("tunnel_id"); tunnelID != "" {
+		if parsed, err := strconv.ParseInt(tunnelID, 10, 64); err == nil {
+			q = q.Where("tunnel_id = ?", parsed)
+		}
+	}
+	return q
+}
+
+func applyTCPStateFilters(q *gorm.DB, query url.Values) *gorm.DB {
+	if state := strings.TrimSpace(query.Get("tcp_state")); state != "" {
+		q = q.Where("tcp_state = ?", strings.ToLower(state))
+	}
+	if initiator := strings.TrimSpace(query.Get("close_initiator")); initiator != "" {
+		q = q.Where("close_initiator = ?", strings.ToLower(initiator))
+	}
+	if handshake := strings.TrimSpace(query.Get("tcp_handshake")); handshake != "" {
+		q = q.Where("tcp_handshake = ?", strings.ToLower(handshake))
+	}
+	if mid := query.Get("mid_connection"); mid != "" {
+		if parsed, err := strconv.ParseBool(mid); err == nil {
+			q = q.Where("mid_connection = ?", parsed)
+		}
+	}
+	return q
+}
+
+// applyDisplayFilter narrows a flows query by the filter expression
+// parameter.
+func applyDisplayFilter(q *gorm.DB, query url.Values) (*gorm.DB, error) {
+	expr, err := displayfilter.Parse(query.Get("filter"), displayfilter.Flows)
+	if err != nil || expr == nil {
+		return q, err
+	}
+	where, args := displayfilter.SQL(expr)
+	return q.Where(where, args...), nil
+}
+
+// writeFilterError reports a filter expression or capture filter that did
+// not parse, with the position of the error.
+func writeFilterError(w http.ResponseWriter, err error) {
+	var syntaxErr *displayfilter.Error
+	if errors.As(err, &syntaxErr) {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error":    "invalid filter: " + syntaxErr.Error(),
+			"position": syntaxErr.Pos,
+		})
+		return
+	}
+	var captureErr *capturefilter.Error
+	if errors.As(err, &captureErr) {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error":    "invalid capture filter: " + captureErr.Error(),
+			"position": captureErr.Pos,
+		})
+		return
+	}
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid filter"})
+}
+
+// storedCaptureFilter returns the capture filter a capture was analyzed
+// with, which was checked when it was uploaded.
+func storedCaptureFilter(record db.Pcap) *capturefilter.Filter {
+	if record.CaptureFilter == nil {
+		return nil
+	}
+	filter, _ := capturefilter.Parse(*record.CaptureFilter)
+	return filter
+}
+
+// flowKeyFromRecord rebuilds the analyzer's key for a stored flow so packets
+// can be matched back to it.
+func flowKeyFromRecord(flow db.Flow) flows.FlowKey {
+	key := flows.FlowKey{
+		Proto:   flow.Proto,
+		SrcIP:   flow.SrcIP,
+		DstIP:   flow.DstIP,
+		SrcPort: flow.SrcPort,
+		DstPort: flow.DstPort,
+	}
+	if flow.TunnelType != nil {
+		key.Tunnel.Type = *flow.TunnelType
+		if flow.TunnelID != nil {
+			key.Tunnel.ID = uint32(*flow.TunnelID)
+		}
+	}
+	return key
+}
+
+func stringValue(v *string) string {
+	if v == nil {
+		return ""
+	}
+	return *v
+}
@@ -10,6 +10,9 @@ import (
 	"netsage/internal/pcap"
 )
 
+// handleCertInspect returns the certificate report extracted from the capture
+// at analysis time. Flows without a plaintext Certificate message (TLS 1.3,
+// resumed sessions, truncated captures) fall back to dialing the host live.
 func (s *Server) handleCertInspect(w http.ResponseWriter, r *http.Request) {
 	user, ok := getUser(r.Context())
 	if !ok {
@@ -29,6 +32,16 @@ func (s *Server) handleCertInspect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if flow.CertReportJSON != nil && r.URL.Query().Get("live") != "1" {
+		var report pcap.CertReport
+		if err := json.Unmarshal([]byte(*flow.CertReportJSON), &report); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "cert report decode error"})
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+
 	host := ""
 	if flow.TLSSNI != nil {
 		host = strings.TrimSpace(*flow.TLSSNI)
@@ -41,7 +54,10 @@ func (s *Server) handleCertInspect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	port := flow.DstPort
+	port := flow.ServerPort
+	if port == 0 {
+		port = flow.DstPort
+	}
 	if p := r.URL.Query().Get("port"); p != "" {
 		if parsed, err := strconv.Atoi(p); err == nil {
 			port = parsed
@@ -57,45 +73,5 @@ func (s *Server) handleCertInspect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(report.Issues) > 0 {
-		severity := 3
-		if report.Expired || !report.HostnameValid || report.SelfSigned {
-			severity = 5
-		} else if report.WeakSignatureAlgo {
-			severity = 2
-		}
-
-		var job db.Job
-		_ = s.store.DB.Where("pcap_id = ? AND user_id = ?", flow.PcapID, user.ID).Order("created_at desc").First(&job).Error
-		var jobID *uint
-		if job.ID != 0 {
-			jobID = &job.ID
-		}
-
-		issue := db.Issue{
-			PcapID:        flow.PcapID,
-			JobID:         jobID,
-			UserID:        user.ID,
-			PrimaryFlowID: &flow.ID,
-			Severity:      severity,
-			IssueType:     "CERT_INSPECTION",
-			Title:         "TLS certificate inspection findings",
-			Summary:       "Active certificate inspection found potential issues.",
-		}
-		if err := s.store.DB.Create(&issue).Error; err == nil {
-			evidenceBytes, _ := json.Marshal(map[string]interface{}{
-				"cert_report": report,
-			})
-			evidence := db.IssueEvidence{
-				IssueID:          issue.ID,
-				FlowID:           flow.ID,
-				PacketStartIndex: 1,
-				PacketEndIndex:   1,
-				MetricsJSON:      string(evidenceBytes),
-			}
-			_ = s.store.DB.Create(&evidence).Error
-		}
-	}
-
 	writeJSON(w, http.StatusOK, report)
 }
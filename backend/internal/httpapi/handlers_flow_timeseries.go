@@ -6,7 +6,6 @@ import (
 	"time"
 
 	"netsage/internal/db"
-	"netsage/internal/flows"
 	"netsage/internal/pcap"
 )
 
@@ -53,23 +52,21 @@ func (s *Server) handleGetFlowTimeseries(w http.ResponseWriter, r *http.Request)
 		serverPort = flow.DstPort
 	}
 
-	flowKey := flows.FlowKey{
-		Proto:   flow.Proto,
-		SrcIP:   flow.SrcIP,
-		DstIP:   flow.DstIP,
-		SrcPort: flow.SrcPort,
-		DstPort: flow.DstPort,
-	}
+	flowKey := flowKeyFromRecord(flow)
 
 	series, err := pcap.BuildStreamTimeseries(
 		r.Context(),
 		pcapRecord.StoragePath,
+		s.captureIndexPath(flow.PcapID, user.ID),
+		storedCaptureFilter(pcapRecord),
 		granularity,
 		flowKey,
 		clientIP,
 		clientPort,
 		serverIP,
 		serverPort,
+		flow.StartTS,
+		flow.EndTS,
 	)
 	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "timeseries error"})
@@ -50,6 +50,14 @@ func (s *Server) handleListFlows(w http.ResponseWriter, r *http.Request) {
 			q = q.Where("tcp_stream = ?", parsed)
 		}
 	}
+	q = applyFingerprintFilters(q, r.URL.Query())
+	q = applyTunnelFilters(q, r.URL.Query())
+	q = applyTCPStateFilters(q, r.URL.Query())
+	q, err = applyDisplayFilter(q, r.URL.Query())
+	if err != nil {
+		writeFilterError(w, err)
+		return
+	}
 	if srcIP := r.URL.Query().Get("src_ip"); srcIP != "" {
 		q = q.Where("src_ip = ?", srcIP)
 	}
@@ -154,6 +162,14 @@ func (s *Server) handleListFlowsForJob(w http.ResponseWriter, r *http.Request) {
 			q = q.Where("tcp_stream = ?", parsed)
 		}
 	}
+	q = applyFingerprintFilters(q, r.URL.Query())
+	q = applyTunnelFilters(q, r.URL.Query())
+	q = applyTCPStateFilters(q, r.URL.Query())
+	q, err = applyDisplayFilter(q, r.URL.Query())
+	if err != nil {
+		writeFilterError(w, err)
+		return
+	}
 
 	limit := 100
 	if l := r.URL.Query().Get("limit"); l != "" {
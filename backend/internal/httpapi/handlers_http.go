@@ -0,0 +1,106 @@
+package httpapi
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"netsage/internal/db"
+)
+
+type httpTransactionRow struct {
+	db.HTTPTransaction
+	ClientIP   string `json:"client_ip"`
+	ClientPort int    `json:"client_port"`
+	ServerIP   string `json:"server_ip"`
+	ServerPort int    `json:"server_port"`
+	TCPStream  *int   `json:"tcp_stream"`
+}
+
+func (s *Server) handleListHTTPForJob(w http.ResponseWriter, r *http.Request) {
+	user, ok := getUser(r.Context())
+	if !ok {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	jobID, err := strconv.Atoi(chiURLParam(r, "id"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		return
+	}
+
+	var job db.Job
+	if err := s.store.DB.Where("id = ? AND user_id = ?", jobID, user.ID).First(&job).Error; err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+
+	q := s.store.DB.Table("http_transactions").
+		Joins("JOIN flows ON flows.id = http_transactions.flow_id").
+		Where("http_transactions.pcap_id = ? AND http_transactions.user_id = ?", job.PcapID, user.ID)
+
+	query := r.URL.Query()
+	if flowID := query.Get("flow_id"); flowID != "" {
+		if parsed, err := strconv.Atoi(flowID); err == nil {
+			q = q.Where("http_transactions.flow_id = ?", parsed)
+		}
+	}
+	if method := strings.TrimSpace(query.Get("method")); method != "" {
+		q = q.Where("http_transactions.method = ?", strings.ToUpper(method))
+	}
+	if host := strings.TrimSpace(query.Get("host")); host != "" {
+		q = q.Where("http_transactions.host ILIKE ?", "%"+host+"%")
+	}
+	if path := strings.TrimSpace(query.Get("path")); path != "" {
+		q = q.Where("http_transactions.path ILIKE ?", "%"+path+"%")
+	}
+	if status := strings.ToLower(strings.TrimSpace(query.Get("status"))); status != "" {
+		if len(status) == 3 && strings.HasSuffix(status, "xx") && status[0] >= '1' && status[0] <= '5' {
+			low := int(status[0]-'0') * 100
+			q = q.Where("http_transactions.status >= ? AND http_transactions.status < ?", low, low+100)
+		} else if status == "none" {
+			q = q.Where("http_transactions.status IS NULL")
+		} else if parsed, err := strconv.Atoi(status); err == nil {
+			q = q.Where("http_transactions.status = ?", parsed)
+		}
+	}
+	if minTTFB := query.Get("min_ttfb_ms"); minTTFB != "" {
+		if parsed, err := strconv.ParseFloat(minTTFB, 64); err == nil {
+			q = q.Where("http_transactions.ttfb_ms >= ?", parsed)
+		}
+	}
+
+	var totalCount int64
+	if err := q.Count(&totalCount).Error; err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "db error"})
+		return
+	}
+
+	limit := 100
+	if l := query.Get("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 500 {
+			limit = parsed
+		}
+	}
+	offset := 0
+	if o := query.Get("offset"); o != "" {
+		if parsed, err := strconv.Atoi(o); err == nil && parsed >= 0 {
+			offset = parsed
+		}
+	}
+
+	rows := make([]httpTransactionRow, 0)
+	if err := q.Select("http_transactions.*, flows.client_ip, flows.client_port, flows.server_ip, flows.server_port, flows.tcp_stream").
+		Order("http_transactions.request_ts asc, http_transactions.id asc").
+		Limit(limit).Offset(offset).
+		Scan(&rows).Error; err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "db error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"transactions": rows,
+		"total_count":  totalCount,
+	})
+}
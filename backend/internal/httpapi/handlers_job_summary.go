@@ -130,7 +130,7 @@ func (s *Server) handleGetJobSummary(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var flowRows []db.Flow
-	if err := s.store.DB.Select("id, proto, packet_count, bytes_client_to_server, bytes_server_to_client, server_port, tls_client_hello, tls_server_hello, tls_alert, http_method").
+	if err := s.store.DB.Select("id, proto, packet_count, bytes_client_to_server, bytes_server_to_client, server_port, tls_client_hello, tls_server_hello, tls_alert, http_method, quic_version").
 		Where("pcap_id = ? AND user_id = ?", job.PcapID, user.ID).
 		Find(&flowRows).Error; err != nil {
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "flow stats error"})
@@ -153,7 +153,7 @@ func (s *Server) handleGetJobSummary(w http.ResponseWriter, r *http.Request) {
 		protocolCounts[proto] += flow.PacketCount
 		streamCounts[proto]++
 
-		if proto == "UDP" && flow.ServerPort == 443 {
+		if proto == "UDP" && (flow.QUICVersion != nil || flow.ServerPort == 443) {
 			appProtocols["Likely QUIC"]++
 		}
 		if proto == "TCP" && flow.ServerPort == 21 {
@@ -188,7 +188,7 @@ func (s *Server) handleGetJobSummary(w http.ResponseWriter, r *http.Request) {
 		return ports[i].Packets > ports[j].Packets
 	})
 
-	timeseries, err := pcap.BuildTimeseries(r.Context(), pcapRecord.StoragePath, time.Second)
+	timeseries, err := pcap.BuildTimeseries(r.Context(), pcapRecord.StoragePath, stringValue(job.IndexPath), storedCaptureFilter(pcapRecord), time.Second)
 	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "timeseries error"})
 		return
@@ -0,0 +1,223 @@
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"netsage/internal/db"
+	"netsage/internal/pcap"
+)
+
+// handleExportPacketsForJob downloads the packets of a job's capture that
+// pass the same filter parameters as the packet list.
+func (s *Server) handleExportPacketsForJob(w http.ResponseWriter, r *http.Request) {
+	user, ok := getUser(r.Context())
+	if !ok {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	jobID, err := strconv.Atoi(chiURLParam(r, "id"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		return
+	}
+
+	var job db.Job
+	if err := s.store.DB.Where("id = ? AND user_id = ?", jobID, user.ID).First(&job).Error; err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+
+	filter, err := packetFilterFromQuery(r.URL.Query())
+	if err != nil {
+		writeFilterError(w, err)
+		return
+	}
+	flowIndex, err := s.loadFlowIndex(job.PcapID, user.ID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "flow lookup error"})
+		return
+	}
+
+	sel := pcap.PacketSelection{Filter: filter, FlowIndex: flowIndex}
+	s.writeCapture(w, r, job.PcapID, stringValue(job.IndexPath), fmt.Sprintf("job-%d-packets", job.ID), sel)
+}
+
+// handleExportStream downloads the packets of one TCP stream of a job.
+func (s *Server) handleExportStream(w http.ResponseWriter, r *http.Request) {
+	user, ok := getUser(r.Context())
+	if !ok {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	jobID, err := strconv.Atoi(chiURLParam(r, "id"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		return
+	}
+	stream, err := strconv.Atoi(chiURLParam(r, "stream"))
+	if err != nil || stream < 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid stream"})
+		return
+	}
+
+	var job db.Job
+	if err := s.store.DB.Where("id = ? AND user_id = ?", jobID, user.ID).First(&job).Error; err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+
+	flowIndex, err := s.loadFlowIndex(job.PcapID, user.ID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "flow lookup error"})
+		return
+	}
+
+	sel := pcap.PacketSelection{Filter: pcap.PacketFilter{StreamID: &stream}, FlowIndex: flowIndex}
+	s.writeCapture(w, r, job.PcapID, stringValue(job.IndexPath), fmt.Sprintf("job-%d-stream-%d", job.ID, stream), sel)
+}
+
+// handleExportFlow downloads the packets of one flow.
+func (s *Server) handleExportFlow(w http.ResponseWriter, r *http.Request) {
+	user, ok := getUser(r.Context())
+	if !ok {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	flowID, err := strconv.Atoi(chiURLParam(r, "id"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		return
+	}
+
+	var flow db.Flow
+	if err := s.store.DB.Where("id = ? AND user_id = ?", flowID, user.ID).First(&flow).Error; err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+
+	flowIndex, err := s.loadFlowIndex(flow.PcapID, user.ID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "flow lookup error"})
+		return
+	}
+
+	sel := pcap.PacketSelection{
+		FlowIndex: flowIndex,
+		Flows:     []pcap.FlowRange{{Key: flowKeyFromRecord(flow), Start: flow.StartTS}},
+	}
+	s.writeCapture(w, r, flow.PcapID, s.captureIndexPath(flow.PcapID, user.ID), fmt.Sprintf("flow-%d", flow.ID), sel)
+}
+
+// handleExportIssueEvidence downloads the packets each piece of an issue's
+// evidence points at.
+func (s *Server) handleExportIssueEvidence(w http.ResponseWriter, r *http.Request) {
+	user, ok := getUser(r.Context())
+	if !ok {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	id, err := strconv.Atoi(chiURLParam(r, "id"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		return
+	}
+
+	var issue db.Issue
+	if err := s.store.DB.Where("id = ? AND user_id = ?", id, user.ID).First(&issue).Error; err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+
+	var evidence []db.IssueEvidence
+	if err := s.store.DB.Where("issue_id = ?", issue.ID).Find(&evidence).Error; err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "db error"})
+		return
+	}
+	if len(evidence) == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no evidence"})
+		return
+	}
+
+	flowIDs := make([]uint, 0, len(evidence))
+	for _, ev := range evidence {
+		flowIDs = append(flowIDs, ev.FlowID)
+	}
+	var flowRows []db.Flow
+	if err := s.store.DB.Where("id IN ? AND user_id = ?", flowIDs, user.ID).Find(&flowRows).Error; err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "db error"})
+		return
+	}
+	flowsByID := make(map[uint]db.Flow, len(flowRows))
+	for _, flow := range flowRows {
+		flowsByID[flow.ID] = flow
+	}
+
+	flowIndex, err := s.loadFlowIndex(issue.PcapID, user.ID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "flow lookup error"})
+		return
+	}
+
+	sel := pcap.PacketSelection{FlowIndex: flowIndex}
+	for _, ev := range evidence {
+		flow, ok := flowsByID[ev.FlowID]
+		if !ok {
+			continue
+		}
+		sel.Flows = append(sel.Flows, pcap.FlowRange{
+			Key:   flowKeyFromRecord(flow),
+			Start: flow.StartTS,
+			First: ev.PacketStartIndex,
+			Last:  ev.PacketEndIndex,
+		})
+	}
+	if len(sel.Flows) == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no evidence"})
+		return
+	}
+
+	indexPath := ""
+	if issue.JobID != nil {
+		var job db.Job
+		if err := s.store.DB.Where("id = ? AND user_id = ?", *issue.JobID, user.ID).First(&job).Error; err == nil {
+			indexPath = stringValue(job.IndexPath)
+		}
+	}
+	s.writeCapture(w, r, issue.PcapID, indexPath, fmt.Sprintf("issue-%d-evidence", issue.ID), sel)
+}
+
+// writeCapture streams the selected packets of a capture as an attachment
+// named after name, in the capture's own format.
+func (s *Server) writeCapture(w http.ResponseWriter, r *http.Request, pcapID uint, indexPath, name string, sel pcap.PacketSelection) {
+	user, _ := getUser(r.Context())
+	var pcapRecord db.Pcap
+	if err := s.store.DB.Where("id = ? AND user_id = ?", pcapID, user.ID).First(&pcapRecord).Error; err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "pcap not found"})
+		return
+	}
+
+	format, err := pcap.CaptureFormat(pcapRecord.StoragePath)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "capture read error"})
+		return
+	}
+	contentType := "application/vnd.tcpdump.pcap"
+	if format == "pcapng" {
+		contentType = "application/x-pcapng"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+format))
+
+	sel.Filter.Capture = storedCaptureFilter(pcapRecord)
+	// The status is sent with the first bytes, so a failure part way
+	// through can only cut the download short.
+	if _, err := pcap.ExportPackets(r.Context(), pcapRecord.StoragePath, indexPath, w, sel); err != nil {
+		s.logger.Error("packet export failed", "pcap_id", pcapID, "err", err)
+	}
+}
@@ -1,12 +1,14 @@
 package httpapi
 
 import (
+	"errors"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 
+	"netsage/internal/capturefilter"
 	"netsage/internal/db"
-	"netsage/internal/flows"
 	"netsage/internal/pcap"
 )
 
@@ -48,8 +50,97 @@ func (s *Server) handleListPacketsForJob(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
-	query := r.URL.Query()
-	filter := pcap.ParsePacketFilter(query.Get("filter"))
+	filter, err := packetFilterFromQuery(r.URL.Query())
+	if err != nil {
+		writeFilterError(w, err)
+		return
+	}
+	flowIndex, err := s.loadFlowIndex(job.PcapID, user.ID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "flow lookup error"})
+		return
+	}
+
+	filter.Capture = storedCaptureFilter(pcapRecord)
+
+	packets, totalCount, err := pcap.ListPackets(r.Context(), pcapRecord.StoragePath, stringValue(job.IndexPath), limit, offset, filter, flowIndex)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "packet parse error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"packets":     packets,
+		"total_count": totalCount,
+	})
+}
+
+// handleGetPacketForJob decodes one packet of a job's capture into its
+// layers. Payload bytes are only returned when the server exposes them.
+func (s *Server) handleGetPacketForJob(w http.ResponseWriter, r *http.Request) {
+	user, ok := getUser(r.Context())
+	if !ok {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	jobID, err := strconv.Atoi(chiURLParam(r, "id"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		return
+	}
+	index, err := strconv.Atoi(chiURLParam(r, "index"))
+	if err != nil || index < 1 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid packet index"})
+		return
+	}
+
+	var job db.Job
+	if err := s.store.DB.Where("id = ? AND user_id = ?", jobID, user.ID).First(&job).Error; err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+
+	var pcapRecord db.Pcap
+	if err := s.store.DB.Where("id = ? AND user_id = ?", job.PcapID, user.ID).First(&pcapRecord).Error; err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "pcap not found"})
+		return
+	}
+
+	flowIndex, err := s.loadFlowIndex(job.PcapID, user.ID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "flow lookup error"})
+		return
+	}
+
+	payloadBytes := 0
+	if s.cfg.ExposePayload {
+		payloadBytes = s.cfg.PayloadPreviewBytes
+	}
+	detail, err := pcap.PacketDetails(r.Context(), pcapRecord.StoragePath, stringValue(job.IndexPath), storedCaptureFilter(pcapRecord), index, flowIndex, payloadBytes)
+	if errors.Is(err, pcap.ErrPacketNotFound) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "packet not found"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "packet parse error"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, detail)
+}
+
+// packetFilterFromQuery reads a packet filter from the filter expression
+// parameter, the bpf capture filter parameter and the individual field
+// parameters, which are anded with them.
+func packetFilterFromQuery(query url.Values) (pcap.PacketFilter, error) {
+	filter, err := pcap.ParsePacketFilter(query.Get("filter"))
+	if err != nil {
+		return filter, err
+	}
+	if filter.BPF, err = capturefilter.Parse(query.Get("bpf")); err != nil {
+		return filter, err
+	}
 	if srcIP := query.Get("src_ip"); srcIP != "" {
 		filter.SrcIP = srcIP
 	}
@@ -88,42 +179,61 @@ func (s *Server) handleListPacketsForJob(w http.ResponseWriter, r *http.Request)
 	if pair := query.Get("pair"); pair != "" {
 		filter.Pair = pair == "1" || strings.EqualFold(pair, "true")
 	}
+	if ja3 := query.Get("ja3"); ja3 != "" {
+		filter.JA3 = strings.ToLower(ja3)
+	}
+	if ja3s := query.Get("ja3s"); ja3s != "" {
+		filter.JA3S = strings.ToLower(ja3s)
+	}
+	if ja4 := query.Get("ja4"); ja4 != "" {
+		filter.JA4 = strings.ToLower(ja4)
+	}
+	if tunnel := query.Get("tunnel_type"); tunnel != "" {
+		filter.Tunnel = strings.ToLower(tunnel)
+	}
+	if tunnelID := query.Get("tunnel_id"); tunnelID != "" {
+		if parsed, err := strconv.Atoi(tunnelID); err == nil {
+			filter.TunnelID = &parsed
+		}
+	}
+	return filter, nil
+}
 
+// loadFlowIndex indexes the stored flows of a capture so packets can be
+// matched back to them.
+func (s *Server) loadFlowIndex(pcapID, userID uint) (pcap.FlowIndex, error) {
 	var flowRows []db.Flow
-	if err := s.store.DB.Select("id, proto, src_ip, dst_ip, src_port, dst_port, client_ip, client_port, server_ip, server_port, tcp_stream").
-		Where("pcap_id = ? AND user_id = ?", job.PcapID, user.ID).
+	if err := s.store.DB.Select("id, proto, src_ip, dst_ip, src_port, dst_port, client_ip, client_port, server_ip, server_port, tunnel_type, tunnel_id, tcp_stream, ja3, ja3s, ja4, first_seen").
+		Where("pcap_id = ? AND user_id = ?", pcapID, userID).
 		Find(&flowRows).Error; err != nil {
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "flow lookup error"})
-		return
+		return nil, err
 	}
 	flowIndex := make(pcap.FlowIndex, len(flowRows)*2)
 	for _, flow := range flowRows {
-		key := flows.FlowKey{
-			Proto:   flow.Proto,
-			SrcIP:   flow.SrcIP,
-			DstIP:   flow.DstIP,
-			SrcPort: flow.SrcPort,
-			DstPort: flow.DstPort,
-		}
+		key := flowKeyFromRecord(flow)
 		meta := pcap.FlowMeta{
+			Start:      flow.StartTS,
 			StreamID:   flow.TCPStream,
 			ClientIP:   flow.ClientIP,
 			ClientPort: flow.ClientPort,
 			ServerIP:   flow.ServerIP,
 			ServerPort: flow.ServerPort,
+			JA3:        stringValue(flow.JA3),
+			JA3S:       stringValue(flow.JA3S),
+			JA4:        stringValue(flow.JA4),
 		}
-		flowIndex[key] = meta
-		flowIndex[key.Reverse()] = meta
+		flowIndex.Add(key, meta)
 	}
+	return flowIndex, nil
+}
 
-	packets, totalCount, err := pcap.ListPackets(r.Context(), pcapRecord.StoragePath, limit, offset, filter, flowIndex)
-	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "packet parse error"})
-		return
+// captureIndexPath returns the packet index of the latest job that wrote one
+// for a capture, or "" if none did.
+func (s *Server) captureIndexPath(pcapID, userID uint) string {
+	var job db.Job
+	if err := s.store.DB.Where("pcap_id = ? AND user_id = ? AND index_path IS NOT NULL", pcapID, userID).
+		Order("id desc").First(&job).Error; err != nil {
+		return ""
 	}
-
-	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"packets":     packets,
-		"total_count": totalCount,
-	})
+	return stringValue(job.IndexPath)
 }
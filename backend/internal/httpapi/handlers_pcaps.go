@@ -6,10 +6,13 @@ import (
     "os"
     "path/filepath"
     "strconv"
+    "strings"
     "time"
 
+    "netsage/internal/capturefilter"
     "netsage/internal/db"
     "netsage/internal/jobs"
+    "netsage/internal/pcap"
 )
 
 func (s *Server) handleUploadPCAP(w http.ResponseWriter, r *http.Request) {
@@ -27,6 +30,15 @@ func (s *Server) handleUploadPCAP(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    var captureFilter *string
+    if raw := strings.TrimSpace(r.FormValue("capture_filter")); raw != "" {
+        if _, err := capturefilter.Parse(raw); err != nil {
+            writeFilterError(w, err)
+            return
+        }
+        captureFilter = &raw
+    }
+
     file, header, err := r.FormFile("pcap")
     if err != nil {
         writeJSON(w, http.StatusBadRequest, map[string]string{"error": "pcap file required"})
@@ -34,30 +46,35 @@ func (s *Server) handleUploadPCAP(w http.ResponseWriter, r *http.Request) {
     }
     defer file.Close()
 
-    if err := os.MkdirAll(s.cfg.UploadDir, 0o755); err != nil {
-        writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "upload dir error"})
-        return
-    }
-
-    safeName := strconv.FormatInt(time.Now().UnixNano(), 10) + "_" + filepath.Base(header.Filename)
-    storagePath := filepath.Join(s.cfg.UploadDir, safeName)
-
-    out, err := os.Create(storagePath)
+    storagePath, err := s.saveUpload(file, header.Filename)
     if err != nil {
         writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "save failed"})
         return
     }
-    defer out.Close()
 
-    if _, err := io.Copy(out, file); err != nil {
-        writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "save failed"})
-        return
+    var keyLogPath *string
+    if keyLogFile, keyLogHeader, err := r.FormFile("keylog"); err == nil {
+        defer keyLogFile.Close()
+        path, err := s.saveUpload(keyLogFile, keyLogHeader.Filename)
+        if err != nil {
+            writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "save failed"})
+            return
+        }
+        if _, err := pcap.LoadKeyLog(path); err != nil {
+            os.Remove(path)
+            os.Remove(storagePath)
+            writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid keylog"})
+            return
+        }
+        keyLogPath = &path
     }
 
     pcap := db.Pcap{
-        UserID:      user.ID,
-        Filename:    header.Filename,
-        StoragePath: storagePath,
+        UserID:        user.ID,
+        Filename:      header.Filename,
+        StoragePath:   storagePath,
+        KeyLogPath:    keyLogPath,
+        CaptureFilter: captureFilter,
     }
     if err := s.store.DB.Create(&pcap).Error; err != nil {
         writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "db error"})
@@ -76,6 +93,95 @@ func (s *Server) handleUploadPCAP(w http.ResponseWriter, r *http.Request) {
     })
 }
 
+// handleUploadKeyLog attaches an NSS key log to an existing capture and
+// queues a new analysis so the TLS sessions it covers are decrypted.
+func (s *Server) handleUploadKeyLog(w http.ResponseWriter, r *http.Request) {
+    user, ok := getUser(r.Context())
+    if !ok {
+        writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+        return
+    }
+
+    id, err := strconv.Atoi(chiURLParam(r, "id"))
+    if err != nil {
+        writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+        return
+    }
+
+    var pcapRecord db.Pcap
+    if err := s.store.DB.Where("id = ? AND user_id = ?", id, user.ID).First(&pcapRecord).Error; err != nil {
+        writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+        return
+    }
+
+    maxBytes := s.cfg.MaxUploadMB * 1024 * 1024
+    r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+
+    if err := r.ParseMultipartForm(maxBytes); err != nil {
+        writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid multipart"})
+        return
+    }
+
+    file, header, err := r.FormFile("keylog")
+    if err != nil {
+        writeJSON(w, http.StatusBadRequest, map[string]string{"error": "keylog file required"})
+        return
+    }
+    defer file.Close()
+
+    keyLogPath, err := s.saveUpload(file, header.Filename)
+    if err != nil {
+        writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "save failed"})
+        return
+    }
+    if _, err := pcap.LoadKeyLog(keyLogPath); err != nil {
+        os.Remove(keyLogPath)
+        writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid keylog"})
+        return
+    }
+
+    previous := pcapRecord.KeyLogPath
+    if err := s.store.DB.Model(&pcapRecord).Update("keylog_path", keyLogPath).Error; err != nil {
+        os.Remove(keyLogPath)
+        writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "db error"})
+        return
+    }
+    if previous != nil && *previous != keyLogPath {
+        os.Remove(*previous)
+    }
+
+    job, err := jobs.Enqueue(r.Context(), s.store.DB, user.ID, pcapRecord.ID)
+    if err != nil {
+        writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "job enqueue failed"})
+        return
+    }
+
+    writeJSON(w, http.StatusOK, map[string]interface{}{
+        "pcap_id": pcapRecord.ID,
+        "job_id":  job.ID,
+    })
+}
+
+func (s *Server) saveUpload(src io.Reader, filename string) (string, error) {
+    if err := os.MkdirAll(s.cfg.UploadDir, 0o755); err != nil {
+        return "", err
+    }
+
+    safeName := strconv.FormatInt(time.Now().UnixNano(), 10) + "_" + filepath.Base(filename)
+    storagePath := filepath.Join(s.cfg.UploadDir, safeName)
+
+    out, err := os.Create(storagePath)
+    if err != nil {
+        return "", err
+    }
+    defer out.Close()
+
+    if _, err := io.Copy(out, src); err != nil {
+        return "", err
+    }
+    return storagePath, nil
+}
+
 func (s *Server) handleListPCAPs(w http.ResponseWriter, r *http.Request) {
     user, ok := getUser(r.Context())
     if !ok {
@@ -146,6 +252,22 @@ func (s *Server) handleDeletePCAP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if pcap.KeyLogPath != nil {
+		if err := os.Remove(*pcap.KeyLogPath); err != nil && !os.IsNotExist(err) {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "delete file failed"})
+			return
+		}
+	}
+
+	var indexPaths []string
+	s.store.DB.Model(&db.Job{}).Where("pcap_id = ? AND index_path IS NOT NULL", pcap.ID).Pluck("index_path", &indexPaths)
+	for _, path := range indexPaths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "delete file failed"})
+			return
+		}
+	}
+
 	if err := s.store.DB.Delete(&pcap).Error; err != nil {
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "db error"})
 		return
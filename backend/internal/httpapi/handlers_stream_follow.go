@@ -0,0 +1,121 @@
+package httpapi
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"netsage/internal/db"
+	"netsage/internal/pcap"
+)
+
+// handleFollowStream returns the application data of one TCP stream of a
+// job, chunk by chunk in each direction.
+func (s *Server) handleFollowStream(w http.ResponseWriter, r *http.Request) {
+	user, ok := getUser(r.Context())
+	if !ok {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	jobID, err := strconv.Atoi(chiURLParam(r, "id"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		return
+	}
+	stream, err := strconv.Atoi(chiURLParam(r, "stream"))
+	if err != nil || stream < 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid stream"})
+		return
+	}
+
+	var job db.Job
+	if err := s.store.DB.Where("id = ? AND user_id = ?", jobID, user.ID).First(&job).Error; err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+
+	flowIndex, err := s.loadFlowIndex(job.PcapID, user.ID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "flow lookup error"})
+		return
+	}
+
+	sel := pcap.PacketSelection{Filter: pcap.PacketFilter{StreamID: &stream}, FlowIndex: flowIndex}
+	s.writeFollow(w, r, job.PcapID, stringValue(job.IndexPath), sel)
+}
+
+// handleFollowFlow is handleFollowStream for one stored flow, which may be
+// UDP.
+func (s *Server) handleFollowFlow(w http.ResponseWriter, r *http.Request) {
+	user, ok := getUser(r.Context())
+	if !ok {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	flowID, err := strconv.Atoi(chiURLParam(r, "id"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid id"})
+		return
+	}
+
+	var flow db.Flow
+	if err := s.store.DB.Where("id = ? AND user_id = ?", flowID, user.ID).First(&flow).Error; err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+
+	flowIndex, err := s.loadFlowIndex(flow.PcapID, user.ID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "flow lookup error"})
+		return
+	}
+
+	sel := pcap.PacketSelection{
+		FlowIndex: flowIndex,
+		Flows:     []pcap.FlowRange{{Key: flowKeyFromRecord(flow), Start: flow.StartTS}},
+	}
+	s.writeFollow(w, r, flow.PcapID, s.captureIndexPath(flow.PcapID, user.ID), sel)
+}
+
+// writeFollow follows the packets sel selects in a capture, paged by the
+// limit and offset parameters. Text previews are only included when the
+// server exposes payload.
+func (s *Server) writeFollow(w http.ResponseWriter, r *http.Request, pcapID uint, indexPath string, sel pcap.PacketSelection) {
+	user, _ := getUser(r.Context())
+	var pcapRecord db.Pcap
+	if err := s.store.DB.Where("id = ? AND user_id = ?", pcapID, user.ID).First(&pcapRecord).Error; err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "pcap not found"})
+		return
+	}
+
+	limit := 1000
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 10000 {
+			limit = parsed
+		}
+	}
+	offset := 0
+	if o := r.URL.Query().Get("offset"); o != "" {
+		if parsed, err := strconv.Atoi(o); err == nil && parsed >= 0 {
+			offset = parsed
+		}
+	}
+	previewBytes := 0
+	if s.cfg.ExposePayload {
+		previewBytes = s.cfg.PayloadPreviewBytes
+	}
+
+	sel.Filter.Capture = storedCaptureFilter(pcapRecord)
+	follow, err := pcap.FollowStream(r.Context(), pcapRecord.StoragePath, indexPath, sel, limit, offset, previewBytes)
+	if errors.Is(err, pcap.ErrStreamNotFound) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "stream not found"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "packet parse error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, follow)
+}
@@ -71,17 +71,26 @@ func (s *Server) Routes() http.Handler {
 			r.Get("/pcaps", s.handleListPCAPs)
 			r.Get("/pcaps/{id}", s.handleGetPCAP)
 			r.Delete("/pcaps/{id}", s.handleDeletePCAP)
+			r.Post("/pcaps/{id}/keylog", s.handleUploadKeyLog)
 			r.Get("/pcaps/{id}/jobs", s.handleListJobsForPCAP)
 			r.Get("/jobs/{id}", s.handleGetJob)
 			r.Get("/jobs/{id}/summary", s.handleGetJobSummary)
 			r.Get("/pcaps/{id}/flows", s.handleListFlows)
 			r.Get("/jobs/{id}/flows", s.handleListFlowsForJob)
 			r.Get("/jobs/{id}/packets", s.handleListPacketsForJob)
+			r.Get("/jobs/{id}/packets/pcap", s.handleExportPacketsForJob)
+			r.Get("/jobs/{id}/packets/{index}", s.handleGetPacketForJob)
+			r.Get("/jobs/{id}/streams/{stream}/pcap", s.handleExportStream)
+			r.Get("/jobs/{id}/streams/{stream}/follow", s.handleFollowStream)
+			r.Get("/jobs/{id}/http", s.handleListHTTPForJob)
 			r.Get("/flows/{id}", s.handleGetFlow)
 			r.Get("/flows/{id}/timeseries", s.handleGetFlowTimeseries)
+			r.Get("/flows/{id}/pcap", s.handleExportFlow)
+			r.Get("/flows/{id}/follow", s.handleFollowFlow)
 			r.Get("/pcaps/{id}/issues", s.handleListIssues)
 			r.Get("/jobs/{id}/issues", s.handleListIssuesForJob)
 			r.Get("/issues/{id}", s.handleGetIssue)
+			r.Get("/issues/{id}/pcap", s.handleExportIssueEvidence)
 			r.Get("/pcaps/{id}/stats", s.handleGetStats)
 			r.Get("/pcaps/{id}/summary", s.handleGetSummary)
 			r.Post("/issues/{id}/explain", s.handleExplainIssue)
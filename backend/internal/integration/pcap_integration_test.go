@@ -13,6 +13,7 @@ import (
 
     "netsage/internal/analysis"
     "netsage/internal/db"
+    "netsage/internal/pcap"
     "netsage/internal/pcap/testutil"
 
     _ "github.com/jackc/pgx/v5/stdlib"
@@ -67,7 +68,7 @@ func TestPcapJobEndToEnd(t *testing.T) {
         t.Fatalf("create job: %v", err)
     }
 
-    if err := analysis.ProcessJob(context.Background(), store.DB, job, pcapRecord, user, nil); err != nil {
+    if err := analysis.ProcessJob(context.Background(), store.DB, job, pcapRecord, user, pcap.Options{}, nil); err != nil {
         t.Fatalf("process job: %v", err)
     }
 
@@ -1,16 +1,18 @@
 package pcap
 
 import (
-	"bufio"
 	"context"
+	"encoding/binary"
+	"fmt"
 	"io"
 	"os"
+	"time"
 
+	"netsage/internal/capturefilter"
 	"netsage/internal/flows"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcapgo"
 )
 
 type Result struct {
@@ -18,11 +20,81 @@ type Result struct {
 	RTTHistogram   *flows.Histogram
 	PacketCount    int64
 	BytesProcessed int64
+	// Indexed is set when the packet index was written to
+	// Options.IndexPath.
+	Indexed bool
 }
 
 type ProgressFunc func(bytesRead, totalBytes int64)
 
-func AnalyzeFile(ctx context.Context, path string, onProgress ProgressFunc) (*Result, error) {
+const (
+	// expirySweepPackets is how often, in packets, the flow table is swept
+	// for flows to finalize early.
+	expirySweepPackets = 4096
+	// flowBatchSize is the most flows handed to Options.OnFlows at once.
+	flowBatchSize = 1000
+)
+
+type Options struct {
+	// KeyLogPath names an NSS key log (SSLKEYLOGFILE) used to decrypt TLS
+	// sessions in memory. Decrypted payload is never stored.
+	KeyLogPath string
+	// TCPIdleTimeout and UDPIdleTimeout start a new flow on a 5-tuple that
+	// was idle for longer: with any packet for UDP, with a SYN for TCP, as
+	// other segments carry the connection on. Zero keeps the 5-tuple on one
+	// flow however long it is idle.
+	TCPIdleTimeout time.Duration
+	UDPIdleTimeout time.Duration
+	// OnFlows receives finalized flows in batches while the capture is
+	// read, so flows do not have to be held until it ends. When it is set,
+	// every flow is passed to it and Result.Flows is left empty; the slice
+	// is not reused after the call.
+	OnFlows func([]*flows.FlowAgg) error
+	// OnForget receives, after flows are handed to OnFlows, the keys of
+	// flows handed off whose connections no later flow will carry on, so
+	// what was kept to store the later parts with them can be dropped.
+	OnForget func([]flows.FlowKey)
+	// FlowExpiry finalizes a flow once no packet has been seen on it for
+	// this long in capture time. Zero only expires closed TCP connections
+	// and flows evicted for the memory budget. Used with OnFlows. A
+	// connection seen again after its flow was finalized early is carried
+	// on in a flow with the same key and ContinuedFrom set.
+	FlowExpiry time.Duration
+	// MemoryBudget bounds the estimated bytes held by flows still open and
+	// by what is kept of flows finalized early to carry their connections
+	// on; past it the flows seen least recently are finalized early, unless
+	// seen within their idle timeout or, without one, a minute. Zero means
+	// no bound. Used with OnFlows.
+	MemoryBudget int64
+	// Workers is how many goroutines decode packets and how many shards
+	// flows are split over. One or less analyzes on the calling goroutine;
+	// the result is the same either way.
+	Workers int
+	// IndexPath, when set, is where a packet index of the capture is
+	// written for ListPackets and the timeseries to read instead of the
+	// capture. It is only written if the whole capture is analyzed, and not
+	// for gzip captures, where packets cannot be read in place.
+	IndexPath string
+	// CaptureFilter is a capture filter, as described in package
+	// capturefilter. Frames that do not pass it are skipped before they
+	// are decoded, so neither flows nor the packet index hold them.
+	CaptureFilter string
+}
+
+func AnalyzeFile(ctx context.Context, path string, opts Options, onProgress ProgressFunc) (*Result, error) {
+	var keyLog *KeyLog
+	if opts.KeyLogPath != "" {
+		loaded, err := LoadKeyLog(opts.KeyLogPath)
+		if err != nil {
+			return nil, err
+		}
+		keyLog = loaded
+	}
+	capture, err := capturefilter.Parse(opts.CaptureFilter)
+	if err != nil {
+		return nil, fmt.Errorf("capture filter: %w", err)
+	}
+
 	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -35,95 +107,58 @@ func AnalyzeFile(ctx context.Context, path string, onProgress ProgressFunc) (*Re
 	}
 
 	progress := &progressReader{r: file}
-	buffered := bufio.NewReader(progress)
-	magic, err := buffered.Peek(4)
+	source, err := newInterfaceSource(progress)
 	if err != nil {
 		return nil, err
 	}
-
-	var packetSource *gopacket.PacketSource
-	if isPcapngMagic(magic) {
-		ngReader, err := pcapgo.NewNgReader(buffered, pcapgo.DefaultNgReaderOptions)
-		if err != nil {
-			return nil, err
-		}
-		packetSource = gopacket.NewPacketSource(ngReader, ngReader.LinkType())
-	} else {
-		reader, err := pcapgo.NewReader(buffered)
-		if err != nil {
-			return nil, err
-		}
-		packetSource = gopacket.NewPacketSource(reader, reader.LinkType())
-	}
+	source.filter = newFrameFilter(capture)
 
 	result := &Result{
 		Flows:        make(map[flows.FlowKey]*flows.FlowAgg),
 		RTTHistogram: flows.NewRTTHistogram(),
 	}
 
-	packetsSinceUpdate := int64(0)
-
-	for packet := range packetSource.Packets() {
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		default:
-		}
-
-		if packet == nil {
-			continue
-		}
-
-		pktInfo, ok := parsePacket(packet)
-		if !ok {
-			continue
-		}
-
-		key := flows.FlowKey{
-			Proto:   pktInfo.Proto,
-			SrcIP:   pktInfo.SrcIP,
-			DstIP:   pktInfo.DstIP,
-			SrcPort: pktInfo.SrcPort,
-			DstPort: pktInfo.DstPort,
-		}
-		rev := key.Reverse()
-
-		flow, forward := result.Flows[key], true
-		if flow == nil {
-			if revFlow, ok := result.Flows[rev]; ok {
-				flow = revFlow
-				forward = false
-			} else {
-				flow = flows.NewFlowAgg(key, pktInfo.Timestamp)
-				result.Flows[key] = flow
-			}
+	run := newAnalysis(result, keyLog, opts)
+	if onProgress != nil {
+		run.onProgress = func(bytesRead int64) {
+			onProgress(bytesRead, stat.Size())
 		}
-
-		flow.Update(pktInfo, forward)
-
-		result.PacketCount++
-		packetsSinceUpdate++
-
-		if packetsSinceUpdate%1000 == 0 && onProgress != nil {
-			onProgress(progress.bytesRead, stat.Size())
+	}
+	if opts.IndexPath != "" && !source.compressed {
+		index, err := createPacketIndex(opts.IndexPath)
+		if err != nil {
+			return nil, err
 		}
+		run.index, run.file = index, file
 	}
-
-	result.BytesProcessed = progress.bytesRead
-	if onProgress != nil {
-		onProgress(progress.bytesRead, stat.Size())
+	bytesRead := func() int64 { return progress.bytesRead }
+	if err := run.run(ctx, source, bytesRead); err != nil {
+		if run.index != nil {
+			run.index.abort()
+		}
+		return nil, err
 	}
-
-	for _, flow := range result.Flows {
-		flow.Finalize()
-		if flow.RTTMs != nil {
-			result.RTTHistogram.Add(*flow.RTTMs)
+	if run.index != nil {
+		if err := run.index.close(); err != nil {
+			return nil, err
 		}
+		result.Indexed = true
 	}
 
 	return result, nil
 }
 
+func packetKey(info flows.PacketInfo) flows.FlowKey {
+	return flows.FlowKey{
+		Proto:   info.Proto,
+		SrcIP:   info.SrcIP,
+		DstIP:   info.DstIP,
+		SrcPort: info.SrcPort,
+		DstPort: info.DstPort,
+		Tunnel:  info.Tunnel,
+	}
+}
+
 type progressReader struct {
 	r         io.Reader
 	bytesRead int64
@@ -140,47 +175,47 @@ func isPcapngMagic(magic []byte) bool {
 }
 
 func parsePacket(packet gopacket.Packet) (flows.PacketInfo, bool) {
-	info := flows.PacketInfo{}
 	if packet.NetworkLayer() == nil {
-		return info, false
+		return flows.PacketInfo{}, false
 	}
+	return parseLayers(packetBase(packet), packet.Layers())
+}
 
-	ts := packet.Metadata().Timestamp
-	info.Timestamp = ts
-	if packet.Metadata() != nil {
-		info.Length = packet.Metadata().CaptureLength
+// packetBase holds what a packet contributes besides its layers: capture
+// time, captured length and interface.
+func packetBase(packet gopacket.Packet) flows.PacketInfo {
+	info := flows.PacketInfo{Interface: packetInterface(packet)}
+	if meta := packet.Metadata(); meta != nil {
+		info.Timestamp = meta.Timestamp
+		info.Length = meta.CaptureLength
 	} else {
 		info.Length = len(packet.Data())
 	}
+	return info
+}
 
-	var srcIP, dstIP string
-	isFragment := false
-
-	if ip4Layer := packet.Layer(layers.LayerTypeIPv4); ip4Layer != nil {
-		ip4 := ip4Layer.(*layers.IPv4)
-		srcIP = ip4.SrcIP.String()
-		dstIP = ip4.DstIP.String()
-		if ip4.Flags&layers.IPv4MoreFragments != 0 || ip4.FragOffset > 0 {
-			isFragment = true
-		}
-	} else if ip6Layer := packet.Layer(layers.LayerTypeIPv6); ip6Layer != nil {
-		ip6 := ip6Layer.(*layers.IPv6)
-		srcIP = ip6.SrcIP.String()
-		dstIP = ip6.DstIP.String()
-	} else {
+// parseLayers decodes one IP datagram from its layers on top of base.
+func parseLayers(info flows.PacketInfo, ls []gopacket.Layer) (flows.PacketInfo, bool) {
+	inner := decapsulate(ls)
+	switch ip := inner.network.(type) {
+	case *layers.IPv4:
+		info.SrcIP = ip.SrcIP.String()
+		info.DstIP = ip.DstIP.String()
+		info.IsFragment = ip.Flags&layers.IPv4MoreFragments != 0 || ip.FragOffset > 0
+	case *layers.IPv6:
+		info.SrcIP = ip.SrcIP.String()
+		info.DstIP = ip.DstIP.String()
+	default:
 		return info, false
 	}
+	info.Tunnel = inner.tunnel
 
-	info.SrcIP = srcIP
-	info.DstIP = dstIP
-	info.IsFragment = isFragment
-
-	if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-		tcp := tcpLayer.(*layers.TCP)
+	if tcp, ok := inner.transport.(*layers.TCP); ok {
 		info.Proto = "TCP"
 		info.SrcPort = int(tcp.SrcPort)
 		info.DstPort = int(tcp.DstPort)
 		info.PayloadLen = len(tcp.Payload)
+		info.Payload = tcp.Payload
 		info.Seq = tcp.Seq
 		info.Ack = tcp.Ack
 		info.Window = tcp.Window
@@ -193,51 +228,120 @@ func parsePacket(packet gopacket.Packet) (flows.PacketInfo, bool) {
 			URG: tcp.URG,
 		}
 
-		if tcp.SYN {
-			for _, opt := range tcp.Options {
-				if opt.OptionType == layers.TCPOptionKindMSS && len(opt.OptionData) == 2 {
-					mss := int(opt.OptionData[0])<<8 | int(opt.OptionData[1])
-					info.MSS = &mss
-				}
-			}
-		}
+		parseTCPOptions(&info, tcp)
 
-		if len(tcp.Payload) > 0 {
-			sni, version, alpn, clientHello, serverHello, alert, alertCode := parseTLS(tcp.Payload)
-			info.TLSSNI = sni
-			info.TLSVersion = version
-			info.ALPN = alpn
-			info.TLSClientHello = clientHello
-			info.TLSServerHello = serverHello
-			info.TLSAlert = alert
-			info.TLSAlertCode = alertCode
-
-			method, host := parseHTTP(tcp.Payload)
-			info.HTTPMethod = method
-			info.HTTPHost = host
+		// TLS and HTTP are parsed from the reassembled stream, not here.
+		if len(tcp.Payload) > 0 && isDNSPort(info.SrcPort, info.DstPort) {
+			info.DNS = parseDNS(tcp.Payload, true)
 		}
 
 		return info, true
 	}
 
-	if udpLayer := packet.Layer(layers.LayerTypeUDP); udpLayer != nil {
-		udp := udpLayer.(*layers.UDP)
+	if udp, ok := inner.transport.(*layers.UDP); ok {
 		info.Proto = "UDP"
 		info.SrcPort = int(udp.SrcPort)
 		info.DstPort = int(udp.DstPort)
 		info.PayloadLen = len(udp.Payload)
+		info.Payload = udp.Payload
+		if len(udp.Payload) > 0 && isDNSPort(info.SrcPort, info.DstPort) {
+			info.DNS = parseDNS(udp.Payload, false)
+		}
+		if len(udp.Payload) > 0 && isQUICPort(info.SrcPort, info.DstPort) {
+			parseQUIC(udp.Payload).apply(&info)
+		}
 		return info, true
 	}
 
+	if icmpLayer, ok := inner.transport.(*layers.ICMPv4); ok {
+		info.Proto = "ICMP"
+		info.PayloadLen = len(icmpLayer.LayerPayload())
+		info.ICMP = parseICMP(layerBytes(icmpLayer), false)
+		return info, info.ICMP != nil
+	}
+
+	if icmpLayer, ok := inner.transport.(*layers.ICMPv6); ok {
+		info.Proto = "ICMPv6"
+		info.PayloadLen = len(icmpLayer.LayerPayload())
+		info.ICMP = parseICMP(layerBytes(icmpLayer), true)
+		return info, info.ICMP != nil
+	}
+
 	return info, false
 }
 
-func parseTLS(payload []byte) (*string, *string, *string, bool, bool, bool, *int) {
+// parseTCPOptions decodes the options that matter for loss and window
+// analysis. MSS, window scale and SACK-permitted only count on a SYN.
+func parseTCPOptions(info *flows.PacketInfo, tcp *layers.TCP) {
+	for _, opt := range tcp.Options {
+		data := opt.OptionData
+		switch opt.OptionType {
+		case layers.TCPOptionKindMSS:
+			if tcp.SYN && len(data) == 2 {
+				mss := int(binary.BigEndian.Uint16(data))
+				info.MSS = &mss
+			}
+		case layers.TCPOptionKindWindowScale:
+			if tcp.SYN && len(data) == 1 {
+				shift := int(data[0])
+				info.WindowScale = &shift
+			}
+		case layers.TCPOptionKindSACKPermitted:
+			info.SACKPermitted = tcp.SYN
+		case layers.TCPOptionKindSACK:
+			for len(data) >= 8 {
+				info.SACKBlocks = append(info.SACKBlocks, flows.SACKBlock{
+					Left:  binary.BigEndian.Uint32(data[0:4]),
+					Right: binary.BigEndian.Uint32(data[4:8]),
+				})
+				data = data[8:]
+			}
+		case layers.TCPOptionKindTimestamps:
+			if len(data) == 8 {
+				info.TCPTimestamp = &flows.TCPTimestamp{
+					Val: binary.BigEndian.Uint32(data[0:4]),
+					Ecr: binary.BigEndian.Uint32(data[4:8]),
+				}
+			}
+		}
+	}
+}
+
+func parseTLS(payload []byte) tlsResult {
 	info := tlsInfo{payload: payload}
 	return info.Parse()
 }
 
-func parseHTTP(payload []byte) (*string, *string) {
-	info := httpInfo{payload: payload}
+func parseDNS(payload []byte, tcp bool) []flows.DNSMessage {
+	info := dnsInfo{payload: payload, tcp: tcp}
 	return info.Parse()
 }
+
+func parseQUIC(payload []byte) quicResult {
+	info := quicInfo{payload: payload}
+	return info.Parse()
+}
+
+func layerBytes(layer gopacket.Layer) []byte {
+	data := make([]byte, 0, len(layer.LayerContents())+len(layer.LayerPayload()))
+	data = append(data, layer.LayerContents()...)
+	return append(data, layer.LayerPayload()...)
+}
+
+func parseICMP(payload []byte, v6 bool) *flows.ICMPMessage {
+	info := icmpInfo{payload: payload, v6: v6}
+	return info.Parse()
+}
+
+func isDNSPort(srcPort, dstPort int) bool {
+	return srcPort == dnsPort || dstPort == dnsPort
+}
+
+func isQUICPort(srcPort, dstPort int) bool {
+	for _, port := range quicPorts {
+		if srcPort == port || dstPort == port {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,281 @@
+package pcap
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"netsage/internal/flows"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestParseTCPOptions(t *testing.T) {
+	mac := net.HardwareAddr{0x00, 0x0c, 0x29, 0xaa, 0xbb, 0xcc}
+	frame := func(tcp *layers.TCP) gopacket.Packet {
+		data := serializeLayers(t,
+			&layers.Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: layers.EthernetTypeIPv4},
+			&layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}},
+			tcp,
+		)
+		return gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.Default)
+	}
+
+	syn, ok := parsePacket(frame(&layers.TCP{SrcPort: 40000, DstPort: 443, SYN: true, Window: 64240, Options: []layers.TCPOption{
+		{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xb4}},
+		{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2},
+		{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: []byte{0, 0, 0, 1, 0, 0, 0, 0}},
+		{OptionType: layers.TCPOptionKindNop},
+		{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{7}},
+	}}))
+	if !ok || syn.MSS == nil || *syn.MSS != 1460 || syn.WindowScale == nil || *syn.WindowScale != 7 || !syn.SACKPermitted {
+		t.Fatalf("unexpected SYN options %+v", syn)
+	}
+	if syn.TCPTimestamp == nil || syn.TCPTimestamp.Val != 1 {
+		t.Fatalf("expected timestamps option, got %v", syn.TCPTimestamp)
+	}
+
+	ack, ok := parsePacket(frame(&layers.TCP{SrcPort: 40000, DstPort: 443, ACK: true, Ack: 1000, Window: 100, Options: []layers.TCPOption{
+		{OptionType: layers.TCPOptionKindNop},
+		{OptionType: layers.TCPOptionKindNop},
+		{OptionType: layers.TCPOptionKindSACK, OptionLength: 18, OptionData: []byte{0, 0, 0x07, 0xd0, 0, 0, 0x0b, 0xb8, 0, 0, 0x0f, 0xa0, 0, 0, 0x13, 0x88}},
+	}}))
+	want := []flows.SACKBlock{{Left: 2000, Right: 3000}, {Left: 4000, Right: 5000}}
+	if !ok || ack.MSS != nil || len(ack.SACKBlocks) != 2 || ack.SACKBlocks[0] != want[0] || ack.SACKBlocks[1] != want[1] {
+		t.Fatalf("unexpected SACK blocks %+v", ack.SACKBlocks)
+	}
+}
+
+// writeShortFlows writes a capture of n short TCP connections, one starting
+// every millisecond, each a handshake, one request and a FIN exchange.
+func writeShortFlows(tb testing.TB, path string, n int) {
+	tb.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		tb.Fatalf("create: %v", err)
+	}
+	defer file.Close()
+	writer := pcapgo.NewWriter(file)
+	if err := writer.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		tb.Fatalf("header: %v", err)
+	}
+
+	mac := net.HardwareAddr{0x00, 0x0c, 0x29, 0xaa, 0xbb, 0xcc}
+	server := net.IP{10, 1, 0, 1}
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	payload := gopacket.Payload("GET / HTTP/1.1\r\n\r\n")
+	for i := 0; i < n; i++ {
+		client := net.IP{10, byte(i >> 16), byte(i >> 8), byte(i)}
+		clientPort := layers.TCPPort(10000 + i%50000)
+		at := start.Add(time.Duration(i) * time.Millisecond)
+		segments := []struct {
+			out  bool
+			tcp  layers.TCP
+			data bool
+		}{
+			{true, layers.TCP{SYN: true, Seq: 100}, false},
+			{false, layers.TCP{SYN: true, ACK: true, Seq: 900, Ack: 101}, false},
+			{true, layers.TCP{ACK: true, PSH: true, Seq: 101, Ack: 901}, true},
+			{true, layers.TCP{FIN: true, ACK: true, Seq: 101 + uint32(len(payload)), Ack: 901}, false},
+			{false, layers.TCP{FIN: true, ACK: true, Seq: 901, Ack: 102 + uint32(len(payload))}, false},
+			{true, layers.TCP{ACK: true, Seq: 102 + uint32(len(payload)), Ack: 902}, false},
+		}
+		for j, seg := range segments {
+			tcp := seg.tcp
+			ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: client, DstIP: server}
+			tcp.SrcPort, tcp.DstPort, tcp.Window = clientPort, 80, 64240
+			if !seg.out {
+				ip.SrcIP, ip.DstIP = server, client
+				tcp.SrcPort, tcp.DstPort = 80, clientPort
+			}
+			layersOut := []gopacket.SerializableLayer{&layers.Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: layers.EthernetTypeIPv4}, ip, &tcp}
+			if seg.data {
+				layersOut = append(layersOut, payload)
+			}
+			frame := serializeLayers(tb, layersOut...)
+			ts := at.Add(time.Duration(j) * 100 * time.Microsecond)
+			if err := writer.WritePacket(gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(frame), Length: len(frame)}, frame); err != nil {
+				tb.Fatalf("write packet: %v", err)
+			}
+		}
+	}
+}
+
+func TestAnalyzeFileHandsOffFlowsInBatches(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "short-flows.pcap")
+	const count = 3000
+	writeShortFlows(t, path, count)
+
+	seen := make(map[flows.FlowKey]bool)
+	streams := make(map[int]bool)
+	batches := 0
+	opts := Options{FlowExpiry: time.Second, OnFlows: func(batch []*flows.FlowAgg) error {
+		batches++
+		for _, flow := range batch {
+			if seen[flow.Key] {
+				t.Fatalf("flow %+v handed off twice", flow.Key)
+			}
+			seen[flow.Key] = true
+			if flow.TCPStreamID == nil || streams[*flow.TCPStreamID] {
+				t.Fatalf("expected a distinct tcp stream, got %v", flow.TCPStreamID)
+			}
+			streams[*flow.TCPStreamID] = true
+			if flow.TCPState == nil || *flow.TCPState != flows.TCPStateClosed {
+				t.Fatalf("expected a finalized closed flow, got %v", flow.TCPState)
+			}
+		}
+		return nil
+	}}
+	result, err := AnalyzeFile(context.Background(), path, opts, nil)
+	if err != nil {
+		t.Fatalf("analyze: %v", err)
+	}
+	if len(seen) != count || len(result.Flows) != 0 {
+		t.Fatalf("expected %d flows handed off and none kept, got %d and %d", count, len(seen), len(result.Flows))
+	}
+	if batches < 3 {
+		t.Fatalf("expected flows to be handed off during the scan, got %d batches", batches)
+	}
+}
+
+// A connection expired while idle and then resumed is carried on under the
+// same key and stream, and the packet index files both parts under its start.
+func TestAnalyzeFileContinuesExpiredConnection(t *testing.T) {
+	mac := net.HardwareAddr{0x00, 0x0c, 0x29, 0xaa, 0xbb, 0xcc}
+	client, server := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+	segment := func(out bool, tcp layers.TCP, payload int) []byte {
+		ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: client, DstIP: server}
+		tcp.SrcPort, tcp.DstPort, tcp.Window = 40000, 443, 64240
+		if !out {
+			ip.SrcIP, ip.DstIP = server, client
+			tcp.SrcPort, tcp.DstPort = 443, 40000
+		}
+		eth := &layers.Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: layers.EthernetTypeIPv4}
+		return serializeLayers(t, eth, ip, &tcp, gopacket.Payload(make([]byte, payload)))
+	}
+	frames := [][]byte{
+		segment(true, layers.TCP{SYN: true, Seq: 100}, 0),
+		segment(false, layers.TCP{SYN: true, ACK: true, Seq: 900, Ack: 101}, 0),
+		segment(true, layers.TCP{ACK: true, Seq: 101, Ack: 901}, 100),
+	}
+	// Frames are a millisecond apart, so the connection sits idle for over
+	// a second, past the expiry, while a sweep runs.
+	for i := 0; i < expirySweepPackets; i++ {
+		ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IP{10, 0, 0, 3}, DstIP: server}
+		udp := &layers.UDP{SrcPort: 5000, DstPort: 5001}
+		udp.SetNetworkLayerForChecksum(ip)
+		eth := &layers.Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: layers.EthernetTypeIPv4}
+		frames = append(frames, serializeLayers(t, eth, ip, udp, gopacket.Payload("filler")))
+	}
+	frames = append(frames,
+		segment(false, layers.TCP{ACK: true, Seq: 901, Ack: 201}, 100),
+		segment(true, layers.TCP{FIN: true, ACK: true, Seq: 201, Ack: 1001}, 0),
+		segment(false, layers.TCP{FIN: true, ACK: true, Seq: 1001, Ack: 202}, 0),
+		segment(true, layers.TCP{ACK: true, Seq: 202, Ack: 1002}, 0),
+	)
+	path := filepath.Join(t.TempDir(), "resumed.pcap")
+	writeEthernetFrames(t, path, frames)
+
+	var parts []*flows.FlowAgg
+	opts := Options{FlowExpiry: time.Second, IndexPath: filepath.Join(t.TempDir(), "resumed.idx"), OnFlows: func(batch []*flows.FlowAgg) error {
+		for _, flow := range batch {
+			if flow.Key.Proto == "TCP" {
+				parts = append(parts, flow)
+			}
+		}
+		return nil
+	}}
+	if _, err := AnalyzeFile(context.Background(), path, opts, nil); err != nil {
+		t.Fatalf("analyze: %v", err)
+	}
+	if len(parts) != 2 {
+		t.Fatalf("expected the connection to be handed off in two parts, got %d", len(parts))
+	}
+	first, second := parts[0], parts[1]
+	if second.Key != first.Key || *second.TCPStreamID != *first.TCPStreamID {
+		t.Fatalf("expected one key and stream, got %+v stream %d and %+v stream %d", first.Key, *first.TCPStreamID, second.Key, *second.TCPStreamID)
+	}
+	if second.ContinuedFrom == nil || !second.ContinuedFrom.Equal(first.FirstSeen) {
+		t.Fatalf("expected the second part to continue the first, got %v", second.ContinuedFrom)
+	}
+	if second.TCPState == nil || *second.TCPState != flows.TCPStateClosed || second.Handshake == nil || *second.Handshake != flows.HandshakeCompleted || second.MidConnection {
+		t.Fatalf("expected the lifecycle to carry on, got state %v handshake %v", second.TCPState, second.Handshake)
+	}
+	if clientIP, _, _, _ := second.ClientServer(); clientIP != client.String() {
+		t.Fatalf("expected the client to carry on, got %s", clientIP)
+	}
+
+	index, err := openPacketIndex(opts.IndexPath)
+	if err != nil {
+		t.Fatalf("open index: %v", err)
+	}
+	defer index.close()
+	tcpPackets := 0
+	for {
+		p, err := index.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read index: %v", err)
+		}
+		if p.flow == nil || p.flow.key.Proto != "TCP" {
+			continue
+		}
+		tcpPackets++
+		if !p.flow.start.Equal(first.FirstSeen) || *p.flow.stream != *first.TCPStreamID {
+			t.Fatalf("expected frame %d filed under the connection's start, got %v", p.frame, p.flow.start)
+		}
+	}
+	if tcpPackets != 7 {
+		t.Fatalf("expected 7 indexed TCP packets, got %d", tcpPackets)
+	}
+}
+
+// BenchmarkAnalyzeManyFlows analyzes captures of short connections with flow
+// expiry and a memory budget. The live heap, sampled as each batch is handed
+// off, should stay about the same whatever the number of flows, so the
+// benchmark fails when the larger capture peaks a quarter higher.
+func BenchmarkAnalyzeManyFlows(b *testing.B) {
+	counts := []int{20000, 100000}
+	peaks := make(map[int]uint64)
+	for _, count := range counts {
+		b.Run(fmt.Sprintf("flows=%d", count), func(b *testing.B) {
+			path := filepath.Join(b.TempDir(), "short-flows.pcap")
+			writeShortFlows(b, path, count)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				var peak uint64
+				var stats runtime.MemStats
+				opts := Options{
+					FlowExpiry:   5 * time.Second,
+					MemoryBudget: 8 << 20,
+					OnFlows: func(batch []*flows.FlowAgg) error {
+						runtime.GC()
+						runtime.ReadMemStats(&stats)
+						peak = max(peak, stats.HeapAlloc)
+						return nil
+					},
+				}
+				if _, err := AnalyzeFile(context.Background(), path, opts, nil); err != nil {
+					b.Fatalf("analyze: %v", err)
+				}
+				b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+				peaks[count] = max(peaks[count], peak)
+			}
+		})
+	}
+	small, large := peaks[counts[0]], peaks[counts[1]]
+	if small > 0 && large > small/4*5 {
+		b.Fatalf("expected the peak heap to stay flat, got %.1f MB for %d flows and %.1f MB for %d", float64(small)/(1<<20), counts[0], float64(large)/(1<<20), counts[1])
+	}
+}
@@ -0,0 +1,97 @@
+package pcap
+
+import (
+	"io"
+
+	"netsage/internal/capturefilter"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+// frameFilter runs a capture filter against raw frames, compiling it once
+// for each link type it meets. Frames of link types the filter cannot be
+// compiled for never match. It is not safe for concurrent use. A nil
+// frameFilter matches every frame.
+type frameFilter struct {
+	filter *capturefilter.Filter
+	vms    map[layers.LinkType]*bpf.VM
+}
+
+func newFrameFilter(filter *capturefilter.Filter) *frameFilter {
+	if filter == nil {
+		return nil
+	}
+	return &frameFilter{filter: filter, vms: make(map[layers.LinkType]*bpf.VM)}
+}
+
+// matches reports whether a frame of linkType passes the filter.
+func (f *frameFilter) matches(data []byte, linkType layers.LinkType) bool {
+	if f == nil {
+		return true
+	}
+	vm, ok := f.vms[linkType]
+	if !ok {
+		if link, known := captureLink(linkType); known {
+			if program, err := f.filter.Compile(link); err == nil {
+				vm, _ = bpf.NewVM(program)
+			}
+		}
+		f.vms[linkType] = vm
+	}
+	if vm == nil {
+		return false
+	}
+	n, err := vm.Run(data)
+	return err == nil && n > 0
+}
+
+// matchesCaptured is matches for a frame an interfaceSource read.
+func (f *frameFilter) matchesCaptured(data []byte, ci gopacket.CaptureInfo) bool {
+	if f == nil {
+		return true
+	}
+	var linkType layers.LinkType
+	if len(ci.AncillaryData) > 0 {
+		if iface, ok := ci.AncillaryData[0].(captureInterface); ok {
+			linkType = iface.linkType
+		}
+	}
+	return f.matches(data, linkType)
+}
+
+// matchesIndexed is matches for an indexed packet, whose frame it reads
+// from file.
+func (f *frameFilter) matchesIndexed(file io.ReaderAt, p indexedPacket) (bool, error) {
+	if f == nil {
+		return true, nil
+	}
+	data, err := readIndexedData(file, p)
+	if err != nil {
+		return false, err
+	}
+	return f.matches(data, p.iface.linkType), nil
+}
+
+// captureLink returns the framing capture filters are compiled for on
+// linkType.
+func captureLink(linkType layers.LinkType) (capturefilter.Link, bool) {
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		return capturefilter.LinkEthernet, true
+	case layers.LinkTypeLinuxSLL:
+		return capturefilter.LinkLinuxSLL, true
+	case linkTypeLinuxSLL2:
+		return capturefilter.LinkLinuxSLL2, true
+	case layers.LinkTypeRaw, linkTypeRawBSD, linkTypeRawOpenBSD:
+		return capturefilter.LinkRaw, true
+	case layers.LinkTypeIPv4:
+		return capturefilter.LinkIPv4, true
+	case layers.LinkTypeIPv6:
+		return capturefilter.LinkIPv6, true
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		return capturefilter.LinkNull, true
+	}
+	return 0, false
+}
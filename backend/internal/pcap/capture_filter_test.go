@@ -0,0 +1,95 @@
+package pcap
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"netsage/internal/capturefilter"
+)
+
+func TestCaptureFilterAnalysis(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "short-flows.pcap")
+	writeShortFlows(t, path, 50)
+
+	const capture = "host 10.0.0.7 or src port 10003"
+	indexPath, flowIndex, stored := indexedCapture(t, path, Options{CaptureFilter: capture, Workers: 2})
+	counts := map[string]int64{}
+	for _, flow := range stored {
+		clientIP, _, _, _ := flow.ClientServer()
+		counts[clientIP] = flow.PacketCount
+	}
+	if len(counts) != 2 || counts["10.0.0.7"] != 6 || counts["10.0.0.3"] != 4 {
+		t.Fatalf("expected all of one flow and the client half of another, got %v", counts)
+	}
+
+	filter, err := capturefilter.Parse(capture)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	ctx := context.Background()
+	for raw, wantTotal := range map[string]int{"": 10, "dst port 80": 8, "src host 10.1.0.1 and tcp": 2, "udp": 0} {
+		bpf, err := capturefilter.Parse(raw)
+		if err != nil {
+			t.Fatalf("parse %q: %v", raw, err)
+		}
+		sel := PacketFilter{Capture: filter, BPF: bpf}
+		want, total, err := ListPackets(ctx, path, "", 500, 0, sel, flowIndex)
+		if err != nil {
+			t.Fatalf("scan: %v", err)
+		}
+		got, gotTotal, err := ListPackets(ctx, path, indexPath, 500, 0, sel, flowIndex)
+		if err != nil {
+			t.Fatalf("indexed: %v", err)
+		}
+		if total != wantTotal || gotTotal != total || mustJSON(t, got) != mustJSON(t, want) {
+			t.Fatalf("bpf %q: expected %d packets\n got %d %s\nwant %d %s", raw, wantTotal, gotTotal, mustJSON(t, got), total, mustJSON(t, want))
+		}
+	}
+
+	want, err := BuildTimeseries(ctx, path, "", filter, time.Second)
+	if err != nil {
+		t.Fatalf("scan timeseries: %v", err)
+	}
+	got, err := BuildTimeseries(ctx, path, indexPath, filter, time.Second)
+	if err != nil {
+		t.Fatalf("indexed timeseries: %v", err)
+	}
+	if mustJSON(t, got) != mustJSON(t, want) || len(want.PacketsPerSec) != 1 || want.PacketsPerSec[0].Value != 10 {
+		t.Fatalf("timeseries differ:\n got %s\nwant %s", mustJSON(t, got), mustJSON(t, want))
+	}
+
+	if _, err := AnalyzeFile(ctx, path, Options{CaptureFilter: "tcp port"}, nil); err == nil {
+		t.Fatalf("expected an invalid capture filter to fail analysis")
+	}
+}
+
+// Packets reassembled from fragments are tested on the frame that completed
+// them, with or without the index.
+func TestBPFListingMatchesScan(t *testing.T) {
+	dir := t.TempDir()
+	fragmented := filepath.Join(dir, "fragmented.pcapng")
+	writeFragmentedCapture(t, fragmented, true)
+	indexPath, flowIndex, _ := indexedCapture(t, fragmented, Options{})
+
+	ctx := context.Background()
+	for _, raw := range []string{"tcp port 443", "src host 10.0.0.1", "not tcp", "greater 1000", "ip6"} {
+		bpf, err := capturefilter.Parse(raw)
+		if err != nil {
+			t.Fatalf("parse %q: %v", raw, err)
+		}
+		filter := PacketFilter{BPF: bpf}
+		want, wantTotal, err := ListPackets(ctx, fragmented, "", 500, 0, filter, flowIndex)
+		if err != nil {
+			t.Fatalf("scan: %v", err)
+		}
+		got, gotTotal, err := ListPackets(ctx, fragmented, indexPath, 500, 0, filter, flowIndex)
+		if err != nil {
+			t.Fatalf("indexed: %v", err)
+		}
+		if gotTotal != wantTotal || mustJSON(t, got) != mustJSON(t, want) {
+			t.Fatalf("bpf %q: indexed listing differs\n got %d %s\nwant %d %s", raw, gotTotal, mustJSON(t, got), wantTotal, mustJSON(t, want))
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package pcap
+
+import (
+	"crypto/x509"
+	"encoding/binary"
+
+	"netsage/internal/flows"
+)
+
+const maxCertStreamBytes = 256 * 1024
+
+// certStream reassembles one direction of a TCP connection far enough to read
+// the plaintext TLS handshake and pull out the server Certificate message,
+// which for TLS 1.2 and earlier routinely spans several segments.
+type certStream struct {
+	started        bool
+	done           bool
+	records        []byte
+	handshake      []byte
+	total          int
+	sawServerHello bool
+}
+
+// feed adds in-order bytes and returns the certificate chain once a complete
+// Certificate message following a ServerHello has been read.
+func (s *certStream) feed(data []byte) ([]*x509.Certificate, bool) {
+	if s.done || len(data) == 0 {
+		return nil, false
+	}
+	if !s.started {
+		if len(data) < 2 || data[0] != 22 || data[1] != 3 {
+			s.finish()
+			return nil, false
+		}
+		s.started = true
+	}
+
+	s.append(data)
+	if s.done {
+		return nil, false
+	}
+	return s.parse()
+}
+
+func (s *certStream) append(data []byte) {
+	s.total += len(data)
+	if s.total > maxCertStreamBytes {
+		s.finish()
+		return
+	}
+	s.records = append(s.records, data...)
+}
+
+func (s *certStream) parse() ([]*x509.Certificate, bool) {
+	for len(s.records) >= 5 {
+		contentType := s.records[0]
+		recordLen := int(binary.BigEndian.Uint16(s.records[3:5]))
+		if s.records[1] != 3 || contentType < 20 || contentType > 23 {
+			s.finish()
+			return nil, false
+		}
+		if len(s.records) < 5+recordLen {
+			break
+		}
+		if contentType != 22 {
+			// ChangeCipherSpec, alerts and application data end the
+			// plaintext part of the handshake.
+			s.finish()
+			return nil, false
+		}
+		s.handshake = append(s.handshake, s.records[5:5+recordLen]...)
+		s.records = s.records[5+recordLen:]
+	}
+
+	for len(s.handshake) >= 4 {
+		msgType := s.handshake[0]
+		msgLen := int(s.handshake[1])<<16 | int(s.handshake[2])<<8 | int(s.handshake[3])
+		if len(s.handshake) < 4+msgLen {
+			break
+		}
+		body := s.handshake[4 : 4+msgLen]
+		s.handshake = s.handshake[4+msgLen:]
+
+		switch msgType {
+		case 2:
+			s.sawServerHello = true
+			for _, v := range parseServerHello(body).supportedVersions {
+				if v == 0x0304 {
+					// TLS 1.3 encrypts the Certificate message.
+					s.finish()
+					return nil, false
+				}
+			}
+		case 11:
+			if !s.sawServerHello {
+				s.finish()
+				return nil, false
+			}
+			chain := parseCertificateMessage(body)
+			s.finish()
+			return chain, len(chain) > 0
+		case 1, 14:
+			s.finish()
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+func (s *certStream) finish() {
+	s.done = true
+	s.records = nil
+	s.handshake = nil
+}
+
+func parseCertificateMessage(body []byte) []*x509.Certificate {
+	if len(body) < 3 {
+		return nil
+	}
+	listLen := int(body[0])<<16 | int(body[1])<<8 | int(body[2])
+	if len(body) < 3+listLen {
+		return nil
+	}
+	data := body[3 : 3+listLen]
+
+	var chain []*x509.Certificate
+	for len(data) >= 3 {
+		certLen := int(data[0])<<16 | int(data[1])<<8 | int(data[2])
+		if len(data) < 3+certLen {
+			break
+		}
+		cert, err := x509.ParseCertificate(data[3 : 3+certLen])
+		if err != nil {
+			break
+		}
+		chain = append(chain, cert)
+		data = data[3+certLen:]
+	}
+	return chain
+}
+
+// certTracker holds the per-direction certificate streams for each TCP flow
+// until a chain has been extracted.
+type certTracker struct {
+	streams map[*flows.FlowAgg]*[2]certStream
+}
+
+func newCertTracker() *certTracker {
+	return &certTracker{streams: make(map[*flows.FlowAgg]*[2]certStream)}
+}
+
+func (t *certTracker) observe(flow *flows.FlowAgg, chunk streamChunk, info flows.PacketInfo) {
+	if flow.CertReport != nil {
+		return
+	}
+	streams, ok := t.streams[flow]
+	if !ok {
+		if len(chunk.data) == 0 || chunk.data[0] != 22 {
+			return
+		}
+		streams = &[2]certStream{}
+		t.streams[flow] = streams
+	}
+	if chunk.gap {
+		streams[chunk.dir].finish()
+	}
+
+	chain, ok := streams[chunk.dir].feed(chunk.data)
+	if ok {
+		host := ""
+		if flow.TLSSNI != nil {
+			host = *flow.TLSSNI
+		}
+		report := flows.BuildCertReport(chain, host, info.SrcPort, info.Timestamp)
+		report.Source = "capture"
+		flow.SetCertReport(report)
+	}
+	if streams[0].done && streams[1].done || flow.CertReport != nil {
+		delete(t.streams, flow)
+	}
+}
+
+// release drops the streams of a flow that is finalized early.
+func (t *certTracker) release(flow *flows.FlowAgg) {
+	delete(t.streams, flow)
+}
@@ -0,0 +1,101 @@
+package pcap
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"netsage/internal/flows"
+)
+
+func TestCertificateReassembledAcrossSegments(t *testing.T) {
+	notAfter := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	der := selfSignedCert(t, "internal.example.com", notAfter)
+
+	serverHello := []byte{0x03, 0x03}
+	serverHello = append(serverHello, make([]byte, 32)...)
+	serverHello = append(serverHello, 0, 0xc0, 0x2f, 0, 0, 0)
+
+	certList := []byte{byte(len(der) >> 16), byte(len(der) >> 8), byte(len(der))}
+	certList = append(certList, der...)
+	certBody := []byte{byte(len(certList) >> 16), byte(len(certList) >> 8), byte(len(certList))}
+	certBody = append(certBody, certList...)
+
+	stream := tlsRecord(2, serverHello)
+	stream = append(stream, tlsRecord(11, certBody)...)
+
+	key := flows.FlowKey{Proto: "TCP", SrcIP: "10.0.0.5", DstIP: "10.0.0.80", SrcPort: 50000, DstPort: 443}
+	ts := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	flow := flows.NewFlowAgg(key, ts)
+	sni := "www.example.com"
+	flow.TLSSNI = &sni
+
+	reassembly := newTCPReassembler()
+	tracker := newCertTracker()
+	third := len(stream) / 3
+	segments := []struct {
+		seq  uint32
+		data []byte
+	}{
+		{1000, stream[:third]},
+		{1000 + uint32(2*third), stream[2*third:]},
+		{1000 + uint32(third), stream[third : 2*third]},
+	}
+	for i, seg := range segments {
+		info := flows.PacketInfo{
+			Timestamp:  ts.Add(time.Duration(i) * time.Millisecond),
+			Proto:      "TCP",
+			SrcIP:      key.DstIP,
+			DstIP:      key.SrcIP,
+			SrcPort:    key.DstPort,
+			DstPort:    key.SrcPort,
+			Seq:        seg.seq,
+			Payload:    seg.data,
+			PayloadLen: len(seg.data),
+		}
+		flow.Update(info, false)
+		tracker.observe(flow, reassembly.push(flow, info, false), info)
+	}
+
+	report := flow.CertReport
+	if report == nil {
+		t.Fatalf("expected certificate report after reassembly")
+	}
+	if report.Source != "capture" || report.Port != 443 {
+		t.Fatalf("unexpected report source/port %s %d", report.Source, report.Port)
+	}
+	if !report.Expired || !report.SelfSigned {
+		t.Fatalf("expected expired self-signed certificate, got %+v", report)
+	}
+	if !report.HostnameChecked || report.HostnameValid {
+		t.Fatalf("expected SAN/SNI mismatch, got checked=%v valid=%v", report.HostnameChecked, report.HostnameValid)
+	}
+	if got := flow.CertIndexes(); len(got) != 1 || got[0] != 3 {
+		t.Fatalf("expected evidence at packet 3, got %v", got)
+	}
+}
+
+func selfSignedCert(t *testing.T, host string, notAfter time.Time) []byte {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    notAfter.AddDate(-1, 0, 0),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	return der
+}
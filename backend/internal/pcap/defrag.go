@@ -0,0 +1,393 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"netsage/internal/flows"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// fragmentTimeout matches the Linux default for ipfrag_time.
+	fragmentTimeout = 30 * time.Second
+
+	// Bounds on fragments held while waiting for the rest of a datagram. When
+	// they are exceeded the oldest datagram is given up as incomplete.
+	maxPendingDatagrams  = 1024
+	maxDatagramFragments = 256
+	maxDefragBytes       = 4 << 20
+	maxDatagramLen       = 65535
+)
+
+// fragmentKey identifies the datagram a fragment belongs to. The tunnel keeps
+// fragments from overlapping address spaces in different VNIs apart.
+type fragmentKey struct {
+	v6     bool
+	src    string
+	dst    string
+	id     uint32
+	proto  layers.IPProtocol
+	tunnel flows.Tunnel
+}
+
+type ipFragment struct {
+	offset int
+	data   []byte
+}
+
+type pendingDatagram struct {
+	key       fragmentKey
+	firstSeen time.Time
+	members   []int
+	base      flows.PacketInfo
+	prefix    []gopacket.Layer
+	header    []byte
+	next      layers.IPProtocol
+	fragments []ipFragment
+	bytes     int
+	frames    int
+	length    int
+	total     int
+	done      bool
+}
+
+// fragmentLoss reports a datagram that was never reassembled. info is decoded
+// from the fragments that did arrive, so it is only reported when the first
+// fragment (the one carrying the transport header) was seen.
+type fragmentLoss struct {
+	info     flows.PacketInfo
+	frames   int
+	timedOut bool
+}
+
+// ipDefragmenter reassembles IPv4 and IPv6 fragments before the datagram is
+// keyed to a flow, so fragmented UDP lands on the flow named by its ports
+// instead of being dropped. Captures are read in timestamp order, so pending
+// datagrams expire oldest first against capture time.
+type ipDefragmenter struct {
+	pending map[fragmentKey]*pendingDatagram
+	order   []*pendingDatagram
+	bytes   int
+	onLoss  func(fragmentLoss)
+	// frame counts the packets passed to assemble; firstFrame is the frame
+	// of the first fragment of the datagram it last returned, or of the
+	// packet itself when it was not fragmented. members lists the frames a
+	// reassembled datagram was built from, in capture order, and is nil
+	// otherwise.
+	frame      int
+	firstFrame int
+	members    []int
+}
+
+func newIPDefragmenter(onLoss func(fragmentLoss)) *ipDefragmenter {
+	return &ipDefragmenter{
+		pending: make(map[fragmentKey]*pendingDatagram),
+		onLoss:  onLoss,
+	}
+}
+
+// decodedPacket is what one captured packet yields on its own, ahead of
+// defragmentation, so decoding can run on any goroutine.
+type decodedPacket struct {
+	network    bool
+	fragmented bool
+	base       flows.PacketInfo
+	layers     []gopacket.Layer
+	info       flows.PacketInfo
+	ok         bool
+}
+
+func decodePacket(packet gopacket.Packet) decodedPacket {
+	if packet.NetworkLayer() == nil {
+		return decodedPacket{}
+	}
+	decoded := decodedPacket{network: true, base: packetBase(packet), layers: packet.Layers()}
+	if fragmentedLayer(decoded.layers) >= 0 {
+		decoded.fragmented = true
+		return decoded
+	}
+	decoded.info, decoded.ok = parseLayers(decoded.base, decoded.layers)
+	return decoded
+}
+
+// parse decodes packet like parsePacket, but holds fragments back until their
+// datagram is complete and then returns the whole datagram, stamped with the
+// time and interface of the fragment that completed it.
+func (d *ipDefragmenter) parse(packet gopacket.Packet) (flows.PacketInfo, bool) {
+	return d.assemble(decodePacket(packet))
+}
+
+// assemble is parse for a packet decoded already. Packets must be passed in
+// capture order.
+func (d *ipDefragmenter) assemble(decoded decodedPacket) (flows.PacketInfo, bool) {
+	d.frame++
+	d.firstFrame, d.members = d.frame, nil
+	if !decoded.network {
+		return flows.PacketInfo{}, false
+	}
+	base := decoded.base
+	d.expire(base.Timestamp)
+	if !decoded.fragmented {
+		return decoded.info, decoded.ok
+	}
+
+	ls := decoded.layers
+	members, length := []int{d.frame}, base.Length
+	for {
+		index := fragmentedLayer(ls)
+		if index < 0 {
+			break
+		}
+		datagram := d.add(base, ls, index, members, length)
+		if datagram == nil {
+			return flows.PacketInfo{}, false
+		}
+		// The reassembled datagram may itself be a fragment of a tunnelled
+		// datagram, so look again.
+		ls = datagram.layers()
+		members, length = datagram.members, datagram.length
+	}
+	sort.Ints(members)
+	d.firstFrame, d.members = members[0], members
+	frames := len(members)
+
+	info, ok := parseLayers(base, ls)
+	if ok && frames > 1 {
+		info.Length = length
+		info.IsFragment = true
+		info.Fragments = frames
+	}
+	return info, ok
+}
+
+// flush gives up on every datagram still waiting for fragments.
+func (d *ipDefragmenter) flush() {
+	for _, datagram := range d.order {
+		if !datagram.done {
+			d.drop(datagram, false)
+		}
+	}
+	d.order = nil
+}
+
+func (d *ipDefragmenter) expire(now time.Time) {
+	for len(d.order) > 0 {
+		oldest := d.order[0]
+		if !oldest.done {
+			if now.Sub(oldest.firstSeen) <= fragmentTimeout {
+				return
+			}
+			d.drop(oldest, true)
+		}
+		d.order = d.order[1:]
+	}
+}
+
+func (d *ipDefragmenter) add(base flows.PacketInfo, ls []gopacket.Layer, index int, members []int, length int) *pendingDatagram {
+	key, frag, more, ok := fragmentOf(ls, index)
+	if !ok {
+		return nil
+	}
+	key.tunnel = decapsulate(ls[:index]).tunnel
+
+	datagram := d.pending[key]
+	if datagram == nil {
+		datagram = &pendingDatagram{
+			key:       key,
+			firstSeen: base.Timestamp,
+			prefix:    ls[:index],
+			header:    ipHeader(ls[index]),
+			next:      key.proto,
+			total:     -1,
+		}
+		if ip6, ok := ls[index].(*layers.IPv6); ok {
+			datagram.next = nextHeaderAfterFragment(ls[index+1:], ip6)
+		}
+		d.pending[key] = datagram
+		d.order = append(d.order, datagram)
+	}
+
+	end := frag.offset + len(frag.data)
+	switch {
+	case end > maxDatagramLen, more && len(frag.data)%8 != 0,
+		!more && datagram.total >= 0 && datagram.total != end,
+		len(datagram.fragments) >= maxDatagramFragments:
+		d.drop(datagram, false)
+		return nil
+	}
+
+	if frag.offset == 0 {
+		// Only the first fragment carries the full set of IPv4 options.
+		datagram.base = base
+		datagram.header = ipHeader(ls[index])
+	}
+	if !more {
+		datagram.total = end
+	}
+	at := sort.Search(len(datagram.fragments), func(i int) bool {
+		return datagram.fragments[i].offset > frag.offset
+	})
+	datagram.fragments = append(datagram.fragments, ipFragment{})
+	copy(datagram.fragments[at+1:], datagram.fragments[at:])
+	datagram.fragments[at] = frag
+	datagram.bytes += len(frag.data)
+	datagram.frames += len(members)
+	datagram.members = append(datagram.members, members...)
+	datagram.length += length
+	d.bytes += len(frag.data)
+
+	if datagram.total >= 0 && datagram.contiguous() >= datagram.total {
+		d.release(datagram)
+		return datagram
+	}
+	for len(d.pending) > maxPendingDatagrams || d.bytes > maxDefragBytes {
+		d.evictOldest()
+	}
+	return nil
+}
+
+func (d *ipDefragmenter) evictOldest() {
+	for len(d.order) > 0 {
+		oldest := d.order[0]
+		d.order = d.order[1:]
+		if !oldest.done {
+			d.drop(oldest, false)
+			return
+		}
+	}
+}
+
+func (d *ipDefragmenter) release(datagram *pendingDatagram) {
+	datagram.done = true
+	d.bytes -= datagram.bytes
+	if d.pending[datagram.key] == datagram {
+		delete(d.pending, datagram.key)
+	}
+}
+
+func (d *ipDefragmenter) drop(datagram *pendingDatagram, timedOut bool) {
+	if datagram.done {
+		return
+	}
+	d.release(datagram)
+	if d.onLoss == nil || datagram.base.Timestamp.IsZero() {
+		return
+	}
+	if info, ok := parseLayers(datagram.base, datagram.layers()); ok {
+		info.IsFragment = true
+		d.onLoss(fragmentLoss{info: info, frames: datagram.frames, timedOut: timedOut})
+	}
+}
+
+// contiguous returns how many bytes from offset zero have arrived without a
+// hole.
+func (p *pendingDatagram) contiguous() int {
+	covered := 0
+	for _, frag := range p.fragments {
+		if frag.offset > covered {
+			break
+		}
+		covered = max(covered, frag.offset+len(frag.data))
+	}
+	return covered
+}
+
+// layers decodes the datagram rebuilt from its contiguous fragments behind a
+// header copied from the first fragment, following the layers that carried
+// it.
+func (p *pendingDatagram) layers() []gopacket.Layer {
+	data := make([]byte, p.contiguous())
+	for _, frag := range p.fragments {
+		if frag.offset >= len(data) {
+			break
+		}
+		copy(data[frag.offset:], frag.data)
+	}
+
+	header := append([]byte(nil), p.header...)
+	var first gopacket.LayerType
+	if p.key.v6 {
+		header[6] = byte(p.next)
+		binary.BigEndian.PutUint16(header[4:6], uint16(len(data)))
+		first = layers.LayerTypeIPv6
+	} else {
+		binary.BigEndian.PutUint16(header[2:4], uint16(len(header)+len(data)))
+		header[6] &= 0x40
+		header[7] = 0
+		first = layers.LayerTypeIPv4
+	}
+
+	datagram := gopacket.NewPacket(append(header, data...), first, gopacket.NoCopy)
+	ls := make([]gopacket.Layer, 0, len(p.prefix)+len(datagram.Layers()))
+	ls = append(ls, p.prefix...)
+	return append(ls, datagram.Layers()...)
+}
+
+// fragmentedLayer returns the index of the outermost IP layer that carries a
+// fragment, or -1.
+func fragmentedLayer(ls []gopacket.Layer) int {
+	for i, layer := range ls {
+		switch ip := layer.(type) {
+		case *layers.IPv4:
+			if ip.Flags&layers.IPv4MoreFragments != 0 || ip.FragOffset > 0 {
+				return i
+			}
+		case *layers.IPv6:
+			for _, next := range ls[i+1:] {
+				if _, ok := next.(*layers.IPv6Fragment); ok {
+					return i
+				}
+				if _, ok := next.(*layers.IPv6HopByHop); !ok {
+					break
+				}
+			}
+		}
+	}
+	return -1
+}
+
+func fragmentOf(ls []gopacket.Layer, index int) (fragmentKey, ipFragment, bool, bool) {
+	switch ip := ls[index].(type) {
+	case *layers.IPv4:
+		if len(ip.Payload) < int(ip.Length)-int(ip.IHL)*4 {
+			// Cut short by the snap length.
+			return fragmentKey{}, ipFragment{}, false, false
+		}
+		key := fragmentKey{src: ip.SrcIP.String(), dst: ip.DstIP.String(), id: uint32(ip.Id), proto: ip.Protocol}
+		frag := ipFragment{offset: int(ip.FragOffset) * 8, data: ip.Payload}
+		return key, frag, ip.Flags&layers.IPv4MoreFragments != 0, true
+	case *layers.IPv6:
+		for _, next := range ls[index+1:] {
+			fragment, ok := next.(*layers.IPv6Fragment)
+			if !ok {
+				continue
+			}
+			key := fragmentKey{v6: true, src: ip.SrcIP.String(), dst: ip.DstIP.String(), id: fragment.Identification}
+			frag := ipFragment{offset: int(fragment.FragmentOffset) * 8, data: fragment.Payload}
+			return key, frag, fragment.MoreFragments, true
+		}
+	}
+	return fragmentKey{}, ipFragment{}, false, false
+}
+
+func nextHeaderAfterFragment(ls []gopacket.Layer, ip *layers.IPv6) layers.IPProtocol {
+	for _, layer := range ls {
+		if fragment, ok := layer.(*layers.IPv6Fragment); ok {
+			return fragment.NextHeader
+		}
+	}
+	return ip.NextHeader
+}
+
+// ipHeader copies the header of a fragment to put in front of the rebuilt
+// datagram. IPv6 extension headers ahead of the fragment header are dropped.
+func ipHeader(layer gopacket.Layer) []byte {
+	if _, ok := layer.(*layers.IPv6); ok {
+		return append([]byte(nil), layer.LayerContents()[:40]...)
+	}
+	return append([]byte(nil), layer.LayerContents()...)
+}
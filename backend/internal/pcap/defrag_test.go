@@ -0,0 +1,161 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"netsage/internal/flows"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var defragMAC = net.HardwareAddr{0x00, 0x0c, 0x29, 0xaa, 0xbb, 0xcc}
+
+func TestDefragIPv4OutOfOrder(t *testing.T) {
+	payload := bytes.Repeat([]byte("ike!"), 900)
+	l4 := serializeLayers(t, &layers.UDP{SrcPort: 500, DstPort: 500}, gopacket.Payload(payload))
+	frames := fragmentIPv4(t, net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}, 77, l4, 1480)
+	if len(frames) != 3 {
+		t.Fatalf("expected 3 fragments, got %d", len(frames))
+	}
+
+	defrag := newIPDefragmenter(nil)
+	ts := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	order := []int{2, 0, 1}
+	total := 0
+	for i, n := range order {
+		total += len(frames[n])
+		info, ok := defrag.parse(framePacket(frames[n], ts.Add(time.Duration(i)*time.Millisecond)))
+		if i < len(order)-1 {
+			if ok {
+				t.Fatalf("fragment %d should be held", n)
+			}
+			continue
+		}
+		if !ok {
+			t.Fatalf("expected the datagram to complete")
+		}
+		if info.Proto != "UDP" || info.SrcPort != 500 || info.DstPort != 500 || info.PayloadLen != len(payload) {
+			t.Fatalf("unexpected datagram %s %d->%d len %d", info.Proto, info.SrcPort, info.DstPort, info.PayloadLen)
+		}
+		if !info.IsFragment || info.Fragments != 3 || info.Length != total {
+			t.Fatalf("expected 3 fragments of %d bytes, got %d of %d", total, info.Fragments, info.Length)
+		}
+	}
+	if len(defrag.pending) != 0 || defrag.bytes != 0 {
+		t.Fatalf("expected reassembly state to be released")
+	}
+}
+
+func TestDefragIPv6(t *testing.T) {
+	src, dst := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::53")
+	payload := bytes.Repeat([]byte{0xab}, 2500)
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 4500}
+	l4 := serializeLayers(t, udp, gopacket.Payload(payload))
+
+	defrag := newIPDefragmenter(nil)
+	ts := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	var info flows.PacketInfo
+	var ok bool
+	for offset := 0; offset < len(l4); offset += 1232 {
+		end := min(offset+1232, len(l4))
+		fragment := make([]byte, 8)
+		fragment[0] = byte(layers.IPProtocolUDP)
+		flags := uint16(offset)
+		if end < len(l4) {
+			flags |= 1
+		}
+		binary.BigEndian.PutUint16(fragment[2:4], flags)
+		binary.BigEndian.PutUint32(fragment[4:8], 0xdeadbeef)
+		frame := serializeLayers(t,
+			&layers.Ethernet{SrcMAC: defragMAC, DstMAC: defragMAC, EthernetType: layers.EthernetTypeIPv6},
+			&layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolIPv6Fragment, SrcIP: src, DstIP: dst},
+			gopacket.Payload(append(fragment, l4[offset:end]...)),
+		)
+		info, ok = defrag.parse(framePacket(frame, ts))
+	}
+	if !ok || info.SrcIP != "2001:db8::1" || info.DstPort != 4500 || info.PayloadLen != len(payload) || info.Fragments != 3 {
+		t.Fatalf("expected reassembled IPv6 datagram, got ok=%v %+v", ok, info)
+	}
+}
+
+func TestDefragTunnelledInFragments(t *testing.T) {
+	inner := serializeLayers(t,
+		&layers.Ethernet{SrcMAC: defragMAC, DstMAC: defragMAC, EthernetType: layers.EthernetTypeIPv4},
+		&layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IP{192, 168, 1, 10}, DstIP: net.IP{192, 168, 1, 53}},
+		&layers.UDP{SrcPort: 33000, DstPort: 5353},
+		gopacket.Payload(bytes.Repeat([]byte("x"), 1600)),
+	)
+	l4 := serializeLayers(t,
+		&layers.UDP{SrcPort: 50000, DstPort: 4789},
+		&layers.VXLAN{ValidIDFlag: true, VNI: 9},
+		gopacket.Payload(inner),
+	)
+
+	defrag := newIPDefragmenter(nil)
+	ts := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	var info flows.PacketInfo
+	var ok bool
+	for _, frame := range fragmentIPv4(t, net.IP{172, 16, 0, 1}, net.IP{172, 16, 0, 2}, 5, l4, 1000) {
+		info, ok = defrag.parse(framePacket(frame, ts))
+	}
+	if !ok || info.SrcIP != "192.168.1.10" || info.DstPort != 5353 || info.Tunnel != (flows.Tunnel{Type: tunnelVXLAN, ID: 9}) {
+		t.Fatalf("expected the inner flow of the reassembled VXLAN datagram, got ok=%v %+v", ok, info)
+	}
+}
+
+func TestDefragReportsLostDatagrams(t *testing.T) {
+	l4 := serializeLayers(t, &layers.UDP{SrcPort: 53, DstPort: 41000}, gopacket.Payload(bytes.Repeat([]byte("d"), 3000)))
+	timedOut := fragmentIPv4(t, net.IP{10, 0, 0, 53}, net.IP{10, 0, 0, 9}, 1, l4, 1480)
+	incomplete := fragmentIPv4(t, net.IP{10, 0, 0, 53}, net.IP{10, 0, 0, 9}, 2, l4, 1480)
+
+	var losses []fragmentLoss
+	defrag := newIPDefragmenter(func(loss fragmentLoss) { losses = append(losses, loss) })
+	ts := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	defrag.parse(framePacket(timedOut[0], ts))
+	defrag.parse(framePacket(timedOut[1], ts))
+	// The second datagram's first fragment arrives last; its ports still
+	// identify the flow once it does.
+	defrag.parse(framePacket(incomplete[2], ts.Add(time.Second)))
+	defrag.parse(framePacket(incomplete[0], ts.Add(fragmentTimeout+time.Second)))
+
+	if len(losses) != 1 || !losses[0].timedOut || losses[0].frames != 2 || losses[0].info.SrcPort != 53 || losses[0].info.DstPort != 41000 {
+		t.Fatalf("expected one timed-out datagram on 53->41000, got %+v", losses)
+	}
+
+	defrag.flush()
+	if len(losses) != 2 || losses[1].timedOut || losses[1].frames != 2 {
+		t.Fatalf("expected the unfinished datagram to be reported incomplete, got %+v", losses)
+	}
+}
+
+// fragmentIPv4 splits l4 into Ethernet frames carrying IPv4 fragments of at
+// most size payload bytes.
+func fragmentIPv4(t *testing.T, src, dst net.IP, id uint16, l4 []byte, size int) [][]byte {
+	t.Helper()
+	var frames [][]byte
+	for offset := 0; offset < len(l4); offset += size {
+		end := min(offset+size, len(l4))
+		ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Id: id, Protocol: layers.IPProtocolUDP, SrcIP: src, DstIP: dst, FragOffset: uint16(offset / 8)}
+		if end < len(l4) {
+			ip.Flags = layers.IPv4MoreFragments
+		}
+		frames = append(frames, serializeLayers(t,
+			&layers.Ethernet{SrcMAC: defragMAC, DstMAC: defragMAC, EthernetType: layers.EthernetTypeIPv4},
+			ip, gopacket.Payload(l4[offset:end]),
+		))
+	}
+	return frames
+}
+
+func framePacket(frame []byte, ts time.Time) gopacket.Packet {
+	packet := gopacket.NewPacket(frame, layers.LinkTypeEthernet, gopacket.Default)
+	packet.Metadata().Timestamp = ts
+	packet.Metadata().CaptureLength = len(frame)
+	packet.Metadata().Length = len(frame)
+	return packet
+}
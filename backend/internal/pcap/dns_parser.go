@@ -0,0 +1,155 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+
+	"netsage/internal/flows"
+)
+
+const dnsPort = 53
+
+type dnsInfo struct {
+	payload []byte
+	tcp     bool
+}
+
+// Parse decodes the DNS messages carried in the payload. UDP payloads hold a
+// single message; TCP payloads hold zero or more length-prefixed messages.
+func (d dnsInfo) Parse() []flows.DNSMessage {
+	if !d.tcp {
+		msg, ok := parseDNSMessage(d.payload)
+		if !ok {
+			return nil
+		}
+		return []flows.DNSMessage{msg}
+	}
+
+	var messages []flows.DNSMessage
+	data := d.payload
+	for len(data) >= 2 {
+		msgLen := int(binary.BigEndian.Uint16(data[0:2]))
+		if msgLen == 0 || len(data) < 2+msgLen {
+			break
+		}
+		if msg, ok := parseDNSMessage(data[2 : 2+msgLen]); ok {
+			messages = append(messages, msg)
+		}
+		data = data[2+msgLen:]
+	}
+	return messages
+}
+
+func parseDNSMessage(data []byte) (flows.DNSMessage, bool) {
+	msg := flows.DNSMessage{}
+	if len(data) < 12 {
+		return msg, false
+	}
+	opcode := (data[2] >> 3) & 0x0f
+	if opcode != 0 {
+		return msg, false
+	}
+	msg.ID = binary.BigEndian.Uint16(data[0:2])
+	msg.Response = data[2]&0x80 != 0
+	msg.RCode = int(data[3] & 0x0f)
+	qdCount := int(binary.BigEndian.Uint16(data[4:6]))
+	msg.AnswerCount = int(binary.BigEndian.Uint16(data[6:8]))
+
+	if qdCount == 0 {
+		return msg, true
+	}
+	name, end, ok := parseDNSName(data, 12)
+	if !ok || end+4 > len(data) {
+		return msg, true
+	}
+	msg.QueryName = name
+	msg.QueryType = dnsTypeString(binary.BigEndian.Uint16(data[end : end+2]))
+	return msg, true
+}
+
+func parseDNSName(data []byte, offset int) (string, int, bool) {
+	labels := make([]string, 0, 4)
+	end := -1
+	idx := offset
+	for hops := 0; hops < 32; hops++ {
+		if idx >= len(data) {
+			return "", 0, false
+		}
+		length := int(data[idx])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = idx + 1
+			}
+			return strings.Join(labels, "."), end, true
+		case length&0xc0 == 0xc0:
+			if idx+1 >= len(data) {
+				return "", 0, false
+			}
+			if end < 0 {
+				end = idx + 2
+			}
+			idx = int(binary.BigEndian.Uint16(data[idx:idx+2]) & 0x3fff)
+		case length&0xc0 != 0:
+			return "", 0, false
+		default:
+			if idx+1+length > len(data) {
+				return "", 0, false
+			}
+			labels = append(labels, string(data[idx+1:idx+1+length]))
+			idx += 1 + length
+		}
+	}
+	return "", 0, false
+}
+
+func dnsTypeString(qtype uint16) string {
+	switch qtype {
+	case 1:
+		return "A"
+	case 2:
+		return "NS"
+	case 5:
+		return "CNAME"
+	case 6:
+		return "SOA"
+	case 12:
+		return "PTR"
+	case 15:
+		return "MX"
+	case 16:
+		return "TXT"
+	case 28:
+		return "AAAA"
+	case 33:
+		return "SRV"
+	case 64:
+		return "SVCB"
+	case 65:
+		return "HTTPS"
+	case 255:
+		return "ANY"
+	default:
+		return "TYPE" + strconv.Itoa(int(qtype))
+	}
+}
+
+func dnsRCodeString(rcode int) string {
+	switch rcode {
+	case flows.DNSRCodeNoError:
+		return "NOERROR"
+	case 1:
+		return "FORMERR"
+	case flows.DNSRCodeServFail:
+		return "SERVFAIL"
+	case flows.DNSRCodeNXDomain:
+		return "NXDOMAIN"
+	case 4:
+		return "NOTIMP"
+	case 5:
+		return "REFUSED"
+	default:
+		return "RCODE" + strconv.Itoa(rcode)
+	}
+}
@@ -0,0 +1,336 @@
+package pcap
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"netsage/internal/flows"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// FlowRange selects the packets of one stored flow: those on its key that
+// the flow index attributes to the flow started at Start. First and Last,
+// when positive, keep only the packets numbered First to Last within the
+// flow, counting from one as flow evidence does.
+type FlowRange struct {
+	Key   flows.FlowKey
+	Start time.Time
+	First int
+	Last  int
+}
+
+// PacketSelection picks the packets ExportPackets writes: those that pass
+// Filter and, when Flows is not empty, belong to one of the flow ranges.
+type PacketSelection struct {
+	Filter    PacketFilter
+	FlowIndex FlowIndex
+	Flows     []FlowRange
+}
+
+// flowCounter numbers the packets of the selected flows as they are read.
+type flowCounter struct {
+	ranges []FlowRange
+	counts []int
+}
+
+func newFlowCounter(ranges []FlowRange) *flowCounter {
+	return &flowCounter{ranges: ranges, counts: make([]int, len(ranges))}
+}
+
+// selects reports whether a packet on key, attributed to the stored flow
+// meta, is in one of the ranges. Every packet read must be passed to it.
+func (c *flowCounter) selects(key flows.FlowKey, meta FlowMeta, hasMeta bool) bool {
+	if len(c.ranges) == 0 {
+		return true
+	}
+	if !hasMeta {
+		return false
+	}
+	key.Generation = 0
+	selected := false
+	for i, r := range c.ranges {
+		want := r.Key
+		want.Generation = 0
+		if (key != want && key != want.Reverse()) || !meta.Start.Equal(r.Start) {
+			continue
+		}
+		c.counts[i]++
+		n := c.counts[i]
+		if (r.First <= 0 || n >= r.First) && (r.Last <= 0 || n <= r.Last) {
+			selected = true
+		}
+	}
+	return selected
+}
+
+// rawFrame is a frame as read from a capture.
+type rawFrame struct {
+	frame int
+	data  []byte
+	ci    gopacket.CaptureInfo
+	iface captureInterface
+}
+
+// captureWriter writes frames in the format of the capture they came from:
+// pcap with its link type, snap length and timestamp resolution, or pcapng
+// with an interface block for each interface frames are written from.
+type captureWriter struct {
+	pcap   *pcapgo.Writer
+	ng     *pcapgo.NgWriter
+	ifaces map[captureInterface]int
+}
+
+func newCaptureWriter(w io.Writer, source *interfaceSource) (*captureWriter, error) {
+	if source.pcap != nil {
+		writer := pcapgo.NewWriter(w)
+		if source.nanos {
+			writer = pcapgo.NewWriterNanos(w)
+		}
+		if err := writer.WriteFileHeader(source.pcap.Snaplen(), source.pcap.LinkType()); err != nil {
+			return nil, err
+		}
+		return &captureWriter{pcap: writer}, nil
+	}
+
+	first := pcapgo.NgInterface{LinkType: source.ng.LinkType()}
+	if iface, err := source.ng.Interface(0); err == nil {
+		first = iface
+	}
+	writer, err := pcapgo.NewNgWriterInterface(w, first, pcapgo.DefaultNgWriterOptions)
+	if err != nil {
+		return nil, err
+	}
+	ifaces := map[captureInterface]int{{linkType: first.LinkType, name: first.Name}: 0}
+	return &captureWriter{ng: writer, ifaces: ifaces}, nil
+}
+
+func (c *captureWriter) write(frame rawFrame) error {
+	ci := frame.ci
+	ci.AncillaryData = nil
+	if c.pcap != nil {
+		return c.pcap.WritePacket(ci, frame.data)
+	}
+	index, ok := c.ifaces[frame.iface]
+	if !ok {
+		var err error
+		index, err = c.ng.AddInterface(pcapgo.NgInterface{Name: frame.iface.name, LinkType: frame.iface.linkType})
+		if err != nil {
+			return err
+		}
+		c.ifaces[frame.iface] = index
+	}
+	ci.InterfaceIndex = index
+	return c.ng.WritePacket(ci, frame.data)
+}
+
+func (c *captureWriter) flush() error {
+	if c.ng != nil {
+		return c.ng.Flush()
+	}
+	return nil
+}
+
+// ExportPackets writes the packets of the capture at path that sel selects
+// to w, as a capture in the same format with the original timestamps and
+// link types. A packet reassembled from IP fragments is written as all of
+// its fragments, just before the frame that completed it. indexPath names
+// the capture's packet index; without a usable one the capture is decoded
+// from the start. It returns how many frames were written.
+func ExportPackets(ctx context.Context, path, indexPath string, w io.Writer, sel PacketSelection) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	source, err := newInterfaceSource(file)
+	if err != nil {
+		return 0, err
+	}
+	source.filter = newFrameFilter(sel.Filter.Capture)
+	out, err := newCaptureWriter(w, source)
+	if err != nil {
+		return 0, err
+	}
+
+	var written int
+	if index, err := openPacketIndex(indexPath); err == nil {
+		defer index.close()
+		written, err = exportIndexedPackets(ctx, file, index, out, sel)
+		if err != nil {
+			return written, err
+		}
+	} else if written, err = exportScannedPackets(ctx, source, out, sel); err != nil {
+		return written, err
+	}
+	return written, out.flush()
+}
+
+func exportScannedPackets(ctx context.Context, source *interfaceSource, out *captureWriter, sel PacketSelection) (int, error) {
+	counter := newFlowCounter(sel.Flows)
+	trackers := make(map[flowTrackerKey]*packetTracker)
+	frames := newFrameFilter(sel.Filter.BPF)
+	defrag := newIPDefragmenter(nil)
+	var fragments []rawFrame
+	written := 0
+	for {
+		data, ci, ok := nextPacketData(ctx, source)
+		if !ok {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return written, ctx.Err()
+		default:
+		}
+
+		passes := frames.matchesCaptured(data, ci)
+		decoded := decodePacket(decodeCaptured(data, ci))
+		info, ok := defrag.assemble(decoded)
+		frame := rawFrame{frame: defrag.frame, data: data, ci: ci}
+		frame.iface, _ = ci.AncillaryData[0].(captureInterface)
+		if decoded.fragmented {
+			fragments = keepFragments(append(fragments, frame), ci.Timestamp)
+		}
+		if !ok {
+			continue
+		}
+
+		var meta FlowMeta
+		hasMeta := false
+		if len(sel.FlowIndex) > 0 {
+			meta, hasMeta = sel.FlowIndex.lookup(packetKey(info), info.Timestamp)
+		}
+		tracker, dir := resolvePacketTracker(info, meta, hasMeta, trackers)
+		tracker.annotate(&info, dir)
+		if !counter.selects(packetKey(info), meta, hasMeta) || !passes || !sel.Filter.Matches(info, meta) {
+			continue
+		}
+
+		frames := []rawFrame{frame}
+		if defrag.members != nil {
+			frames = membersOf(fragments, defrag.members)
+		}
+		for _, frame := range frames {
+			if err := out.write(frame); err != nil {
+				return written, err
+			}
+			written++
+		}
+	}
+	return written, ctx.Err()
+}
+
+func exportIndexedPackets(ctx context.Context, file *os.File, index *packetIndexReader, out *captureWriter, sel PacketSelection) (int, error) {
+	counter := newFlowCounter(sel.Flows)
+	frames := newFrameFilter(sel.Filter.BPF)
+	var fragments fragmentWindow
+	written := 0
+	for {
+		p, err := index.next()
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+		if p.frame%4096 == 0 {
+			select {
+			case <-ctx.Done():
+				return written, ctx.Err()
+			default:
+			}
+		}
+		if p.fragment {
+			fragments.add(p)
+		}
+		if p.flow == nil {
+			continue
+		}
+
+		meta, hasMeta := p.flow.storedMeta(sel.FlowIndex)
+		info := p.info()
+		if !counter.selects(packetKey(info), meta, hasMeta) || !sel.Filter.Matches(info, meta) {
+			continue
+		}
+		if passes, err := frames.matchesIndexed(file, p); err != nil {
+			return written, err
+		} else if !passes {
+			continue
+		}
+
+		frames, err := readDatagramFrames(file, p, fragments.before(p))
+		if err != nil {
+			return written, err
+		}
+		for _, frame := range frames {
+			if err := out.write(frame); err != nil {
+				return written, err
+			}
+			written++
+		}
+	}
+}
+
+// keepFragments drops the fragment frames too old to still be reassembled.
+func keepFragments(frames []rawFrame, now time.Time) []rawFrame {
+	keep := 0
+	for keep < len(frames) && (now.Sub(frames[keep].ci.Timestamp) > fragmentTimeout || len(frames)-keep > maxPendingDatagrams*4) {
+		keep++
+	}
+	return frames[keep:]
+}
+
+// membersOf returns the frames numbered in members.
+func membersOf(frames []rawFrame, members []int) []rawFrame {
+	out := make([]rawFrame, 0, len(members))
+	for _, frame := range frames {
+		for _, member := range members {
+			if frame.frame == member {
+				out = append(out, frame)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// readDatagramFrames reads the frames an indexed packet was built from: the
+// packet's own frame and, for a reassembled datagram, the fragments among
+// candidates that went into it.
+func readDatagramFrames(file io.ReaderAt, p indexedPacket, candidates []indexedPacket) ([]rawFrame, error) {
+	read := func(p indexedPacket, frame int) (rawFrame, error) {
+		data := make([]byte, p.captured)
+		if _, err := file.ReadAt(data, p.offset); err != nil {
+			return rawFrame{}, err
+		}
+		ci := gopacket.CaptureInfo{Timestamp: p.ts, CaptureLength: p.captured, Length: p.wire}
+		return rawFrame{frame: frame, data: data, ci: ci, iface: p.iface}, nil
+	}
+	if !p.fragment {
+		frame, err := read(p, p.frame)
+		return []rawFrame{frame}, err
+	}
+
+	// Reassemble again, numbering frames as this defragmenter sees them.
+	defrag := newIPDefragmenter(nil)
+	frames := make([]rawFrame, 0, len(candidates)+1)
+	for _, candidate := range append(candidates, p) {
+		frame, err := read(candidate, len(frames)+1)
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+		ci := frame.ci
+		ci.AncillaryData = []interface{}{candidate.iface}
+		defrag.assemble(decodePacket(decodeCaptured(frame.data, ci)))
+	}
+	if defrag.members == nil {
+		return nil, errors.New("capture does not match its packet index")
+	}
+	return membersOf(frames, defrag.members), nil
+}
@@ -0,0 +1,152 @@
+package pcap
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"netsage/internal/flows"
+	"netsage/internal/pcap/testutil"
+
+	"github.com/google/gopacket"
+)
+
+// readFrames reads every frame of a capture with the interface it was
+// captured on.
+func readFrames(t *testing.T, capture []byte) []rawFrame {
+	t.Helper()
+	source, err := newInterfaceSource(bytes.NewReader(capture))
+	if err != nil {
+		t.Fatalf("read capture: %v", err)
+	}
+	var frames []rawFrame
+	for {
+		data, ci, ok := nextPacketData(context.Background(), source)
+		if !ok {
+			return frames
+		}
+		iface, _ := ci.AncillaryData[0].(captureInterface)
+		frames = append(frames, rawFrame{frame: len(frames) + 1, data: data, ci: gopacket.CaptureInfo{Timestamp: ci.Timestamp, CaptureLength: ci.CaptureLength, Length: ci.Length}, iface: iface})
+	}
+}
+
+func sameFrames(t *testing.T, got, want []rawFrame) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("expected %d frames, got %d", len(want), len(got))
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if !bytes.Equal(g.data, w.data) || !g.ci.Timestamp.Equal(w.ci.Timestamp) || g.ci.Length != w.ci.Length || g.iface != w.iface {
+			t.Fatalf("frame %d differs: got %v %v, want %v %v", i+1, g.ci, g.iface, w.ci, w.iface)
+		}
+	}
+}
+
+// export writes the selection both by scanning and from the index and
+// checks the two agree.
+func export(t *testing.T, path, indexPath string, sel PacketSelection) []byte {
+	t.Helper()
+	var scanned, indexed bytes.Buffer
+	n, err := ExportPackets(context.Background(), path, "", &scanned, sel)
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	m, err := ExportPackets(context.Background(), path, indexPath, &indexed, sel)
+	if err != nil {
+		t.Fatalf("export from index: %v", err)
+	}
+	if n != m || !bytes.Equal(scanned.Bytes(), indexed.Bytes()) {
+		t.Fatalf("export from index differs: %d frames, want %d", m, n)
+	}
+	return scanned.Bytes()
+}
+
+func TestExportPacketsKeepsFramesAndFormat(t *testing.T) {
+	dir := t.TempDir()
+	generated := filepath.Join(dir, "generated.pcap")
+	if err := testutil.GenerateSamplePCAP(generated); err != nil {
+		t.Fatalf("generate sample: %v", err)
+	}
+	fragmentedNg := filepath.Join(dir, "fragmented.pcapng")
+	writeFragmentedCapture(t, fragmentedNg, true)
+
+	for _, path := range []string{filepath.Join("..", "..", "testdata", "sample.pcap"), generated, fragmentedNg} {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			indexPath, flowIndex, _ := indexedCapture(t, path, Options{})
+			original := mustRead(t, path)
+			exported := export(t, path, indexPath, PacketSelection{FlowIndex: flowIndex})
+			if !bytes.Equal(exported[:4], original[:4]) {
+				t.Fatalf("expected the capture format to be kept, got magic %x want %x", exported[:4], original[:4])
+			}
+			sameFrames(t, readFrames(t, exported), readFrames(t, original))
+		})
+	}
+}
+
+func TestExportFlowIncludesFragments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fragmented.pcap")
+	writeFragmentedCapture(t, path, false)
+	indexPath, flowIndex, stored := indexedCapture(t, path, Options{})
+	original := readFrames(t, mustRead(t, path))
+
+	for _, flow := range stored {
+		sel := PacketSelection{FlowIndex: flowIndex, Flows: []FlowRange{{Key: flow.Key, Start: flow.FirstSeen.Truncate(time.Microsecond)}}}
+		frames := readFrames(t, export(t, path, indexPath, sel))
+		switch flow.Key.Proto {
+		case "UDP":
+			// Every frame but the three TCP segments is a fragment.
+			if len(frames) != len(original)-3 || int64(len(frames)) != flow.FragmentCount {
+				t.Fatalf("expected %d fragments, got %d", flow.FragmentCount, len(frames))
+			}
+		case "TCP":
+			if len(frames) != 3 {
+				t.Fatalf("expected the 3 TCP segments, got %d", len(frames))
+			}
+		}
+	}
+}
+
+func TestExportEvidenceRange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "short-flows.pcap")
+	writeShortFlows(t, path, 20)
+	indexPath, flowIndex, stored := indexedCapture(t, path, Options{})
+	flow := stored[0]
+	for _, other := range stored {
+		if flows.KeyLess(other.Key, flow.Key) {
+			flow = other
+		}
+	}
+	start := flow.FirstSeen.Truncate(time.Microsecond)
+
+	sel := PacketSelection{FlowIndex: flowIndex, Flows: []FlowRange{{Key: flow.Key, Start: start, First: 2, Last: 4}}}
+	frames := readFrames(t, export(t, path, indexPath, sel))
+	if len(frames) != 3 {
+		t.Fatalf("expected packets 2 to 4 of the flow, got %d", len(frames))
+	}
+	// The second packet of each connection is the SYN-ACK, 100 µs in.
+	if want := flow.FirstSeen.Add(100 * time.Microsecond); !frames[0].ci.Timestamp.Equal(want) {
+		t.Fatalf("expected the range to start at %v, got %v", want, frames[0].ci.Timestamp)
+	}
+
+	filter, err := ParsePacketFilter("flags:SYN")
+	if err != nil {
+		t.Fatalf("parse filter: %v", err)
+	}
+	sel = PacketSelection{FlowIndex: flowIndex, Filter: filter}
+	if frames := readFrames(t, export(t, path, indexPath, sel)); len(frames) != 2*len(stored) {
+		t.Fatalf("expected a SYN and a SYN-ACK per flow, got %d", len(frames))
+	}
+}
+
+func mustRead(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return data
+}
@@ -0,0 +1,199 @@
+package pcap
+
+import (
+	"net/netip"
+	"strings"
+
+	"netsage/internal/displayfilter"
+	"netsage/internal/flows"
+)
+
+// packetPredicate reports whether a packet, attributed to the stored flow
+// meta, passes a compiled filter expression.
+type packetPredicate func(info *flows.PacketInfo, meta *FlowMeta) bool
+
+// compilePacketExpr compiles an expression parsed for packets.
+func compilePacketExpr(expr displayfilter.Expr) packetPredicate {
+	switch e := expr.(type) {
+	case *displayfilter.And:
+		x, y := compilePacketExpr(e.X), compilePacketExpr(e.Y)
+		return func(info *flows.PacketInfo, meta *FlowMeta) bool { return x(info, meta) && y(info, meta) }
+	case *displayfilter.Or:
+		x, y := compilePacketExpr(e.X), compilePacketExpr(e.Y)
+		return func(info *flows.PacketInfo, meta *FlowMeta) bool { return x(info, meta) || y(info, meta) }
+	case *displayfilter.Not:
+		x := compilePacketExpr(e.X)
+		return func(info *flows.PacketInfo, meta *FlowMeta) bool { return !x(info, meta) }
+	case *displayfilter.Compare:
+		match := compilePacketCompare(e)
+		if e.Op == displayfilter.OpNe {
+			return func(info *flows.PacketInfo, meta *FlowMeta) bool { return !match(info, meta) }
+		}
+		return match
+	}
+	return func(*flows.PacketInfo, *FlowMeta) bool { return false }
+}
+
+// compilePacketCompare compiles a comparison, matching for OpNe as OpEq
+// does so the caller can negate it.
+func compilePacketCompare(c *displayfilter.Compare) packetPredicate {
+	switch c.Field.Kind {
+	case displayfilter.KindIP:
+		get := packetText(c.Field.Name)
+		return func(info *flows.PacketInfo, meta *FlowMeta) bool {
+			values, n := get(info, meta)
+			for _, value := range values[:n] {
+				addr, err := netip.ParseAddr(value)
+				if err != nil {
+					continue
+				}
+				for _, prefix := range c.Prefixes {
+					if prefix.Contains(addr) {
+						return true
+					}
+				}
+			}
+			return false
+		}
+	case displayfilter.KindNumber:
+		get := packetNumbers(c.Field.Name)
+		return func(info *flows.PacketInfo, meta *FlowMeta) bool {
+			values, n := get(info, meta)
+			for _, value := range values[:n] {
+				if compareNumber(c, value) {
+					return true
+				}
+			}
+			return false
+		}
+	case displayfilter.KindString:
+		get := packetText(c.Field.Name)
+		return func(info *flows.PacketInfo, meta *FlowMeta) bool {
+			values, n := get(info, meta)
+			for _, value := range values[:n] {
+				value = strings.ToLower(value)
+				for _, want := range c.Strings {
+					if (c.Op == displayfilter.OpContains && strings.Contains(value, want)) || value == want {
+						return true
+					}
+				}
+			}
+			return false
+		}
+	case displayfilter.KindFlags:
+		return func(info *flows.PacketInfo, meta *FlowMeta) bool {
+			if strings.ToUpper(info.Proto) != "TCP" {
+				return false
+			}
+			for _, flag := range c.Flags {
+				if !hasFlag(info.TCPFlags, flag) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return func(*flows.PacketInfo, *FlowMeta) bool { return false }
+}
+
+func compareNumber(c *displayfilter.Compare, value float64) bool {
+	switch c.Op {
+	case displayfilter.OpLt:
+		return value < c.Ranges[0].Lo
+	case displayfilter.OpLe:
+		return value <= c.Ranges[0].Lo
+	case displayfilter.OpGt:
+		return value > c.Ranges[0].Lo
+	case displayfilter.OpGe:
+		return value >= c.Ranges[0].Lo
+	}
+	for _, r := range c.Ranges {
+		if value >= r.Lo && value <= r.Hi {
+			return true
+		}
+	}
+	return false
+}
+
+// packetText returns the getter for a text or address field: the packet's
+// values for it, of which there are at most two.
+func packetText(name string) func(*flows.PacketInfo, *FlowMeta) ([2]string, int) {
+	switch name {
+	case "ip":
+		return func(info *flows.PacketInfo, _ *FlowMeta) ([2]string, int) {
+			return [2]string{info.SrcIP, info.DstIP}, 2
+		}
+	case "src":
+		return func(info *flows.PacketInfo, _ *FlowMeta) ([2]string, int) { return [2]string{info.SrcIP}, 1 }
+	case "dst":
+		return func(info *flows.PacketInfo, _ *FlowMeta) ([2]string, int) { return [2]string{info.DstIP}, 1 }
+	case "proto":
+		return func(info *flows.PacketInfo, _ *FlowMeta) ([2]string, int) { return [2]string{info.Proto}, 1 }
+	case "sni":
+		return func(info *flows.PacketInfo, _ *FlowMeta) ([2]string, int) { return textValues(info.TLSSNI, "") }
+	case "tunnel":
+		return func(info *flows.PacketInfo, _ *FlowMeta) ([2]string, int) { return textValues(&info.Tunnel.Type, "") }
+	// Fingerprints match every packet of a flow whose stored fingerprint
+	// matches, as well as the hello that carries it.
+	case "ja3":
+		return func(info *flows.PacketInfo, meta *FlowMeta) ([2]string, int) { return textValues(info.JA3, meta.JA3) }
+	case "ja3s":
+		return func(info *flows.PacketInfo, meta *FlowMeta) ([2]string, int) { return textValues(info.JA3S, meta.JA3S) }
+	case "ja4":
+		return func(info *flows.PacketInfo, meta *FlowMeta) ([2]string, int) { return textValues(info.JA4, meta.JA4) }
+	}
+	return func(*flows.PacketInfo, *FlowMeta) ([2]string, int) { return [2]string{}, 0 }
+}
+
+// textValues returns the values of a field the packet and its flow may
+// each lack.
+func textValues(packet *string, flow string) ([2]string, int) {
+	var out [2]string
+	n := 0
+	if packet != nil && *packet != "" {
+		out[n] = *packet
+		n++
+	}
+	if flow != "" {
+		out[n] = flow
+		n++
+	}
+	return out, n
+}
+
+// packetNumbers returns the getter for a numeric field.
+func packetNumbers(name string) func(*flows.PacketInfo, *FlowMeta) ([2]float64, int) {
+	switch name {
+	case "port":
+		return func(info *flows.PacketInfo, _ *FlowMeta) ([2]float64, int) {
+			return [2]float64{float64(info.SrcPort), float64(info.DstPort)}, 2
+		}
+	case "src_port":
+		return func(info *flows.PacketInfo, _ *FlowMeta) ([2]float64, int) {
+			return [2]float64{float64(info.SrcPort)}, 1
+		}
+	case "dst_port":
+		return func(info *flows.PacketInfo, _ *FlowMeta) ([2]float64, int) {
+			return [2]float64{float64(info.DstPort)}, 1
+		}
+	case "len":
+		return func(info *flows.PacketInfo, _ *FlowMeta) ([2]float64, int) {
+			return [2]float64{float64(info.Length)}, 1
+		}
+	case "stream":
+		return func(_ *flows.PacketInfo, meta *FlowMeta) ([2]float64, int) {
+			if meta.StreamID == nil {
+				return [2]float64{}, 0
+			}
+			return [2]float64{float64(*meta.StreamID)}, 1
+		}
+	case "tunnel_id":
+		return func(info *flows.PacketInfo, _ *FlowMeta) ([2]float64, int) {
+			if info.Tunnel.Type == "" {
+				return [2]float64{}, 0
+			}
+			return [2]float64{float64(info.Tunnel.ID)}, 1
+		}
+	}
+	return func(*flows.PacketInfo, *FlowMeta) ([2]float64, int) { return [2]float64{}, 0 }
+}
@@ -0,0 +1,56 @@
+package pcap
+
+import (
+	"testing"
+
+	"netsage/internal/flows"
+)
+
+func TestPacketFilterExpressions(t *testing.T) {
+	sni := "api.example.com"
+	ja3 := "abc123"
+	stream := 4
+	hello := flows.PacketInfo{Proto: "TCP", SrcIP: "10.1.2.3", DstIP: "192.0.2.10", SrcPort: 51000, DstPort: 443,
+		Length: 1400, TCPFlags: flows.TCPFlags{ACK: true, PSH: true}, TLSSNI: &sni}
+	reset := flows.PacketInfo{Proto: "TCP", SrcIP: "192.0.2.10", DstIP: "10.1.2.3", SrcPort: 443, DstPort: 51000,
+		Length: 60, TCPFlags: flows.TCPFlags{RST: true, ACK: true}}
+	dns := flows.PacketInfo{Proto: "UDP", SrcIP: "172.16.0.5", DstIP: "8.8.8.8", SrcPort: 5353, DstPort: 53, Length: 80}
+	meta := FlowMeta{StreamID: &stream, JA3: ja3}
+
+	cases := []struct {
+		raw  string
+		want [3]bool // hello, reset, dns
+	}{
+		{raw: `(ip in 10.0.0.0/8 or sni ~ "api") and not flags:RST and len > 1000`, want: [3]bool{true, false, false}},
+		{raw: "ip in 10.0.0.0/8", want: [3]bool{true, true, false}},
+		{raw: "ip != 10.1.2.3", want: [3]bool{false, false, true}},
+		{raw: "src in {172.16.0.0/12 192.0.2.10}", want: [3]bool{false, true, true}},
+		{raw: "port in {53 440..450}", want: [3]bool{true, true, true}},
+		{raw: "dst_port < 100 or flags:SYN", want: [3]bool{false, false, true}},
+		{raw: "proto:tcp flags:RST,ACK", want: [3]bool{false, true, false}},
+		{raw: "not proto == TCP", want: [3]bool{false, false, true}},
+		{raw: "sni == API.EXAMPLE.COM", want: [3]bool{true, false, false}},
+		{raw: "sni != api.example.com", want: [3]bool{false, true, true}},
+		{raw: "stream:4 and ja3:ABC123", want: [3]bool{true, true, false}},
+		{raw: "stream != 4", want: [3]bool{false, false, true}},
+		{raw: "len >= 80 && len <= 80", want: [3]bool{false, false, true}},
+	}
+	for _, tc := range cases {
+		filter, err := ParsePacketFilter(tc.raw)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.raw, err)
+		}
+		got := [3]bool{
+			filter.Matches(hello, meta),
+			filter.Matches(reset, meta),
+			filter.Matches(dns, FlowMeta{}),
+		}
+		if got != tc.want {
+			t.Fatalf("%q: expected %v, got %v", tc.raw, tc.want, got)
+		}
+	}
+
+	if _, err := ParsePacketFilter("bytes > 100"); err == nil {
+		t.Fatalf("expected a flow-only field to be rejected")
+	}
+}
@@ -0,0 +1,319 @@
+package pcap
+
+import (
+	"sort"
+	"time"
+
+	"netsage/internal/flows"
+)
+
+// closedFlowLinger is how long a reset or fully closed TCP connection stays
+// in the table after its last packet, so late ACKs and retransmitted FINs
+// still reach it, before it is expired.
+const closedFlowLinger = time.Minute
+
+// maxFinishedFlows bounds the flows finalized early that the table remembers
+// so their connections can be carried on. With a memory budget, no more are
+// remembered than fit in a quarter of it.
+const maxFinishedFlows = 1 << 16
+
+// finishedFlowBytes approximates what the table keeps of a flow finalized
+// early: its key twice, as the map's and its own, its reuse tracker and its
+// continuation.
+const finishedFlowBytes = 512
+
+// flowTable assigns packets to flows. Each 5-tuple maps to its latest
+// connection; when a packet starts a new connection on a reused 5-tuple, a
+// new flow is created with the next generation and the old one is left as
+// it was. TCP flows are numbered in the order their first packet appears,
+// as Wireshark numbers tcp.stream. The table decides where packets go from
+// its own copy of what reuse depends on, so it never reads a flow that may be
+// being updated on a shard.
+//
+// A flow finalized early, because it went idle past the expiry or the table
+// was over its memory budget, is remembered by 5-tuple. A later packet on the
+// 5-tuple that does not start a new connection carries the connection on in
+// a flow with the same key and TCP stream, which is stored as part of the
+// same flow; one that does gets the next generation.
+type flowTable struct {
+	flows    map[flows.FlowKey]*flows.FlowAgg
+	latest   map[flows.FlowKey]*tableEntry
+	finished map[flows.FlowKey]*finishedFlow
+	streams  int
+	created  int
+	tcpIdle  time.Duration
+	udpIdle  time.Duration
+	expiry   time.Duration
+	budget   int64
+	// dropped are the keys of flows finalized early that the table stopped
+	// remembering since the last hand-off.
+	dropped []flows.FlowKey
+}
+
+type tableEntry struct {
+	flow  *flows.FlowAgg
+	reuse *flows.ReuseTracker
+	// id numbers flows in the order they were created and start is when
+	// their connection started, for the packet index; indexed is set once
+	// the index has the flow.
+	id      int
+	start   time.Time
+	indexed bool
+}
+
+// finishedFlow is what the table keeps of a flow finalized early.
+type finishedFlow struct {
+	key      flows.FlowKey
+	reuse    *flows.ReuseTracker
+	from     flows.Continuation
+	lastSeen time.Time
+}
+
+func newFlowTable(result map[flows.FlowKey]*flows.FlowAgg, opts Options) *flowTable {
+	return &flowTable{
+		flows:    result,
+		latest:   make(map[flows.FlowKey]*tableEntry),
+		finished: make(map[flows.FlowKey]*finishedFlow),
+		tcpIdle:  opts.TCPIdleTimeout,
+		udpIdle:  opts.UDPIdleTimeout,
+		expiry:   opts.FlowExpiry,
+		budget:   opts.MemoryBudget,
+	}
+}
+
+// lookup returns the entry of the flow info belongs to and whether info
+// travels in the flow's key direction, creating the flow when needed. Every
+// packet passed to lookup must then be passed to the flow's Update.
+func (t *flowTable) lookup(info flows.PacketInfo) (*tableEntry, bool) {
+	key := packetKey(info)
+	entry, forward := t.latest[key], true
+	if entry == nil {
+		entry, forward = t.latest[key.Reverse()], false
+	}
+	switch {
+	case entry == nil:
+		entry, forward = t.resume(key, info)
+	case entry.reuse.StartsNewConnection(info, t.idleTimeout(info.Proto)):
+		// The new connection is keyed in the direction of its first
+		// packet, so a SYN makes its sender the client.
+		old := entry.flow.Key
+		old.Generation = 0
+		delete(t.latest, old)
+		next := key
+		next.Generation = entry.flow.Key.Generation + 1
+		entry, forward = t.newEntry(next, info.Timestamp), true
+		t.latest[key] = entry
+	}
+	entry.reuse.Observe(info, forward)
+	return entry, forward
+}
+
+// find returns the latest flow on a 5-tuple in either direction.
+func (t *flowTable) find(key flows.FlowKey) *flows.FlowAgg {
+	key.Generation = 0
+	if entry, ok := t.latest[key]; ok {
+		return entry.flow
+	}
+	if entry, ok := t.latest[key.Reverse()]; ok {
+		return entry.flow
+	}
+	return nil
+}
+
+// add starts a flow for info on a 5-tuple that has none in the table.
+func (t *flowTable) add(info flows.PacketInfo) *flows.FlowAgg {
+	entry, _ := t.resume(packetKey(info), info)
+	return entry.flow
+}
+
+// resume starts the flow of info on a 5-tuple that has none in the table.
+// When the 5-tuple's last flow was finalized early and info does not start a
+// new connection, the new flow carries that flow's connection on.
+func (t *flowTable) resume(key flows.FlowKey, info flows.PacketInfo) (*tableEntry, bool) {
+	finished, forward := t.finished[key], true
+	if finished == nil {
+		finished, forward = t.finished[key.Reverse()], false
+	}
+	if finished == nil {
+		entry := t.newEntry(key, info.Timestamp)
+		t.latest[key] = entry
+		return entry, true
+	}
+	tuple := finished.key
+	tuple.Generation = 0
+	delete(t.finished, tuple)
+
+	if finished.reuse.StartsNewConnection(info, t.idleTimeout(info.Proto)) {
+		t.dropped = append(t.dropped, finished.key)
+		next := key
+		next.Generation = finished.key.Generation + 1
+		entry := t.newEntry(next, info.Timestamp)
+		t.latest[key] = entry
+		return entry, true
+	}
+	flow := flows.ContinueFlowAgg(finished.key, info.Timestamp, finished.from)
+	t.flows[flow.Key] = flow
+	entry := &tableEntry{flow: flow, reuse: finished.reuse, id: t.created, start: finished.from.Start}
+	t.created++
+	t.latest[tuple] = entry
+	return entry, forward
+}
+
+func (t *flowTable) newEntry(key flows.FlowKey, ts time.Time) *tableEntry {
+	flow := flows.NewFlowAgg(key, ts)
+	if key.Proto == "TCP" {
+		stream := t.streams
+		t.streams++
+		flow.TCPStreamID = &stream
+	}
+	t.flows[key] = flow
+	entry := &tableEntry{flow: flow, reuse: flows.NewReuseTracker(ts), id: t.created, start: ts}
+	t.created++
+	return entry
+}
+
+// expire removes and returns the flows that can be finalized before the
+// capture ends: flows idle for longer than the expiry, closed TCP
+// connections past closedFlowLinger and, while the estimated footprint of
+// the table, with the flows it remembers, is over budget, the flows seen
+// least recently. Eviction goes
+// down to three quarters of the budget so it does not run on every sweep,
+// and spares open flows still active, seen within their idle timeout or,
+// without one, closedFlowLinger.
+func (t *flowTable) expire(now time.Time) []*flows.FlowAgg {
+	linger := closedFlowLinger
+	if t.expiry > 0 && t.expiry < linger {
+		linger = t.expiry
+	}
+	var expired []*flows.FlowAgg
+	var footprint int64
+	for _, flow := range t.flows {
+		idle := now.Sub(flow.LastSeen)
+		if (t.expiry > 0 && idle > t.expiry) || (flow.Closed() && idle > linger) {
+			t.remove(flow)
+			expired = append(expired, flow)
+			continue
+		}
+		footprint += flow.Footprint()
+	}
+	footprint += int64(len(t.finished)) * finishedFlowBytes
+	if t.budget <= 0 || footprint <= t.budget {
+		return expired
+	}
+
+	oldest := make([]*flows.FlowAgg, 0, len(t.flows))
+	for _, flow := range t.flows {
+		oldest = append(oldest, flow)
+	}
+	sort.Slice(oldest, func(i, j int) bool {
+		if !oldest[i].LastSeen.Equal(oldest[j].LastSeen) {
+			return oldest[i].LastSeen.Before(oldest[j].LastSeen)
+		}
+		return flows.KeyLess(oldest[i].Key, oldest[j].Key)
+	})
+	target := t.budget / 4 * 3
+	for _, flow := range oldest {
+		if footprint <= target {
+			break
+		}
+		if !flow.Closed() && now.Sub(flow.LastSeen) <= t.activeWindow(flow.Key.Proto) {
+			continue
+		}
+		footprint -= flow.Footprint() - finishedFlowBytes
+		t.remove(flow)
+		expired = append(expired, flow)
+	}
+	return expired
+}
+
+func (t *flowTable) remove(flow *flows.FlowAgg) {
+	delete(t.flows, flow.Key)
+	tuple := flow.Key
+	tuple.Generation = 0
+	if entry, ok := t.latest[tuple]; ok && entry.flow == flow {
+		delete(t.latest, tuple)
+		t.finished[tuple] = &finishedFlow{key: flow.Key, reuse: entry.reuse, from: flow.Continuation(), lastSeen: flow.LastSeen}
+	}
+}
+
+// forgetFinished drops the flows finalized early that a packet could no
+// longer carry on, as it would start a new connection after the idle
+// timeout of a flow that is not TCP, and, past maxFinished, those seen least
+// recently. It must only run once the flows finalized so far have been
+// handed off, so a new flow on a forgotten 5-tuple cannot share a key with
+// one still held.
+func (t *flowTable) forgetFinished(now time.Time) {
+	for tuple, finished := range t.finished {
+		if idle := t.idleTimeout(tuple.Proto); tuple.Proto != "TCP" && idle > 0 && now.Sub(finished.lastSeen) > idle {
+			t.dropped = append(t.dropped, finished.key)
+			delete(t.finished, tuple)
+		}
+	}
+	limit := t.maxFinished()
+	if len(t.finished) <= limit {
+		return
+	}
+	oldest := make([]*finishedFlow, 0, len(t.finished))
+	for _, finished := range t.finished {
+		oldest = append(oldest, finished)
+	}
+	sort.Slice(oldest, func(i, j int) bool {
+		if !oldest[i].lastSeen.Equal(oldest[j].lastSeen) {
+			return oldest[i].lastSeen.Before(oldest[j].lastSeen)
+		}
+		return flows.KeyLess(oldest[i].key, oldest[j].key)
+	})
+	for _, finished := range oldest[:len(oldest)-limit/4*3] {
+		t.dropped = append(t.dropped, finished.key)
+		tuple := finished.key
+		tuple.Generation = 0
+		delete(t.finished, tuple)
+	}
+}
+
+// forgotten returns the keys of the flows in batch, just handed off, and of
+// those handed off before, whose connections no later flow will carry on.
+func (t *flowTable) forgotten(batch []*flows.FlowAgg) []flows.FlowKey {
+	keys := t.dropped
+	t.dropped = nil
+	for _, flow := range batch {
+		tuple := flow.Key
+		tuple.Generation = 0
+		if finished, ok := t.finished[tuple]; ok && finished.key == flow.Key {
+			continue
+		}
+		if entry, ok := t.latest[tuple]; ok && entry.flow.Key == flow.Key {
+			continue
+		}
+		keys = append(keys, flow.Key)
+	}
+	return keys
+}
+
+// maxFinished is how many flows finalized early the table remembers.
+func (t *flowTable) maxFinished() int {
+	if t.budget > 0 {
+		return int(min(maxFinishedFlows, t.budget/4/finishedFlowBytes))
+	}
+	return maxFinishedFlows
+}
+
+// activeWindow is how recently a flow must have been seen to be spared by
+// the memory budget.
+func (t *flowTable) activeWindow(proto string) time.Duration {
+	if idle := t.idleTimeout(proto); idle > 0 {
+		return idle
+	}
+	return closedFlowLinger
+}
+
+func (t *flowTable) idleTimeout(proto string) time.Duration {
+	switch proto {
+	case "TCP":
+		return t.tcpIdle
+	case "UDP":
+		return t.udpIdle
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,246 @@
+package pcap
+
+import (
+	"testing"
+	"time"
+
+	"netsage/internal/flows"
+)
+
+func TestFlowTableSplitsReusedTuple(t *testing.T) {
+	result := make(map[flows.FlowKey]*flows.FlowAgg)
+	table := newFlowTable(result, Options{UDPIdleTimeout: time.Minute})
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	at := func(sec int) time.Time { return start.Add(time.Duration(sec) * time.Second) }
+	tcp := func(sec int, forward bool, flags flows.TCPFlags, seq uint32) flows.PacketInfo {
+		info := flows.PacketInfo{Timestamp: at(sec), Proto: "TCP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: 40000, DstPort: 443, Seq: seq, TCPFlags: flags}
+		if !forward {
+			info.SrcIP, info.DstIP, info.SrcPort, info.DstPort = info.DstIP, info.SrcIP, info.DstPort, info.SrcPort
+		}
+		return info
+	}
+	feed := func(info flows.PacketInfo) *flows.FlowAgg {
+		entry, forward := table.lookup(info)
+		entry.flow.Update(info, forward)
+		return entry.flow
+	}
+
+	first := feed(tcp(0, true, flows.TCPFlags{SYN: true}, 100))
+	if again := feed(tcp(1, true, flows.TCPFlags{SYN: true}, 100)); again != first {
+		t.Fatalf("expected a retransmitted SYN to stay on the flow")
+	}
+	feed(tcp(1, false, flows.TCPFlags{SYN: true, ACK: true}, 900))
+	feed(tcp(2, true, flows.TCPFlags{FIN: true, ACK: true}, 101))
+	feed(tcp(2, false, flows.TCPFlags{FIN: true, ACK: true}, 901))
+
+	second := feed(tcp(12, true, flows.TCPFlags{SYN: true}, 5000))
+	if second == first || second.Key.Generation != 1 {
+		t.Fatalf("expected a new flow for the SYN after FIN, got generation %d", second.Key.Generation)
+	}
+	// Without a FIN, a different ISN is still a new connection.
+	third := feed(tcp(13, true, flows.TCPFlags{SYN: true}, 7000))
+	if third == second || third.Key.Generation != 2 {
+		t.Fatalf("expected a new flow for a SYN with a new ISN")
+	}
+	if len(result) != 3 {
+		t.Fatalf("expected 3 flows, got %d", len(result))
+	}
+	if entry, forward := table.lookup(tcp(14, false, flows.TCPFlags{ACK: true}, 1)); entry.flow != third || forward {
+		t.Fatalf("expected replies to land on the latest flow")
+	}
+
+	udp := flows.PacketInfo{Timestamp: at(0), Proto: "UDP", SrcIP: "10.0.0.1", DstIP: "10.0.0.53", SrcPort: 5353, DstPort: 53}
+	dns := feed(udp)
+	udp.Timestamp = at(30)
+	if feed(udp) != dns {
+		t.Fatalf("expected UDP within the idle timeout to stay on the flow")
+	}
+	udp.Timestamp = at(200)
+	if feed(udp) == dns {
+		t.Fatalf("expected UDP after the idle timeout to start a new flow")
+	}
+}
+
+func TestFlowTableTCPIdleTimeoutSplitsOnSYN(t *testing.T) {
+	table := newFlowTable(make(map[flows.FlowKey]*flows.FlowAgg), Options{TCPIdleTimeout: time.Minute})
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	feed := func(sec int, flags flows.TCPFlags, seq uint32) *flows.FlowAgg {
+		info := flows.PacketInfo{Timestamp: start.Add(time.Duration(sec) * time.Second), Proto: "TCP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: 40000, DstPort: 443, Seq: seq, TCPFlags: flags}
+		entry, forward := table.lookup(info)
+		entry.flow.Update(info, forward)
+		return entry.flow
+	}
+
+	first := feed(0, flows.TCPFlags{SYN: true}, 100)
+	// A data segment after a gap longer than the idle timeout still belongs
+	// to the connection.
+	if data := feed(300, flows.TCPFlags{ACK: true, PSH: true}, 101); data != first {
+		t.Fatalf("expected a data segment after the idle timeout to stay on the flow, got generation %d", data.Key.Generation)
+	}
+	// A SYN after the gap starts a new connection, even with the same ISN.
+	if next := feed(600, flows.TCPFlags{SYN: true}, 100); next == first || next.Key.Generation != 1 || *next.TCPStreamID != 1 {
+		t.Fatalf("expected a SYN after the idle timeout to start a new flow")
+	}
+}
+
+func TestFlowIndexPicksFlowByTime(t *testing.T) {
+	key := flows.FlowKey{Proto: "TCP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: 40000, DstPort: 443}
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	first, second := 0, 1
+	index := make(FlowIndex)
+	index.Add(key, FlowMeta{Start: start.Add(10 * time.Second), StreamID: &second})
+	index.Add(key, FlowMeta{Start: start, StreamID: &first})
+
+	for _, tc := range []struct {
+		key  flows.FlowKey
+		at   time.Duration
+		want int
+	}{
+		{key, 0, 0},
+		{key.Reverse(), 9 * time.Second, 0},
+		{key.Reverse(), 10*time.Second + 500*time.Nanosecond, 1},
+	} {
+		meta, ok := index.lookup(tc.key, start.Add(tc.at))
+		if !ok || *meta.StreamID != tc.want {
+			t.Fatalf("expected stream %d at %v, got %v", tc.want, tc.at, meta.StreamID)
+		}
+	}
+}
+
+func TestFlowTableExpiresFlows(t *testing.T) {
+	table := newFlowTable(make(map[flows.FlowKey]*flows.FlowAgg), Options{FlowExpiry: time.Minute})
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	at := func(sec int) time.Time { return start.Add(time.Duration(sec) * time.Second) }
+	feed := func(info flows.PacketInfo) *flows.FlowAgg {
+		entry, forward := table.lookup(info)
+		entry.flow.Update(info, forward)
+		return entry.flow
+	}
+	tcp := func(sec int, port int, flags flows.TCPFlags) flows.PacketInfo {
+		return flows.PacketInfo{Timestamp: at(sec), Proto: "TCP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: port, DstPort: 443, TCPFlags: flags}
+	}
+
+	closed := feed(tcp(0, 40000, flows.TCPFlags{RST: true}))
+	idle := feed(tcp(0, 40001, flows.TCPFlags{ACK: true}))
+	busy := feed(tcp(0, 40002, flows.TCPFlags{ACK: true}))
+	if *closed.TCPStreamID != 0 || *idle.TCPStreamID != 1 || *busy.TCPStreamID != 2 {
+		t.Fatalf("expected TCP streams numbered in order of appearance")
+	}
+	feed(tcp(50, 40002, flows.TCPFlags{ACK: true}))
+
+	expired := table.expire(at(40))
+	if len(expired) != 0 {
+		t.Fatalf("expected nothing to expire yet, got %d flows", len(expired))
+	}
+	expired = table.expire(at(61))
+	if len(expired) != 2 || len(table.flows) != 1 {
+		t.Fatalf("expected the idle and reset flows to expire, got %d with %d left", len(expired), len(table.flows))
+	}
+
+	// A packet that carries on the connection of an expired flow continues
+	// it under the same key and stream; one that starts a new connection
+	// gets the next generation.
+	again := feed(tcp(62, 40001, flows.TCPFlags{ACK: true}))
+	if again == idle || again.Key != idle.Key || *again.TCPStreamID != 1 {
+		t.Fatalf("expected the expired connection to carry on, got %+v", again.Key)
+	}
+	if again.ContinuedFrom == nil || !again.ContinuedFrom.Equal(idle.FirstSeen) {
+		t.Fatalf("expected the flow to continue the one started at %v, got %v", idle.FirstSeen, again.ContinuedFrom)
+	}
+	reused := feed(tcp(63, 40000, flows.TCPFlags{SYN: true}))
+	if reused.Key.Generation != 1 || reused.ContinuedFrom != nil || *reused.TCPStreamID != 3 {
+		t.Fatalf("expected a new generation for a SYN on the reset 5-tuple, got %+v", reused.Key)
+	}
+
+	// A TCP 5-tuple keeps counting generations once its flows are handed
+	// off, as a segment may still carry the connection on; one that is not
+	// TCP is forgotten after its idle timeout.
+	table.expire(at(200))
+	table.forgetFinished(at(200))
+	syn := tcp(201, 40000, flows.TCPFlags{SYN: true})
+	syn.Seq = 5000
+	if next := feed(syn); next.Key.Generation != 2 {
+		t.Fatalf("expected the next generation on the handed-off 5-tuple, got %d", next.Key.Generation)
+	}
+	table.tcpIdle, table.udpIdle = time.Minute, time.Minute
+	udp := flows.PacketInfo{Timestamp: at(202), Proto: "UDP", SrcIP: "10.0.0.1", DstIP: "10.0.0.53", SrcPort: 5353, DstPort: 53}
+	feed(udp)
+	table.expire(at(400))
+	table.forgetFinished(at(400))
+	udp.Timestamp = at(401)
+	oldest := feed(udp)
+	if oldest.Key.Generation != 0 {
+		t.Fatalf("expected UDP generations to restart once the idle timeout has passed")
+	}
+	if next := feed(tcp(402, 40000, flows.TCPFlags{SYN: true})); next.Key.Generation != 3 {
+		t.Fatalf("expected a SYN after the idle timeout to take the next generation, got %d", next.Key.Generation)
+	}
+
+	// Over budget, the flows seen least recently go first, but not while
+	// they are within the idle timeout.
+	table.expiry = 0
+	table.budget = 3 * oldest.Footprint()
+	for port := 50000; port < 50004; port++ {
+		feed(tcp(402+port-50000, port, flows.TCPFlags{ACK: true}))
+	}
+	if expired = table.expire(at(410)); len(expired) != 0 {
+		t.Fatalf("expected active flows to be spared, got %d evicted", len(expired))
+	}
+	expired = table.expire(at(500))
+	if len(expired) == 0 || expired[0] != oldest {
+		t.Fatalf("expected eviction to start with the least recently seen flow")
+	}
+	var footprint int64
+	for _, flow := range table.flows {
+		footprint += flow.Footprint()
+	}
+	if footprint > table.budget/4*3 {
+		t.Fatalf("expected eviction below three quarters of the budget, got %d", footprint)
+	}
+}
+
+// The table reports the flows handed off whose connections it will not carry
+// on: those it never remembered, those a new connection replaced and those
+// it forgot.
+func TestFlowTableReportsForgottenFlows(t *testing.T) {
+	table := newFlowTable(make(map[flows.FlowKey]*flows.FlowAgg), Options{FlowExpiry: time.Minute})
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	at := func(sec int) time.Time { return start.Add(time.Duration(sec) * time.Second) }
+	feed := func(sec int, port int, flags flows.TCPFlags, seq uint32) *flows.FlowAgg {
+		info := flows.PacketInfo{Timestamp: at(sec), Proto: "TCP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: port, DstPort: 443, Seq: seq, TCPFlags: flags}
+		entry, forward := table.lookup(info)
+		entry.flow.Update(info, forward)
+		return entry.flow
+	}
+
+	closed := feed(0, 40000, flows.TCPFlags{RST: true}, 0)
+	idle := feed(0, 40001, flows.TCPFlags{ACK: true}, 0)
+	replaced := feed(0, 40002, flows.TCPFlags{SYN: true}, 100)
+	feed(1, 40002, flows.TCPFlags{RST: true}, 101)
+	latest := feed(2, 40002, flows.TCPFlags{SYN: true}, 5000)
+	if latest.Key.Generation != 1 {
+		t.Fatalf("expected a new generation after the reset, got %d", latest.Key.Generation)
+	}
+
+	expired := table.expire(at(100))
+	if len(expired) != 4 {
+		t.Fatalf("expected every flow to expire, got %d", len(expired))
+	}
+	if keys := table.forgotten(expired); len(keys) != 1 || keys[0] != replaced.Key {
+		t.Fatalf("expected only the replaced generation forgotten, got %+v", keys)
+	}
+
+	if again := feed(101, 40001, flows.TCPFlags{ACK: true}, 0); again.Key != idle.Key {
+		t.Fatalf("expected the idle connection to carry on, got %+v", again.Key)
+	}
+	feed(102, 40000, flows.TCPFlags{SYN: true}, 9000)
+	if keys := table.forgotten(nil); len(keys) != 1 || keys[0] != closed.Key {
+		t.Fatalf("expected the reset connection forgotten once a SYN reused its 5-tuple, got %+v", keys)
+	}
+
+	table.budget = 1
+	table.forgetFinished(at(103))
+	if keys := table.forgotten(nil); len(keys) != 1 || keys[0] != latest.Key {
+		t.Fatalf("expected the remembered flow forgotten past the limit, got %+v", keys)
+	}
+}
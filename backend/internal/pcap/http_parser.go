@@ -2,44 +2,79 @@ package pcap
 
 import (
     "bytes"
+    "strconv"
 )
 
+// httpInfo holds one complete HTTP/1.x message head, as cut from an ordered
+// stream by httpStream.
 type httpInfo struct {
     payload []byte
 }
 
-func (h httpInfo) Parse() (*string, *string) {
+type httpResult struct {
+    method *string
+    host   *string
+    path   *string
+    status *int
+}
+
+func (h httpInfo) Parse() httpResult {
+    result := httpResult{}
     if len(h.payload) < 8 {
-        return nil, nil
+        return result
     }
 
-    methods := [][]byte{
-        []byte("GET "), []byte("POST "), []byte("PUT "), []byte("DELETE "),
-        []byte("HEAD "), []byte("OPTIONS "), []byte("PATCH "),
+    if status, ok := parseHTTPStatusLine(h.payload); ok {
+        result.status = &status
+        return result
     }
-    method := ""
-    for _, m := range methods {
-        if bytes.HasPrefix(h.payload, m) {
-            method = string(bytes.TrimSpace(m))
-            break
-        }
+
+    lines := bytes.Split(h.payload, []byte("\r\n"))
+    requestLine := bytes.Fields(lines[0])
+    if len(requestLine) != 3 || !isHTTPMethod(string(requestLine[0])) || !bytes.HasPrefix(requestLine[2], []byte("HTTP/1.")) {
+        return result
     }
-    if method == "" {
-        return nil, nil
+    method := string(requestLine[0])
+    result.method = &method
+
+    path := requestLine[1]
+    if q := bytes.IndexByte(path, '?'); q >= 0 {
+        path = path[:q]
     }
+    pathValue := string(path)
+    result.path = &pathValue
 
-    host := ""
-    lines := bytes.Split(h.payload, []byte("\r\n"))
-    for _, line := range lines {
+    for _, line := range lines[1:] {
         if bytes.HasPrefix(bytes.ToLower(line), []byte("host:")) {
-            host = string(bytes.TrimSpace(line[5:]))
+            host := string(bytes.TrimSpace(line[5:]))
+            if host != "" {
+                result.host = &host
+            }
             break
         }
     }
+    return result
+}
+
+// parseHTTPStatusLine reads the status code from an HTTP/1.x status line such
+// as "HTTP/1.1 404 Not Found".
+func parseHTTPStatusLine(payload []byte) (int, bool) {
+    if !bytes.HasPrefix(payload, []byte("HTTP/1.")) || len(payload) < 12 {
+        return 0, false
+    }
+    if payload[8] != ' ' {
+        return 0, false
+    }
+    status, err := strconv.Atoi(string(payload[9:12]))
+    if err != nil || status < 100 || status > 999 {
+        return 0, false
+    }
+    return status, true
+}
 
-    methodPtr := method
-    if host == "" {
-        return &methodPtr, nil
+func stringValue(v *string) string {
+    if v == nil {
+        return ""
     }
-    return &methodPtr, &host
+    return *v
 }
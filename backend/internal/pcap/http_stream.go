@@ -0,0 +1,444 @@
+package pcap
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+
+	"netsage/internal/flows"
+)
+
+const (
+	maxHTTPHeadBytes       = 64 * 1024
+	maxHTTPPendingRequests = 256
+)
+
+var httpMethods = []string{"GET", "POST", "PUT", "DELETE", "HEAD", "OPTIONS", "PATCH", "CONNECT", "TRACE"}
+
+type httpParseState int
+
+const (
+	httpStateHead httpParseState = iota
+	httpStateBody
+	httpStateChunkSize
+	httpStateChunkData
+	httpStateChunkEnd
+	httpStateTrailer
+	httpStateUntilClose
+	httpStateDone
+)
+
+// httpMessage is the metadata of one request or response head plus the size
+// of its body. Body bytes are skipped, not copied.
+type httpMessage struct {
+	method        string
+	path          string
+	host          string
+	status        int
+	contentLength *int64
+	start         time.Time
+	startIndex    int
+	end           time.Time
+	endIndex      int
+}
+
+// httpStream parses the HTTP/1.x messages of one direction of a connection,
+// following Content-Length and chunked framing so keep-alive and pipelined
+// messages are split correctly.
+type httpStream struct {
+	requests  bool
+	onHead    func(httpMessage)
+	state     httpParseState
+	buf       []byte
+	remaining int64
+	bodyBytes int64
+	msg       *httpMessage
+}
+
+// feed consumes in-order bytes. headNoBody reports whether the response
+// currently being parsed answers a HEAD request; emit receives every
+// completed message.
+func (s *httpStream) feed(data []byte, ts time.Time, index int, headNoBody func() bool, emit func(httpMessage)) {
+	for len(data) > 0 && s.state != httpStateDone {
+		if s.msg == nil {
+			s.msg = &httpMessage{start: ts, startIndex: index}
+		}
+
+		switch s.state {
+		case httpStateHead:
+			s.buf = append(s.buf, data...)
+			data = nil
+			end := bytes.Index(s.buf, []byte("\r\n\r\n"))
+			if end < 0 {
+				if len(s.buf) > maxHTTPHeadBytes {
+					s.stop()
+				}
+				continue
+			}
+			head := s.buf[:end]
+			data = append([]byte(nil), s.buf[end+4:]...)
+			s.buf = nil
+			if !s.readHead(head, headNoBody) {
+				s.stop()
+				continue
+			}
+			if s.onHead != nil && s.msg != nil {
+				s.onHead(*s.msg)
+			}
+			if s.state == httpStateHead && s.msg != nil {
+				s.complete(ts, index, emit)
+			}
+
+		case httpStateBody, httpStateUntilClose:
+			n := int64(len(data))
+			if s.state == httpStateBody && n > s.remaining {
+				n = s.remaining
+			}
+			s.bodyBytes += n
+			data = data[n:]
+			if s.state == httpStateBody {
+				s.remaining -= n
+				if s.remaining == 0 {
+					s.state = httpStateHead
+					s.complete(ts, index, emit)
+				}
+			}
+
+		case httpStateChunkSize:
+			s.buf = append(s.buf, data...)
+			data = nil
+			end := bytes.Index(s.buf, []byte("\r\n"))
+			if end < 0 {
+				if len(s.buf) > 1024 {
+					s.stop()
+				}
+				continue
+			}
+			line := string(s.buf[:end])
+			data = append([]byte(nil), s.buf[end+2:]...)
+			s.buf = nil
+			if semi := strings.IndexByte(line, ';'); semi >= 0 {
+				line = line[:semi]
+			}
+			size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+			if err != nil || size < 0 {
+				s.stop()
+				continue
+			}
+			if size == 0 {
+				s.state = httpStateTrailer
+				continue
+			}
+			s.remaining = size
+			s.state = httpStateChunkData
+
+		case httpStateChunkData:
+			n := int64(len(data))
+			if n > s.remaining {
+				n = s.remaining
+			}
+			s.bodyBytes += n
+			s.remaining -= n
+			data = data[n:]
+			if s.remaining == 0 {
+				s.remaining = 2
+				s.state = httpStateChunkEnd
+			}
+
+		case httpStateChunkEnd:
+			n := int64(len(data))
+			if n > s.remaining {
+				n = s.remaining
+			}
+			s.remaining -= n
+			data = data[n:]
+			if s.remaining == 0 {
+				s.state = httpStateChunkSize
+			}
+
+		case httpStateTrailer:
+			s.buf = append(s.buf, data...)
+			data = nil
+			consumed := -1
+			if bytes.HasPrefix(s.buf, []byte("\r\n")) {
+				consumed = 2
+			} else if end := bytes.Index(s.buf, []byte("\r\n\r\n")); end >= 0 {
+				consumed = end + 4
+			}
+			if consumed < 0 {
+				if len(s.buf) > maxHTTPHeadBytes {
+					s.stop()
+				}
+				continue
+			}
+			data = append([]byte(nil), s.buf[consumed:]...)
+			s.buf = nil
+			size := s.bodyBytes
+			s.msg.contentLength = &size
+			s.state = httpStateHead
+			s.complete(ts, index, emit)
+		}
+	}
+}
+
+// readHead parses a request or status line and the framing headers, leaving
+// the stream in the state that reads the body.
+func (s *httpStream) readHead(head []byte, headNoBody func() bool) bool {
+	parsed := httpInfo{payload: head}.Parse()
+	if s.requests {
+		if parsed.method == nil {
+			return false
+		}
+		s.msg.method = *parsed.method
+		s.msg.path = stringValue(parsed.path)
+		s.msg.host = stringValue(parsed.host)
+	} else {
+		if parsed.status == nil {
+			return false
+		}
+		s.msg.status = *parsed.status
+	}
+
+	var contentLength *int64
+	chunked := false
+	for _, line := range strings.Split(string(head), "\r\n")[1:] {
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSpace(line[:colon]))
+		value := strings.TrimSpace(line[colon+1:])
+		switch name {
+		case "content-length":
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil && n >= 0 {
+				contentLength = &n
+			}
+		case "transfer-encoding":
+			chunked = strings.Contains(strings.ToLower(value), "chunked")
+		}
+	}
+
+	s.bodyBytes = 0
+	if !s.requests {
+		switch {
+		case s.msg.status == 101:
+			s.msg.contentLength = contentLength
+			s.state = httpStateHead
+			return true
+		case s.msg.status < 200:
+			// Interim responses are followed by the real one.
+			s.msg = nil
+			s.state = httpStateHead
+			return true
+		case s.msg.status == 204 || s.msg.status == 304 || headNoBody():
+			s.msg.contentLength = contentLength
+			s.state = httpStateHead
+			return true
+		}
+	}
+
+	switch {
+	case chunked:
+		s.state = httpStateChunkSize
+	case contentLength != nil && *contentLength > 0:
+		s.msg.contentLength = contentLength
+		s.remaining = *contentLength
+		s.state = httpStateBody
+	case contentLength != nil:
+		s.msg.contentLength = contentLength
+		s.state = httpStateHead
+	case s.requests:
+		s.state = httpStateHead
+	default:
+		s.state = httpStateUntilClose
+	}
+	return true
+}
+
+func (s *httpStream) complete(ts time.Time, index int, emit func(httpMessage)) {
+	msg := *s.msg
+	msg.end = ts
+	msg.endIndex = index
+	s.msg = nil
+	if !s.requests && msg.status == 101 {
+		// The connection switches protocols; nothing after this is HTTP/1.x.
+		s.stop()
+	}
+	emit(msg)
+}
+
+// flush emits a message whose body was still being read when the capture
+// ended, such as a response delimited by connection close.
+func (s *httpStream) flush(emit func(httpMessage)) {
+	if s.msg == nil || s.state == httpStateHead || s.state == httpStateDone {
+		return
+	}
+	msg := *s.msg
+	if msg.contentLength == nil || s.state == httpStateUntilClose {
+		size := s.bodyBytes
+		msg.contentLength = &size
+	}
+	msg.end = msg.start
+	msg.endIndex = msg.startIndex
+	s.msg = nil
+	s.state = httpStateDone
+	emit(msg)
+}
+
+func (s *httpStream) stop() {
+	s.state = httpStateDone
+	s.buf = nil
+	s.msg = nil
+}
+
+// httpConn pairs the requests and responses of one connection in order and
+// hands completed transactions to onTransaction.
+type httpConn struct {
+	requestDir    int
+	streams       [2]httpStream
+	pending       []httpMessage
+	onTransaction func(flows.HTTPTransaction)
+}
+
+func newHTTPConn(requestDir int, onTransaction func(flows.HTTPTransaction)) *httpConn {
+	c := &httpConn{requestDir: requestDir, onTransaction: onTransaction}
+	c.streams[requestDir].requests = true
+	return c
+}
+
+// onHead registers fn to be called as soon as a request or response head has
+// been read, before its body.
+func (c *httpConn) onHead(fn func(httpMessage)) {
+	c.streams[0].onHead = fn
+	c.streams[1].onHead = fn
+}
+
+func (c *httpConn) emit(tx flows.HTTPTransaction) {
+	if c.onTransaction != nil {
+		c.onTransaction(tx)
+	}
+}
+
+func (c *httpConn) feed(dir int, data []byte, ts time.Time, index int) {
+	stream := &c.streams[dir]
+	if dir == c.requestDir {
+		stream.feed(data, ts, index, nil, c.addRequest)
+		return
+	}
+	stream.feed(data, ts, index, c.answersHEAD, c.addResponse)
+}
+
+func (c *httpConn) answersHEAD() bool {
+	return len(c.pending) > 0 && c.pending[0].method == "HEAD"
+}
+
+func (c *httpConn) addRequest(msg httpMessage) {
+	if len(c.pending) >= maxHTTPPendingRequests {
+		c.emit(requestTransaction(c.pending[0]))
+		c.pending = c.pending[1:]
+	}
+	c.pending = append(c.pending, msg)
+}
+
+func (c *httpConn) addResponse(msg httpMessage) {
+	if len(c.pending) == 0 {
+		return
+	}
+	req := c.pending[0]
+	c.pending = c.pending[1:]
+
+	tx := requestTransaction(req)
+	status := msg.status
+	responseTime := msg.start
+	responseIndex := msg.startIndex
+	ttfb := msg.start.Sub(req.end).Seconds() * 1000
+	if ttfb < 0 {
+		ttfb = 0
+	}
+	tx.Status = &status
+	tx.ContentLength = msg.contentLength
+	tx.ResponseTime = &responseTime
+	tx.ResponseIndex = &responseIndex
+	tx.TTFBMs = &ttfb
+	c.emit(tx)
+}
+
+func (c *httpConn) flush() {
+	c.streams[c.requestDir].flush(c.addRequest)
+	c.streams[1-c.requestDir].flush(c.addResponse)
+	for _, req := range c.pending {
+		c.emit(requestTransaction(req))
+	}
+	c.pending = nil
+}
+
+func requestTransaction(msg httpMessage) flows.HTTPTransaction {
+	return flows.HTTPTransaction{
+		Method:       msg.method,
+		Path:         msg.path,
+		Host:         msg.host,
+		RequestTime:  msg.end,
+		RequestIndex: msg.endIndex,
+	}
+}
+
+func isHTTPMethod(token string) bool {
+	for _, method := range httpMethods {
+		if token == method {
+			return true
+		}
+	}
+	return false
+}
+
+// looksLikeHTTPRequest reports whether a payload starts with a request line.
+func looksLikeHTTPRequest(payload []byte) bool {
+	space := bytes.IndexByte(payload, ' ')
+	return space > 0 && isHTTPMethod(string(payload[:space]))
+}
+
+// httpTracker follows plaintext HTTP/1.x connections. A flow is tracked from
+// the first in-order bytes that start with a request line.
+type httpTracker struct {
+	conns map[*flows.FlowAgg]*httpConn
+}
+
+func newHTTPTracker() *httpTracker {
+	return &httpTracker{conns: make(map[*flows.FlowAgg]*httpConn)}
+}
+
+func (t *httpTracker) observe(flow *flows.FlowAgg, chunk streamChunk, ts time.Time) {
+	conn, ok := t.conns[flow]
+	if !ok {
+		if !looksLikeHTTPRequest(chunk.data) {
+			return
+		}
+		conn = newHTTPConn(chunk.dir, flow.AddHTTPTransaction)
+		t.conns[flow] = conn
+	}
+	if chunk.gap {
+		conn.streams[chunk.dir].stop()
+		return
+	}
+	if len(chunk.data) > 0 {
+		conn.feed(chunk.dir, chunk.data, ts, int(flow.PacketCount))
+	}
+}
+
+// flush records requests still waiting for a response when the capture ends.
+func (t *httpTracker) flush() {
+	for flow, conn := range t.conns {
+		conn.flush()
+		delete(t.conns, flow)
+	}
+}
+
+// release records the requests of a flow that is finalized early and stops
+// following it.
+func (t *httpTracker) release(flow *flows.FlowAgg) {
+	if conn, ok := t.conns[flow]; ok {
+		conn.flush()
+		delete(t.conns, flow)
+	}
+}
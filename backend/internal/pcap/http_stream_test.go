@@ -0,0 +1,109 @@
+package pcap
+
+import (
+	"testing"
+	"time"
+
+	"netsage/internal/flows"
+)
+
+func TestHTTPKeepAliveTransactions(t *testing.T) {
+	key := flows.FlowKey{Proto: "TCP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: 40000, DstPort: 80}
+	base := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	flow := flows.NewFlowAgg(key, base)
+	conn := newHTTPConn(0, flow.AddHTTPTransaction)
+
+	requests := "GET /index.html?utm=1 HTTP/1.1\r\nHost: example.com\r\n\r\n" +
+		"POST /api/upload HTTP/1.1\r\nHost: example.com\r\nContent-Length: 11\r\n\r\nhello world" +
+		"HEAD /health HTTP/1.1\r\nHost: example.com\r\n\r\n" +
+		"GET /missing HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	responses := []string{
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6;ext=1\r\n world\r\n0\r\n\r\n",
+		"HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 503 Service Unavailable\r\nContent-Length: 4\r\n\r\nbusy",
+		"HTTP/1.1 200 OK\r\nContent-Length: 1234\r\n\r\n",
+	}
+
+	// Requests arrive split at arbitrary points; responses follow with growing delays.
+	for i, chunk := range splitEvery(requests, 17) {
+		conn.feed(0, []byte(chunk), base.Add(time.Duration(i)*time.Millisecond), i+1)
+	}
+	for i, resp := range responses {
+		ts := base.Add(time.Duration(100*(i+1)) * time.Millisecond)
+		for _, chunk := range splitEvery(resp, 9) {
+			conn.feed(1, []byte(chunk), ts, 50+i)
+		}
+	}
+	conn.flush()
+	flow.Finalize()
+
+	if flow.HTTPRequests != 4 || flow.HTTPResponses != 3 {
+		t.Fatalf("expected 4 requests and 3 responses, got %d/%d", flow.HTTPRequests, flow.HTTPResponses)
+	}
+	if flow.HTTP4xx != 0 || flow.HTTP5xx != 1 {
+		t.Fatalf("unexpected error counts 4xx=%d 5xx=%d", flow.HTTP4xx, flow.HTTP5xx)
+	}
+	if len(flow.HTTPTransactions) != 4 {
+		t.Fatalf("expected 4 transactions, got %d", len(flow.HTTPTransactions))
+	}
+
+	first := flow.HTTPTransactions[0]
+	if first.Method != "GET" || first.Path != "/index.html" || first.Host != "example.com" {
+		t.Fatalf("unexpected first transaction %+v", first)
+	}
+	if first.ContentLength == nil || *first.ContentLength != 11 {
+		t.Fatalf("expected chunked body length 11, got %v", first.ContentLength)
+	}
+	post := flow.HTTPTransactions[1]
+	if post.Status == nil || *post.Status != 503 || post.ContentLength == nil || *post.ContentLength != 4 {
+		t.Fatalf("expected 503 with 4 byte body after 100 Continue, got %+v", post)
+	}
+	head := flow.HTTPTransactions[2]
+	if head.Status == nil || *head.Status != 200 || head.ContentLength == nil || *head.ContentLength != 1234 {
+		t.Fatalf("expected bodiless HEAD response, got %+v", head)
+	}
+	if last := flow.HTTPTransactions[3]; last.Status != nil || last.Path != "/missing" {
+		t.Fatalf("expected unanswered final request, got %+v", last)
+	}
+
+	if flow.HTTPTTFBP50Ms == nil || flow.HTTPTTFBP95Ms == nil {
+		t.Fatalf("expected response time percentiles")
+	}
+	if *flow.HTTPTTFBP50Ms >= *flow.HTTPTTFBP95Ms {
+		t.Fatalf("expected p50 < p95, got %.1f/%.1f", *flow.HTTPTTFBP50Ms, *flow.HTTPTTFBP95Ms)
+	}
+	if got := flow.HTTPErrorIndexes(); len(got) != 1 || got[0] != 51 {
+		t.Fatalf("expected error evidence at packet 51, got %v", got)
+	}
+}
+
+func TestHTTPResponseDelimitedByClose(t *testing.T) {
+	key := flows.FlowKey{Proto: "TCP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: 40001, DstPort: 80}
+	base := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	flow := flows.NewFlowAgg(key, base)
+	conn := newHTTPConn(1, flow.AddHTTPTransaction)
+
+	conn.feed(1, []byte("GET / HTTP/1.0\r\n\r\n"), base, 1)
+	conn.feed(0, []byte("HTTP/1.0 404 Not Found\r\n\r\nnot "), base.Add(20*time.Millisecond), 2)
+	conn.feed(0, []byte("found"), base.Add(21*time.Millisecond), 3)
+	conn.flush()
+
+	if flow.HTTP4xx != 1 || len(flow.HTTPTransactions) != 1 {
+		t.Fatalf("expected one 4xx transaction, got %d/%d", flow.HTTP4xx, len(flow.HTTPTransactions))
+	}
+	tx := flow.HTTPTransactions[0]
+	if tx.ContentLength == nil || *tx.ContentLength != 9 {
+		t.Fatalf("expected close-delimited body of 9 bytes, got %v", tx.ContentLength)
+	}
+	if tx.TTFBMs == nil || *tx.TTFBMs != 20 {
+		t.Fatalf("expected 20ms to first byte, got %v", tx.TTFBMs)
+	}
+}
+
+func splitEvery(s string, n int) []string {
+	var parts []string
+	for len(s) > n {
+		parts = append(parts, s[:n])
+		s = s[n:]
+	}
+	return append(parts, s)
+}
@@ -0,0 +1,182 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+
+	"netsage/internal/flows"
+)
+
+type icmpInfo struct {
+	payload []byte
+	v6      bool
+}
+
+// Parse decodes an ICMP or ICMPv6 message, including the type and code header.
+// Error messages carry the original datagram's IP header and the first bytes
+// of its L4 header, which are used to recover the flow key that triggered it.
+func (i icmpInfo) Parse() *flows.ICMPMessage {
+	data := i.payload
+	if len(data) < 8 {
+		return nil
+	}
+	msg := &flows.ICMPMessage{
+		Type: int(data[0]),
+		Code: int(data[1]),
+		V6:   i.v6,
+	}
+
+	if i.v6 {
+		switch msg.Type {
+		case 1:
+			msg.Unreachable = true
+		case 2:
+			msg.FragNeeded = true
+			mtu := int(binary.BigEndian.Uint32(data[4:8]))
+			msg.NextHopMTU = &mtu
+		case 3:
+			msg.TimeExceeded = true
+		}
+	} else {
+		switch msg.Type {
+		case 3:
+			if msg.Code == 4 {
+				msg.FragNeeded = true
+				if mtu := int(binary.BigEndian.Uint16(data[6:8])); mtu > 0 {
+					msg.NextHopMTU = &mtu
+				}
+			} else {
+				msg.Unreachable = true
+			}
+		case 11:
+			msg.TimeExceeded = true
+		}
+	}
+
+	if msg.IsError() {
+		msg.Original = parseEmbeddedFlowKey(data[8:])
+	}
+	return msg
+}
+
+func parseEmbeddedFlowKey(data []byte) *flows.FlowKey {
+	if len(data) < 1 {
+		return nil
+	}
+	var proto byte
+	var srcIP, dstIP net.IP
+	var l4 []byte
+	fragmented := false
+
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return nil
+		}
+		ihl := int(data[0]&0x0f) * 4
+		if ihl < 20 || len(data) < ihl {
+			return nil
+		}
+		proto = data[9]
+		srcIP = net.IP(data[12:16])
+		dstIP = net.IP(data[16:20])
+		fragmented = binary.BigEndian.Uint16(data[6:8])&0x1fff != 0
+		l4 = data[ihl:]
+	case 6:
+		if len(data) < 40 {
+			return nil
+		}
+		srcIP = net.IP(data[8:24])
+		dstIP = net.IP(data[24:40])
+		var ok bool
+		proto, l4, fragmented, ok = skipIPv6ExtensionHeaders(data[6], data[40:])
+		if !ok {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	key := &flows.FlowKey{SrcIP: srcIP.String(), DstIP: dstIP.String()}
+	switch proto {
+	case 6:
+		key.Proto = "TCP"
+	case 17:
+		key.Proto = "UDP"
+	case 1:
+		key.Proto = "ICMP"
+		return key
+	case 58:
+		key.Proto = "ICMPv6"
+		return key
+	default:
+		return nil
+	}
+	if fragmented || len(l4) < 4 {
+		return nil
+	}
+	key.SrcPort = int(binary.BigEndian.Uint16(l4[0:2]))
+	key.DstPort = int(binary.BigEndian.Uint16(l4[2:4]))
+	return key
+}
+
+func skipIPv6ExtensionHeaders(next byte, data []byte) (byte, []byte, bool, bool) {
+	fragmented := false
+	for hops := 0; hops < 8; hops++ {
+		var hdrLen int
+		switch next {
+		case 0, 43, 60:
+			if len(data) < 2 {
+				return 0, nil, false, false
+			}
+			hdrLen = (int(data[1]) + 1) * 8
+		case 44:
+			if len(data) < 8 {
+				return 0, nil, false, false
+			}
+			fragmented = binary.BigEndian.Uint16(data[2:4])&0xfff8 != 0
+			hdrLen = 8
+		case 51:
+			if len(data) < 2 {
+				return 0, nil, false, false
+			}
+			hdrLen = (int(data[1]) + 2) * 4
+		default:
+			return next, data, fragmented, true
+		}
+		if len(data) < hdrLen {
+			return 0, nil, false, false
+		}
+		next = data[0]
+		data = data[hdrLen:]
+	}
+	return 0, nil, false, false
+}
+
+func icmpTypeString(msg flows.ICMPMessage) string {
+	switch {
+	case msg.V6 && msg.FragNeeded:
+		return "Packet too big"
+	case msg.FragNeeded:
+		return "Fragmentation needed"
+	case msg.Unreachable:
+		return "Destination unreachable"
+	case msg.TimeExceeded:
+		return "Time exceeded"
+	case msg.V6 && msg.Type == 128, !msg.V6 && msg.Type == 8:
+		return "Echo request"
+	case msg.V6 && msg.Type == 129, !msg.V6 && msg.Type == 0:
+		return "Echo reply"
+	case msg.V6 && msg.Type == 133:
+		return "Router solicitation"
+	case msg.V6 && msg.Type == 134:
+		return "Router advertisement"
+	case msg.V6 && msg.Type == 135:
+		return "Neighbor solicitation"
+	case msg.V6 && msg.Type == 136:
+		return "Neighbor advertisement"
+	default:
+		return "Type " + strconv.Itoa(msg.Type)
+	}
+}
@@ -0,0 +1,101 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestICMPFragNeededEmbeddedFlow(t *testing.T) {
+	original := make([]byte, 28)
+	original[0] = 0x45
+	original[9] = 6
+	copy(original[12:16], net.ParseIP("10.0.0.5").To4())
+	copy(original[16:20], net.ParseIP("198.51.100.7").To4())
+	binary.BigEndian.PutUint16(original[20:22], 51514)
+	binary.BigEndian.PutUint16(original[22:24], 443)
+
+	data := []byte{3, 4, 0, 0, 0, 0}
+	data = binary.BigEndian.AppendUint16(data, 1400)
+	data = append(data, original...)
+
+	msg := icmpInfo{payload: data}.Parse()
+	if msg == nil || !msg.FragNeeded || !msg.IsError() {
+		t.Fatalf("expected fragmentation needed, got %+v", msg)
+	}
+	if msg.NextHopMTU == nil || *msg.NextHopMTU != 1400 {
+		t.Fatalf("expected next-hop MTU 1400, got %v", msg.NextHopMTU)
+	}
+	key := msg.Original
+	if key == nil || key.Proto != "TCP" || key.SrcIP != "10.0.0.5" || key.DstIP != "198.51.100.7" || key.SrcPort != 51514 || key.DstPort != 443 {
+		t.Fatalf("unexpected embedded flow key %+v", key)
+	}
+}
+
+func TestICMPv6PacketTooBigEmbeddedFlow(t *testing.T) {
+	original := make([]byte, 56)
+	original[0] = 0x60
+	original[6] = 60
+	copy(original[8:24], net.ParseIP("2001:db8::5"))
+	copy(original[24:40], net.ParseIP("2001:db8::53"))
+	original[40] = 17
+	original[41] = 0
+	binary.BigEndian.PutUint16(original[48:50], 40000)
+	binary.BigEndian.PutUint16(original[50:52], 53)
+
+	data := []byte{2, 0, 0, 0}
+	data = binary.BigEndian.AppendUint32(data, 1280)
+	data = append(data, original...)
+
+	msg := icmpInfo{payload: data, v6: true}.Parse()
+	if msg == nil || !msg.FragNeeded {
+		t.Fatalf("expected packet too big, got %+v", msg)
+	}
+	if msg.NextHopMTU == nil || *msg.NextHopMTU != 1280 {
+		t.Fatalf("expected MTU 1280, got %v", msg.NextHopMTU)
+	}
+	key := msg.Original
+	if key == nil || key.Proto != "UDP" || key.SrcIP != "2001:db8::5" || key.DstPort != 53 || key.SrcPort != 40000 {
+		t.Fatalf("unexpected embedded flow key %+v", key)
+	}
+}
+
+// An ICMP error records its own capture frame on the flow it quotes.
+func TestAnalyzeICMPErrorFrame(t *testing.T) {
+	client, server, router := net.IP{10, 0, 0, 5}, net.IP{198, 51, 100, 7}, net.IP{10, 0, 0, 1}
+	ether := func() *layers.Ethernet {
+		return &layers.Ethernet{SrcMAC: defragMAC, DstMAC: defragMAC, EthernetType: layers.EthernetTypeIPv4}
+	}
+	segment := func(seq uint32) []byte {
+		ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: client, DstIP: server}
+		tcp := &layers.TCP{SrcPort: 51514, DstPort: 443, ACK: true, Seq: seq, Window: 502}
+		return serializeLayers(t, ether(), ip, tcp, gopacket.Payload(make([]byte, 1400)))
+	}
+	quoted := segment(1)[14:42]
+	icmpIP := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolICMPv4, SrcIP: router, DstIP: client}
+	icmp := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(3, 4), Seq: 1300}
+
+	path := filepath.Join(t.TempDir(), "icmp.pcap")
+	writeEthernetFrames(t, path, [][]byte{
+		segment(1),
+		segment(1401),
+		serializeLayers(t, ether(), icmpIP, icmp, gopacket.Payload(quoted)),
+		segment(1),
+	})
+	_, _, stored := indexedCapture(t, path, Options{})
+	for _, flow := range stored {
+		if flow.Key.Proto != "TCP" {
+			continue
+		}
+		if flow.ICMPFragNeeded != 1 || fmt.Sprint(flow.ICMPErrorFrames()) != "[3]" {
+			t.Fatalf("expected the ICMP error's own frame, got %d errors at %v", flow.ICMPFragNeeded, flow.ICMPErrorFrames())
+		}
+		return
+	}
+	t.Fatalf("expected a TCP flow")
+}
@@ -0,0 +1,83 @@
+package pcap
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Labels written by NSS-compatible key loggers (SSLKEYLOGFILE).
+const (
+	keyLogClientRandom            = "CLIENT_RANDOM"
+	keyLogClientHandshakeSecret   = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogServerHandshakeSecret   = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogClientApplicationSecret = "CLIENT_TRAFFIC_SECRET_0"
+	keyLogServerApplicationSecret = "SERVER_TRAFFIC_SECRET_0"
+)
+
+// KeyLog maps a ClientHello random to the secrets logged for that session.
+type KeyLog struct {
+	secrets map[string]map[string][]byte
+}
+
+func LoadKeyLog(path string) (*KeyLog, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseKeyLog(file)
+}
+
+// ParseKeyLog reads the NSS key log format. Comments, blank lines and labels
+// the analyzer does not use are skipped; malformed secret lines are an error.
+func ParseKeyLog(r io.Reader) (*KeyLog, error) {
+	log := &KeyLog{secrets: make(map[string]map[string][]byte)}
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("keylog line %d: expected 3 fields", lineNo)
+		}
+		random, err := hex.DecodeString(fields[1])
+		if err != nil || len(random) != 32 {
+			return nil, fmt.Errorf("keylog line %d: invalid client random", lineNo)
+		}
+		secret, err := hex.DecodeString(fields[2])
+		if err != nil || len(secret) == 0 {
+			return nil, fmt.Errorf("keylog line %d: invalid secret", lineNo)
+		}
+		id := strings.ToLower(fields[1])
+		if log.secrets[id] == nil {
+			log.secrets[id] = make(map[string][]byte)
+		}
+		log.secrets[id][fields[0]] = secret
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+func (k *KeyLog) Len() int {
+	if k == nil {
+		return 0
+	}
+	return len(k.secrets)
+}
+
+func (k *KeyLog) secret(clientRandom []byte, label string) []byte {
+	if k == nil {
+		return nil
+	}
+	return k.secrets[hex.EncodeToString(clientRandom)][label]
+}
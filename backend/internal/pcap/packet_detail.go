@@ -0,0 +1,692 @@
+package pcap
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"netsage/internal/capturefilter"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ErrPacketNotFound is returned for a packet number past the end of the
+// capture.
+var ErrPacketNotFound = errors.New("packet not found")
+
+// PacketDetail is one frame decoded layer by layer. Packet is the frame as
+// the packet list shows it, and is nil for frames that are no packet of
+// their own, such as ARP or the first fragments of a datagram.
+type PacketDetail struct {
+	Index          int         `json:"index"`
+	Timestamp      time.Time   `json:"timestamp"`
+	CapturedLength int         `json:"captured_length"`
+	Length         int         `json:"length"`
+	Packet         *PacketMeta `json:"packet,omitempty"`
+	Layers         []Layer     `json:"layers"`
+	Payload        *Payload    `json:"payload,omitempty"`
+}
+
+// Layer is one protocol header of a frame. Length is how many bytes of the
+// frame it covers.
+type Layer struct {
+	Name   string  `json:"name"`
+	Length int     `json:"length"`
+	Fields []Field `json:"fields"`
+}
+
+// Field is a header field, with the fields it is made of as children.
+type Field struct {
+	Name     string  `json:"name"`
+	Value    string  `json:"value,omitempty"`
+	Children []Field `json:"children,omitempty"`
+}
+
+// Payload holds the first bytes of the innermost transport payload of a
+// frame, hex encoded. Length is the whole payload's.
+type Payload struct {
+	Length    int    `json:"length"`
+	Truncated bool   `json:"truncated"`
+	Hex       string `json:"hex"`
+}
+
+// PacketDetails decodes frame number frame of the capture at path, numbered
+// as in ListPackets. At most payloadBytes of its payload are returned; with
+// 0 the payload is left out. indexPath names the capture's packet index;
+// without a usable one the capture is decoded from the start.
+func PacketDetails(ctx context.Context, path, indexPath string, capture *capturefilter.Filter, frame int, flowIndex FlowIndex, payloadBytes int) (*PacketDetail, error) {
+	if frame < 1 {
+		return nil, ErrPacketNotFound
+	}
+	if index, err := openPacketIndex(indexPath); err == nil {
+		defer index.close()
+		return indexedPacketDetails(ctx, path, index, frame, flowIndex, payloadBytes)
+	}
+
+	var detail *PacketDetail
+	err := scanPackets(ctx, path, capture, flowIndex, func(scanned *scannedPacket) bool {
+		if scanned.frame < frame {
+			return true
+		}
+		detail = newPacketDetail(scanned.frame, scanned.packet, payloadBytes)
+		if scanned.ok {
+			summary := newPacketMeta(scanned.frame, scanned.info, scanned.tags, scanned.meta.StreamID)
+			detail.Packet = &summary
+		}
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if detail == nil {
+		return nil, ErrPacketNotFound
+	}
+	return detail, nil
+}
+
+// indexedPacketDetails is PacketDetails reading the index to find the frame.
+func indexedPacketDetails(ctx context.Context, path string, index *packetIndexReader, frame int, flowIndex FlowIndex, payloadBytes int) (*PacketDetail, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var fragments fragmentWindow
+	for {
+		p, err := index.next()
+		if err == io.EOF {
+			return nil, ErrPacketNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		if p.frame%4096 == 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			default:
+			}
+		}
+		if p.fragment {
+			fragments.add(p)
+		}
+		if p.frame < frame {
+			continue
+		}
+
+		data, err := readIndexedData(file, p)
+		if err != nil {
+			return nil, err
+		}
+		detail := newPacketDetail(p.frame, decodeCaptured(data, p.captureInfo()), payloadBytes)
+		if p.flow != nil {
+			info, err := readIndexedPacket(file, p, fragments.before(p))
+			if err != nil {
+				return nil, err
+			}
+			meta, _ := p.flow.storedMeta(flowIndex)
+			summary := newPacketMeta(p.frame, info, p.tags, meta.StreamID)
+			detail.Packet = &summary
+		}
+		return detail, nil
+	}
+}
+
+func newPacketDetail(frame int, packet gopacket.Packet, payloadBytes int) *PacketDetail {
+	ci := packet.Metadata().CaptureInfo
+	detail := &PacketDetail{
+		Index:          frame,
+		Timestamp:      ci.Timestamp,
+		CapturedLength: ci.CaptureLength,
+		Length:         ci.Length,
+		Layers:         []Layer{},
+	}
+
+	var tcp *layers.TCP
+	var payload []byte
+	hasPayload := false
+	for _, layer := range packet.Layers() {
+		switch layer.(type) {
+		case *layers.TLS, *gopacket.Payload:
+			// Application data is described from the TCP payload below,
+			// and is otherwise only shown as the payload.
+			continue
+		}
+		detail.Layers = append(detail.Layers, describeLayer(layer))
+		if l, ok := layer.(*layers.TCP); ok {
+			tcp = l
+		}
+		if _, ok := layer.(gopacket.TransportLayer); ok {
+			payload, hasPayload = layer.LayerPayload(), true
+		}
+	}
+	if tcp != nil && len(tcp.Payload) > 0 {
+		if layer, ok := tlsLayer(tcp.Payload); ok {
+			detail.Layers = append(detail.Layers, layer)
+		} else if layer, ok := httpLayer(tcp.Payload); ok {
+			detail.Layers = append(detail.Layers, layer)
+		}
+	}
+
+	if payloadBytes > 0 && hasPayload && len(payload) > 0 {
+		shown := payload
+		if len(shown) > payloadBytes {
+			shown = shown[:payloadBytes]
+		}
+		detail.Payload = &Payload{Length: len(payload), Truncated: len(shown) < len(payload), Hex: hex.EncodeToString(shown)}
+	}
+	return detail
+}
+
+func describeLayer(layer gopacket.Layer) Layer {
+	out := Layer{Name: layer.LayerType().String(), Length: len(layer.LayerContents())}
+	switch l := layer.(type) {
+	case *layers.Ethernet:
+		out.Fields = []Field{
+			field("Destination", l.DstMAC),
+			field("Source", l.SrcMAC),
+		}
+		if l.Length > 0 {
+			out.Fields = append(out.Fields, field("Length", l.Length))
+		} else {
+			out.Fields = append(out.Fields, field("Type", etherTypeName(l.EthernetType)))
+		}
+	case *layers.Dot1Q:
+		out.Fields = []Field{
+			field("Priority", l.Priority),
+			field("Drop eligible", l.DropEligible),
+			field("VLAN ID", l.VLANIdentifier),
+			field("Type", etherTypeName(l.Type)),
+		}
+	case *layers.LinuxSLL:
+		out.Fields = []Field{
+			field("Packet type", l.PacketType),
+			field("Address type", l.AddrType),
+			field("Address", l.Addr),
+			field("Protocol", etherTypeName(l.EthernetType)),
+		}
+	case *linuxSLL2:
+		out.Fields = []Field{
+			field("Protocol", etherTypeName(l.Protocol)),
+			field("Interface index", l.InterfaceIndex),
+			field("Packet type", layers.LinuxSLLPacketType(l.PacketType)),
+		}
+	case *layers.Loopback:
+		out.Fields = []Field{field("Family", l.Family)}
+	case *layers.IPv4:
+		out.Fields = []Field{
+			field("Version", l.Version),
+			field("Header length", int(l.IHL)*4),
+			field("DSCP", l.TOS>>2),
+			field("ECN", l.TOS&3),
+			field("Total length", l.Length),
+			field("Identification", fmt.Sprintf("0x%04x", l.Id)),
+			{Name: "Flags", Value: l.Flags.String(), Children: []Field{
+				field("Don't fragment", l.Flags&layers.IPv4DontFragment != 0),
+				field("More fragments", l.Flags&layers.IPv4MoreFragments != 0),
+			}},
+			field("Fragment offset", int(l.FragOffset)*8),
+			field("TTL", l.TTL),
+			field("Protocol", ipProtocolName(l.Protocol)),
+			field("Checksum", fmt.Sprintf("0x%04x", l.Checksum)),
+			field("Source", l.SrcIP),
+			field("Destination", l.DstIP),
+		}
+		if len(l.Options) > 0 {
+			options := Field{Name: "Options"}
+			for _, opt := range l.Options {
+				options.Children = append(options.Children, field(ipv4OptionName(opt.OptionType), fmt.Sprintf("%d bytes", opt.OptionLength)))
+			}
+			out.Fields = append(out.Fields, options)
+		}
+	case *layers.IPv6:
+		out.Fields = []Field{
+			field("Version", l.Version),
+			field("Traffic class", fmt.Sprintf("0x%02x", l.TrafficClass)),
+			field("Flow label", fmt.Sprintf("0x%05x", l.FlowLabel)),
+			field("Payload length", l.Length),
+			field("Next header", ipProtocolName(l.NextHeader)),
+			field("Hop limit", l.HopLimit),
+			field("Source", l.SrcIP),
+			field("Destination", l.DstIP),
+		}
+	case *layers.TCP:
+		out.Fields = []Field{
+			field("Source port", uint16(l.SrcPort)),
+			field("Destination port", uint16(l.DstPort)),
+			field("Sequence number", l.Seq),
+			field("Acknowledgment number", l.Ack),
+			field("Header length", int(l.DataOffset)*4),
+			tcpFlagsField(l),
+			field("Window", l.Window),
+			field("Checksum", fmt.Sprintf("0x%04x", l.Checksum)),
+			field("Urgent pointer", l.Urgent),
+		}
+		if len(l.Options) > 0 {
+			options := Field{Name: "Options"}
+			for _, opt := range l.Options {
+				options.Children = append(options.Children, tcpOptionField(opt))
+			}
+			out.Fields = append(out.Fields, options)
+		}
+		out.Fields = append(out.Fields, field("Payload length", len(l.Payload)))
+	case *layers.UDP:
+		out.Fields = []Field{
+			field("Source port", uint16(l.SrcPort)),
+			field("Destination port", uint16(l.DstPort)),
+			field("Length", l.Length),
+			field("Checksum", fmt.Sprintf("0x%04x", l.Checksum)),
+		}
+	case *layers.ICMPv4:
+		out.Fields = []Field{
+			field("Type", l.TypeCode.Type()),
+			field("Code", l.TypeCode.Code()),
+			field("Message", l.TypeCode),
+			field("Checksum", fmt.Sprintf("0x%04x", l.Checksum)),
+		}
+		if t := l.TypeCode.Type(); t == layers.ICMPv4TypeEchoRequest || t == layers.ICMPv4TypeEchoReply {
+			out.Fields = append(out.Fields, field("Identifier", l.Id), field("Sequence", l.Seq))
+		}
+	case *layers.ICMPv6:
+		out.Fields = []Field{
+			field("Type", l.TypeCode.Type()),
+			field("Code", l.TypeCode.Code()),
+			field("Message", l.TypeCode),
+			field("Checksum", fmt.Sprintf("0x%04x", l.Checksum)),
+		}
+	case *layers.ARP:
+		operation := strconv.Itoa(int(l.Operation))
+		switch l.Operation {
+		case layers.ARPRequest:
+			operation = "request"
+		case layers.ARPReply:
+			operation = "reply"
+		}
+		out.Fields = []Field{
+			field("Hardware type", l.AddrType),
+			field("Protocol type", etherTypeName(l.Protocol)),
+			field("Operation", operation),
+			field("Sender MAC", net.HardwareAddr(l.SourceHwAddress)),
+			field("Sender IP", net.IP(l.SourceProtAddress)),
+			field("Target MAC", net.HardwareAddr(l.DstHwAddress)),
+			field("Target IP", net.IP(l.DstProtAddress)),
+		}
+	case *layers.DNS:
+		out.Fields = dnsFields(l)
+	case *gopacket.DecodeFailure:
+		out.Name = "Malformed"
+		out.Fields = []Field{field("Error", l.Error())}
+	default:
+		out.Fields = reflectedFields(layer)
+	}
+	if out.Fields == nil {
+		out.Fields = []Field{}
+	}
+	return out
+}
+
+func field(name string, value interface{}) Field {
+	return Field{Name: name, Value: fmt.Sprint(value)}
+}
+
+func etherTypeName(t layers.EthernetType) string {
+	return fmt.Sprintf("%s (0x%04x)", t, uint16(t))
+}
+
+func ipProtocolName(p layers.IPProtocol) string {
+	return fmt.Sprintf("%s (%d)", p, uint8(p))
+}
+
+func ipv4OptionName(optionType uint8) string {
+	switch optionType {
+	case 0:
+		return "End of options"
+	case 1:
+		return "No operation"
+	case 7:
+		return "Record route"
+	case 68:
+		return "Timestamp"
+	case 131:
+		return "Loose source route"
+	case 137:
+		return "Strict source route"
+	case 148:
+		return "Router alert"
+	}
+	return fmt.Sprintf("Option %d", optionType)
+}
+
+func tcpFlagsField(l *layers.TCP) Field {
+	flags := []struct {
+		name string
+		set  bool
+	}{
+		{"NS", l.NS}, {"CWR", l.CWR}, {"ECE", l.ECE}, {"URG", l.URG}, {"ACK", l.ACK},
+		{"PSH", l.PSH}, {"RST", l.RST}, {"SYN", l.SYN}, {"FIN", l.FIN},
+	}
+	out := Field{Name: "Flags"}
+	var set []string
+	for _, flag := range flags {
+		if flag.set {
+			set = append(set, flag.name)
+		}
+		out.Children = append(out.Children, field(flag.name, flag.set))
+	}
+	out.Value = strings.Join(set, ", ")
+	return out
+}
+
+func tcpOptionField(opt layers.TCPOption) Field {
+	data := opt.OptionData
+	switch opt.OptionType {
+	case layers.TCPOptionKindEndList:
+		return Field{Name: "End of options"}
+	case layers.TCPOptionKindNop:
+		return Field{Name: "No operation"}
+	case layers.TCPOptionKindMSS:
+		if len(data) == 2 {
+			return field("Maximum segment size", binary.BigEndian.Uint16(data))
+		}
+	case layers.TCPOptionKindWindowScale:
+		if len(data) == 1 {
+			return field("Window scale", fmt.Sprintf("%d (multiply by %d)", data[0], 1<<min(data[0], 14)))
+		}
+	case layers.TCPOptionKindSACKPermitted:
+		return Field{Name: "SACK permitted"}
+	case layers.TCPOptionKindSACK:
+		sack := Field{Name: "SACK", Value: fmt.Sprintf("%d blocks", len(data)/8)}
+		for i := 0; i+8 <= len(data); i += 8 {
+			sack.Children = append(sack.Children, field("Block", fmt.Sprintf("%d-%d", binary.BigEndian.Uint32(data[i:]), binary.BigEndian.Uint32(data[i+4:]))))
+		}
+		return sack
+	case layers.TCPOptionKindTimestamps:
+		if len(data) == 8 {
+			return Field{Name: "Timestamps", Children: []Field{
+				field("TSval", binary.BigEndian.Uint32(data[0:4])),
+				field("TSecr", binary.BigEndian.Uint32(data[4:8])),
+			}}
+		}
+	}
+	return field(opt.OptionType.String(), fmt.Sprintf("%d bytes", len(data)))
+}
+
+func dnsFields(l *layers.DNS) []Field {
+	fields := []Field{
+		field("Transaction ID", fmt.Sprintf("0x%04x", l.ID)),
+		field("Response", l.QR),
+		field("Opcode", l.OpCode),
+		field("Authoritative", l.AA),
+		field("Truncated", l.TC),
+		field("Recursion desired", l.RD),
+		field("Recursion available", l.RA),
+		field("Response code", l.ResponseCode),
+	}
+	questions := Field{Name: "Questions", Value: strconv.Itoa(len(l.Questions))}
+	for _, q := range l.Questions {
+		questions.Children = append(questions.Children, field(string(q.Name), fmt.Sprintf("%s %s", q.Type, q.Class)))
+	}
+	fields = append(fields, questions)
+	for _, section := range []struct {
+		name    string
+		records []layers.DNSResourceRecord
+	}{{"Answers", l.Answers}, {"Authorities", l.Authorities}, {"Additionals", l.Additionals}} {
+		records := Field{Name: section.name, Value: strconv.Itoa(len(section.records))}
+		for _, rr := range section.records {
+			value := fmt.Sprintf("%s %s TTL %d", rr.Type, rr.Class, rr.TTL)
+			switch {
+			case rr.IP != nil:
+				value += " " + rr.IP.String()
+			case rr.CNAME != nil:
+				value += " " + string(rr.CNAME)
+			case rr.NS != nil:
+				value += " " + string(rr.NS)
+			case rr.PTR != nil:
+				value += " " + string(rr.PTR)
+			}
+			records.Children = append(records.Children, field(string(rr.Name), value))
+		}
+		fields = append(fields, records)
+	}
+	return fields
+}
+
+// reflectedFields describes a layer without its own builder by its exported
+// scalar fields. Raw bytes are left out, as they may hold payload.
+func reflectedFields(layer gopacket.Layer) []Field {
+	v := reflect.ValueOf(layer)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	var fields []Field
+	for i := 0; i < v.NumField(); i++ {
+		sf := v.Type().Field(i)
+		if !sf.IsExported() || sf.Anonymous {
+			continue
+		}
+		value := v.Field(i)
+		if stringer, ok := value.Interface().(fmt.Stringer); ok {
+			if value.Kind() == reflect.Ptr && value.IsNil() {
+				continue
+			}
+			fields = append(fields, field(sf.Name, stringer.String()))
+			continue
+		}
+		switch value.Kind() {
+		case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.String:
+			fields = append(fields, field(sf.Name, value.Interface()))
+		}
+	}
+	return fields
+}
+
+// looksLikeTLSRecord reports whether data starts with a TLS record header.
+func looksLikeTLSRecord(data []byte) bool {
+	return len(data) >= 5 && data[0] >= 20 && data[0] <= 24 && data[1] == 3 && data[2] <= 4
+}
+
+var tlsContentTypes = map[byte]string{
+	20: "ChangeCipherSpec",
+	21: "Alert",
+	22: "Handshake",
+	23: "ApplicationData",
+	24: "Heartbeat",
+}
+
+var tlsHandshakeTypes = map[byte]string{
+	0:  "HelloRequest",
+	1:  "ClientHello",
+	2:  "ServerHello",
+	4:  "NewSessionTicket",
+	8:  "EncryptedExtensions",
+	11: "Certificate",
+	12: "ServerKeyExchange",
+	13: "CertificateRequest",
+	14: "ServerHelloDone",
+	15: "CertificateVerify",
+	16: "ClientKeyExchange",
+	20: "Finished",
+	24: "KeyUpdate",
+}
+
+var tlsExtensionNames = map[uint16]string{
+	0x0000: "server_name",
+	0x0005: "status_request",
+	0x000a: "supported_groups",
+	0x000b: "ec_point_formats",
+	0x000d: "signature_algorithms",
+	0x0010: "application_layer_protocol_negotiation",
+	0x0012: "signed_certificate_timestamp",
+	0x0015: "padding",
+	0x0017: "extended_master_secret",
+	0x001b: "compress_certificate",
+	0x001c: "record_size_limit",
+	0x0023: "session_ticket",
+	0x0029: "pre_shared_key",
+	0x002b: "supported_versions",
+	0x002d: "psk_key_exchange_modes",
+	0x0033: "key_share",
+	0xfe0d: "encrypted_client_hello",
+	0xff01: "renegotiation_info",
+}
+
+// tlsLayer describes the TLS records a TCP payload starts with. A record
+// continuing past the segment is described as far as its header.
+func tlsLayer(payload []byte) (Layer, bool) {
+	if !looksLikeTLSRecord(payload) {
+		return Layer{}, false
+	}
+	layer := Layer{Name: "TLS"}
+	data := payload
+	for looksLikeTLSRecord(data) {
+		recordLen := int(binary.BigEndian.Uint16(data[3:5]))
+		record := Field{Name: "Record", Value: tlsContentTypes[data[0]], Children: []Field{
+			field("Content type", fmt.Sprintf("%s (%d)", tlsContentTypes[data[0]], data[0])),
+			field("Version", tlsVersionName(binary.BigEndian.Uint16(data[1:3]))),
+			field("Length", recordLen),
+		}}
+		if len(data) < 5+recordLen {
+			record.Children = append(record.Children, field("Continues in a later segment", 5+recordLen-len(data)))
+			layer.Fields = append(layer.Fields, record)
+			layer.Length += len(data)
+			break
+		}
+		body := data[5 : 5+recordLen]
+		switch data[0] {
+		case 21:
+			// Encrypted alerts are longer than the two plaintext bytes.
+			if len(body) == 2 {
+				record.Children = append(record.Children, field("Level", body[0]), field("Description", body[1]))
+			}
+		case 22:
+			record.Children = append(record.Children, tlsHandshakeFields(body)...)
+		}
+		layer.Fields = append(layer.Fields, record)
+		layer.Length += 5 + recordLen
+		data = data[5+recordLen:]
+	}
+	return layer, true
+}
+
+func tlsHandshakeFields(body []byte) []Field {
+	var fields []Field
+	for len(body) >= 4 {
+		name, known := tlsHandshakeTypes[body[0]]
+		if !known {
+			fields = append(fields, field("Handshake", "Encrypted handshake message"))
+			break
+		}
+		hsLen := int(body[1])<<16 | int(body[2])<<8 | int(body[3])
+		message := Field{Name: "Handshake", Value: name, Children: []Field{
+			field("Type", fmt.Sprintf("%s (%d)", name, body[0])),
+			field("Length", hsLen),
+		}}
+		if len(body) < 4+hsLen {
+			message.Children = append(message.Children, field("Continues in a later record", 4+hsLen-len(body)))
+			fields = append(fields, message)
+			break
+		}
+		if body[0] == 1 || body[0] == 2 {
+			message.Children = append(message.Children, tlsHelloFields(parseHandshake(body[:4+hsLen]))...)
+		}
+		fields = append(fields, message)
+		body = body[4+hsLen:]
+	}
+	return fields
+}
+
+func tlsHelloFields(hello tlsHello) []Field {
+	fields := []Field{field("Version", tlsVersionName(hello.legacyVersion))}
+	if hello.hsType == 1 {
+		suites := Field{Name: "Cipher suites", Value: strconv.Itoa(len(hello.ciphers))}
+		for _, suite := range hello.ciphers {
+			suites.Children = append(suites.Children, Field{Name: fmt.Sprintf("0x%04x", suite)})
+		}
+		fields = append(fields, suites)
+	} else if len(hello.ciphers) == 1 {
+		fields = append(fields, field("Cipher suite", fmt.Sprintf("0x%04x", hello.ciphers[0])))
+	}
+	if hello.sni != nil {
+		fields = append(fields, field("Server name", *hello.sni))
+	}
+	if hello.alpn != nil {
+		fields = append(fields, field("ALPN", *hello.alpn))
+	}
+	if len(hello.supportedVersions) > 0 {
+		versions := Field{Name: "Supported versions"}
+		for _, v := range hello.supportedVersions {
+			versions.Children = append(versions.Children, Field{Name: tlsVersionName(v)})
+		}
+		fields = append(fields, versions)
+	}
+	extensions := Field{Name: "Extensions", Value: strconv.Itoa(len(hello.extensions))}
+	for _, ext := range hello.extensions {
+		name, ok := tlsExtensionNames[ext]
+		if !ok {
+			name = "unknown"
+		}
+		extensions.Children = append(extensions.Children, field(fmt.Sprintf("0x%04x", ext), name))
+	}
+	return append(fields, extensions)
+}
+
+func tlsVersionName(v uint16) string {
+	raw := []byte{byte(v >> 8), byte(v)}
+	if name := tlsVersionString(raw); name != "" {
+		return fmt.Sprintf("%s (0x%04x)", name, v)
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// httpLayer describes an HTTP/1.x message head a TCP payload starts with. It
+// names the headers but leaves their values out.
+func httpLayer(payload []byte) (Layer, bool) {
+	head := payload
+	end := bytes.Index(payload, []byte("\r\n\r\n"))
+	if end >= 0 {
+		head = payload[:end]
+	}
+	lines := bytes.Split(head, []byte("\r\n"))
+	if end < 0 && len(lines) > 1 {
+		// The last line may continue in a later segment.
+		lines = lines[:len(lines)-1]
+	}
+
+	layer := Layer{Name: "HTTP", Length: len(payload)}
+	if end >= 0 {
+		layer.Length = end + 4
+	}
+	if status, ok := parseHTTPStatusLine(payload); ok {
+		layer.Fields = []Field{field("Version", string(payload[:8])), field("Status code", status)}
+	} else if requestLine := bytes.Fields(lines[0]); looksLikeHTTPRequest(payload) && len(requestLine) == 3 && bytes.HasPrefix(requestLine[2], []byte("HTTP/1.")) {
+		layer.Fields = []Field{field("Method", string(requestLine[0])), field("Version", string(requestLine[2]))}
+	} else {
+		return Layer{}, false
+	}
+
+	headers := Field{Name: "Headers"}
+	for _, line := range lines[1:] {
+		if colon := bytes.IndexByte(line, ':'); colon > 0 {
+			headers.Children = append(headers.Children, Field{Name: string(bytes.TrimSpace(line[:colon]))})
+		}
+	}
+	headers.Value = strconv.Itoa(len(headers.Children))
+	layer.Fields = append(layer.Fields, headers)
+	return layer, true
+}
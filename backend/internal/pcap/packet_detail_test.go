@@ -0,0 +1,222 @@
+package pcap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// writeDetailCapture writes a TCP handshake SYN and a ClientHello on a VLAN,
+// an HTTP request and an ARP request.
+func writeDetailCapture(t *testing.T, path string) {
+	t.Helper()
+	client, server := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+	vlan := func(ls ...gopacket.SerializableLayer) []byte {
+		head := []gopacket.SerializableLayer{
+			&layers.Ethernet{SrcMAC: defragMAC, DstMAC: defragMAC, EthernetType: layers.EthernetTypeDot1Q},
+			&layers.Dot1Q{Priority: 3, VLANIdentifier: 42, Type: layers.EthernetTypeIPv4},
+		}
+		return serializeLayers(t, append(head, ls...)...)
+	}
+	ip := func() *layers.IPv4 {
+		return &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Flags: layers.IPv4DontFragment, Protocol: layers.IPProtocolTCP, SrcIP: client, DstIP: server}
+	}
+	timestamps := make([]byte, 8)
+	binary.BigEndian.PutUint32(timestamps, 1000)
+	syn := &layers.TCP{SrcPort: 40000, DstPort: 443, Seq: 100, SYN: true, Window: 64240, Options: []layers.TCPOption{
+		{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xb4}},
+		{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2},
+		{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: timestamps},
+		{OptionType: layers.TCPOptionKindNop},
+		{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{7}},
+	}}
+	hello := buildClientHello("example.test", "h2")
+	record := append([]byte{22, 3, 1, byte(len(hello) >> 8), byte(len(hello))}, hello...)
+	data := &layers.TCP{SrcPort: 40000, DstPort: 443, Seq: 101, ACK: true, PSH: true, Window: 502}
+
+	request := "GET /private?token=s3cret HTTP/1.1\r\nHost: example.test\r\nCookie: session=abc\r\n\r\n"
+	httpIP := ip()
+	httpIP.DstIP = net.IP{10, 0, 0, 3}
+	plain := &layers.TCP{SrcPort: 40001, DstPort: 80, Seq: 1, ACK: true, PSH: true, Window: 502}
+	arp := &layers.ARP{AddrType: layers.LinkTypeEthernet, Protocol: layers.EthernetTypeIPv4, HwAddressSize: 6, ProtAddressSize: 4,
+		Operation: layers.ARPRequest, SourceHwAddress: defragMAC, SourceProtAddress: client, DstHwAddress: make([]byte, 6), DstProtAddress: server}
+
+	frames := [][]byte{
+		vlan(ip(), syn),
+		vlan(ip(), data, gopacket.Payload(record)),
+		serializeLayers(t, &layers.Ethernet{SrcMAC: defragMAC, DstMAC: defragMAC, EthernetType: layers.EthernetTypeIPv4}, httpIP, plain, gopacket.Payload(request)),
+		serializeLayers(t, &layers.Ethernet{SrcMAC: defragMAC, DstMAC: layers.EthernetBroadcast, EthernetType: layers.EthernetTypeARP}, arp),
+	}
+	writeEthernetFrames(t, path, frames)
+}
+
+// writeEthernetFrames writes frames to a pcap at path a millisecond apart.
+func writeEthernetFrames(t *testing.T, path string, frames [][]byte) {
+	t.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	defer file.Close()
+	writer := pcapgo.NewWriter(file)
+	if err := writer.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatalf("header: %v", err)
+	}
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i, frame := range frames {
+		ci := gopacket.CaptureInfo{Timestamp: start.Add(time.Duration(i) * time.Millisecond), CaptureLength: len(frame), Length: len(frame)}
+		if err := writer.WritePacket(ci, frame); err != nil {
+			t.Fatalf("write packet: %v", err)
+		}
+	}
+}
+
+// findField returns the first field named name, searching depth first.
+func findField(fields []Field, name string) *Field {
+	for i := range fields {
+		if fields[i].Name == name {
+			return &fields[i]
+		}
+		if found := findField(fields[i].Children, name); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func layerNames(detail *PacketDetail) string {
+	var names []string
+	for _, layer := range detail.Layers {
+		names = append(names, layer.Name)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestPacketDetailLayers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "detail.pcap")
+	writeDetailCapture(t, path)
+	indexPath, flowIndex, _ := indexedCapture(t, path, Options{})
+	ctx := context.Background()
+
+	details := func(frame, payloadBytes int) *PacketDetail {
+		t.Helper()
+		want, err := PacketDetails(ctx, path, "", nil, frame, flowIndex, payloadBytes)
+		if err != nil {
+			t.Fatalf("frame %d scan: %v", frame, err)
+		}
+		got, err := PacketDetails(ctx, path, indexPath, nil, frame, flowIndex, payloadBytes)
+		if err != nil {
+			t.Fatalf("frame %d indexed: %v", frame, err)
+		}
+		if mustJSON(t, got) != mustJSON(t, want) {
+			t.Fatalf("frame %d: indexed details differ\n got %s\nwant %s", frame, mustJSON(t, got), mustJSON(t, want))
+		}
+		return got
+	}
+
+	syn := details(1, 0)
+	if names := layerNames(syn); names != "Ethernet Dot1Q IPv4 TCP" {
+		t.Fatalf("expected the SYN's layers, got %s", names)
+	}
+	tcp := syn.Layers[3].Fields
+	for _, want := range []struct {
+		layer       int
+		name, value string
+	}{
+		{1, "VLAN ID", "42"}, {2, "Don't fragment", "true"}, {2, "Protocol", "TCP (6)"}, {3, "Flags", "SYN"},
+		{3, "Maximum segment size", "1460"}, {3, "Window scale", "7 (multiply by 128)"}, {3, "TSval", "1000"},
+	} {
+		if f := findField(syn.Layers[want.layer].Fields, want.name); f == nil || f.Value != want.value {
+			t.Fatalf("expected %s %q in %s, got %+v", want.name, want.value, syn.Layers[want.layer].Name, f)
+		}
+	}
+	if findField(tcp, "SACK permitted") == nil || syn.Packet == nil || syn.Packet.StreamID == nil {
+		t.Fatalf("expected SACK permitted and the packet's stream, got %s", mustJSON(t, syn))
+	}
+
+	hello := details(2, 0)
+	if names := layerNames(hello); names != "Ethernet Dot1Q IPv4 TCP TLS" {
+		t.Fatalf("expected TLS after TCP, got %s", names)
+	}
+	fields := hello.Layers[4].Fields
+	if f := findField(fields, "Handshake"); f == nil || f.Value != "ClientHello" {
+		t.Fatalf("expected a ClientHello, got %+v", fields)
+	}
+	if f := findField(fields, "Server name"); f == nil || f.Value != "example.test" {
+		t.Fatalf("expected the SNI, got %+v", f)
+	}
+	if f := findField(fields, "ALPN"); f == nil || f.Value != "h2" {
+		t.Fatalf("expected the ALPN, got %+v", f)
+	}
+	if hello.Payload != nil {
+		t.Fatalf("expected no payload unless asked for")
+	}
+
+	request := details(3, 0)
+	http := request.Layers[len(request.Layers)-1]
+	if http.Name != "HTTP" || findField(http.Fields, "Method").Value != "GET" || findField(http.Fields, "Host") == nil || findField(http.Fields, "Cookie") == nil {
+		t.Fatalf("expected the request's method and header names, got %+v", http)
+	}
+	for _, secret := range []string{"s3cret", "abc", "private"} {
+		if strings.Contains(mustJSON(t, request), secret) {
+			t.Fatalf("expected no header values or path without payload, got %s", mustJSON(t, request))
+		}
+	}
+	withPayload := details(3, 8)
+	if p := withPayload.Payload; p == nil || p.Hex != "474554202f707269" || !p.Truncated || p.Length != 79 {
+		t.Fatalf("expected the first 8 payload bytes, got %+v", p)
+	}
+
+	arp := details(4, 0)
+	if arp.Packet != nil || layerNames(arp) != "Ethernet ARP" || findField(arp.Layers[1].Fields, "Target IP").Value != "10.0.0.2" {
+		t.Fatalf("expected an ARP request with no packet summary, got %s", mustJSON(t, arp))
+	}
+
+	for _, indexPath := range []string{"", indexPath} {
+		if _, err := PacketDetails(ctx, path, indexPath, nil, 5, flowIndex, 0); !errors.Is(err, ErrPacketNotFound) {
+			t.Fatalf("expected ErrPacketNotFound past the last frame, got %v", err)
+		}
+	}
+}
+
+// Every frame of a fragmented capture is described the same with or
+// without the index, including the packet summary of reassembled datagrams.
+func TestPacketDetailsMatchScan(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fragmented.pcapng")
+	writeFragmentedCapture(t, path, true)
+	indexPath, flowIndex, _ := indexedCapture(t, path, Options{})
+	ctx := context.Background()
+	reassembled := 0
+	for frame := 1; ; frame++ {
+		want, err := PacketDetails(ctx, path, "", nil, frame, flowIndex, 64)
+		if errors.Is(err, ErrPacketNotFound) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("frame %d scan: %v", frame, err)
+		}
+		got, err := PacketDetails(ctx, path, indexPath, nil, frame, flowIndex, 64)
+		if err != nil {
+			t.Fatalf("frame %d indexed: %v", frame, err)
+		}
+		if mustJSON(t, got) != mustJSON(t, want) {
+			t.Fatalf("frame %d: indexed details differ\n got %s\nwant %s", frame, mustJSON(t, got), mustJSON(t, want))
+		}
+		if got.Packet != nil && got.Packet.Protocol == "UDP" {
+			reassembled++
+		}
+	}
+	if reassembled != 4 {
+		t.Fatalf("expected the 4 reassembled datagrams to have a summary, got %d", reassembled)
+	}
+}
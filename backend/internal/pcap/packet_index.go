@@ -0,0 +1,721 @@
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"netsage/internal/flows"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// The packet index is a sidecar AnalyzeFile writes next to a capture so the
+// packet list and timeseries can be served without decoding the capture
+// again. It is a stream of records in capture order: each interface and
+// flow is recorded before the first packet that refers to it, and every
+// captured frame has a packet record with its file offset, time, flow and
+// error tags, plus the TLS and HTTP labels that take stream reassembly to
+// find. Integers are varints; times and offsets are stored as deltas from
+// the previous packet.
+const (
+	packetIndexMagic   = "NSPX"
+	packetIndexVersion = 1
+
+	indexRecordInterface byte = 'i'
+	indexRecordFlow      byte = 'f'
+	indexRecordPacket    byte = 'p'
+)
+
+// Packet record flags.
+const (
+	indexPacketForward byte = 1 << iota
+	indexPacketFlow
+	indexPacketFragment
+	indexPacketNote
+)
+
+// Packet note fields, in the order they are stored.
+const (
+	noteClientHello uint16 = 1 << iota
+	noteServerHello
+	noteAlert
+	noteAlertCode
+	noteSNI
+	noteJA3
+	noteJA3S
+	noteJA4
+	noteHTTPMethod
+	noteHTTPHost
+	noteHTTPStatus
+)
+
+var errPacketIndex = errors.New("packet index is corrupt")
+
+// packetTagNames lists the error tags tagsForPacket produces; the index
+// stores a tag as its position here. Tags not listed are stored by name.
+var packetTagNames = []string{
+	"tls_alert", "dns_nxdomain", "dns_servfail",
+	"icmp_frag_needed", "icmp_unreachable", "icmp_time_exceeded",
+	"rst", "syn_retransmission", "retransmission",
+	"rto_retransmission", "fast_retransmission", "tail_loss_probe", "spurious_retransmission",
+	"partial_retransmission", "dsack", "dup_ack",
+	"zero_window", "zero_window_probe", "window_update", "window_full",
+}
+
+var packetTagCodes = func() map[string]int {
+	codes := make(map[string]int, len(packetTagNames))
+	for i, name := range packetTagNames {
+		codes[name] = i + 1
+	}
+	return codes
+}()
+
+// packetNote holds the labels a packet gets from its reassembled stream
+// rather than from its own bytes.
+type packetNote struct {
+	clientHello bool
+	serverHello bool
+	alert       bool
+	alertCode   *int
+	sni         *string
+	ja3         *string
+	ja3s        *string
+	ja4         *string
+	httpMethod  *string
+	httpHost    *string
+	httpStatus  *int
+}
+
+// newPacketNote returns the labels of info worth keeping, or nil.
+func newPacketNote(info flows.PacketInfo) *packetNote {
+	note := packetNote{
+		clientHello: info.TLSClientHello,
+		serverHello: info.TLSServerHello,
+		alert:       info.TLSAlert,
+		alertCode:   info.TLSAlertCode,
+		sni:         info.TLSSNI,
+		ja3:         info.JA3,
+		ja3s:        info.JA3S,
+		ja4:         info.JA4,
+		httpMethod:  info.HTTPMethod,
+		httpHost:    info.HTTPHost,
+		httpStatus:  info.HTTPStatus,
+	}
+	if note == (packetNote{}) {
+		return nil
+	}
+	return &note
+}
+
+// apply puts the labels back on a packet decoded on its own.
+func (n *packetNote) apply(info *flows.PacketInfo) {
+	if n == nil {
+		return
+	}
+	info.TLSClientHello = n.clientHello
+	info.TLSServerHello = n.serverHello
+	info.TLSAlert = n.alert
+	info.TLSAlertCode = n.alertCode
+	info.TLSSNI = n.sni
+	info.JA3 = n.ja3
+	info.JA3S = n.ja3s
+	info.JA4 = n.ja4
+	info.HTTPMethod = n.httpMethod
+	info.HTTPHost = n.httpHost
+	info.HTTPStatus = n.httpStatus
+}
+
+// indexEntry is what the analysis learns about one captured frame. The
+// reader fills in where it is, the dispatcher which flow it went to and the
+// shard owning the flow its tags and note.
+type indexEntry struct {
+	offset   int64
+	ok       bool
+	ts       time.Time
+	captured int
+	wire     int
+	iface    captureInterface
+
+	// flow is nil unless the frame completed a packet: frames without an
+	// IP layer and fragments held for the rest of their datagram have none.
+	flow     *tableEntry
+	forward  bool
+	fragment bool
+	flags    flows.TCPFlags
+	length   int
+	// span is how many frames back the datagram's first fragment was.
+	span int
+
+	tags []string
+	note *packetNote
+}
+
+// packetIndexWriter writes an index to a temporary file that is renamed into
+// place once the whole capture has been indexed.
+type packetIndexWriter struct {
+	path   string
+	file   *os.File
+	w      *bufio.Writer
+	buf    []byte
+	ifaces map[captureInterface]int
+	offset int64
+	ts     int64
+	err    error
+}
+
+func createPacketIndex(path string) (*packetIndexWriter, error) {
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	w := &packetIndexWriter{
+		path:   path,
+		file:   file,
+		w:      bufio.NewWriterSize(file, 64<<10),
+		ifaces: make(map[captureInterface]int),
+	}
+	w.buf = append(w.buf, packetIndexMagic...)
+	w.buf = binary.AppendUvarint(w.buf, packetIndexVersion)
+	w.flush()
+	return w, nil
+}
+
+func (w *packetIndexWriter) write(entry *indexEntry) {
+	if w.err != nil {
+		return
+	}
+	if !entry.ok {
+		w.err = errors.New("packet offset unknown")
+		return
+	}
+
+	iface, ok := w.ifaces[entry.iface]
+	if !ok {
+		iface = len(w.ifaces)
+		w.ifaces[entry.iface] = iface
+		w.buf = append(w.buf, indexRecordInterface)
+		w.buf = binary.AppendUvarint(w.buf, uint64(entry.iface.linkType))
+		w.buf = appendIndexString(w.buf, entry.iface.name)
+	}
+	if entry.flow != nil && !entry.flow.indexed {
+		entry.flow.indexed = true
+		w.appendFlow(entry.flow)
+	}
+
+	var flags byte
+	if entry.forward {
+		flags |= indexPacketForward
+	}
+	if entry.flow != nil {
+		flags |= indexPacketFlow
+	}
+	if entry.fragment {
+		flags |= indexPacketFragment
+	}
+	if entry.note != nil {
+		flags |= indexPacketNote
+	}
+	ts := entry.ts.UnixNano()
+	w.buf = append(w.buf, indexRecordPacket, flags, tcpFlagBits(entry.flags))
+	w.buf = binary.AppendUvarint(w.buf, uint64(iface))
+	w.buf = binary.AppendVarint(w.buf, entry.offset-w.offset)
+	w.buf = binary.AppendVarint(w.buf, ts-w.ts)
+	w.buf = binary.AppendUvarint(w.buf, uint64(entry.captured))
+	w.buf = binary.AppendUvarint(w.buf, uint64(entry.wire))
+	w.offset, w.ts = entry.offset, ts
+	if entry.flow != nil {
+		w.buf = binary.AppendUvarint(w.buf, uint64(entry.flow.id))
+		w.buf = binary.AppendUvarint(w.buf, uint64(entry.length))
+		w.buf = binary.AppendUvarint(w.buf, uint64(entry.span))
+	}
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(entry.tags)))
+	for _, tag := range entry.tags {
+		code := packetTagCodes[tag]
+		w.buf = binary.AppendUvarint(w.buf, uint64(code))
+		if code == 0 {
+			w.buf = appendIndexString(w.buf, tag)
+		}
+	}
+	if entry.note != nil {
+		w.appendNote(entry.note)
+	}
+	w.flush()
+}
+
+func (w *packetIndexWriter) appendFlow(entry *tableEntry) {
+	key := entry.flow.Key
+	stream := 0
+	if entry.flow.TCPStreamID != nil {
+		stream = *entry.flow.TCPStreamID + 1
+	}
+	w.buf = append(w.buf, indexRecordFlow)
+	w.buf = binary.AppendUvarint(w.buf, uint64(entry.id))
+	w.buf = appendIndexString(w.buf, key.Proto)
+	w.buf = appendIndexString(w.buf, key.SrcIP)
+	w.buf = appendIndexString(w.buf, key.DstIP)
+	w.buf = binary.AppendUvarint(w.buf, uint64(key.SrcPort))
+	w.buf = binary.AppendUvarint(w.buf, uint64(key.DstPort))
+	w.buf = appendIndexString(w.buf, key.Tunnel.Type)
+	w.buf = binary.AppendUvarint(w.buf, uint64(key.Tunnel.ID))
+	w.buf = binary.AppendUvarint(w.buf, uint64(key.Generation))
+	w.buf = binary.AppendVarint(w.buf, entry.start.UnixNano())
+	w.buf = binary.AppendUvarint(w.buf, uint64(stream))
+}
+
+func (w *packetIndexWriter) appendNote(note *packetNote) {
+	var fields uint16
+	set := func(field uint16, present bool) {
+		if present {
+			fields |= field
+		}
+	}
+	set(noteClientHello, note.clientHello)
+	set(noteServerHello, note.serverHello)
+	set(noteAlert, note.alert)
+	set(noteAlertCode, note.alertCode != nil)
+	set(noteSNI, note.sni != nil)
+	set(noteJA3, note.ja3 != nil)
+	set(noteJA3S, note.ja3s != nil)
+	set(noteJA4, note.ja4 != nil)
+	set(noteHTTPMethod, note.httpMethod != nil)
+	set(noteHTTPHost, note.httpHost != nil)
+	set(noteHTTPStatus, note.httpStatus != nil)
+
+	w.buf = binary.AppendUvarint(w.buf, uint64(fields))
+	if note.alertCode != nil {
+		w.buf = binary.AppendVarint(w.buf, int64(*note.alertCode))
+	}
+	for _, value := range []*string{note.sni, note.ja3, note.ja3s, note.ja4, note.httpMethod, note.httpHost} {
+		if value != nil {
+			w.buf = appendIndexString(w.buf, *value)
+		}
+	}
+	if note.httpStatus != nil {
+		w.buf = binary.AppendVarint(w.buf, int64(*note.httpStatus))
+	}
+}
+
+func (w *packetIndexWriter) flush() {
+	if w.err == nil {
+		_, w.err = w.w.Write(w.buf)
+	}
+	w.buf = w.buf[:0]
+}
+
+// close moves the index into place, or removes it if anything went wrong.
+func (w *packetIndexWriter) close() error {
+	err := w.err
+	if err == nil {
+		err = w.w.Flush()
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(w.file.Name(), w.path)
+	}
+	if err != nil {
+		os.Remove(w.file.Name())
+	}
+	return err
+}
+
+// abort removes the partial index.
+func (w *packetIndexWriter) abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+func appendIndexString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func tcpFlagBits(flags flows.TCPFlags) byte {
+	var bits byte
+	for i, set := range []bool{flags.SYN, flags.ACK, flags.FIN, flags.RST, flags.PSH, flags.URG} {
+		if set {
+			bits |= 1 << i
+		}
+	}
+	return bits
+}
+
+func tcpFlagsFromBits(bits byte) flows.TCPFlags {
+	return flows.TCPFlags{
+		SYN: bits&(1<<0) != 0,
+		ACK: bits&(1<<1) != 0,
+		FIN: bits&(1<<2) != 0,
+		RST: bits&(1<<3) != 0,
+		PSH: bits&(1<<4) != 0,
+		URG: bits&(1<<5) != 0,
+	}
+}
+
+// indexedFlow is a flow as recorded in the index.
+type indexedFlow struct {
+	key    flows.FlowKey
+	start  time.Time
+	stream *int
+
+	// The stored flow matched to it, looked up once per listing.
+	meta    FlowMeta
+	hasMeta bool
+	looked  bool
+}
+
+// storedMeta returns the stored flow this one was saved as, as ListPackets
+// finds it for each packet.
+func (f *indexedFlow) storedMeta(flowIndex FlowIndex) (FlowMeta, bool) {
+	if !f.looked {
+		f.looked = true
+		if len(flowIndex) > 0 {
+			key := f.key
+			key.Generation = 0
+			f.meta, f.hasMeta = flowIndex.lookup(key, f.start)
+		}
+	}
+	return f.meta, f.hasMeta
+}
+
+// indexedPacket is one frame as recorded in the index.
+type indexedPacket struct {
+	frame    int
+	offset   int64
+	ts       time.Time
+	captured int
+	wire     int
+	iface    captureInterface
+	flow     *indexedFlow
+	forward  bool
+	fragment bool
+	flags    flows.TCPFlags
+	length   int
+	span     int
+	tags     []string
+	note     *packetNote
+}
+
+// info returns what the index knows of the packet without reading the
+// capture: enough to filter it and count it, but not to describe it.
+func (p indexedPacket) info() flows.PacketInfo {
+	key := p.flow.key
+	if !p.forward {
+		key = key.Reverse()
+	}
+	info := flows.PacketInfo{
+		Timestamp: p.ts,
+		Proto:     key.Proto,
+		SrcIP:     key.SrcIP,
+		DstIP:     key.DstIP,
+		SrcPort:   key.SrcPort,
+		DstPort:   key.DstPort,
+		Tunnel:    key.Tunnel,
+		Length:    p.length,
+		TCPFlags:  p.flags,
+	}
+	p.note.apply(&info)
+	return info
+}
+
+// packetIndexReader reads an index from the start.
+type packetIndexReader struct {
+	file   *os.File
+	r      *bufio.Reader
+	ifaces []captureInterface
+	flows  map[uint64]*indexedFlow
+	frame  int
+	offset int64
+	ts     int64
+	bad    bool
+}
+
+// openPacketIndex opens the index at path, failing if there is none or it
+// was written in another format.
+func openPacketIndex(path string) (*packetIndexReader, error) {
+	if path == "" {
+		return nil, os.ErrNotExist
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &packetIndexReader{file: file, r: bufio.NewReaderSize(file, 64<<10), flows: make(map[uint64]*indexedFlow)}
+	magic := make([]byte, len(packetIndexMagic))
+	if _, err := io.ReadFull(r.r, magic); err != nil || string(magic) != packetIndexMagic {
+		file.Close()
+		return nil, errPacketIndex
+	}
+	if version, err := binary.ReadUvarint(r.r); err != nil || version != packetIndexVersion {
+		file.Close()
+		return nil, fmt.Errorf("packet index version %d not supported", version)
+	}
+	return r, nil
+}
+
+func (r *packetIndexReader) close() error {
+	return r.file.Close()
+}
+
+// next returns the next frame, or io.EOF after the last.
+func (r *packetIndexReader) next() (indexedPacket, error) {
+	for {
+		kind, err := r.r.ReadByte()
+		if err != nil {
+			if r.bad {
+				return indexedPacket{}, errPacketIndex
+			}
+			return indexedPacket{}, err
+		}
+		switch kind {
+		case indexRecordInterface:
+			linkType, name := r.uvarint(), r.string()
+			r.ifaces = append(r.ifaces, captureInterface{linkType: layers.LinkType(linkType), name: name})
+		case indexRecordFlow:
+			r.readFlow()
+		case indexRecordPacket:
+			return r.readPacket()
+		default:
+			return indexedPacket{}, errPacketIndex
+		}
+	}
+}
+
+func (r *packetIndexReader) readFlow() {
+	id := r.uvarint()
+	flow := &indexedFlow{}
+	flow.key.Proto = r.string()
+	flow.key.SrcIP = r.string()
+	flow.key.DstIP = r.string()
+	flow.key.SrcPort = int(r.uvarint())
+	flow.key.DstPort = int(r.uvarint())
+	flow.key.Tunnel.Type = r.string()
+	flow.key.Tunnel.ID = uint32(r.uvarint())
+	flow.key.Generation = int(r.uvarint())
+	flow.start = time.Unix(0, r.varint())
+	if stream := int(r.uvarint()); stream > 0 {
+		stream--
+		flow.stream = &stream
+	}
+	r.flows[id] = flow
+}
+
+func (r *packetIndexReader) readPacket() (indexedPacket, error) {
+	flags, err := r.r.ReadByte()
+	if err != nil {
+		return indexedPacket{}, errPacketIndex
+	}
+	bits, err := r.r.ReadByte()
+	if err != nil {
+		return indexedPacket{}, errPacketIndex
+	}
+	r.frame++
+	p := indexedPacket{
+		frame:    r.frame,
+		forward:  flags&indexPacketForward != 0,
+		fragment: flags&indexPacketFragment != 0,
+		flags:    tcpFlagsFromBits(bits),
+	}
+	iface := r.uvarint()
+	r.offset += r.varint()
+	r.ts += r.varint()
+	p.offset, p.ts = r.offset, time.Unix(0, r.ts)
+	p.captured, p.wire = int(r.uvarint()), int(r.uvarint())
+	if iface >= uint64(len(r.ifaces)) {
+		return indexedPacket{}, errPacketIndex
+	}
+	p.iface = r.ifaces[iface]
+	if flags&indexPacketFlow != 0 {
+		p.flow = r.flows[r.uvarint()]
+		if p.flow == nil {
+			return indexedPacket{}, errPacketIndex
+		}
+		p.length, p.span = int(r.uvarint()), int(r.uvarint())
+	}
+	if count := r.uvarint(); count > 0 {
+		p.tags = make([]string, 0, count)
+		for i := uint64(0); i < count; i++ {
+			code := r.uvarint()
+			switch {
+			case code == 0:
+				p.tags = append(p.tags, r.string())
+			case code <= uint64(len(packetTagNames)):
+				p.tags = append(p.tags, packetTagNames[code-1])
+			default:
+				return indexedPacket{}, errPacketIndex
+			}
+		}
+	}
+	if flags&indexPacketNote != 0 {
+		p.note = r.readNote()
+	}
+	return p, r.errAfter()
+}
+
+func (r *packetIndexReader) readNote() *packetNote {
+	fields := uint16(r.uvarint())
+	note := &packetNote{
+		clientHello: fields&noteClientHello != 0,
+		serverHello: fields&noteServerHello != 0,
+		alert:       fields&noteAlert != 0,
+	}
+	if fields&noteAlertCode != 0 {
+		code := int(r.varint())
+		note.alertCode = &code
+	}
+	for _, field := range []struct {
+		bit   uint16
+		value **string
+	}{
+		{noteSNI, &note.sni}, {noteJA3, &note.ja3}, {noteJA3S, &note.ja3s},
+		{noteJA4, &note.ja4}, {noteHTTPMethod, &note.httpMethod}, {noteHTTPHost, &note.httpHost},
+	} {
+		if fields&field.bit != 0 {
+			value := r.string()
+			*field.value = &value
+		}
+	}
+	if fields&noteHTTPStatus != 0 {
+		status := int(r.varint())
+		note.httpStatus = &status
+	}
+	return note
+}
+
+// The field readers below note the first error and return zero values
+// after it; readPacket checks once it is done.
+func (r *packetIndexReader) uvarint() uint64 {
+	value, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		r.corrupt()
+	}
+	return value
+}
+
+func (r *packetIndexReader) varint() int64 {
+	value, err := binary.ReadVarint(r.r)
+	if err != nil {
+		r.corrupt()
+	}
+	return value
+}
+
+func (r *packetIndexReader) string() string {
+	n := r.uvarint()
+	if n > maxDatagramLen {
+		r.corrupt()
+		return ""
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		r.corrupt()
+	}
+	return string(buf)
+}
+
+// corrupt makes every later read fail by dropping the rest of the index.
+func (r *packetIndexReader) corrupt() {
+	r.r.Reset(eofReader{})
+	r.bad = true
+}
+
+func (r *packetIndexReader) errAfter() error {
+	if r.bad {
+		return errPacketIndex
+	}
+	return nil
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
+
+// fragmentWindow keeps the recent fragment frames seen while reading an
+// index, so a reassembled datagram can be decoded again from its fragments.
+type fragmentWindow struct {
+	frames []indexedPacket
+}
+
+func (w *fragmentWindow) add(p indexedPacket) {
+	keep := 0
+	for keep < len(w.frames) && (p.ts.Sub(w.frames[keep].ts) > fragmentTimeout || len(w.frames)-keep >= maxPendingDatagrams) {
+		keep++
+	}
+	w.frames = append(w.frames[keep:], p)
+}
+
+// before returns the fragment frames p's datagram may have been built from.
+func (w *fragmentWindow) before(p indexedPacket) []indexedPacket {
+	if p.span == 0 {
+		return nil
+	}
+	var frames []indexedPacket
+	for _, frame := range w.frames {
+		if frame.frame >= p.frame-p.span && frame.frame < p.frame {
+			frames = append(frames, frame)
+		}
+	}
+	return frames
+}
+
+// readIndexedPacket decodes an indexed packet from the capture, reassembling
+// it from fragments when it completed a fragmented datagram.
+func readIndexedPacket(file io.ReaderAt, p indexedPacket, fragments []indexedPacket) (flows.PacketInfo, error) {
+	decoded, err := readIndexedFrame(file, p)
+	if err != nil {
+		return flows.PacketInfo{}, err
+	}
+	var info flows.PacketInfo
+	ok := decoded.ok
+	if p.fragment {
+		defrag := newIPDefragmenter(nil)
+		for _, fragment := range fragments {
+			earlier, err := readIndexedFrame(file, fragment)
+			if err != nil {
+				return flows.PacketInfo{}, err
+			}
+			defrag.assemble(earlier)
+		}
+		info, ok = defrag.assemble(decoded)
+	} else {
+		info = decoded.info
+	}
+	if !ok {
+		return flows.PacketInfo{}, errors.New("capture does not match its packet index")
+	}
+	p.note.apply(&info)
+	return info, nil
+}
+
+func readIndexedFrame(file io.ReaderAt, p indexedPacket) (decodedPacket, error) {
+	data, err := readIndexedData(file, p)
+	if err != nil {
+		return decodedPacket{}, err
+	}
+	return decodePacket(decodeCaptured(data, p.captureInfo())), nil
+}
+
+// captureInfo is the CaptureInfo the packet was read with.
+func (p indexedPacket) captureInfo() gopacket.CaptureInfo {
+	return gopacket.CaptureInfo{
+		Timestamp:     p.ts,
+		CaptureLength: p.captured,
+		Length:        p.wire,
+		AncillaryData: []interface{}{p.iface},
+	}
+}
+
+// readIndexedData reads the raw frame of an indexed packet.
+func readIndexedData(file io.ReaderAt, p indexedPacket) ([]byte, error) {
+	data := make([]byte, p.captured)
+	if _, err := file.ReadAt(data, p.offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,281 @@
+package pcap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"netsage/internal/flows"
+	"netsage/internal/pcap/testutil"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// indexedCapture analyzes path, writing its packet index, and returns the
+// index path and the flow index the API would build from the stored flows.
+func indexedCapture(t *testing.T, path string, opts Options) (string, FlowIndex, []*flows.FlowAgg) {
+	t.Helper()
+	opts.IndexPath = filepath.Join(t.TempDir(), "capture.idx")
+	result, err := AnalyzeFile(context.Background(), path, opts, nil)
+	if err != nil {
+		t.Fatalf("analyze: %v", err)
+	}
+	if !result.Indexed {
+		t.Fatalf("expected the capture to be indexed")
+	}
+	index, err := openPacketIndex(opts.IndexPath)
+	if err != nil {
+		t.Fatalf("open index: %v", err)
+	}
+	index.close()
+	flowIndex := make(FlowIndex)
+	var stored []*flows.FlowAgg
+	for key, flow := range result.Flows {
+		clientIP, clientPort, serverIP, serverPort := flow.ClientServer()
+		flowIndex.Add(key, FlowMeta{
+			// Stored times keep microseconds.
+			Start:      flow.FirstSeen.Truncate(time.Microsecond),
+			StreamID:   flow.TCPStreamID,
+			ClientIP:   clientIP,
+			ClientPort: clientPort,
+			ServerIP:   serverIP,
+			ServerPort: serverPort,
+		})
+		stored = append(stored, flow)
+	}
+	return opts.IndexPath, flowIndex, stored
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	out, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	return string(out)
+}
+
+func TestPacketIndexMatchesScan(t *testing.T) {
+	dir := t.TempDir()
+	generated := filepath.Join(dir, "generated.pcap")
+	if err := testutil.GenerateSamplePCAP(generated); err != nil {
+		t.Fatalf("generate sample: %v", err)
+	}
+	tlsPath, keyLogPath := filepath.Join(dir, "tls.pcap"), filepath.Join(dir, "keys.log")
+	if err := testutil.GenerateTLSPCAP(tlsPath, keyLogPath, testutil.TLSSessionOptions{MaxVersion: tls.VersionTLS13}); err != nil {
+		t.Fatalf("generate tls: %v", err)
+	}
+	shortFlows := filepath.Join(dir, "short-flows.pcap")
+	writeShortFlows(t, shortFlows, 50)
+	fragmented := filepath.Join(dir, "fragmented.pcap")
+	writeFragmentedCapture(t, fragmented, false)
+	fragmentedNg := filepath.Join(dir, "fragmented.pcapng")
+	writeFragmentedCapture(t, fragmentedNg, true)
+
+	cases := []struct {
+		name string
+		path string
+		opts Options
+	}{
+		{name: "sample", path: filepath.Join("..", "..", "testdata", "sample.pcap")},
+		{name: "generated", path: generated},
+		{name: "tls", path: tlsPath, opts: Options{KeyLogPath: keyLogPath}},
+		{name: "short flows", path: shortFlows, opts: Options{Workers: 4}},
+		{name: "fragmented", path: fragmented},
+		{name: "fragmented pcapng", path: fragmentedNg, opts: Options{Workers: 3}},
+	}
+	filters := []string{"", "proto:TCP", "proto:UDP", "stream:1", "flags:SYN", "port:443", "ip:10.0.0.1",
+		"(ip in 10.0.0.0/8 or sni ~ \"example\") and not flags:RST and len > 60", "port in {53 443} or proto == udp"}
+	pages := []struct{ limit, offset int }{{500, 0}, {7, 0}, {7, 5}}
+	ctx := context.Background()
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			indexPath, flowIndex, stored := indexedCapture(t, tc.path, tc.opts)
+			for _, raw := range filters {
+				filter, err := ParsePacketFilter(raw)
+				if err != nil {
+					t.Fatalf("parse filter %q: %v", raw, err)
+				}
+				for _, page := range pages {
+					want, wantTotal, err := ListPackets(ctx, tc.path, "", page.limit, page.offset, filter, flowIndex)
+					if err != nil {
+						t.Fatalf("scan: %v", err)
+					}
+					got, gotTotal, err := ListPackets(ctx, tc.path, indexPath, page.limit, page.offset, filter, flowIndex)
+					if err != nil {
+						t.Fatalf("indexed: %v", err)
+					}
+					if gotTotal != wantTotal || mustJSON(t, got) != mustJSON(t, want) {
+						t.Fatalf("filter %q page %+v: indexed listing differs\n got %d %s\nwant %d %s",
+							raw, page, gotTotal, mustJSON(t, got), wantTotal, mustJSON(t, want))
+					}
+				}
+			}
+
+			want, err := BuildTimeseries(ctx, tc.path, "", nil, time.Second)
+			if err != nil {
+				t.Fatalf("scan timeseries: %v", err)
+			}
+			got, err := BuildTimeseries(ctx, tc.path, indexPath, nil, time.Second)
+			if err != nil {
+				t.Fatalf("indexed timeseries: %v", err)
+			}
+			if mustJSON(t, got) != mustJSON(t, want) {
+				t.Fatalf("indexed timeseries differs\n got %s\nwant %s", mustJSON(t, got), mustJSON(t, want))
+			}
+
+			for _, flow := range stored[:min(len(stored), 5)] {
+				clientIP, clientPort, serverIP, serverPort := flow.ClientServer()
+				key := flow.Key
+				key.Generation = 0
+				series := func(indexPath string) StreamTimeseries {
+					out, err := BuildStreamTimeseries(ctx, tc.path, indexPath, nil, time.Second, key, clientIP, clientPort, serverIP, serverPort,
+						flow.FirstSeen.Truncate(time.Microsecond), flow.LastSeen.Truncate(time.Microsecond))
+					if err != nil {
+						t.Fatalf("stream timeseries: %v", err)
+					}
+					return out
+				}
+				if got, want := mustJSON(t, series(indexPath)), mustJSON(t, series("")); got != want {
+					t.Fatalf("flow %v: indexed stream timeseries differs\n got %s\nwant %s", flow.Key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPacketIndexSameWithWorkers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "short-flows.pcap")
+	writeShortFlows(t, path, 3000)
+	single, _, _ := indexedCapture(t, path, Options{Workers: 1})
+	parallel, _, _ := indexedCapture(t, path, Options{Workers: 4})
+	want, err := os.ReadFile(single)
+	if err != nil {
+		t.Fatalf("read index: %v", err)
+	}
+	got, err := os.ReadFile(parallel)
+	if err != nil {
+		t.Fatalf("read index: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("expected the same index with workers, got %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestPacketIndexSkipsGzipCaptures(t *testing.T) {
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "short-flows.pcap")
+	writeShortFlows(t, plain, 10)
+	data, err := os.ReadFile(plain)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	path := filepath.Join(dir, "short-flows.pcap.gz")
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	indexPath := filepath.Join(dir, "capture.idx")
+	result, err := AnalyzeFile(context.Background(), path, Options{IndexPath: indexPath}, nil)
+	if err != nil {
+		t.Fatalf("analyze: %v", err)
+	}
+	if result.Indexed {
+		t.Fatalf("expected a gzip capture not to be indexed")
+	}
+	if _, err := os.Stat(indexPath); !os.IsNotExist(err) {
+		t.Fatalf("expected no index file, got %v", err)
+	}
+}
+
+func TestPacketIndexRemovedOnCancel(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "short-flows.pcap")
+	writeShortFlows(t, path, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	indexPath := filepath.Join(dir, "capture.idx")
+	if _, err := AnalyzeFile(ctx, path, Options{IndexPath: indexPath, Workers: 2}, nil); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only the capture to be left, got %d files", len(entries))
+	}
+}
+
+// writeFragmentedCapture writes UDP datagrams split into IPv4 fragments,
+// some out of order, between the segments of a TCP connection, as pcapng
+// when ng is set.
+func writeFragmentedCapture(t *testing.T, path string, ng bool) {
+	t.Helper()
+	var frames [][]byte
+	client, server := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+	tcp := func(flags layers.TCP, out bool) []byte {
+		ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: client, DstIP: server}
+		flags.SrcPort, flags.DstPort, flags.Window = 40000, 443, 64240
+		if !out {
+			ip.SrcIP, ip.DstIP = server, client
+			flags.SrcPort, flags.DstPort = 443, 40000
+		}
+		return serializeLayers(t, &layers.Ethernet{SrcMAC: defragMAC, DstMAC: defragMAC, EthernetType: layers.EthernetTypeIPv4}, ip, &flags)
+	}
+	frames = append(frames, tcp(layers.TCP{SYN: true, Seq: 100}, true))
+	for i := 0; i < 4; i++ {
+		payload := bytes.Repeat([]byte{byte('a' + i)}, 2000+i*700)
+		l4 := serializeLayers(t, &layers.UDP{SrcPort: 500, DstPort: 500}, gopacket.Payload(payload))
+		fragments := fragmentIPv4(t, net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 3}, uint16(10+i), l4, 1480)
+		if i%2 == 1 {
+			fragments[0], fragments[len(fragments)-1] = fragments[len(fragments)-1], fragments[0]
+		}
+		frames = append(frames, fragments...)
+		if i == 1 {
+			frames = append(frames, tcp(layers.TCP{SYN: true, ACK: true, Seq: 900, Ack: 101}, false))
+		}
+	}
+	frames = append(frames, tcp(layers.TCP{ACK: true, Seq: 101, Ack: 901}, true))
+
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	defer file.Close()
+	var write func(gopacket.CaptureInfo, []byte) error
+	if ng {
+		writer, err := pcapgo.NewNgWriter(file, layers.LinkTypeEthernet)
+		if err != nil {
+			t.Fatalf("writer: %v", err)
+		}
+		defer writer.Flush()
+		write = writer.WritePacket
+	} else {
+		writer := pcapgo.NewWriter(file)
+		if err := writer.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+			t.Fatalf("header: %v", err)
+		}
+		write = writer.WritePacket
+	}
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i, frame := range frames {
+		ci := gopacket.CaptureInfo{Timestamp: start.Add(time.Duration(i) * 1500 * time.Microsecond), CaptureLength: len(frame), Length: len(frame)}
+		if err := write(ci, frame); err != nil {
+			t.Fatalf("write packet: %v", err)
+		}
+	}
+}
@@ -3,10 +3,17 @@ package pcap
 import (
 	"context"
 	"fmt"
+	"io"
+	"os"
+	"sort"
 	"strings"
 	"time"
 
+	"netsage/internal/capturefilter"
+	"netsage/internal/displayfilter"
 	"netsage/internal/flows"
+
+	"github.com/google/gopacket"
 )
 
 type PacketMeta struct {
@@ -30,19 +37,62 @@ type PacketMeta struct {
 	TLSAlert       bool           `json:"tls_alert"`
 	TLSAlertCode   *int           `json:"tls_alert_code,omitempty"`
 	TLSSNI         *string        `json:"tls_sni,omitempty"`
+	JA3            *string        `json:"ja3,omitempty"`
+	JA3S           *string        `json:"ja3s,omitempty"`
+	JA4            *string        `json:"ja4,omitempty"`
 	HTTPMethod     *string        `json:"http_method,omitempty"`
 	HTTPHost       *string        `json:"http_host,omitempty"`
+	DNSQueryName   *string        `json:"dns_query_name,omitempty"`
+	TunnelType     *string        `json:"tunnel_type,omitempty"`
+	TunnelID       *uint32        `json:"tunnel_id,omitempty"`
+	Interface      string         `json:"interface,omitempty"`
 }
 
 type FlowMeta struct {
+	// Start is when the flow's first packet was seen. It tells apart flows
+	// on a reused 5-tuple.
+	Start      time.Time
 	StreamID   *int
 	ClientIP   string
 	ClientPort int
 	ServerIP   string
 	ServerPort int
+	JA3        string
+	JA3S       string
+	JA4        string
 }
 
-type FlowIndex map[flows.FlowKey]FlowMeta
+// FlowIndex holds the stored flows of each 5-tuple in both directions,
+// oldest first.
+type FlowIndex map[flows.FlowKey][]FlowMeta
+
+// Add indexes a stored flow under its key and the reverse key.
+func (idx FlowIndex) Add(key flows.FlowKey, meta FlowMeta) {
+	key.Generation = 0
+	for _, k := range []flows.FlowKey{key, key.Reverse()} {
+		metas := append(idx[k], meta)
+		sort.SliceStable(metas, func(i, j int) bool { return metas[i].Start.Before(metas[j].Start) })
+		idx[k] = metas
+	}
+}
+
+// lookup returns the flow a packet on key at ts belongs to: the last one
+// started by then. Stored times may be truncated to microseconds.
+func (idx FlowIndex) lookup(key flows.FlowKey, ts time.Time) (FlowMeta, bool) {
+	metas := idx[key]
+	if len(metas) == 0 {
+		return FlowMeta{}, false
+	}
+	ts = ts.Truncate(time.Microsecond)
+	meta := metas[0]
+	for _, candidate := range metas[1:] {
+		if candidate.Start.After(ts) {
+			break
+		}
+		meta = candidate
+	}
+	return meta, true
+}
 
 type flowTrackerKey struct {
 	Proto      string
@@ -50,18 +100,80 @@ type flowTrackerKey struct {
 	ServerIP   string
 	ClientPort int
 	ServerPort int
+	Tunnel     flows.Tunnel
+	Start      int64
 }
 
 type packetTracker struct {
-	seqCache   *flows.SeqCache
+	retrans    flows.RetransTracker
 	lastAck    [2]uint32
 	lastAckSet [2]bool
 	synSeen    [2]int
+	windows    flows.WindowTracker
+	reassembly tcpReassembly
+	records    [2]tlsRecordStream
+	quic       quicCryptoStream
+	http       *httpConn
+	current    *flows.PacketInfo
 }
 
 func newPacketTracker() *packetTracker {
-	return &packetTracker{
-		seqCache: flows.NewSeqCache(2048, 3*time.Second),
+	return &packetTracker{}
+}
+
+// annotate reassembles TCP payload and labels the packet that completes a TLS
+// record, an HTTP message head or a QUIC ClientHello, as the analyzer does.
+func (t *packetTracker) annotate(info *flows.PacketInfo, dir int) {
+	if info.Proto == "UDP" {
+		t.quic.feed(info)
+		return
+	}
+	if info.Proto != "TCP" {
+		return
+	}
+	chunk := t.reassembly.push(*info, dir)
+	if chunk.gap {
+		t.records[dir].stop()
+	} else if len(chunk.data) > 0 {
+		if result, ok := t.records[dir].feed(chunk.data); ok {
+			result.apply(info)
+		}
+	}
+	t.annotateHTTP(info, chunk)
+}
+
+// annotateHTTP labels the packet that completes an HTTP message head in
+// chunk, the payload it added to its reassembled stream.
+func (t *packetTracker) annotateHTTP(info *flows.PacketInfo, chunk streamChunk) {
+	dir := chunk.dir
+	if chunk.gap {
+		if t.http != nil {
+			t.http.streams[dir].stop()
+		}
+		return
+	}
+	if len(chunk.data) == 0 {
+		return
+	}
+
+	if t.http == nil && looksLikeHTTPRequest(chunk.data) {
+		t.http = newHTTPConn(dir, nil)
+		t.http.onHead(func(msg httpMessage) {
+			if msg.method != "" {
+				method, host, path := msg.method, msg.host, msg.path
+				t.current.HTTPMethod = &method
+				t.current.HTTPHost = strPtr(host)
+				t.current.HTTPPath = &path
+				return
+			}
+			status := msg.status
+			t.current.HTTPStatus = &status
+		})
+	}
+	if t.http != nil {
+		t.current = info
+		t.http.feed(dir, chunk.data, info.Timestamp, 0)
+		t.current = nil
 	}
 }
 
@@ -71,6 +183,27 @@ func (t *packetTracker) tagsForPacket(info flows.PacketInfo, dir int) []string {
 	if info.TLSAlert {
 		tags = append(tags, "tls_alert")
 	}
+	for _, msg := range info.DNS {
+		if !msg.Response {
+			continue
+		}
+		switch msg.RCode {
+		case flows.DNSRCodeNXDomain:
+			tags = append(tags, "dns_nxdomain")
+		case flows.DNSRCodeServFail:
+			tags = append(tags, "dns_servfail")
+		}
+	}
+	if info.ICMP != nil {
+		switch {
+		case info.ICMP.FragNeeded:
+			tags = append(tags, "icmp_frag_needed")
+		case info.ICMP.Unreachable:
+			tags = append(tags, "icmp_unreachable")
+		case info.ICMP.TimeExceeded:
+			tags = append(tags, "icmp_time_exceeded")
+		}
+	}
 	if strings.ToUpper(info.Proto) == "TCP" {
 		if info.TCPFlags.RST {
 			tags = append(tags, "rst")
@@ -81,11 +214,25 @@ func (t *packetTracker) tagsForPacket(info flows.PacketInfo, dir int) []string {
 				tags = append(tags, "syn_retransmission")
 			}
 		}
-		if info.PayloadLen > 0 {
-			key := flows.SeqKey{Direction: dir, Seq: info.Seq, Length: info.PayloadLen}
-			if t.seqCache.Seen(key, info.Timestamp) {
-				tags = append(tags, "retransmission")
-			}
+		retrans := t.retrans.Observe(info, dir)
+		if retrans.Kind != flows.RetransNone {
+			tags = append(tags, "retransmission")
+		}
+		switch retrans.Kind {
+		case flows.RetransRTO:
+			tags = append(tags, "rto_retransmission")
+		case flows.RetransFast:
+			tags = append(tags, "fast_retransmission")
+		case flows.RetransTLP:
+			tags = append(tags, "tail_loss_probe")
+		case flows.RetransSpurious:
+			tags = append(tags, "spurious_retransmission")
+		}
+		if retrans.Partial {
+			tags = append(tags, "partial_retransmission")
+		}
+		if retrans.DSACK {
+			tags = append(tags, "dsack")
 		}
 		if info.TCPFlags.ACK && info.PayloadLen == 0 && !info.TCPFlags.SYN {
 			if t.lastAckSet[dir] && info.Ack == t.lastAck[dir] {
@@ -94,6 +241,19 @@ func (t *packetTracker) tagsForPacket(info flows.PacketInfo, dir int) []string {
 			t.lastAck[dir] = info.Ack
 			t.lastAckSet[dir] = true
 		}
+		window := t.windows.Observe(info, dir)
+		if window.ZeroWindow {
+			tags = append(tags, "zero_window")
+		}
+		if window.ZeroWindowProbe {
+			tags = append(tags, "zero_window_probe")
+		}
+		if window.WindowUpdate {
+			tags = append(tags, "window_update")
+		}
+		if window.WindowFull {
+			tags = append(tags, "window_full")
+		}
 	}
 	return tags
 }
@@ -110,65 +270,41 @@ type PacketFilter struct {
 	StreamID *int
 	Flags    []string
 	Pair     bool
+	JA3      string
+	JA3S     string
+	JA4      string
+	Tunnel   string
+	TunnelID *int
+
+	// Capture is the capture filter the capture was analyzed with. Frames
+	// that fail it are skipped as analysis skipped them, so packets are
+	// numbered the same with or without the packet index.
+	Capture *capturefilter.Filter
+	// BPF is a capture filter the raw frame of a packet must pass.
+	BPF *capturefilter.Filter
+
+	// match is the filter expression the fields are anded with.
+	match packetPredicate
 }
 
-func ParsePacketFilter(raw string) PacketFilter {
-	filter := PacketFilter{}
-	if raw == "" {
-		return filter
+// ParsePacketFilter parses a filter expression, as described in package
+// displayfilter, into a packet filter. Errors are *displayfilter.Error.
+func ParsePacketFilter(raw string) (PacketFilter, error) {
+	expr, err := displayfilter.Parse(raw, displayfilter.Packets)
+	if err != nil {
+		return PacketFilter{}, err
 	}
-	parts := strings.Fields(raw)
-	for _, part := range parts {
-		if !strings.Contains(part, ":") {
-			continue
-		}
-		key, value, _ := strings.Cut(part, ":")
-		key = strings.ToLower(strings.TrimSpace(key))
-		value = strings.TrimSpace(value)
-		if value == "" {
-			continue
-		}
-		switch key {
-		case "ip":
-			filter.IP = value
-		case "src":
-			filter.SrcIP = value
-		case "dst":
-			filter.DstIP = value
-		case "port":
-			var port int
-			if _, err := fmt.Sscanf(value, "%d", &port); err == nil {
-				filter.Port = &port
-			}
-		case "src_port":
-			var port int
-			if _, err := fmt.Sscanf(value, "%d", &port); err == nil {
-				filter.SrcPort = &port
-			}
-		case "dst_port":
-			var port int
-			if _, err := fmt.Sscanf(value, "%d", &port); err == nil {
-				filter.DstPort = &port
-			}
-		case "proto":
-			filter.Proto = strings.ToUpper(value)
-		case "sni":
-			filter.SNI = strings.ToLower(value)
-		case "stream":
-			var stream int
-			if _, err := fmt.Sscanf(value, "%d", &stream); err == nil {
-				filter.StreamID = &stream
-			}
-		case "flags":
-			filter.Flags = parseFlags(value)
-		case "pair":
-			filter.Pair = value == "1" || strings.EqualFold(value, "true")
-		}
+	filter := PacketFilter{}
+	if expr != nil {
+		filter.match = compilePacketExpr(expr)
 	}
-	return filter
+	return filter, nil
 }
 
-func (f PacketFilter) Matches(info flows.PacketInfo, streamID *int) bool {
+// Matches reports whether the packet passes the filter. Fingerprint terms
+// match every packet of a flow whose stored fingerprint matches, as well as
+// the hello packet that carries it.
+func (f PacketFilter) Matches(info flows.PacketInfo, meta FlowMeta) bool {
 	if f.IP != "" && info.SrcIP != f.IP && info.DstIP != f.IP {
 		return false
 	}
@@ -208,10 +344,25 @@ func (f PacketFilter) Matches(info flows.PacketInfo, streamID *int) bool {
 		}
 	}
 	if f.StreamID != nil {
-		if streamID == nil || *streamID != *f.StreamID {
+		if meta.StreamID == nil || *meta.StreamID != *f.StreamID {
 			return false
 		}
 	}
+	if f.JA3 != "" && !matchesFingerprint(f.JA3, info.JA3, meta.JA3) {
+		return false
+	}
+	if f.JA3S != "" && !matchesFingerprint(f.JA3S, info.JA3S, meta.JA3S) {
+		return false
+	}
+	if f.JA4 != "" && !matchesFingerprint(f.JA4, info.JA4, meta.JA4) {
+		return false
+	}
+	if f.Tunnel != "" && info.Tunnel.Type != f.Tunnel {
+		return false
+	}
+	if f.TunnelID != nil && (info.Tunnel.Type == "" || int64(info.Tunnel.ID) != int64(*f.TunnelID)) {
+		return false
+	}
 	if len(f.Flags) > 0 {
 		if strings.ToUpper(info.Proto) != "TCP" {
 			return false
@@ -222,103 +373,211 @@ func (f PacketFilter) Matches(info flows.PacketInfo, streamID *int) bool {
 			}
 		}
 	}
+	if f.match != nil && !f.match(&info, &meta) {
+		return false
+	}
 	return true
 }
 
-func ListPackets(ctx context.Context, path string, limit, offset int, filter PacketFilter, flowIndex FlowIndex) ([]PacketMeta, int, error) {
+func matchesFingerprint(want string, packetValue *string, flowValue string) bool {
+	if packetValue != nil && strings.EqualFold(*packetValue, want) {
+		return true
+	}
+	return flowValue != "" && strings.EqualFold(flowValue, want)
+}
+
+// ListPackets returns a page of the packets in the capture at path that pass
+// filter, and how many pass in all. indexPath names the capture's packet
+// index; without a usable one the capture is decoded from the start.
+func ListPackets(ctx context.Context, path, indexPath string, limit, offset int, filter PacketFilter, flowIndex FlowIndex) ([]PacketMeta, int, error) {
 	if limit <= 0 {
 		limit = 500
 	}
-	packetSource, file, err := openPacketSource(path)
+	if index, err := openPacketIndex(indexPath); err == nil {
+		defer index.close()
+		return listIndexedPackets(ctx, path, index, limit, offset, filter, flowIndex)
+	}
+	results := make([]PacketMeta, 0, limit)
+	matched := 0
+	frames := newFrameFilter(filter.BPF)
+	err := scanPackets(ctx, path, filter.Capture, flowIndex, func(scanned *scannedPacket) bool {
+		// Frames the BPF filter drops were still parsed, for the
+		// reassembly and trackers of the packets that follow.
+		if !scanned.ok || !frames.matchesCaptured(scanned.packet.Data(), scanned.packet.Metadata().CaptureInfo) {
+			return true
+		}
+		if !filter.Matches(scanned.info, scanned.meta) {
+			return true
+		}
+		matched++
+		if matched > offset && len(results) < limit {
+			results = append(results, newPacketMeta(scanned.frame, scanned.info, scanned.tags, scanned.meta.StreamID))
+		}
+		return true
+	})
 	if err != nil {
 		return nil, 0, err
 	}
+	return results, matched, nil
+}
+
+// scannedPacket is one frame of a capture decoded from the start. ok is
+// false for frames that are no packet of their own, such as fragments of a
+// datagram that is not complete yet; the rest is only set when it is true.
+type scannedPacket struct {
+	frame   int
+	packet  gopacket.Packet
+	info    flows.PacketInfo
+	ok      bool
+	meta    FlowMeta
+	hasMeta bool
+	tags    []string
+}
+
+// scanPackets decodes the capture at path from the start and passes fn each
+// frame that passes capture, numbered as in the packet index, until fn
+// returns false.
+func scanPackets(ctx context.Context, path string, capture *capturefilter.Filter, flowIndex FlowIndex, fn func(*scannedPacket) bool) error {
+	packetSource, file, err := openPacketSource(path, capture)
+	if err != nil {
+		return err
+	}
 	defer file.Close()
 
-	results := make([]PacketMeta, 0, limit)
-	matched := 0
-	index := 0
+	frame := 0
 	trackers := make(map[flowTrackerKey]*packetTracker)
-
+	defrag := newIPDefragmenter(nil)
 	for packet := range packetSource.Packets() {
 		select {
 		case <-ctx.Done():
-			return nil, 0, ctx.Err()
+			return ctx.Err()
 		default:
 		}
 
 		if packet == nil {
 			continue
 		}
-		index++
-
-		info, ok := parsePacket(packet)
-		if !ok {
-			continue
-		}
-
-		var streamID *int
-		var meta FlowMeta
-		hasMeta := false
-		if len(flowIndex) > 0 {
-			key := flows.FlowKey{
-				Proto:   info.Proto,
-				SrcIP:   info.SrcIP,
-				DstIP:   info.DstIP,
-				SrcPort: info.SrcPort,
-				DstPort: info.DstPort,
-			}
-			if stored, ok := flowIndex[key]; ok {
-				meta = stored
-				hasMeta = true
-				streamID = meta.StreamID
+		frame++
+		scanned := scannedPacket{frame: frame, packet: packet}
+		scanned.info, scanned.ok = defrag.parse(packet)
+		if scanned.ok {
+			if len(flowIndex) > 0 {
+				scanned.meta, scanned.hasMeta = flowIndex.lookup(packetKey(scanned.info), scanned.info.Timestamp)
 			}
+			tracker, dir := resolvePacketTracker(scanned.info, scanned.meta, scanned.hasMeta, trackers)
+			tracker.annotate(&scanned.info, dir)
+			scanned.tags = tracker.tagsForPacket(scanned.info, dir)
 		}
+		if !fn(&scanned) {
+			return nil
+		}
+	}
+	return nil
+}
 
-		tracker, dir := resolvePacketTracker(info, meta, hasMeta, trackers)
-		errorTags := tracker.tagsForPacket(info, dir)
+// listIndexedPackets is ListPackets reading the index, and the capture only
+// for the packets on the page.
+func listIndexedPackets(ctx context.Context, path string, index *packetIndexReader, limit, offset int, filter PacketFilter, flowIndex FlowIndex) ([]PacketMeta, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
 
-		if !filter.Matches(info, streamID) {
+	results := make([]PacketMeta, 0, limit)
+	matched := 0
+	frames := newFrameFilter(filter.BPF)
+	var fragments fragmentWindow
+	for {
+		p, err := index.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if p.frame%4096 == 0 {
+			select {
+			case <-ctx.Done():
+				return nil, 0, ctx.Err()
+			default:
+			}
+		}
+		if p.fragment {
+			fragments.add(p)
+		}
+		if p.flow == nil {
 			continue
 		}
 
-		matched++
-		if matched <= offset {
+		meta, hasMeta := p.flow.storedMeta(flowIndex)
+		if !filter.Matches(p.info(), meta) {
 			continue
 		}
-		if len(results) >= limit {
+		if passes, err := frames.matchesIndexed(file, p); err != nil {
+			return nil, 0, err
+		} else if !passes {
+			continue
+		}
+		matched++
+		if matched <= offset || len(results) >= limit {
 			continue
 		}
 
-		results = append(results, PacketMeta{
-			Index:          index,
-			Timestamp:      info.Timestamp,
-			Protocol:       info.Proto,
-			SrcIP:          info.SrcIP,
-			DstIP:          info.DstIP,
-			SrcPort:        info.SrcPort,
-			DstPort:        info.DstPort,
-			Length:         info.Length,
-			Info:           buildPacketInfo(info),
-			ErrorTags:      errorTags,
-			TCPFlags:       info.TCPFlags,
-			Seq:            info.Seq,
-			Ack:            info.Ack,
-			Window:         info.Window,
-			StreamID:       streamID,
-			TLSClientHello: info.TLSClientHello,
-			TLSServerHello: info.TLSServerHello,
-			TLSAlert:       info.TLSAlert,
-			TLSAlertCode:   info.TLSAlertCode,
-			TLSSNI:         info.TLSSNI,
-			HTTPMethod:     info.HTTPMethod,
-			HTTPHost:       info.HTTPHost,
-		})
+		info, err := readIndexedPacket(file, p, fragments.before(p))
+		if err != nil {
+			return nil, 0, err
+		}
+		var streamID *int
+		if hasMeta {
+			streamID = meta.StreamID
+		}
+		results = append(results, newPacketMeta(p.frame, info, p.tags, streamID))
 	}
-
 	return results, matched, nil
 }
 
+func newPacketMeta(index int, info flows.PacketInfo, errorTags []string, streamID *int) PacketMeta {
+	var tunnelType *string
+	var tunnelID *uint32
+	if info.Tunnel.Type != "" {
+		tunnelType = &info.Tunnel.Type
+		tunnelID = &info.Tunnel.ID
+	}
+
+	return PacketMeta{
+		Index:          index,
+		Timestamp:      info.Timestamp,
+		Protocol:       info.Proto,
+		SrcIP:          info.SrcIP,
+		DstIP:          info.DstIP,
+		SrcPort:        info.SrcPort,
+		DstPort:        info.DstPort,
+		Length:         info.Length,
+		Info:           buildPacketInfo(info),
+		ErrorTags:      errorTags,
+		TCPFlags:       info.TCPFlags,
+		Seq:            info.Seq,
+		Ack:            info.Ack,
+		Window:         info.Window,
+		StreamID:       streamID,
+		TLSClientHello: info.TLSClientHello,
+		TLSServerHello: info.TLSServerHello,
+		TLSAlert:       info.TLSAlert,
+		TLSAlertCode:   info.TLSAlertCode,
+		TLSSNI:         info.TLSSNI,
+		JA3:            info.JA3,
+		JA3S:           info.JA3S,
+		JA4:            info.JA4,
+		HTTPMethod:     info.HTTPMethod,
+		HTTPHost:       info.HTTPHost,
+		DNSQueryName:   dnsQueryName(info.DNS),
+		TunnelType:     tunnelType,
+		TunnelID:       tunnelID,
+		Interface:      info.Interface,
+	}
+}
+
 func resolvePacketTracker(info flows.PacketInfo, meta FlowMeta, hasMeta bool, trackers map[flowTrackerKey]*packetTracker) (*packetTracker, int) {
 	if hasMeta && meta.ClientIP != "" {
 		key := flowTrackerKey{
@@ -327,6 +586,8 @@ func resolvePacketTracker(info flows.PacketInfo, meta FlowMeta, hasMeta bool, tr
 			ClientPort: meta.ClientPort,
 			ServerIP:   meta.ServerIP,
 			ServerPort: meta.ServerPort,
+			Tunnel:     info.Tunnel,
+			Start:      meta.Start.UnixNano(),
 		}
 		dir := 0
 		if info.SrcIP == meta.ServerIP && info.SrcPort == meta.ServerPort {
@@ -346,6 +607,7 @@ func resolvePacketTracker(info flows.PacketInfo, meta FlowMeta, hasMeta bool, tr
 		ClientPort: info.SrcPort,
 		ServerIP:   info.DstIP,
 		ServerPort: info.DstPort,
+		Tunnel:     info.Tunnel,
 	}
 	if tracker, ok := trackers[key]; ok {
 		return tracker, 0
@@ -356,6 +618,7 @@ func resolvePacketTracker(info flows.PacketInfo, meta FlowMeta, hasMeta bool, tr
 		ClientPort: info.DstPort,
 		ServerIP:   info.SrcIP,
 		ServerPort: info.SrcPort,
+		Tunnel:     info.Tunnel,
 	}
 	if tracker, ok := trackers[rev]; ok {
 		return tracker, 1
@@ -416,12 +679,24 @@ func buildPacketInfo(info flows.PacketInfo) string {
 		}
 		return "TLS Alert"
 	}
+	if len(info.DNS) > 0 {
+		return buildDNSInfo(info.DNS[0])
+	}
+	if info.QUIC != nil {
+		return buildQUICInfo(*info.QUIC, info.TLSSNI)
+	}
+	if info.ICMP != nil {
+		return buildICMPInfo(info.Proto, *info.ICMP)
+	}
 	if info.HTTPMethod != nil {
 		if info.HTTPHost != nil {
 			return fmt.Sprintf("HTTP %s %s", *info.HTTPMethod, *info.HTTPHost)
 		}
 		return fmt.Sprintf("HTTP %s", *info.HTTPMethod)
 	}
+	if info.HTTPStatus != nil {
+		return fmt.Sprintf("HTTP %d", *info.HTTPStatus)
+	}
 	if info.TCPFlags.SYN && info.TCPFlags.ACK {
 		return "SYN, ACK"
 	}
@@ -442,3 +717,46 @@ func buildPacketInfo(info flows.PacketInfo) string {
 	}
 	return "TCP segment"
 }
+
+func buildDNSInfo(msg flows.DNSMessage) string {
+	if !msg.Response {
+		return strings.TrimSpace(fmt.Sprintf("DNS query 0x%04x %s %s", msg.ID, msg.QueryType, msg.QueryName))
+	}
+	return strings.TrimSpace(fmt.Sprintf("DNS response 0x%04x %s %s %s", msg.ID, dnsRCodeString(msg.RCode), msg.QueryType, msg.QueryName))
+}
+
+func buildQUICInfo(pkt flows.QUICPacket, sni *string) string {
+	label := strings.Join(strings.Fields(fmt.Sprintf("QUIC %s %s", pkt.Version, pkt.PacketType)), " ")
+	if pkt.ClientHello {
+		label += " ClientHello"
+		if sni != nil {
+			label += " " + *sni
+		}
+	}
+	if pkt.ConnectionClose {
+		label += " CONNECTION_CLOSE"
+	}
+	return label
+}
+
+func buildICMPInfo(proto string, msg flows.ICMPMessage) string {
+	label := fmt.Sprintf("%s %s (code %d)", proto, icmpTypeString(msg), msg.Code)
+	if msg.NextHopMTU != nil {
+		label += fmt.Sprintf(", MTU %d", *msg.NextHopMTU)
+	}
+	if msg.Original != nil {
+		orig := msg.Original
+		label += fmt.Sprintf(" for %s %s:%d -> %s:%d", orig.Proto, orig.SrcIP, orig.SrcPort, orig.DstIP, orig.DstPort)
+	}
+	return label
+}
+
+func dnsQueryName(messages []flows.DNSMessage) *string {
+	for _, msg := range messages {
+		if msg.QueryName != "" {
+			name := msg.QueryName
+			return &name
+		}
+	}
+	return nil
+}
@@ -0,0 +1,571 @@
+package pcap
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"netsage/internal/flows"
+
+	"github.com/google/gopacket"
+)
+
+// readBatchSize is how many packets the reader hands a decoder at once.
+const readBatchSize = 256
+
+// analysis runs one AnalyzeFile. Packets are read and decoded, then
+// defragmented, assigned to flows and counted in capture order; everything
+// else about a packet is done by the shard that owns its flow. With more
+// than one worker, decoding runs on a pool of goroutines and each shard on
+// its own, with flows spread over the shards by 5-tuple, so per-flow packet
+// order is kept and the results do not depend on the number of workers.
+type analysis struct {
+	opts     Options
+	result   *Result
+	live     map[flows.FlowKey]*flows.FlowAgg
+	table    *flowTable
+	defrag   *ipDefragmenter
+	shards   []*flowShard
+	parallel bool
+	// pending holds the tasks for each shard until the current read batch
+	// has been dispatched.
+	pending [][]shardTask
+	tasks   []chan []shardTask
+	running sync.WaitGroup
+
+	batch      []*flows.FlowAgg
+	latest     time.Time
+	onProgress func(bytesRead int64)
+
+	// index, when set, records every frame; file is the capture, for
+	// locating pcapng blocks. With workers, frames are written on their own
+	// goroutine once the shards have applied their read batch.
+	index   *packetIndexWriter
+	file    io.ReaderAt
+	indexed chan *readBatch
+	writing sync.WaitGroup
+}
+
+func newAnalysis(result *Result, keyLog *KeyLog, opts Options) *analysis {
+	a := &analysis{opts: opts, result: result, live: result.Flows}
+	if opts.OnFlows != nil {
+		a.live = make(map[flows.FlowKey]*flows.FlowAgg)
+	}
+	a.table = newFlowTable(a.live, opts)
+	a.defrag = newIPDefragmenter(func(loss fragmentLoss) {
+		key := packetKey(loss.info)
+		flow := a.table.find(key)
+		if flow == nil {
+			flow = a.table.add(loss.info)
+		}
+		a.send(shardTask{op: taskFragmentLoss, flow: flow, frames: loss.frames, timedOut: loss.timedOut})
+	})
+
+	workers := max(opts.Workers, 1)
+	a.parallel = workers > 1
+	a.shards = make([]*flowShard, workers)
+	for i := range a.shards {
+		a.shards[i] = newFlowShard(keyLog)
+	}
+	return a
+}
+
+// run reads the capture from source to the end and finalizes every flow.
+func (a *analysis) run(ctx context.Context, source *interfaceSource, bytesRead func() int64) error {
+	if !a.parallel {
+		var entry *indexEntry
+		if a.index != nil {
+			entry = &indexEntry{}
+		}
+		for {
+			data, ci, ok := nextPacketData(ctx, source)
+			if !ok {
+				break
+			}
+			if entry != nil {
+				*entry = a.frameEntry(source, ci)
+			}
+			if err := a.dispatch(ctx, decodePacket(decodeCaptured(data, ci)), bytesRead(), entry); err != nil {
+				return err
+			}
+			if entry != nil {
+				a.index.write(entry)
+			}
+		}
+		return a.finish(bytesRead())
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	a.startIndexing()
+	defer a.stopIndexing()
+	a.startShards()
+	defer a.stopShards()
+
+	ordered := a.startDecoders(ctx, source, bytesRead)
+	for batch := range ordered {
+		<-batch.done
+		for i, decoded := range batch.decoded {
+			var entry *indexEntry
+			if batch.entries != nil {
+				entry = &batch.entries[i]
+			}
+			if err := a.dispatch(ctx, decoded, batch.bytesRead, entry); err != nil {
+				return err
+			}
+		}
+		if a.index != nil {
+			a.markApplied(&batch.applied)
+			a.indexed <- batch
+		}
+		a.flushShards()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// The reader has returned once ordered is closed.
+	return a.finish(bytesRead())
+}
+
+// dispatch does the capture-ordered part of handling one decoded packet.
+// entry, when the capture is indexed, is completed for the packet.
+func (a *analysis) dispatch(ctx context.Context, decoded decodedPacket, bytesRead int64, entry *indexEntry) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	pktInfo, ok := a.defrag.assemble(decoded)
+	if entry != nil {
+		entry.fragment = decoded.fragmented
+	}
+	if !ok {
+		return nil
+	}
+
+	tracked, forward := a.table.lookup(pktInfo)
+	flow := tracked.flow
+	if entry != nil {
+		entry.flow, entry.forward = tracked, forward
+		entry.flags, entry.length = pktInfo.TCPFlags, pktInfo.Length
+		entry.span = a.defrag.frame - a.defrag.firstFrame
+	}
+	a.send(shardTask{op: taskPacket, flow: flow, info: pktInfo, forward: forward, entry: entry})
+	if pktInfo.ICMP != nil && pktInfo.ICMP.IsError() {
+		target := flow
+		if pktInfo.ICMP.Original != nil {
+			// The quoted header travelled inside the same tunnel as the error.
+			originalKey := *pktInfo.ICMP.Original
+			originalKey.Tunnel = pktInfo.Tunnel
+			if original := a.table.find(originalKey); original != nil {
+				target = original
+			}
+		}
+		a.send(shardTask{op: taskICMPError, flow: target, info: pktInfo, frame: a.defrag.frame})
+	}
+
+	a.result.PacketCount++
+	if pktInfo.Timestamp.After(a.latest) {
+		a.latest = pktInfo.Timestamp
+	}
+	if a.opts.OnFlows != nil && a.result.PacketCount%expirySweepPackets == 0 {
+		a.sync()
+		for _, flow := range a.table.expire(a.latest) {
+			a.shardFor(flow).release(flow)
+			a.finalize(flow)
+			a.batch = append(a.batch, flow)
+		}
+		if err := a.emit(false); err != nil {
+			return err
+		}
+	}
+
+	if a.result.PacketCount%1000 == 0 && a.onProgress != nil {
+		a.onProgress(bytesRead)
+	}
+	return nil
+}
+
+// finish gives up on incomplete datagrams and HTTP exchanges once the
+// capture has been read, finalizes the flows still open and hands them off.
+func (a *analysis) finish(bytesRead int64) error {
+	a.result.BytesProcessed = bytesRead
+	if a.onProgress != nil {
+		a.onProgress(bytesRead)
+	}
+
+	a.defrag.flush()
+	a.flushShards()
+	a.stopShards()
+	for _, shard := range a.shards {
+		shard.transactions.flush()
+	}
+	for _, shard := range a.shards {
+		shard.decrypt.flush()
+	}
+
+	for _, flow := range a.live {
+		a.finalize(flow)
+	}
+	if a.opts.OnFlows == nil {
+		return nil
+	}
+	for _, flow := range a.live {
+		a.batch = append(a.batch, flow)
+	}
+	return a.emit(true)
+}
+
+func (a *analysis) finalize(flow *flows.FlowAgg) {
+	flow.Finalize()
+	if samples := flow.RTTSamples(); len(samples) > 0 {
+		for _, rtt := range samples {
+			a.result.RTTHistogram.Add(rtt)
+		}
+	} else if flow.RTTMs != nil {
+		a.result.RTTHistogram.Add(*flow.RTTMs)
+	}
+}
+
+// emit hands the finalized flows to OnFlows once a batch is full, or with
+// all set whenever any are left.
+func (a *analysis) emit(all bool) error {
+	if len(a.batch) == 0 || (!all && len(a.batch) < flowBatchSize) {
+		return nil
+	}
+	for start := 0; start < len(a.batch); start += flowBatchSize {
+		if err := a.opts.OnFlows(a.batch[start:min(start+flowBatchSize, len(a.batch))]); err != nil {
+			return err
+		}
+	}
+	a.table.forgetFinished(a.latest)
+	if keys := a.table.forgotten(a.batch); len(keys) > 0 && a.opts.OnForget != nil {
+		a.opts.OnForget(keys)
+	}
+	a.batch = nil
+	return nil
+}
+
+func (a *analysis) shardFor(flow *flows.FlowAgg) *flowShard {
+	return a.shards[shardIndex(flow.Key, len(a.shards))]
+}
+
+// send queues a task for the shard owning its flow, or runs it right away
+// without workers.
+func (a *analysis) send(task shardTask) {
+	if !a.parallel {
+		a.shards[0].apply(&task)
+		return
+	}
+	index := shardIndex(task.flow.Key, len(a.shards))
+	a.pending[index] = append(a.pending[index], task)
+}
+
+func (a *analysis) flushShards() {
+	if !a.parallel {
+		return
+	}
+	for i, tasks := range a.pending {
+		if len(tasks) > 0 {
+			a.tasks[i] <- tasks
+			a.pending[i] = nil
+		}
+	}
+}
+
+// sync waits until every shard has applied the tasks sent so far. Until the
+// next tasks are sent, the flows and shard state can be used from the
+// dispatching goroutine.
+func (a *analysis) sync() {
+	if !a.parallel {
+		return
+	}
+	a.flushShards()
+	var idle sync.WaitGroup
+	idle.Add(len(a.shards))
+	for _, tasks := range a.tasks {
+		tasks <- []shardTask{{op: taskSync, idle: &idle}}
+	}
+	idle.Wait()
+}
+
+// frameEntry starts the index entry of the frame source just read.
+func (a *analysis) frameEntry(source *interfaceSource, ci gopacket.CaptureInfo) indexEntry {
+	entry := indexEntry{ts: ci.Timestamp, captured: ci.CaptureLength, wire: ci.Length}
+	entry.offset, entry.ok = source.dataOffset(a.file, ci.CaptureLength)
+	if len(ci.AncillaryData) > 0 {
+		entry.iface, _ = ci.AncillaryData[0].(captureInterface)
+	}
+	return entry
+}
+
+// markApplied has applied count down once every shard has applied the tasks
+// sent before it.
+func (a *analysis) markApplied(applied *sync.WaitGroup) {
+	applied.Add(len(a.shards))
+	for i := range a.pending {
+		a.pending[i] = append(a.pending[i], shardTask{op: taskSync, idle: applied})
+	}
+}
+
+// startIndexing writes the index entries of each read batch, in capture
+// order, once the shards are done with it.
+func (a *analysis) startIndexing() {
+	if a.index == nil {
+		return
+	}
+	a.indexed = make(chan *readBatch, len(a.shards)*4)
+	a.writing.Add(1)
+	go func() {
+		defer a.writing.Done()
+		for batch := range a.indexed {
+			batch.applied.Wait()
+			for i := range batch.entries {
+				a.index.write(&batch.entries[i])
+			}
+		}
+	}()
+}
+
+// stopIndexing waits for the batches sent so far to be written. The shards
+// must have been stopped first.
+func (a *analysis) stopIndexing() {
+	if a.indexed == nil {
+		return
+	}
+	close(a.indexed)
+	a.writing.Wait()
+	a.indexed = nil
+}
+
+func (a *analysis) startShards() {
+	a.pending = make([][]shardTask, len(a.shards))
+	a.tasks = make([]chan []shardTask, len(a.shards))
+	for i, shard := range a.shards {
+		tasks := make(chan []shardTask, 16)
+		a.tasks[i] = tasks
+		a.running.Add(1)
+		go func(shard *flowShard) {
+			defer a.running.Done()
+			for batch := range tasks {
+				for j := range batch {
+					shard.apply(&batch[j])
+				}
+			}
+		}(shard)
+	}
+}
+
+// stopShards waits for the shards to apply every task sent and stops them.
+// It is safe to call more than once.
+func (a *analysis) stopShards() {
+	if a.tasks == nil {
+		return
+	}
+	for _, tasks := range a.tasks {
+		close(tasks)
+	}
+	a.running.Wait()
+	a.tasks = nil
+}
+
+// readBatch is a run of consecutive packets, decoded on a worker. done is
+// closed once decoded is filled in. When the capture is indexed, entries
+// holds an index entry per packet, complete once applied is done.
+type readBatch struct {
+	data      [][]byte
+	info      []gopacket.CaptureInfo
+	decoded   []decodedPacket
+	bytesRead int64
+	done      chan struct{}
+	entries   []indexEntry
+	applied   sync.WaitGroup
+}
+
+// startDecoders reads the capture on one goroutine and decodes it on a pool,
+// returning the batches in capture order.
+func (a *analysis) startDecoders(ctx context.Context, source *interfaceSource, bytesRead func() int64) <-chan *readBatch {
+	workers := len(a.shards)
+	work := make(chan *readBatch, workers*2)
+	ordered := make(chan *readBatch, workers*4)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for batch := range work {
+				batch.decoded = make([]decodedPacket, len(batch.data))
+				for j := range batch.data {
+					batch.decoded[j] = decodePacket(decodeCaptured(batch.data[j], batch.info[j]))
+				}
+				close(batch.done)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(ordered)
+		defer close(work)
+		for {
+			batch := &readBatch{done: make(chan struct{})}
+			for len(batch.data) < readBatchSize {
+				data, ci, ok := nextPacketData(ctx, source)
+				if !ok {
+					break
+				}
+				batch.data = append(batch.data, data)
+				batch.info = append(batch.info, ci)
+				if a.index != nil {
+					batch.entries = append(batch.entries, a.frameEntry(source, ci))
+				}
+			}
+			if len(batch.data) == 0 {
+				return
+			}
+			batch.bytesRead = bytesRead()
+			select {
+			case work <- batch:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case ordered <- batch:
+			case <-ctx.Done():
+				return
+			}
+			if len(batch.data) < readBatchSize {
+				return
+			}
+		}
+	}()
+	return ordered
+}
+
+type shardOp int
+
+const (
+	taskPacket shardOp = iota
+	taskICMPError
+	taskFragmentLoss
+	taskSync
+)
+
+// shardTask is one thing a shard does to one of its flows.
+type shardTask struct {
+	op       shardOp
+	flow     *flows.FlowAgg
+	info     flows.PacketInfo
+	forward  bool
+	frames   int
+	frame    int
+	timedOut bool
+	idle     *sync.WaitGroup
+	entry    *indexEntry
+}
+
+// flowShard holds the stream state of the flows it owns.
+type flowShard struct {
+	reassembly   *tcpReassembler
+	records      *tlsRecordTracker
+	quic         *quicCryptoTracker
+	certs        *certTracker
+	decrypt      *tlsDecryptTracker
+	transactions *httpTracker
+	// packets labels packets for the index as ListPackets does.
+	packets map[*flows.FlowAgg]*packetTracker
+}
+
+func newFlowShard(keyLog *KeyLog) *flowShard {
+	return &flowShard{
+		reassembly:   newTCPReassembler(),
+		records:      newTLSRecordTracker(),
+		quic:         newQUICCryptoTracker(),
+		certs:        newCertTracker(),
+		decrypt:      newTLSDecryptTracker(keyLog),
+		transactions: newHTTPTracker(),
+		packets:      make(map[*flows.FlowAgg]*packetTracker),
+	}
+}
+
+func (s *flowShard) apply(task *shardTask) {
+	flow := task.flow
+	switch task.op {
+	case taskPacket:
+		info := task.info
+		chunk := s.reassembly.push(flow, info, task.forward)
+		s.records.observe(flow, chunk, &info)
+		s.quic.observe(flow, &info)
+		if task.entry != nil {
+			s.label(flow, chunk, info, task.forward, task.entry)
+		}
+		flow.Update(info, task.forward)
+		s.certs.observe(flow, chunk, info)
+		s.decrypt.observe(flow, chunk, info.Timestamp)
+		s.transactions.observe(flow, chunk, info.Timestamp)
+	case taskICMPError:
+		flow.RecordICMPError(*task.info.ICMP, task.frame)
+	case taskFragmentLoss:
+		flow.RecordFragmentLoss(task.frames, task.timedOut)
+	case taskSync:
+		task.idle.Done()
+	}
+}
+
+// label finds the HTTP message heads and error tags of a packet for the
+// index. info carries its TLS labels already.
+func (s *flowShard) label(flow *flows.FlowAgg, chunk streamChunk, info flows.PacketInfo, forward bool, entry *indexEntry) {
+	tracker := s.packets[flow]
+	if tracker == nil {
+		tracker = newPacketTracker()
+		s.packets[flow] = tracker
+	}
+	dir := 0
+	if !forward {
+		dir = 1
+	}
+	if info.Proto == "TCP" {
+		tracker.annotateHTTP(&info, chunk)
+	}
+	entry.tags = tracker.tagsForPacket(info, dir)
+	entry.note = newPacketNote(info)
+}
+
+// release stops following a flow that is finalized early, recording the
+// HTTP exchanges still open on it.
+func (s *flowShard) release(flow *flows.FlowAgg) {
+	delete(s.packets, flow)
+	s.transactions.release(flow)
+	s.decrypt.release(flow)
+	s.reassembly.release(flow)
+	s.records.release(flow)
+	s.quic.release(flow)
+	s.certs.release(flow)
+}
+
+// shardIndex spreads flows over n shards by 5-tuple and tunnel, the same in
+// both directions, so every packet and every generation of a connection is
+// handled by one shard. It hashes with FNV-1a.
+func shardIndex(key flows.FlowKey, n int) int {
+	if n <= 1 {
+		return 0
+	}
+	lowIP, lowPort, highIP, highPort := key.SrcIP, key.SrcPort, key.DstIP, key.DstPort
+	if highIP < lowIP || (highIP == lowIP && highPort < lowPort) {
+		lowIP, lowPort, highIP, highPort = highIP, highPort, lowIP, lowPort
+	}
+
+	h := uint64(14695981039346656037)
+	for _, part := range []string{key.Proto, lowIP, highIP, key.Tunnel.Type} {
+		for i := 0; i < len(part); i++ {
+			h ^= uint64(part[i])
+			h *= 1099511628211
+		}
+		h ^= 0xff
+		h *= 1099511628211
+	}
+	for _, value := range []uint64{uint64(lowPort), uint64(highPort), uint64(key.Tunnel.ID)} {
+		h ^= value
+		h *= 1099511628211
+	}
+	return int(h % uint64(n))
+}
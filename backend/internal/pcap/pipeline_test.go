@@ -0,0 +1,153 @@
+package pcap
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"netsage/internal/flows"
+	"netsage/internal/pcap/testutil"
+)
+
+// analysisSnapshot serializes everything AnalyzeFile reports, with flows in
+// key order, so two runs can be compared byte for byte.
+func analysisSnapshot(t *testing.T, path string, opts Options) []byte {
+	t.Helper()
+	var handed []*flows.FlowAgg
+	if opts.OnFlows != nil {
+		opts.OnFlows = func(batch []*flows.FlowAgg) error {
+			handed = append(handed, batch...)
+			return nil
+		}
+	}
+	result, err := AnalyzeFile(context.Background(), path, opts, nil)
+	if err != nil {
+		t.Fatalf("analyze: %v", err)
+	}
+	for _, flow := range result.Flows {
+		handed = append(handed, flow)
+	}
+	sort.Slice(handed, func(i, j int) bool { return flows.KeyLess(handed[i].Key, handed[j].Key) })
+
+	type flowSnapshot struct {
+		Flow    *flows.FlowAgg
+		Indexes [][]int
+		Samples []float64
+	}
+	snapshot := struct {
+		Flows          []flowSnapshot
+		Histogram      *flows.Histogram
+		PacketCount    int64
+		BytesProcessed int64
+	}{Histogram: result.RTTHistogram, PacketCount: result.PacketCount, BytesProcessed: result.BytesProcessed}
+	for _, flow := range handed {
+		snapshot.Flows = append(snapshot.Flows, flowSnapshot{
+			Flow: flow,
+			Indexes: [][]int{
+				flow.SynRetransmissionIndexes(), flow.RetransmissionIndexes(), flow.DupAckIndexes(),
+				flow.TLSClientHelloIndexes(), flow.TLSServerHelloIndexes(), flow.TLSAlertIndexes(),
+				flow.ZeroWindowIndexes(), flow.DNSErrorIndexes(), flow.QUICInitialIndexes(),
+				flow.QUICCloseIndexes(), flow.ICMPErrorFrames(), flow.CertIndexes(),
+				flow.HTTPErrorIndexes(), flow.HTTPSlowestIndexes(),
+			},
+			Samples: flow.RTTSamples(),
+		})
+	}
+	out, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	return out
+}
+
+func TestAnalyzeFileWorkersMatchSingleThreaded(t *testing.T) {
+	dir := t.TempDir()
+	generated := filepath.Join(dir, "generated.pcap")
+	if err := testutil.GenerateSamplePCAP(generated); err != nil {
+		t.Fatalf("generate sample: %v", err)
+	}
+	tlsPath, keyLogPath := filepath.Join(dir, "tls.pcap"), filepath.Join(dir, "keys.log")
+	if err := testutil.GenerateTLSPCAP(tlsPath, keyLogPath, testutil.TLSSessionOptions{MaxVersion: tls.VersionTLS13}); err != nil {
+		t.Fatalf("generate tls: %v", err)
+	}
+	shortFlows := filepath.Join(dir, "short-flows.pcap")
+	writeShortFlows(t, shortFlows, 3000)
+	batched := Options{FlowExpiry: time.Second, MemoryBudget: 1 << 20, OnFlows: func([]*flows.FlowAgg) error { return nil }}
+
+	cases := []struct {
+		name string
+		path string
+		opts Options
+	}{
+		{name: "sample", path: filepath.Join("..", "..", "testdata", "sample.pcap")},
+		{name: "generated", path: generated},
+		{name: "tls", path: tlsPath, opts: Options{KeyLogPath: keyLogPath}},
+		{name: "short flows", path: shortFlows},
+		{name: "short flows batched", path: shortFlows, opts: batched},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			single := tc.opts
+			single.Workers = 1
+			want := analysisSnapshot(t, tc.path, single)
+			for _, workers := range []int{2, 4, 7} {
+				parallel := tc.opts
+				parallel.Workers = workers
+				got := analysisSnapshot(t, tc.path, parallel)
+				if bytes.Equal(got, want) {
+					continue
+				}
+				at := 0
+				for at < len(got) && at < len(want) && got[at] == want[at] {
+					at++
+				}
+				from := max(at-200, 0)
+				t.Fatalf("%d workers differ from one at byte %d:\n got ...%s\nwant ...%s",
+					workers, at, got[from:min(at+200, len(got))], want[from:min(at+200, len(want))])
+			}
+		})
+	}
+}
+
+func TestAnalyzeFileWorkersStopOnCancel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "short-flows.pcap")
+	writeShortFlows(t, path, 2000)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := AnalyzeFile(ctx, path, Options{Workers: 4}, nil); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+// BenchmarkAnalyzeWorkers analyzes one capture of short connections with an
+// increasing number of workers.
+func BenchmarkAnalyzeWorkers(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "short-flows.pcap")
+	writeShortFlows(b, path, 20000)
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := AnalyzeFile(context.Background(), path, Options{Workers: workers}, nil); err != nil {
+					b.Fatalf("analyze: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestShardIndexIgnoresDirectionAndGeneration(t *testing.T) {
+	key := flows.FlowKey{Proto: "TCP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: 40000, DstPort: 443}
+	next := key.Reverse()
+	next.Generation = 3
+	for _, n := range []int{2, 5, 16} {
+		if shardIndex(key, n) != shardIndex(next, n) {
+			t.Fatalf("expected both directions and generations on one of %d shards", n)
+		}
+	}
+}
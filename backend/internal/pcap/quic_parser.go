@@ -0,0 +1,546 @@
+package pcap
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"sort"
+
+	"netsage/internal/flows"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	quicVersion1      = 0x00000001
+	quicVersion2      = 0x6b3343cf
+	quicVersionDraft  = 0xff00001d
+	quicMaxCIDLen     = 20
+	quicMaxCryptoData = 16 * 1024
+)
+
+var quicPorts = []int{443, 8443}
+
+var (
+	quicSaltV1    = mustHex("38762cf7f55934b34d179ae6a4c80cadccbb7f0a")
+	quicSaltV2    = mustHex("0dede3def700a6db819381be6e269dcbf9bd2ed9")
+	quicSaltDraft = mustHex("afbfec289993d24c9e9786f19c6111e04390a899")
+)
+
+type quicInfo struct {
+	payload []byte
+}
+
+type quicResult struct {
+	packet *flows.QUICPacket
+	sni    *string
+	alpn   *string
+	ja4    *string
+}
+
+// Parse inspects the QUIC packets coalesced in a UDP datagram and describes
+// the first. Client Initial packets are decrypted with the version's
+// well-known initial secrets so the TLS ClientHello carried in their CRYPTO
+// frames can be read when the datagram holds all of it; quicCryptoStream
+// puts together one that spans datagrams.
+func (q quicInfo) Parse() quicResult {
+	result := quicResult{}
+	data := q.payload
+	if len(data) < 1 {
+		return result
+	}
+
+	first := data[0]
+	if first&0x80 == 0 {
+		if first&0x40 == 0 {
+			return result
+		}
+		result.packet = &flows.QUICPacket{PacketType: flows.QUICPacket1RTT}
+		return result
+	}
+
+	hdr, ok := parseQUICLongHeader(data)
+	if !ok {
+		return result
+	}
+	packet := &flows.QUICPacket{
+		Version:    quicVersionString(hdr.version),
+		PacketType: hdr.packetType,
+		LongHeader: true,
+		DCID:       hex.EncodeToString(hdr.dcid),
+		SCID:       hex.EncodeToString(hdr.scid),
+	}
+	result.packet = packet
+
+	if hdr.packetType != flows.QUICPacketInitial {
+		return result
+	}
+
+	frames := quicInitialFrames(data)
+	packet.ClientInitial = frames.client
+	packet.ConnectionClose = frames.connectionClose
+	result.readClientHello(assembleQUICCrypto(frames.crypto))
+	return result
+}
+
+// readClientHello reads the ClientHello at the start of a CRYPTO stream,
+// reporting whether the stream holds all of it.
+func (r *quicResult) readClientHello(crypto []byte) bool {
+	hello := parseHandshake(crypto)
+	if hello.hsType != 1 {
+		return false
+	}
+	r.packet.ClientHello = true
+	r.sni = hello.sni
+	r.alpn = hello.alpn
+	r.ja4 = strPtr(ja4Fingerprint(hello, 'q'))
+	return true
+}
+
+// apply copies the ClientHello's metadata onto the packet that completed it.
+func (r quicResult) apply(info *flows.PacketInfo) {
+	info.QUIC = r.packet
+	if r.packet == nil || !r.packet.ClientHello {
+		return
+	}
+	version := "TLS1.3"
+	info.TLSSNI = r.sni
+	info.ALPN = r.alpn
+	info.TLSVersion = &version
+	info.JA4 = r.ja4
+}
+
+type quicLongHeader struct {
+	version    uint32
+	packetType string
+	dcid       []byte
+	scid       []byte
+	pnOffset   int
+	end        int
+}
+
+func parseQUICLongHeader(data []byte) (quicLongHeader, bool) {
+	hdr := quicLongHeader{}
+	if len(data) < 7 {
+		return hdr, false
+	}
+	hdr.version = binary.BigEndian.Uint32(data[1:5])
+	idx := 5
+
+	dcidLen := int(data[idx])
+	idx++
+	if dcidLen > quicMaxCIDLen || len(data) < idx+dcidLen+1 {
+		return hdr, false
+	}
+	hdr.dcid = data[idx : idx+dcidLen]
+	idx += dcidLen
+
+	scidLen := int(data[idx])
+	idx++
+	if scidLen > quicMaxCIDLen || len(data) < idx+scidLen {
+		return hdr, false
+	}
+	hdr.scid = data[idx : idx+scidLen]
+	idx += scidLen
+
+	if hdr.version == 0 {
+		hdr.packetType = flows.QUICPacketVersionNegotiation
+		hdr.end = len(data)
+		return hdr, true
+	}
+	if !isKnownQUICVersion(hdr.version) {
+		return hdr, false
+	}
+
+	hdr.packetType = quicLongPacketType(hdr.version, (data[0]>>4)&0x03)
+	if hdr.packetType == flows.QUICPacketRetry {
+		hdr.end = len(data)
+		return hdr, true
+	}
+
+	if hdr.packetType == flows.QUICPacketInitial {
+		tokenLen, n := readQUICVarint(data[idx:])
+		if n == 0 || uint64(len(data)-idx-n) < tokenLen {
+			return hdr, false
+		}
+		idx += n + int(tokenLen)
+	}
+
+	length, n := readQUICVarint(data[idx:])
+	if n == 0 {
+		return hdr, false
+	}
+	idx += n
+	if uint64(len(data)-idx) < length {
+		return hdr, false
+	}
+	hdr.pnOffset = idx
+	hdr.end = idx + int(length)
+	return hdr, true
+}
+
+type quicKeys struct {
+	key []byte
+	iv  []byte
+	hp  []byte
+}
+
+func clientInitialKeys(version uint32, dcid []byte) quicKeys {
+	salt := quicSaltV1
+	keyLabel, ivLabel, hpLabel := "quic key", "quic iv", "quic hp"
+	switch version {
+	case quicVersion2:
+		salt = quicSaltV2
+		keyLabel, ivLabel, hpLabel = "quicv2 key", "quicv2 iv", "quicv2 hp"
+	case quicVersionDraft:
+		salt = quicSaltDraft
+	}
+
+	initialSecret := hkdf.Extract(sha256.New, dcid, salt)
+	clientSecret := hkdfExpandLabel(initialSecret, "client in", 32)
+	return quicKeys{
+		key: hkdfExpandLabel(clientSecret, keyLabel, 16),
+		iv:  hkdfExpandLabel(clientSecret, ivLabel, 12),
+		hp:  hkdfExpandLabel(clientSecret, hpLabel, 16),
+	}
+}
+
+// hkdfExpandLabel implements HKDF-Expand-Label from RFC 8446 with an empty
+// context, as used by QUIC and TLS 1.3 key schedules.
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	return hkdfExpandLabelHash(sha256.New, secret, label, length)
+}
+
+func hkdfExpandLabelHash(h func() hash.Hash, secret []byte, label string, length int) []byte {
+	fullLabel := "tls13 " + label
+	info := make([]byte, 0, 4+len(fullLabel))
+	info = binary.BigEndian.AppendUint16(info, uint16(length))
+	info = append(info, byte(len(fullLabel)))
+	info = append(info, fullLabel...)
+	info = append(info, 0)
+
+	out := make([]byte, length)
+	reader := hkdf.Expand(h, secret, info)
+	if _, err := reader.Read(out); err != nil {
+		return nil
+	}
+	return out
+}
+
+func decryptQUICInitial(packet []byte, hdr quicLongHeader, keys quicKeys) ([]byte, bool) {
+	sampleOffset := hdr.pnOffset + 4
+	if len(packet) < sampleOffset+16 {
+		return nil, false
+	}
+
+	hpBlock, err := aes.NewCipher(keys.hp)
+	if err != nil {
+		return nil, false
+	}
+	mask := make([]byte, 16)
+	hpBlock.Encrypt(mask, packet[sampleOffset:sampleOffset+16])
+
+	header := make([]byte, hdr.pnOffset+4)
+	copy(header, packet[:hdr.pnOffset+4])
+	header[0] ^= mask[0] & 0x0f
+	pnLen := int(header[0]&0x03) + 1
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		header[hdr.pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(header[hdr.pnOffset+i])
+	}
+	header = header[:hdr.pnOffset+pnLen]
+
+	block, err := aes.NewCipher(keys.key)
+	if err != nil {
+		return nil, false
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, false
+	}
+
+	nonce := make([]byte, len(keys.iv))
+	copy(nonce, keys.iv)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+
+	plaintext, err := aead.Open(nil, nonce, packet[hdr.pnOffset+pnLen:], header)
+	if err != nil {
+		return nil, false
+	}
+	return plaintext, true
+}
+
+type quicFrames struct {
+	crypto          []quicCryptoFrame
+	client          bool
+	connectionClose bool
+}
+
+type quicCryptoFrame struct {
+	offset uint64
+	data   []byte
+}
+
+// quicInitialFrames walks the packets coalesced in a datagram by their
+// Length fields and gathers the frames of the client Initial packets among
+// them. A packet with a short header runs to the end of the datagram.
+func quicInitialFrames(data []byte) quicFrames {
+	result := quicFrames{}
+	for len(data) > 0 && data[0]&0x80 != 0 {
+		hdr, ok := parseQUICLongHeader(data)
+		if !ok {
+			break
+		}
+		if hdr.packetType == flows.QUICPacketInitial {
+			if plaintext, ok := decryptQUICInitial(data[:hdr.end], hdr, clientInitialKeys(hdr.version, hdr.dcid)); ok {
+				result.client = true
+				frames := parseQUICFrames(plaintext)
+				result.crypto = append(result.crypto, frames.crypto...)
+				result.connectionClose = result.connectionClose || frames.connectionClose
+			}
+		}
+		data = data[hdr.end:]
+	}
+	return result
+}
+
+// parseQUICFrames walks the frames of a decrypted Initial packet and returns
+// its CRYPTO frames.
+func parseQUICFrames(data []byte) quicFrames {
+	result := quicFrames{}
+
+	idx := 0
+	for idx < len(data) {
+		frameType, n := readQUICVarint(data[idx:])
+		if n == 0 {
+			break
+		}
+		idx += n
+
+		switch {
+		case frameType == 0x00 || frameType == 0x01:
+		case frameType == 0x02 || frameType == 0x03:
+			next, ok := skipQUICAckFrame(data, idx, frameType == 0x03)
+			if !ok {
+				return result
+			}
+			idx = next
+		case frameType == 0x06:
+			offset, n1 := readQUICVarint(data[idx:])
+			if n1 == 0 {
+				return result
+			}
+			length, n2 := readQUICVarint(data[idx+n1:])
+			if n2 == 0 {
+				return result
+			}
+			start := idx + n1 + n2
+			if uint64(len(data)-start) < length || offset+length > quicMaxCryptoData {
+				return result
+			}
+			result.crypto = append(result.crypto, quicCryptoFrame{offset: offset, data: data[start : start+int(length)]})
+			idx = start + int(length)
+		case frameType == 0x1c || frameType == 0x1d:
+			result.connectionClose = true
+			return result
+		default:
+			return result
+		}
+	}
+	return result
+}
+
+// assembleQUICCrypto returns the contiguous CRYPTO stream the chunks hold
+// from offset zero. It sorts chunks in place.
+func assembleQUICCrypto(chunks []quicCryptoFrame) []byte {
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].offset < chunks[j].offset })
+	var stream []byte
+	for _, chunk := range chunks {
+		end := chunk.offset + uint64(len(chunk.data))
+		if chunk.offset > uint64(len(stream)) {
+			break
+		}
+		if end <= uint64(len(stream)) {
+			continue
+		}
+		stream = append(stream, chunk.data[uint64(len(stream))-chunk.offset:]...)
+	}
+	return stream
+}
+
+// quicCryptoStream puts together the ClientHello of a QUIC connection whose
+// CRYPTO frames span several client Initial datagrams, as Chrome's and
+// Firefox's do once post-quantum key shares make it too large for one, and
+// labels the packet that completes it. The frames are buffered for one
+// original Destination Connection ID, from which the Initial keys derive.
+type quicCryptoStream struct {
+	dcid   string
+	chunks []quicCryptoFrame
+	size   int
+	done   bool
+}
+
+// feed takes the next datagram of the flow. Only Initials whose datagram
+// did not carry a whole ClientHello are decrypted again here.
+func (s *quicCryptoStream) feed(info *flows.PacketInfo) {
+	pkt := info.QUIC
+	if pkt == nil || pkt.PacketType != flows.QUICPacketInitial {
+		return
+	}
+	if pkt.ClientHello {
+		*s = quicCryptoStream{dcid: pkt.DCID, done: true}
+		return
+	}
+	if s.done && pkt.DCID == s.dcid {
+		return
+	}
+
+	frames := quicInitialFrames(info.Payload)
+	if len(frames.crypto) == 0 {
+		return
+	}
+	if pkt.DCID != s.dcid {
+		// A new connection attempt, such as one after a Retry, starts the
+		// stream again under its own keys.
+		*s = quicCryptoStream{dcid: pkt.DCID}
+	}
+	for _, chunk := range frames.crypto {
+		s.size += len(chunk.data)
+		if s.size > quicMaxCryptoData {
+			s.done = true
+			s.chunks = nil
+			return
+		}
+		s.chunks = append(s.chunks, chunk)
+	}
+
+	result := quicResult{packet: pkt}
+	if result.readClientHello(assembleQUICCrypto(s.chunks)) {
+		result.apply(info)
+		s.done = true
+		s.chunks = nil
+	}
+}
+
+// quicCryptoTracker follows the CRYPTO streams of every QUIC flow.
+type quicCryptoTracker struct {
+	streams map[*flows.FlowAgg]*quicCryptoStream
+}
+
+func newQUICCryptoTracker() *quicCryptoTracker {
+	return &quicCryptoTracker{streams: make(map[*flows.FlowAgg]*quicCryptoStream)}
+}
+
+func (t *quicCryptoTracker) observe(flow *flows.FlowAgg, info *flows.PacketInfo) {
+	stream, ok := t.streams[flow]
+	if !ok {
+		if info.QUIC == nil || info.QUIC.PacketType != flows.QUICPacketInitial {
+			return
+		}
+		stream = &quicCryptoStream{}
+		t.streams[flow] = stream
+	}
+	stream.feed(info)
+}
+
+// release drops the CRYPTO stream of a flow that is finalized early.
+func (t *quicCryptoTracker) release(flow *flows.FlowAgg) {
+	delete(t.streams, flow)
+}
+
+func skipQUICAckFrame(data []byte, idx int, ecn bool) (int, bool) {
+	// Largest Acknowledged, ACK Delay, ACK Range Count, First ACK Range.
+	var rangeCount uint64
+	for i := 0; i < 4; i++ {
+		v, n := readQUICVarint(data[idx:])
+		if n == 0 {
+			return 0, false
+		}
+		if i == 2 {
+			rangeCount = v
+		}
+		idx += n
+	}
+	for i := uint64(0); i < rangeCount*2; i++ {
+		_, n := readQUICVarint(data[idx:])
+		if n == 0 {
+			return 0, false
+		}
+		idx += n
+	}
+	if ecn {
+		for i := 0; i < 3; i++ {
+			_, n := readQUICVarint(data[idx:])
+			if n == 0 {
+				return 0, false
+			}
+			idx += n
+		}
+	}
+	return idx, true
+}
+
+func readQUICVarint(data []byte) (uint64, int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+	length := 1 << (data[0] >> 6)
+	if len(data) < length {
+		return 0, 0
+	}
+	value := uint64(data[0] & 0x3f)
+	for i := 1; i < length; i++ {
+		value = value<<8 | uint64(data[i])
+	}
+	return value, length
+}
+
+func isKnownQUICVersion(version uint32) bool {
+	return version == quicVersion1 || version == quicVersion2 || version == quicVersionDraft
+}
+
+func quicLongPacketType(version uint32, bits byte) string {
+	if version == quicVersion2 {
+		bits = (bits + 3) & 0x03
+	}
+	switch bits {
+	case 0:
+		return flows.QUICPacketInitial
+	case 1:
+		return flows.QUICPacket0RTT
+	case 2:
+		return flows.QUICPacketHandshake
+	default:
+		return flows.QUICPacketRetry
+	}
+}
+
+func quicVersionString(version uint32) string {
+	switch version {
+	case 0:
+		return ""
+	case quicVersion1:
+		return "QUICv1"
+	case quicVersion2:
+		return "QUICv2"
+	case quicVersionDraft:
+		return "QUIC-draft-29"
+	default:
+		return fmt.Sprintf("0x%08x", version)
+	}
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,212 @@
+package pcap
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"netsage/internal/flows"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestQUICClientInitialKeys(t *testing.T) {
+	// Test vectors from RFC 9001 Appendix A.1.
+	keys := clientInitialKeys(quicVersion1, mustHex("8394c8f03e515708"))
+	if got := hex.EncodeToString(keys.key); got != "1f369613dd76d5467730efcbe3b1a22d" {
+		t.Fatalf("unexpected client key %s", got)
+	}
+	if got := hex.EncodeToString(keys.iv); got != "fa044b2f42a3fd3b46fb255c" {
+		t.Fatalf("unexpected client iv %s", got)
+	}
+	if got := hex.EncodeToString(keys.hp); got != "9f50449e04a0e810283a1e9933adedd2" {
+		t.Fatalf("unexpected client hp %s", got)
+	}
+}
+
+func TestQUICInitialClientHello(t *testing.T) {
+	dcid := mustHex("8394c8f03e515708")
+	packet := buildQUICInitial(t, dcid, buildClientHello("video.example.com", "h3"))
+
+	result := quicInfo{payload: packet}.Parse()
+	if result.packet == nil {
+		t.Fatalf("expected QUIC packet to be parsed")
+	}
+	if result.packet.Version != "QUICv1" || result.packet.PacketType != flows.QUICPacketInitial {
+		t.Fatalf("unexpected header %s %s", result.packet.Version, result.packet.PacketType)
+	}
+	if result.packet.DCID != "8394c8f03e515708" {
+		t.Fatalf("unexpected dcid %s", result.packet.DCID)
+	}
+	if !result.packet.ClientHello {
+		t.Fatalf("expected ClientHello in Initial CRYPTO frames")
+	}
+	if result.sni == nil || *result.sni != "video.example.com" {
+		t.Fatalf("expected SNI, got %v", result.sni)
+	}
+	if result.alpn == nil || *result.alpn != "h3" {
+		t.Fatalf("expected ALPN h3, got %v", result.alpn)
+	}
+
+	packet[len(packet)-1] ^= 0xff
+	corrupted := quicInfo{payload: packet}.Parse()
+	if corrupted.packet == nil || corrupted.packet.ClientHello {
+		t.Fatalf("expected header only for a packet that fails authentication")
+	}
+}
+
+// A ClientHello split across Initials is read once all of it is there,
+// whether the Initials are coalesced in one datagram or sent in several.
+func TestQUICClientHelloSpansInitials(t *testing.T) {
+	dcid := mustHex("8394c8f03e515708")
+	hello := buildClientHello("video.example.com", "h3")
+	whole := quicInfo{payload: buildQUICInitial(t, dcid, hello)}.Parse()
+	split := len(hello) / 2
+	head := buildQUICInitialPacket(t, dcid, 0, buildQUICCryptoFrame(0, hello[:split]))
+	tail := buildQUICInitialPacket(t, dcid, 1, buildQUICCryptoFrame(split, hello[split:]))
+
+	coalesced := quicInfo{payload: append(append([]byte(nil), head...), tail...)}.Parse()
+	if !coalesced.packet.ClientHello || *coalesced.sni != "video.example.com" || *coalesced.ja4 != *whole.ja4 {
+		t.Fatalf("expected the ClientHello of coalesced Initials, got %+v", coalesced)
+	}
+
+	var stream quicCryptoStream
+	for i, datagram := range [][]byte{tail, head} {
+		info := flows.PacketInfo{Proto: "UDP", Payload: datagram}
+		quicInfo{payload: datagram}.Parse().apply(&info)
+		if info.QUIC.ClientHello {
+			t.Fatalf("datagram %d: expected no ClientHello from half of it", i)
+		}
+		stream.feed(&info)
+		if complete := info.QUIC.ClientHello; complete != (i == 1) {
+			t.Fatalf("datagram %d: expected the ClientHello only once complete, got %v", i, complete)
+		}
+		if i == 1 && (*info.TLSSNI != "video.example.com" || *info.ALPN != "h3" || *info.JA4 != *whole.ja4) {
+			t.Fatalf("expected the SNI, ALPN and JA4 of the whole ClientHello, got %+v", info)
+		}
+	}
+}
+
+// The analyzer and the packet list both label the Initial that completes a
+// ClientHello sent in two datagrams, and both Initials count as the client's.
+func TestAnalyzeQUICClientHelloSpansDatagrams(t *testing.T) {
+	dcid := mustHex("0011223344556677")
+	hello := buildClientHello("split.example.com", "h3")
+	split := len(hello) / 2
+	client, server := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+	datagram := func(payload []byte) []byte {
+		ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: client, DstIP: server}
+		return serializeLayers(t, &layers.Ethernet{SrcMAC: defragMAC, DstMAC: defragMAC, EthernetType: layers.EthernetTypeIPv4},
+			ip, &layers.UDP{SrcPort: 50000, DstPort: 443}, gopacket.Payload(payload))
+	}
+	path := filepath.Join(t.TempDir(), "quic.pcap")
+	writeEthernetFrames(t, path, [][]byte{
+		datagram(buildQUICInitialPacket(t, dcid, 0, buildQUICCryptoFrame(0, hello[:split]))),
+		datagram(buildQUICInitialPacket(t, dcid, 1, buildQUICCryptoFrame(split, hello[split:]))),
+	})
+	indexPath, flowIndex, stored := indexedCapture(t, path, Options{})
+	if len(stored) != 1 || stored[0].TLSSNI == nil || *stored[0].TLSSNI != "split.example.com" || stored[0].JA4 == nil {
+		t.Fatalf("expected the flow to carry the ClientHello's SNI and JA4, got %+v", stored)
+	}
+	if stored[0].QUICClientInitials != 2 || !stored[0].QUICHandshakeFailed {
+		t.Fatalf("expected both Initials counted and no server reply, got %d initials, failed %v", stored[0].QUICClientInitials, stored[0].QUICHandshakeFailed)
+	}
+
+	for _, indexPath := range []string{"", indexPath} {
+		packets, _, err := ListPackets(context.Background(), path, indexPath, 0, 0, PacketFilter{}, flowIndex)
+		if err != nil {
+			t.Fatalf("list packets: %v", err)
+		}
+		if len(packets) != 2 || packets[0].TLSSNI != nil || packets[1].TLSSNI == nil || *packets[1].TLSSNI != "split.example.com" {
+			t.Fatalf("expected the second Initial to carry the SNI, got %s", mustJSON(t, packets))
+		}
+	}
+}
+
+func buildClientHello(sni, alpn string) []byte {
+	var ext []byte
+	serverName := append([]byte{0}, byte(len(sni)>>8), byte(len(sni)))
+	serverName = append(serverName, sni...)
+	ext = binary.BigEndian.AppendUint16(ext, 0)
+	ext = binary.BigEndian.AppendUint16(ext, uint16(len(serverName)+2))
+	ext = binary.BigEndian.AppendUint16(ext, uint16(len(serverName)))
+	ext = append(ext, serverName...)
+
+	protocols := append([]byte{byte(len(alpn))}, alpn...)
+	ext = binary.BigEndian.AppendUint16(ext, 16)
+	ext = binary.BigEndian.AppendUint16(ext, uint16(len(protocols)+2))
+	ext = binary.BigEndian.AppendUint16(ext, uint16(len(protocols)))
+	ext = append(ext, protocols...)
+
+	body := []byte{0x03, 0x03}
+	body = append(body, make([]byte, 32)...)
+	body = append(body, 0)
+	body = append(body, 0x00, 0x02, 0x13, 0x01)
+	body = append(body, 0x01, 0x00)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(ext)))
+	body = append(body, ext...)
+
+	hs := []byte{1, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	return append(hs, body...)
+}
+
+func buildQUICInitial(t *testing.T, dcid []byte, clientHello []byte) []byte {
+	t.Helper()
+	return buildQUICInitialPacket(t, dcid, 2, buildQUICCryptoFrame(0, clientHello))
+}
+
+func buildQUICCryptoFrame(offset int, data []byte) []byte {
+	frame := []byte{0x06}
+	frame = binary.BigEndian.AppendUint16(frame, 0x4000|uint16(offset))
+	frame = binary.BigEndian.AppendUint16(frame, 0x4000|uint16(len(data)))
+	return append(frame, data...)
+}
+
+// buildQUICInitialPacket protects frames as client Initial packet pn,
+// padding them to 1100 bytes.
+func buildQUICInitialPacket(t *testing.T, dcid []byte, pn byte, frames []byte) []byte {
+	t.Helper()
+	keys := clientInitialKeys(quicVersion1, dcid)
+
+	frames = append(frames, make([]byte, 1100-len(frames))...)
+
+	const pnLen = 4
+	header := []byte{0xc0 | (pnLen - 1)}
+	header = binary.BigEndian.AppendUint32(header, quicVersion1)
+	header = append(header, byte(len(dcid)))
+	header = append(header, dcid...)
+	header = append(header, 0, 0)
+	header = binary.BigEndian.AppendUint16(header, 0x4000|uint16(pnLen+len(frames)+16))
+	pnOffset := len(header)
+	header = binary.BigEndian.AppendUint32(header, uint32(pn))
+
+	block, err := aes.NewCipher(keys.key)
+	if err != nil {
+		t.Fatalf("cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatalf("gcm: %v", err)
+	}
+	nonce := append([]byte(nil), keys.iv...)
+	nonce[len(nonce)-1] ^= pn
+	packet := aead.Seal(append([]byte(nil), header...), nonce, frames, header)
+
+	hpBlock, err := aes.NewCipher(keys.hp)
+	if err != nil {
+		t.Fatalf("hp cipher: %v", err)
+	}
+	mask := make([]byte, 16)
+	hpBlock.Encrypt(mask, packet[pnOffset+4:pnOffset+20])
+	packet[0] ^= mask[0] & 0x0f
+	for i := 0; i < pnLen; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+	}
+	return packet
+}
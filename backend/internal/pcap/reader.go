@@ -2,38 +2,327 @@ package pcap
 
 import (
 	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"netsage/internal/capturefilter"
 
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcapgo"
 )
 
-func openPacketSource(path string) (*gopacket.PacketSource, *os.File, error) {
-	file, err := os.Open(path)
+// linkTypeLinuxSLL2 is LINKTYPE_LINUX_SLL2 (276), written by tcpdump -i any
+// since libpcap 1.10. gopacket does not know it and pcapgo keeps link types in
+// a uint8, so it arrives as its low byte; 20 is not otherwise assigned.
+const linkTypeLinuxSLL2 = layers.LinkType(276 & 0xff)
+
+// Raw IP captures from some BSDs carry DLT_RAW's native value instead of 101.
+const (
+	linkTypeRawBSD     layers.LinkType = 12
+	linkTypeRawOpenBSD layers.LinkType = 14
+)
+
+var layerTypeLinuxSLL2 = gopacket.RegisterLayerType(2276, gopacket.LayerTypeMetadata{
+	Name:    "LinuxSLL2",
+	Decoder: gopacket.DecodeFunc(decodeLinuxSLL2),
+})
+
+// linuxSLL2 is the Linux cooked capture v2 header. Unlike v1 it names the
+// interface the packet was seen on.
+type linuxSLL2 struct {
+	layers.BaseLayer
+	Protocol       layers.EthernetType
+	InterfaceIndex uint32
+	PacketType     uint8
+}
+
+func (l *linuxSLL2) LayerType() gopacket.LayerType { return layerTypeLinuxSLL2 }
+
+func decodeLinuxSLL2(data []byte, p gopacket.PacketBuilder) error {
+	if len(data) < 20 {
+		return errors.New("linux sll2 header too short")
+	}
+	l := &linuxSLL2{
+		Protocol:       layers.EthernetType(binary.BigEndian.Uint16(data[0:2])),
+		InterfaceIndex: binary.BigEndian.Uint32(data[4:8]),
+		PacketType:     data[10],
+	}
+	l.Contents = data[:20]
+	l.Payload = data[20:]
+	p.AddLayer(l)
+	return p.NextDecoder(l.Protocol)
+}
+
+// captureInterface is stored in CaptureInfo.AncillaryData so parsePacket can
+// tell which interface a packet came from without access to the reader.
+type captureInterface struct {
+	linkType layers.LinkType
+	name     string
+}
+
+// interfaceSource reads pcap or pcapng packet data and decodes every packet
+// with the link type of the interface it was captured on, so pcapng files
+// mixing Ethernet, cooked and raw IP interfaces decode fully. It is both the
+// data source and the decoder of its gopacket.PacketSource; the source reads
+// each packet right before decoding it.
+type interfaceSource struct {
+	pcap    *pcapgo.Reader
+	ng      *pcapgo.NgReader
+	current captureInterface
+
+	consumed   *progressReader
+	buffered   *bufio.Reader
+	order      binary.ByteOrder
+	compressed bool
+	// nanos is set for pcap files with nanosecond timestamps. The pcapgo
+	// reader's Resolution reports them the wrong way round.
+	nanos bool
+	// filter, when set, skips the frames that do not pass it, as if they
+	// had never been captured.
+	filter *frameFilter
+}
+
+func (s *interfaceSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := s.readFrame()
+		if err != nil || s.filter.matches(data, s.current.linkType) {
+			return data, ci, err
+		}
+	}
+}
+
+func (s *interfaceSource) readFrame() ([]byte, gopacket.CaptureInfo, error) {
+	if s.pcap != nil {
+		data, ci, err := s.pcap.ReadPacketData()
+		if err == nil {
+			ci.AncillaryData = []interface{}{s.current}
+		}
+		return data, ci, err
+	}
+
+	data, ci, err := s.ng.ReadPacketData()
 	if err != nil {
-		return nil, nil, err
+		return data, ci, err
+	}
+	s.current = captureInterface{linkType: s.ng.LinkType()}
+	if iface, ifErr := s.ng.Interface(ci.InterfaceIndex); ifErr == nil {
+		s.current.linkType = iface.LinkType
+		s.current.name = iface.Name
+	}
+	if s.current.name == "" && s.ng.NInterfaces() > 1 {
+		s.current.name = fmt.Sprintf("if%d", ci.InterfaceIndex)
+	}
+	ci.AncillaryData = []interface{}{s.current}
+	return data, ci, nil
+}
+
+func (s *interfaceSource) Decode(data []byte, p gopacket.PacketBuilder) error {
+	return decodeLinkType(s.current.linkType, data, p)
+}
+
+func decodeLinkType(linkType layers.LinkType, data []byte, p gopacket.PacketBuilder) error {
+	switch linkType {
+	case linkTypeLinuxSLL2:
+		return decodeLinuxSLL2(data, p)
+	case linkTypeRawBSD, linkTypeRawOpenBSD:
+		return layers.LinkTypeRaw.Decode(data, p)
+	case layers.LinkTypeIPv4:
+		return layers.LayerTypeIPv4.Decode(data, p)
+	case layers.LinkTypeIPv6:
+		return layers.LayerTypeIPv6.Decode(data, p)
+	default:
+		return linkType.Decode(data, p)
 	}
+}
+
+// newPacketSource detects pcap or pcapng from the magic number and returns a
+// packet source over r of the frames that pass capture.
+func newPacketSource(r io.Reader, capture *capturefilter.Filter) (*gopacket.PacketSource, error) {
+	source, err := newInterfaceSource(r)
+	if err != nil {
+		return nil, err
+	}
+	source.filter = newFrameFilter(capture)
+	return gopacket.NewPacketSource(source, source), nil
+}
 
-	buffered := bufio.NewReader(file)
+func newInterfaceSource(r io.Reader) (*interfaceSource, error) {
+	consumed := &progressReader{r: r}
+	buffered := bufio.NewReader(consumed)
 	magic, err := buffered.Peek(4)
 	if err != nil {
-		file.Close()
-		return nil, nil, err
+		return nil, err
 	}
 
+	// The pcapgo readers buffer through buffered itself rather than wrapping
+	// it again, so what they have consumed is known between packets.
+	source := &interfaceSource{consumed: consumed, buffered: buffered}
 	if isPcapngMagic(magic) {
-		ngReader, err := pcapgo.NewNgReader(buffered, pcapgo.DefaultNgReaderOptions)
+		source.order = binary.LittleEndian
+		if header, err := buffered.Peek(12); err == nil && binary.BigEndian.Uint32(header[8:12]) == ngByteOrderMagic {
+			source.order = binary.BigEndian
+		}
+		options := pcapgo.DefaultNgReaderOptions
+		options.WantMixedLinkType = true
+		source.ng, err = pcapgo.NewNgReader(buffered, options)
 		if err != nil {
-			file.Close()
-			return nil, nil, err
+			return nil, err
 		}
-		return gopacket.NewPacketSource(ngReader, ngReader.LinkType()), file, nil
+	} else {
+		source.compressed = len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b
+		source.nanos = binary.LittleEndian.Uint32(magic) == pcapNanosMagic || binary.BigEndian.Uint32(magic) == pcapNanosMagic
+		source.pcap, err = pcapgo.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		source.current.linkType = source.pcap.LinkType()
 	}
+	return source, nil
+}
 
-	reader, err := pcapgo.NewReader(buffered)
+// pcapng block types that carry packet data.
+const (
+	ngBlockPacket         = 0x00000002
+	ngBlockSimplePacket   = 0x00000003
+	ngBlockEnhancedPacket = 0x00000006
+	ngByteOrderMagic      = 0x1a2b3c4d
+	pcapNanosMagic        = 0xa1b23c4d
+)
+
+// dataOffset returns where in the file the data of the packet just read
+// starts, so it can be read again without the reader. pcapng blocks are
+// located from their trailing length, read through file. It reports false
+// for gzip captures, whose offsets are not file offsets. Sections in a byte
+// order other than the first are not supported.
+func (s *interfaceSource) dataOffset(file io.ReaderAt, captureLength int) (int64, bool) {
+	if s.compressed {
+		return 0, false
+	}
+	end := s.consumed.bytesRead - int64(s.buffered.Buffered())
+	if s.pcap != nil {
+		return end - int64(captureLength), true
+	}
+
+	var word [4]byte
+	if _, err := file.ReadAt(word[:], end-4); err != nil {
+		return 0, false
+	}
+	start := end - int64(s.order.Uint32(word[:]))
+	if _, err := file.ReadAt(word[:], start); err != nil {
+		return 0, false
+	}
+	switch s.order.Uint32(word[:]) {
+	case ngBlockEnhancedPacket, ngBlockPacket:
+		return start + 28, true
+	case ngBlockSimplePacket:
+		return start + 12, true
+	default:
+		return 0, false
+	}
+}
+
+// nextPacketData reads the next packet, retrying errors as
+// gopacket.PacketSource does, and reports false at the end of the capture.
+func nextPacketData(ctx context.Context, source gopacket.PacketDataSource) ([]byte, gopacket.CaptureInfo, bool) {
+	for {
+		data, ci, err := source.ReadPacketData()
+		if err == nil {
+			return data, ci, true
+		}
+		if err == syscall.EAGAIN {
+			continue
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF ||
+			err == io.ErrNoProgress || err == io.ErrClosedPipe || err == io.ErrShortBuffer ||
+			err == syscall.EBADF || strings.Contains(err.Error(), "use of closed file") {
+			return nil, ci, false
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ci, false
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+// linkDecoder decodes packet data of one link type.
+type linkDecoder layers.LinkType
+
+func (l linkDecoder) Decode(data []byte, p gopacket.PacketBuilder) error {
+	return decodeLinkType(layers.LinkType(l), data, p)
+}
+
+// decodeCaptured decodes what an interfaceSource read, with the link type it
+// recorded for the packet, exactly as the packet source would. Unlike the
+// packet source it can run away from the reader.
+func decodeCaptured(data []byte, ci gopacket.CaptureInfo) gopacket.Packet {
+	var linkType layers.LinkType
+	if len(ci.AncillaryData) > 0 {
+		if iface, ok := ci.AncillaryData[0].(captureInterface); ok {
+			linkType = iface.linkType
+		}
+	}
+	packet := gopacket.NewPacket(data, linkDecoder(linkType), gopacket.DecodeOptions{})
+	m := packet.Metadata()
+	m.CaptureInfo = ci
+	m.Truncated = m.Truncated || ci.CaptureLength < ci.Length
+	return packet
+}
+
+// openPacketSource opens the capture at path for reading the frames that
+// pass capture, the filter it was analyzed with.
+func openPacketSource(path string, capture *capturefilter.Filter) (*gopacket.PacketSource, *os.File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	packetSource, err := newPacketSource(file, capture)
 	if err != nil {
 		file.Close()
 		return nil, nil, err
 	}
-	return gopacket.NewPacketSource(reader, reader.LinkType()), file, nil
+	return packetSource, file, nil
+}
+
+// CaptureFormat reports whether the capture at path is "pcapng" or "pcap".
+func CaptureFormat(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return "", err
+	}
+	if isPcapngMagic(magic) {
+		return "pcapng", nil
+	}
+	return "pcap", nil
+}
+
+// packetInterface names the capture interface of a decoded packet, from the
+// pcapng interface block or, for cooked v2 captures, the interface index.
+func packetInterface(packet gopacket.Packet) string {
+	name := ""
+	if meta := packet.Metadata(); meta != nil && len(meta.AncillaryData) > 0 {
+		if iface, ok := meta.AncillaryData[0].(captureInterface); ok {
+			name = iface.name
+		}
+	}
+	if name == "" || name == "any" {
+		if sll2, ok := packet.Layer(layerTypeLinuxSLL2).(*linuxSLL2); ok {
+			name = fmt.Sprintf("if%d", sll2.InterfaceIndex)
+		}
+	}
+	return name
 }
@@ -0,0 +1,128 @@
+package pcap
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestMixedLinkTypePcapng(t *testing.T) {
+	mac := net.HardwareAddr{0x00, 0x0c, 0x29, 0xaa, 0xbb, 0xcc}
+	segment := func(host byte) []gopacket.SerializableLayer {
+		return []gopacket.SerializableLayer{
+			&layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IP{10, 0, 0, host}, DstIP: net.IP{10, 0, 1, host}},
+			&layers.TCP{SrcPort: 40000, DstPort: 443, SYN: true, Window: 1024},
+		}
+	}
+	loopback := make([]byte, 4)
+	binary.LittleEndian.PutUint32(loopback, 2)
+	cooked := make([]byte, 16)
+	binary.BigEndian.PutUint16(cooked[2:4], 1)
+	binary.BigEndian.PutUint16(cooked[4:6], 6)
+	copy(cooked[6:], mac)
+	binary.BigEndian.PutUint16(cooked[14:16], uint16(layers.EthernetTypeIPv4))
+
+	interfaces := []struct {
+		name     string
+		linkType layers.LinkType
+		frame    []byte
+	}{
+		{"eth0", layers.LinkTypeEthernet, serializeLayers(t, append([]gopacket.SerializableLayer{
+			&layers.Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: layers.EthernetTypeIPv4},
+		}, segment(1)...)...)},
+		{"tun0", layers.LinkTypeRaw, serializeLayers(t, segment(2)...)},
+		{"lo0", layers.LinkTypeNull, append(loopback, serializeLayers(t, segment(3)...)...)},
+		{"any", layers.LinkTypeLinuxSLL, append(cooked, serializeLayers(t, segment(4)...)...)},
+	}
+
+	var buf bytes.Buffer
+	writer, err := pcapgo.NewNgWriterInterface(&buf, pcapgo.NgInterface{Name: interfaces[0].name, LinkType: interfaces[0].linkType, SnapLength: 65535}, pcapgo.DefaultNgWriterOptions)
+	if err != nil {
+		t.Fatalf("writer: %v", err)
+	}
+	ts := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i, iface := range interfaces {
+		index := 0
+		if i > 0 {
+			index, err = writer.AddInterface(pcapgo.NgInterface{Name: iface.name, LinkType: iface.linkType, SnapLength: 65535})
+			if err != nil {
+				t.Fatalf("add interface: %v", err)
+			}
+		}
+		ci := gopacket.CaptureInfo{Timestamp: ts.Add(time.Duration(i) * time.Millisecond), CaptureLength: len(iface.frame), Length: len(iface.frame), InterfaceIndex: index}
+		if err := writer.WritePacket(ci, iface.frame); err != nil {
+			t.Fatalf("write packet: %v", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "mixed.pcapng")
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	result, err := AnalyzeFile(context.Background(), path, Options{}, nil)
+	if err != nil {
+		t.Fatalf("analyze: %v", err)
+	}
+	if len(result.Flows) != len(interfaces) {
+		t.Fatalf("expected %d flows, got %d", len(interfaces), len(result.Flows))
+	}
+	for key, flow := range result.Flows {
+		host := net.ParseIP(key.SrcIP).To4()[3]
+		want := interfaces[host-1].name
+		if len(flow.Interfaces) != 1 || flow.Interfaces[0] != want {
+			t.Fatalf("flow %s: expected interface %s, got %v", key.SrcIP, want, flow.Interfaces)
+		}
+	}
+}
+
+func TestLinuxSLL2Capture(t *testing.T) {
+	header := make([]byte, 20)
+	binary.BigEndian.PutUint16(header[0:2], uint16(layers.EthernetTypeIPv6))
+	binary.BigEndian.PutUint32(header[4:8], 3)
+	binary.BigEndian.PutUint16(header[8:10], 1)
+	header[11] = 6
+	ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8::2")}
+	udp := &layers.UDP{SrcPort: 5000, DstPort: 6000}
+	udp.SetNetworkLayerForChecksum(ip)
+	frame := append(header, serializeLayers(t, ip, udp, gopacket.Payload("ping"))...)
+
+	var buf bytes.Buffer
+	writer := pcapgo.NewWriter(&buf)
+	if err := writer.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatalf("header: %v", err)
+	}
+	if err := writer.WritePacket(gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(frame), Length: len(frame)}, frame); err != nil {
+		t.Fatalf("write packet: %v", err)
+	}
+	// pcapgo can only write 8-bit link types; patch in LINKTYPE_LINUX_SLL2.
+	raw := buf.Bytes()
+	binary.LittleEndian.PutUint32(raw[20:24], 276)
+
+	source, err := newPacketSource(bytes.NewReader(raw), nil)
+	if err != nil {
+		t.Fatalf("source: %v", err)
+	}
+	packet, err := source.NextPacket()
+	if err != nil {
+		t.Fatalf("next packet: %v", err)
+	}
+	info, ok := parsePacket(packet)
+	if !ok || info.Proto != "UDP" || info.SrcIP != "2001:db8::1" || info.DstPort != 6000 {
+		t.Fatalf("expected UDP over IPv6 behind SLL2, got %+v", info)
+	}
+	if info.Interface != "if3" {
+		t.Fatalf("expected interface from SLL2 header, got %q", info.Interface)
+	}
+}
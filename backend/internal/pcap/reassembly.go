@@ -0,0 +1,173 @@
+package pcap
+
+import (
+	"netsage/internal/flows"
+)
+
+const (
+	// maxPendingSegments bounds the early segments held per direction while
+	// waiting for a gap to fill.
+	maxPendingSegments = 64
+	// maxReassemblyBytes bounds the out-of-order payload held per flow across
+	// both directions.
+	maxReassemblyBytes = 256 * 1024
+)
+
+// streamChunk is the in-order payload one TCP segment released for its
+// direction. gap is set once the direction has been abandoned because a hole
+// in the sequence space never filled within the bounds above; parsers must
+// stop reading that direction.
+type streamChunk struct {
+	dir  int
+	data []byte
+	gap  bool
+}
+
+// orderedStream releases the payload of one TCP direction in sequence order,
+// trimming retransmitted bytes and holding a bounded number of early segments
+// until the gap before them fills.
+type orderedStream struct {
+	started      bool
+	broken       bool
+	nextSeq      uint32
+	pending      map[uint32][]byte
+	pendingBytes int
+}
+
+// start anchors the stream at the first byte after a SYN so a data segment
+// that overtakes the first one is held rather than taken as the start.
+func (s *orderedStream) start(seq uint32) {
+	if !s.started {
+		s.started = true
+		s.nextSeq = seq
+	}
+}
+
+// push returns the bytes that became contiguous with this segment. It reports
+// false once too many segments or bytes are waiting on a gap; budget is the
+// number of out-of-order bytes the flow may still hold.
+func (s *orderedStream) push(seq uint32, payload []byte, budget int) ([]byte, bool) {
+	if s.broken {
+		return nil, false
+	}
+	s.start(seq)
+
+	diff := int32(seq - s.nextSeq)
+	if diff > 0 {
+		if _, ok := s.pending[seq]; ok {
+			return nil, true
+		}
+		if len(s.pending) >= maxPendingSegments || len(payload) > budget {
+			s.abandon()
+			return nil, false
+		}
+		if s.pending == nil {
+			s.pending = make(map[uint32][]byte)
+		}
+		s.pending[seq] = append([]byte(nil), payload...)
+		s.pendingBytes += len(payload)
+		return nil, true
+	}
+	if diff < 0 {
+		if int(-diff) >= len(payload) {
+			return nil, true
+		}
+		payload = payload[-diff:]
+	}
+
+	out := payload
+	s.nextSeq += uint32(len(payload))
+	for len(s.pending) > 0 {
+		next, ok := s.takePending()
+		if !ok {
+			break
+		}
+		if len(out) == len(payload) {
+			// Never append into the packet's own buffer.
+			out = append([]byte(nil), out...)
+		}
+		out = append(out, next...)
+		s.nextSeq += uint32(len(next))
+	}
+	return out, true
+}
+
+// takePending removes the held segment that covers nextSeq, trimmed to start
+// there, and drops any held segment that is now entirely behind it.
+func (s *orderedStream) takePending() ([]byte, bool) {
+	for seq, data := range s.pending {
+		offset := int32(s.nextSeq - seq)
+		if offset < 0 {
+			continue
+		}
+		delete(s.pending, seq)
+		s.pendingBytes -= len(data)
+		if int(offset) < len(data) {
+			return data[offset:], true
+		}
+	}
+	return nil, false
+}
+
+func (s *orderedStream) abandon() {
+	s.broken = true
+	s.pending = nil
+	s.pendingBytes = 0
+}
+
+// tcpReassembly holds both directions of one TCP connection.
+type tcpReassembly struct {
+	dirs [2]orderedStream
+}
+
+// push orders one segment and returns the payload it made available.
+func (r *tcpReassembly) push(info flows.PacketInfo, dir int) streamChunk {
+	chunk := streamChunk{dir: dir}
+	s := &r.dirs[dir]
+	if info.TCPFlags.SYN {
+		s.start(info.Seq + 1)
+		return chunk
+	}
+	if len(info.Payload) == 0 || s.broken {
+		return chunk
+	}
+
+	budget := maxReassemblyBytes - r.dirs[0].pendingBytes - r.dirs[1].pendingBytes
+	data, ok := s.push(info.Seq, info.Payload, budget)
+	if !ok {
+		chunk.gap = true
+		return chunk
+	}
+	chunk.data = data
+	return chunk
+}
+
+// tcpReassembler keeps the reassembly state of every TCP flow in a capture.
+type tcpReassembler struct {
+	flows map[*flows.FlowAgg]*tcpReassembly
+}
+
+func newTCPReassembler() *tcpReassembler {
+	return &tcpReassembler{flows: make(map[*flows.FlowAgg]*tcpReassembly)}
+}
+
+func (r *tcpReassembler) push(flow *flows.FlowAgg, info flows.PacketInfo, forward bool) streamChunk {
+	dir := 0
+	if !forward {
+		dir = 1
+	}
+	if info.Proto != "TCP" {
+		return streamChunk{dir: dir}
+	}
+	state, ok := r.flows[flow]
+	if !ok {
+		state = &tcpReassembly{}
+		r.flows[flow] = state
+	}
+	return state.push(info, dir)
+}
+
+// release drops the reassembly state of a flow that is finalized early.
+func (r *tcpReassembler) release(flow *flows.FlowAgg) {
+	delete(r.flows, flow)
+}
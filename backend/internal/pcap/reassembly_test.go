@@ -0,0 +1,129 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"netsage/internal/flows"
+)
+
+func TestReassemblyOrdersSegments(t *testing.T) {
+	var r tcpReassembly
+	push := func(seq uint32, payload string) streamChunk {
+		return r.push(flows.PacketInfo{Proto: "TCP", Seq: seq, Payload: []byte(payload)}, 0)
+	}
+
+	r.push(flows.PacketInfo{Proto: "TCP", Seq: 999, TCPFlags: flows.TCPFlags{SYN: true}}, 0)
+	if got := push(1005, "world"); len(got.data) != 0 {
+		t.Fatalf("expected early segment to be held, got %q", got.data)
+	}
+	if got := push(1000, "hello"); string(got.data) != "helloworld" {
+		t.Fatalf("expected gap to fill, got %q", got.data)
+	}
+	if got := push(1000, "hello"); len(got.data) != 0 {
+		t.Fatalf("expected retransmission to be dropped, got %q", got.data)
+	}
+	if got := push(1008, "ld!"); string(got.data) != "!" {
+		t.Fatalf("expected overlap to be trimmed, got %q", got.data)
+	}
+
+	// A held segment that overlaps the bytes released before it is trimmed
+	// rather than left waiting on a sequence number that never comes.
+	push(1014, "4567")
+	if got := push(1011, "1234"); string(got.data) != "1234567" {
+		t.Fatalf("expected overlapping held segment to be trimmed, got %q", got.data)
+	}
+}
+
+func TestReassemblyCapsPendingBytes(t *testing.T) {
+	var r tcpReassembly
+	r.push(flows.PacketInfo{Proto: "TCP", Seq: 0, Payload: []byte("a")}, 0)
+
+	segment := make([]byte, 64*1024)
+	gaps := 0
+	for i := 0; i < 8; i++ {
+		seq := uint32(100 + i*len(segment))
+		chunk := r.push(flows.PacketInfo{Proto: "TCP", Seq: seq, Payload: segment}, 0)
+		if chunk.gap {
+			gaps++
+		}
+	}
+	if gaps != 1 {
+		t.Fatalf("expected the direction to be abandoned once, got %d gaps", gaps)
+	}
+	if r.dirs[0].pendingBytes != 0 || r.dirs[0].pending != nil {
+		t.Fatalf("expected held segments to be released")
+	}
+	if chunk := r.push(flows.PacketInfo{Proto: "TCP", Seq: 1, Payload: []byte("b")}, 0); len(chunk.data) != 0 {
+		t.Fatalf("expected abandoned direction to stay closed")
+	}
+
+	// The other direction still has its own stream.
+	if chunk := r.push(flows.PacketInfo{Proto: "TCP", Seq: 50, Payload: []byte("ok")}, 1); string(chunk.data) != "ok" {
+		t.Fatalf("expected reverse direction to be unaffected, got %q", chunk.data)
+	}
+}
+
+func TestClientHelloSplitAcrossSegments(t *testing.T) {
+	hello := buildClientHello("split.example.com", "h2")
+	record := []byte{22, 0x03, 0x01}
+	record = binary.BigEndian.AppendUint16(record, uint16(len(hello)))
+	record = append(record, hello...)
+	request := append(record, []byte{23, 0x03, 0x03, 0x00, 0x04, 1, 2, 3, 4}...)
+
+	key := flows.FlowKey{Proto: "TCP", SrcIP: "10.0.0.5", DstIP: "10.0.0.80", SrcPort: 50000, DstPort: 443}
+	ts := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	flow := flows.NewFlowAgg(key, ts)
+	reassembly := newTCPReassembler()
+	records := newTLSRecordTracker()
+
+	split := len(record) / 2
+	segments := []struct {
+		seq  uint32
+		syn  bool
+		data []byte
+	}{
+		{999, true, nil},
+		{1000 + uint32(split), false, request[split:]},
+		{1000, false, request[:split]},
+		{1000, false, request[:split]},
+	}
+	for i, seg := range segments {
+		info := flows.PacketInfo{
+			Timestamp:  ts.Add(time.Duration(i) * time.Millisecond),
+			Proto:      "TCP",
+			SrcIP:      key.SrcIP,
+			DstIP:      key.DstIP,
+			SrcPort:    key.SrcPort,
+			DstPort:    key.DstPort,
+			Seq:        seg.seq,
+			TCPFlags:   flows.TCPFlags{SYN: seg.syn},
+			Payload:    seg.data,
+			PayloadLen: len(seg.data),
+		}
+		records.observe(flow, reassembly.push(flow, info, true), &info)
+		if i != 2 && info.TLSClientHello {
+			t.Fatalf("packet %d should not carry the ClientHello", i+1)
+		}
+		flow.Update(info, true)
+	}
+
+	if flow.TLSSNI == nil || *flow.TLSSNI != "split.example.com" {
+		t.Fatalf("expected SNI from reassembled ClientHello, got %v", flow.TLSSNI)
+	}
+	if flow.ALPN == nil || *flow.ALPN != "h2" || flow.JA3 == nil || flow.JA4 == nil {
+		t.Fatalf("expected ALPN and fingerprints, got alpn=%v ja3=%v ja4=%v", flow.ALPN, flow.JA3, flow.JA4)
+	}
+	if got := flow.TLSClientHelloIndexes(); len(got) != 1 || got[0] != 3 {
+		t.Fatalf("expected ClientHello evidence at packet 3, got %v", got)
+	}
+}
+
+func TestTLSRecordStreamStopsOnNonTLS(t *testing.T) {
+	var s tlsRecordStream
+	if _, ok := s.feed([]byte(strings.Repeat("GET / HTTP/1.1\r\n", 2))); ok || !s.done {
+		t.Fatalf("expected plaintext HTTP to stop the record stream")
+	}
+}
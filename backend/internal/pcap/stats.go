@@ -15,32 +15,51 @@ type Stats struct {
 	RTTQuantiles map[string]float64 `json:"rtt_quantiles"`
 }
 
-func BuildStats(flowMap map[flows.FlowKey]*flows.FlowAgg, hist *flows.Histogram) Stats {
-	talkerBytes := make(map[string]float64)
-	topTalkers := flows.NewTopK(5)
-	topFlows := flows.NewTopK(5)
+// StatsBuilder accumulates capture statistics one flow at a time, so flows
+// can be released as soon as they are added.
+type StatsBuilder struct {
+	talkerBytes map[string]float64
+	topFlows    *flows.TopK
+}
 
-	for _, flow := range flowMap {
-		total := float64(flow.BytesSent + flow.BytesRecv)
-		if total == 0 {
-			continue
-		}
+func NewStatsBuilder() *StatsBuilder {
+	return &StatsBuilder{
+		talkerBytes: make(map[string]float64),
+		topFlows:    flows.NewTopK(5),
+	}
+}
 
-		talkerBytes[flow.Key.SrcIP] += float64(flow.BytesSent)
-		talkerBytes[flow.Key.DstIP] += float64(flow.BytesRecv)
+func (b *StatsBuilder) Add(flow *flows.FlowAgg) {
+	b.AddContinued(flow, 0)
+}
 
-		clientIP, clientPort, serverIP, serverPort := flow.ClientServer()
-		key := fmt.Sprintf("%s:%d -> %s:%d (%s)", clientIP, clientPort, serverIP, serverPort, flow.Key.Proto)
-		topFlows.Add(flows.TopKItem{Key: key, Value: total})
+// AddContinued adds a flow that carries on a connection whose earlier flows
+// were added with earlier bytes in all, so the connection ranks among the
+// top flows once, by its bytes in all.
+func (b *StatsBuilder) AddContinued(flow *flows.FlowAgg, earlier int64) {
+	total := float64(flow.BytesSent + flow.BytesRecv)
+	if total == 0 {
+		return
 	}
 
-	for ip, bytes := range talkerBytes {
+	b.talkerBytes[flow.Key.SrcIP] += float64(flow.BytesSent)
+	b.talkerBytes[flow.Key.DstIP] += float64(flow.BytesRecv)
+
+	clientIP, clientPort, serverIP, serverPort := flow.ClientServer()
+	key := fmt.Sprintf("%s:%d -> %s:%d (%s)", clientIP, clientPort, serverIP, serverPort, flow.Key.Proto)
+	prev := flows.TopKItem{Key: key, Value: float64(earlier)}
+	b.topFlows.Update(prev, flows.TopKItem{Key: key, Value: float64(earlier) + total})
+}
+
+func (b *StatsBuilder) Build(hist *flows.Histogram) Stats {
+	topTalkers := flows.NewTopK(5)
+	for ip, bytes := range b.talkerBytes {
 		topTalkers.Add(flows.TopKItem{Key: ip, Value: bytes})
 	}
 
 	stats := Stats{
 		TopTalkers: topTalkers.ItemsDesc(),
-		TopFlows:   topFlows.ItemsDesc(),
+		TopFlows:   b.topFlows.ItemsDesc(),
 		RTTBuckets: hist.Buckets,
 		RTTCounts:  hist.Counts,
 		RTTQuantiles: map[string]float64{
@@ -53,6 +72,14 @@ func BuildStats(flowMap map[flows.FlowKey]*flows.FlowAgg, hist *flows.Histogram)
 	return stats
 }
 
+func BuildStats(flowMap map[flows.FlowKey]*flows.FlowAgg, hist *flows.Histogram) Stats {
+	builder := NewStatsBuilder()
+	for _, flow := range flowMap {
+		builder.Add(flow)
+	}
+	return builder.Build(hist)
+}
+
 func (s Stats) JSON() (string, string, string) {
 	topTalkers, _ := json.Marshal(s.TopTalkers)
 	topFlows, _ := json.Marshal(s.TopFlows)
@@ -0,0 +1,281 @@
+package pcap
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"netsage/internal/flows"
+)
+
+// ErrStreamNotFound is returned when a selection holds no packets to follow.
+var ErrStreamNotFound = errors.New("stream not found")
+
+const (
+	DirectionClientToServer = "client_to_server"
+	DirectionServerToClient = "server_to_client"
+)
+
+// StreamFollow is the application data of one connection in the order it
+// was captured, as Wireshark's Follow Stream shows it. The byte counts are
+// of the data delivered in order, without retransmissions.
+type StreamFollow struct {
+	Protocol    string        `json:"protocol"`
+	ClientIP    string        `json:"client_ip"`
+	ClientPort  int           `json:"client_port"`
+	ServerIP    string        `json:"server_ip"`
+	ServerPort  int           `json:"server_port"`
+	ClientBytes int64         `json:"bytes_client_to_server"`
+	ServerBytes int64         `json:"bytes_server_to_client"`
+	Chunks      []StreamChunk `json:"chunks"`
+	TotalChunks int           `json:"total_chunks"`
+}
+
+// StreamChunk is a run of bytes one packet delivered to a direction. Offset
+// counts from the direction's first byte: for TCP the byte after the SYN,
+// or the first segment seen when the handshake was not captured. Missing is
+// how many bytes before it were never captured. A retransmission chunk
+// either resent bytes already delivered, which are not delivered again, or
+// delivered new bytes in a packet classed as a retransmission.
+type StreamChunk struct {
+	Packet         int       `json:"packet"`
+	Timestamp      time.Time `json:"timestamp"`
+	Direction      string    `json:"direction"`
+	Offset         int64     `json:"offset"`
+	Length         int       `json:"length"`
+	Missing        int64     `json:"missing,omitempty"`
+	Retransmission bool      `json:"retransmission"`
+	Preview        *string   `json:"preview,omitempty"`
+}
+
+// FollowStream returns the chunks of application data of the packets sel
+// selects in the capture at path, which must belong to one connection, such
+// as those of a PacketFilter.StreamID. TCP segments are put back in order
+// per direction; other protocols deliver each datagram as it is. limit and
+// offset page the chunks. Each chunk carries a preview of up to
+// previewBytes of its data, with bytes that are not printable text shown as
+// dots; with 0 no previews are returned. indexPath names the capture's
+// packet index; without a usable one the capture is decoded from the start.
+func FollowStream(ctx context.Context, path, indexPath string, sel PacketSelection, limit, offset, previewBytes int) (*StreamFollow, error) {
+	if limit <= 0 {
+		limit = 1000
+	}
+	follower := &streamFollower{
+		out:          &StreamFollow{Chunks: make([]StreamChunk, 0)},
+		limit:        limit,
+		offset:       offset,
+		previewBytes: previewBytes,
+	}
+	if err := selectPackets(ctx, path, indexPath, sel, follower.add); err != nil {
+		return nil, err
+	}
+	if !follower.started {
+		return nil, ErrStreamNotFound
+	}
+	return follower.out, nil
+}
+
+// streamFollower turns the packets of a connection into chunks.
+type streamFollower struct {
+	out          *StreamFollow
+	limit        int
+	offset       int
+	previewBytes int
+
+	started bool
+	tcp     tcpReassembly
+	based   [2]bool
+	base    [2]uint32
+	end     [2]int64
+}
+
+func (f *streamFollower) add(frame int, info flows.PacketInfo, meta FlowMeta, hasMeta bool, tags []string) {
+	if !f.started {
+		f.started = true
+		f.out.Protocol = info.Proto
+		f.out.ClientIP, f.out.ClientPort = info.SrcIP, info.SrcPort
+		f.out.ServerIP, f.out.ServerPort = info.DstIP, info.DstPort
+		if hasMeta && meta.ClientIP != "" {
+			f.out.ClientIP, f.out.ClientPort = meta.ClientIP, meta.ClientPort
+			f.out.ServerIP, f.out.ServerPort = meta.ServerIP, meta.ServerPort
+		}
+	}
+	dir := 0
+	if info.SrcIP == f.out.ServerIP && info.SrcPort == f.out.ServerPort {
+		dir = 1
+	}
+
+	if info.Proto != "TCP" {
+		if len(info.Payload) > 0 {
+			f.emit(frame, info.Timestamp, dir, f.end[dir], info.Payload, len(info.Payload), hasTag(tags, "retransmission"))
+		}
+		return
+	}
+
+	if info.TCPFlags.SYN && !f.based[dir] {
+		f.based[dir], f.base[dir] = true, info.Seq+1
+	}
+	if len(info.Payload) == 0 {
+		f.tcp.push(info, dir)
+		return
+	}
+	if !f.based[dir] {
+		f.based[dir], f.base[dir] = true, info.Seq
+	}
+
+	s := &f.tcp.dirs[dir]
+	held := s.started && int32(info.Seq-s.nextSeq) > 0
+	chunk := f.tcp.push(info, dir)
+	if chunk.gap {
+		// Too much is waiting on a hole that never filled; give up on the
+		// held segments and carry on from this one.
+		*s = orderedStream{}
+		held = false
+		chunk = f.tcp.push(info, dir)
+	}
+	switch {
+	case len(chunk.data) > 0:
+		start := int64(s.nextSeq - uint32(len(chunk.data)) - f.base[dir])
+		f.emit(frame, info.Timestamp, dir, start, chunk.data, len(chunk.data), hasTag(tags, "retransmission"))
+	case !held:
+		// Every byte of the segment was delivered before.
+		f.emit(frame, info.Timestamp, dir, int64(info.Seq-f.base[dir]), nil, len(info.Payload), true)
+	}
+}
+
+// emit adds a chunk of length bytes at offset. data is nil for a chunk
+// that resent bytes already delivered.
+func (f *streamFollower) emit(frame int, ts time.Time, dir int, offset int64, data []byte, length int, retransmission bool) {
+	chunk := StreamChunk{
+		Packet:         frame,
+		Timestamp:      ts,
+		Direction:      DirectionClientToServer,
+		Offset:         offset,
+		Length:         length,
+		Retransmission: retransmission,
+	}
+	if dir == 1 {
+		chunk.Direction = DirectionServerToClient
+	}
+	if data != nil {
+		if offset > f.end[dir] {
+			chunk.Missing = offset - f.end[dir]
+		}
+		f.end[dir] = offset + int64(length)
+		if dir == 0 {
+			f.out.ClientBytes += int64(length)
+		} else {
+			f.out.ServerBytes += int64(length)
+		}
+		if f.previewBytes > 0 {
+			preview := printablePreview(data, f.previewBytes)
+			chunk.Preview = &preview
+		}
+	}
+
+	f.out.TotalChunks++
+	if f.out.TotalChunks > f.offset && len(f.out.Chunks) < f.limit {
+		f.out.Chunks = append(f.out.Chunks, chunk)
+	}
+}
+
+// printablePreview returns up to n bytes of data as text, with bytes other
+// than printable ASCII and line breaks replaced by dots.
+func printablePreview(data []byte, n int) string {
+	if len(data) > n {
+		data = data[:n]
+	}
+	out := make([]byte, len(data))
+	for i, b := range data {
+		if (b >= 0x20 && b < 0x7f) || b == '\n' || b == '\r' || b == '\t' {
+			out[i] = b
+		} else {
+			out[i] = '.'
+		}
+	}
+	return string(out)
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// selectPackets passes fn the packets of the capture at path that sel
+// selects, in capture order, with the stored flow each belongs to and its
+// error tags. indexPath names the capture's packet index; without a usable
+// one the capture is decoded from the start.
+func selectPackets(ctx context.Context, path, indexPath string, sel PacketSelection, fn func(frame int, info flows.PacketInfo, meta FlowMeta, hasMeta bool, tags []string)) error {
+	counter := newFlowCounter(sel.Flows)
+	frames := newFrameFilter(sel.Filter.BPF)
+	if index, err := openPacketIndex(indexPath); err == nil {
+		defer index.close()
+		return selectIndexedPackets(ctx, path, index, sel, counter, frames, fn)
+	}
+	return scanPackets(ctx, path, sel.Filter.Capture, sel.FlowIndex, func(scanned *scannedPacket) bool {
+		if !scanned.ok {
+			return true
+		}
+		passes := frames.matchesCaptured(scanned.packet.Data(), scanned.packet.Metadata().CaptureInfo)
+		if !counter.selects(packetKey(scanned.info), scanned.meta, scanned.hasMeta) || !passes || !sel.Filter.Matches(scanned.info, scanned.meta) {
+			return true
+		}
+		fn(scanned.frame, scanned.info, scanned.meta, scanned.hasMeta, scanned.tags)
+		return true
+	})
+}
+
+func selectIndexedPackets(ctx context.Context, path string, index *packetIndexReader, sel PacketSelection, counter *flowCounter, frames *frameFilter, fn func(frame int, info flows.PacketInfo, meta FlowMeta, hasMeta bool, tags []string)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var fragments fragmentWindow
+	for {
+		p, err := index.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if p.frame%4096 == 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+		}
+		if p.fragment {
+			fragments.add(p)
+		}
+		if p.flow == nil {
+			continue
+		}
+
+		meta, hasMeta := p.flow.storedMeta(sel.FlowIndex)
+		info := p.info()
+		if !counter.selects(packetKey(info), meta, hasMeta) || !sel.Filter.Matches(info, meta) {
+			continue
+		}
+		if passes, err := frames.matchesIndexed(file, p); err != nil {
+			return err
+		} else if !passes {
+			continue
+		}
+
+		full, err := readIndexedPacket(file, p, fragments.before(p))
+		if err != nil {
+			return err
+		}
+		fn(p.frame, full, meta, hasMeta, p.tags)
+	}
+}
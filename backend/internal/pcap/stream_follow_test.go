@@ -0,0 +1,162 @@
+package pcap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// writeFollowCapture writes a TCP connection whose request is retransmitted
+// and whose response segments arrive out of order, and a UDP exchange.
+func writeFollowCapture(t *testing.T, path string) {
+	t.Helper()
+	client, server := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+	tcp := func(seg layers.TCP, out bool, payload string) []byte {
+		ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: client, DstIP: server}
+		seg.SrcPort, seg.DstPort, seg.Window = 40000, 80, 64240
+		if !out {
+			ip.SrcIP, ip.DstIP = server, client
+			seg.SrcPort, seg.DstPort = 80, 40000
+		}
+		return serializeLayers(t, &layers.Ethernet{SrcMAC: defragMAC, DstMAC: defragMAC, EthernetType: layers.EthernetTypeIPv4}, ip, &seg, gopacket.Payload(payload))
+	}
+	udp := func(out bool, payload string) []byte {
+		ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: client, DstIP: server}
+		dgram := &layers.UDP{SrcPort: 5000, DstPort: 6000}
+		if !out {
+			ip.SrcIP, ip.DstIP = server, client
+			dgram.SrcPort, dgram.DstPort = 6000, 5000
+		}
+		return serializeLayers(t, &layers.Ethernet{SrcMAC: defragMAC, DstMAC: defragMAC, EthernetType: layers.EthernetTypeIPv4}, ip, dgram, gopacket.Payload(payload))
+	}
+	request := "GET / HTTP/1.1\r\n\r\n"
+	writeEthernetFrames(t, path, [][]byte{
+		tcp(layers.TCP{SYN: true, Seq: 1000}, true, ""),
+		tcp(layers.TCP{SYN: true, ACK: true, Seq: 5000, Ack: 1001}, false, ""),
+		tcp(layers.TCP{ACK: true, Seq: 1001, Ack: 5001}, true, ""),
+		tcp(layers.TCP{ACK: true, PSH: true, Seq: 1001, Ack: 5001}, true, request),
+		udp(true, "ping"),
+		tcp(layers.TCP{ACK: true, PSH: true, Seq: 1001, Ack: 5001}, true, request),
+		tcp(layers.TCP{ACK: true, PSH: true, Seq: 5018, Ack: 1019}, false, "body\x00\x01"),
+		tcp(layers.TCP{ACK: true, Seq: 5001, Ack: 1019}, false, "HTTP/1.1 200 OK\r\n"),
+		udp(false, "pong"),
+		tcp(layers.TCP{ACK: true, Seq: 1019, Ack: 5024}, true, ""),
+	})
+}
+
+func TestFollowStream(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "follow.pcap")
+	writeFollowCapture(t, path)
+	indexPath, flowIndex, stored := indexedCapture(t, path, Options{})
+	ctx := context.Background()
+
+	follow := func(sel PacketSelection, limit, offset, previewBytes int) *StreamFollow {
+		t.Helper()
+		want, err := FollowStream(ctx, path, "", sel, limit, offset, previewBytes)
+		if err != nil {
+			t.Fatalf("scan: %v", err)
+		}
+		got, err := FollowStream(ctx, path, indexPath, sel, limit, offset, previewBytes)
+		if err != nil {
+			t.Fatalf("indexed: %v", err)
+		}
+		if mustJSON(t, got) != mustJSON(t, want) {
+			t.Fatalf("indexed follow differs\n got %s\nwant %s", mustJSON(t, got), mustJSON(t, want))
+		}
+		return got
+	}
+
+	stream := 0
+	byStream := PacketSelection{Filter: PacketFilter{StreamID: &stream}, FlowIndex: flowIndex}
+	out := follow(byStream, 0, 0, 64)
+	if out.Protocol != "TCP" || out.ClientPort != 40000 || out.ServerPort != 80 || out.ClientBytes != 18 || out.ServerBytes != 23 {
+		t.Fatalf("expected the connection's endpoints and byte counts, got %s", mustJSON(t, out))
+	}
+	want := []struct {
+		packet         int
+		direction      string
+		offset         int64
+		length         int
+		retransmission bool
+		preview        string
+	}{
+		{4, DirectionClientToServer, 0, 18, false, "GET / HTTP/1.1\r\n\r\n"},
+		{6, DirectionClientToServer, 0, 18, true, ""},
+		// The early segment is held until the one before it arrives.
+		{8, DirectionServerToClient, 0, 23, false, "HTTP/1.1 200 OK\r\nbody.."},
+	}
+	if out.TotalChunks != len(want) || len(out.Chunks) != len(want) {
+		t.Fatalf("expected %d chunks, got %s", len(want), mustJSON(t, out))
+	}
+	for i, w := range want {
+		c := out.Chunks[i]
+		preview := ""
+		if c.Preview != nil {
+			preview = *c.Preview
+		}
+		if c.Packet != w.packet || c.Direction != w.direction || c.Offset != w.offset || c.Length != w.length || c.Retransmission != w.retransmission || preview != w.preview {
+			t.Fatalf("chunk %d: expected %+v, got %s", i, w, mustJSON(t, c))
+		}
+	}
+
+	page := follow(byStream, 1, 1, 0)
+	if page.TotalChunks != 3 || len(page.Chunks) != 1 || page.Chunks[0].Packet != 6 || page.Chunks[0].Preview != nil {
+		t.Fatalf("expected the second chunk without a preview, got %s", mustJSON(t, page))
+	}
+
+	for _, flow := range stored {
+		if flow.Key.Proto != "UDP" {
+			continue
+		}
+		sel := PacketSelection{FlowIndex: flowIndex, Flows: []FlowRange{{Key: flow.Key, Start: flow.FirstSeen.Truncate(time.Microsecond)}}}
+		out := follow(sel, 0, 0, 2)
+		if len(out.Chunks) != 2 || *out.Chunks[0].Preview != "pi" || out.Chunks[1].Direction != DirectionServerToClient || out.Chunks[1].Offset != 0 || out.ServerBytes != 4 {
+			t.Fatalf("expected a datagram each way, got %s", mustJSON(t, out))
+		}
+	}
+
+	missing := 7
+	for _, indexPath := range []string{"", indexPath} {
+		_, err := FollowStream(ctx, path, indexPath, PacketSelection{Filter: PacketFilter{StreamID: &missing}, FlowIndex: flowIndex}, 0, 0, 0)
+		if !errors.Is(err, ErrStreamNotFound) {
+			t.Fatalf("expected ErrStreamNotFound, got %v", err)
+		}
+	}
+}
+
+// A hole that never fills is skipped once too many segments wait on it,
+// and reported as missing bytes.
+func TestFollowStreamSkipsLostData(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lost.pcap")
+	client, server := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+	var frames [][]byte
+	for i := 0; i <= maxPendingSegments+2; i++ {
+		ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: client, DstIP: server}
+		seg := &layers.TCP{SrcPort: 40000, DstPort: 80, ACK: true, Seq: uint32(100 + 10*i), Window: 502}
+		if i == 1 {
+			continue
+		}
+		frames = append(frames, serializeLayers(t, &layers.Ethernet{SrcMAC: defragMAC, DstMAC: defragMAC, EthernetType: layers.EthernetTypeIPv4}, ip, seg, gopacket.Payload("0123456789")))
+	}
+	writeEthernetFrames(t, path, frames)
+	_, flowIndex, _ := indexedCapture(t, path, Options{})
+
+	stream := 0
+	out, err := FollowStream(context.Background(), path, "", PacketSelection{Filter: PacketFilter{StreamID: &stream}, FlowIndex: flowIndex}, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("follow: %v", err)
+	}
+	if len(out.Chunks) != 2 {
+		t.Fatalf("expected the first segment and the one that gave up on the hole, got %s", mustJSON(t, out))
+	}
+	last := out.Chunks[1]
+	if last.Offset != 10*(maxPendingSegments+2) || last.Missing != 10*(maxPendingSegments+1) || out.ClientBytes != 20 {
+		t.Fatalf("expected the held segments to be reported missing, got %s", mustJSON(t, out))
+	}
+}
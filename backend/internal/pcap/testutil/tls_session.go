@@ -0,0 +1,201 @@
+package testutil
+
+import (
+    "bufio"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "fmt"
+    "io"
+    "math/big"
+    "net"
+    "net/http"
+    "os"
+    "sync"
+    "time"
+
+    "github.com/google/gopacket/layers"
+    "github.com/google/gopacket/pcapgo"
+)
+
+// TLSSessionOptions controls the session GenerateTLSPCAP records.
+type TLSSessionOptions struct {
+    MaxVersion   uint16
+    CipherSuites []uint16
+    Path         string
+    Status       int
+}
+
+type tlsChunk struct {
+    fromClient bool
+    data       []byte
+}
+
+type tlsRecorder struct {
+    mu     sync.Mutex
+    chunks []tlsChunk
+}
+
+type recordingConn struct {
+    net.Conn
+    fromClient bool
+    recorder   *tlsRecorder
+}
+
+func (c recordingConn) Write(p []byte) (int, error) {
+    c.recorder.mu.Lock()
+    c.recorder.chunks = append(c.recorder.chunks, tlsChunk{fromClient: c.fromClient, data: append([]byte(nil), p...)})
+    c.recorder.mu.Unlock()
+    return c.Conn.Write(p)
+}
+
+// GenerateTLSPCAP runs a crypto/tls client and server over an in-memory pipe,
+// performs one HTTP/1.1 exchange and writes the encrypted bytes as a TCP
+// capture, along with the NSS key log the client produced.
+func GenerateTLSPCAP(pcapPath, keyLogPath string, opts TLSSessionOptions) error {
+    if opts.Path == "" {
+        opts.Path = "/"
+    }
+    if opts.Status == 0 {
+        opts.Status = http.StatusOK
+    }
+
+    cert, err := tlsTestCertificate("www.example.test")
+    if err != nil {
+        return err
+    }
+
+    keyLog, err := os.Create(keyLogPath)
+    if err != nil {
+        return err
+    }
+    defer keyLog.Close()
+
+    recorder := &tlsRecorder{}
+    clientSide, serverSide := net.Pipe()
+
+    serverErr := make(chan error, 1)
+    go func() {
+        defer serverSide.Close()
+        server := tls.Server(recordingConn{Conn: serverSide, recorder: recorder}, &tls.Config{
+            Certificates:           []tls.Certificate{cert},
+            MaxVersion:             opts.MaxVersion,
+            CipherSuites:           opts.CipherSuites,
+            SessionTicketsDisabled: true,
+        })
+        req, err := http.ReadRequest(bufio.NewReader(server))
+        if err != nil {
+            serverErr <- err
+            return
+        }
+        req.Body.Close()
+        _, err = fmt.Fprintf(server, "HTTP/1.1 %d %s\r\nContent-Length: 2\r\n\r\nok", opts.Status, http.StatusText(opts.Status))
+        serverErr <- err
+    }()
+
+    client := tls.Client(recordingConn{Conn: clientSide, fromClient: true, recorder: recorder}, &tls.Config{
+        ServerName:         "www.example.test",
+        InsecureSkipVerify: true,
+        MaxVersion:         opts.MaxVersion,
+        CipherSuites:       opts.CipherSuites,
+        KeyLogWriter:       keyLog,
+    })
+    if _, err := fmt.Fprintf(client, "GET %s HTTP/1.1\r\nHost: www.example.test\r\n\r\n", opts.Path); err != nil {
+        return err
+    }
+    resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+    if err != nil {
+        return err
+    }
+    io.Copy(io.Discard, resp.Body)
+    resp.Body.Close()
+    clientSide.Close()
+    if err := <-serverErr; err != nil {
+        return err
+    }
+
+    return writeTLSCapture(pcapPath, recorder.chunks)
+}
+
+func writeTLSCapture(path string, chunks []tlsChunk) error {
+    file, err := os.Create(path)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    writer := pcapgo.NewWriter(file)
+    if err := writer.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+        return err
+    }
+
+    clientMAC := []byte{0x00, 0x0c, 0x29, 0xaa, 0xbb, 0xcc}
+    serverMAC := []byte{0x00, 0x0c, 0x29, 0xdd, 0xee, 0xff}
+    clientIP := []byte{10, 0, 0, 1}
+    serverIP := []byte{10, 0, 0, 2}
+    clientPort, serverPort := 51000, 443
+
+    ts := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+    seqClient := uint32(1000)
+    seqServer := uint32(5000)
+
+    if err := writeTCPPacket(writer, ts, clientMAC, serverMAC, clientIP, serverIP, clientPort, serverPort, seqClient, 0, true, false, nil, nil); err != nil {
+        return err
+    }
+    ts = ts.Add(5 * time.Millisecond)
+    if err := writeTCPPacket(writer, ts, serverMAC, clientMAC, serverIP, clientIP, serverPort, clientPort, seqServer, seqClient+1, true, true, nil, nil); err != nil {
+        return err
+    }
+    seqClient++
+    seqServer++
+    ts = ts.Add(5 * time.Millisecond)
+    if err := writeTCPPacket(writer, ts, clientMAC, serverMAC, clientIP, serverIP, clientPort, serverPort, seqClient, seqServer, false, true, nil, nil); err != nil {
+        return err
+    }
+
+    const segmentSize = 1200
+    for _, chunk := range chunks {
+        for data := chunk.data; len(data) > 0; {
+            n := len(data)
+            if n > segmentSize {
+                n = segmentSize
+            }
+            ts = ts.Add(5 * time.Millisecond)
+            if chunk.fromClient {
+                if err := writeTCPPacket(writer, ts, clientMAC, serverMAC, clientIP, serverIP, clientPort, serverPort, seqClient, seqServer, false, true, data[:n], nil); err != nil {
+                    return err
+                }
+                seqClient += uint32(n)
+            } else {
+                if err := writeTCPPacket(writer, ts, serverMAC, clientMAC, serverIP, clientIP, serverPort, clientPort, seqServer, seqClient, false, true, data[:n], nil); err != nil {
+                    return err
+                }
+                seqServer += uint32(n)
+            }
+            data = data[n:]
+        }
+    }
+    return nil
+}
+
+func tlsTestCertificate(host string) (tls.Certificate, error) {
+    priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return tls.Certificate{}, err
+    }
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject:      pkix.Name{CommonName: host},
+        DNSNames:     []string{host},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(24 * time.Hour),
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+    if err != nil {
+        return tls.Certificate{}, err
+    }
+    return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}, nil
+}
@@ -2,9 +2,11 @@ package pcap
 
 import (
 	"context"
+	"io"
 	"sort"
 	"time"
 
+	"netsage/internal/capturefilter"
 	"netsage/internal/flows"
 )
 
@@ -32,20 +34,41 @@ type StreamTimeseries struct {
 	BytesPerSec    []StreamPoint `json:"bytes_per_sec"`
 }
 
-func BuildTimeseries(ctx context.Context, path string, granularity time.Duration) (Timeseries, error) {
+// BuildTimeseries counts the packets and bytes of the capture at path per
+// interval of granularity, from its packet index at indexPath when there is
+// a usable one. capture is the capture filter the capture was analyzed with.
+func BuildTimeseries(ctx context.Context, path, indexPath string, capture *capturefilter.Filter, granularity time.Duration) (Timeseries, error) {
 	if granularity <= 0 {
 		granularity = time.Second
 	}
 
-	packetSource, file, err := openPacketSource(path)
+	packetBuckets := make(map[time.Time]int64)
+	byteBuckets := make(map[time.Time]int64)
+
+	if index, err := openPacketIndex(indexPath); err == nil {
+		defer index.close()
+		err := eachIndexedPacket(ctx, index, func(p indexedPacket) {
+			bucket := p.ts.Truncate(granularity)
+			packetBuckets[bucket]++
+			byteBuckets[bucket] += int64(p.length)
+		})
+		if err != nil {
+			return Timeseries{}, err
+		}
+		return Timeseries{
+			GranularitySec: int(granularity.Seconds()),
+			PacketsPerSec:  bucketSeries(packetBuckets),
+			BytesPerSec:    bucketSeries(byteBuckets),
+		}, nil
+	}
+
+	packetSource, file, err := openPacketSource(path, capture)
 	if err != nil {
 		return Timeseries{}, err
 	}
 	defer file.Close()
 
-	packetBuckets := make(map[time.Time]int64)
-	byteBuckets := make(map[time.Time]int64)
-
+	defrag := newIPDefragmenter(nil)
 	for packet := range packetSource.Packets() {
 		select {
 		case <-ctx.Done():
@@ -56,7 +79,7 @@ func BuildTimeseries(ctx context.Context, path string, granularity time.Duration
 		if packet == nil {
 			continue
 		}
-		info, ok := parsePacket(packet)
+		info, ok := defrag.parse(packet)
 		if !ok {
 			continue
 		}
@@ -75,26 +98,27 @@ func BuildTimeseries(ctx context.Context, path string, granularity time.Duration
 	}, nil
 }
 
+// BuildStreamTimeseries counts the packets and bytes of one flow in each
+// direction per interval of granularity. Like BuildTimeseries it reads the
+// packet index at indexPath when there is a usable one.
 func BuildStreamTimeseries(
 	ctx context.Context,
 	path string,
+	indexPath string,
+	capture *capturefilter.Filter,
 	granularity time.Duration,
 	flowKey flows.FlowKey,
 	clientIP string,
 	clientPort int,
 	serverIP string,
 	serverPort int,
+	start time.Time,
+	end time.Time,
 ) (StreamTimeseries, error) {
 	if granularity <= 0 {
 		granularity = time.Second
 	}
 
-	packetSource, file, err := openPacketSource(path)
-	if err != nil {
-		return StreamTimeseries{}, err
-	}
-	defer file.Close()
-
 	type bucket struct {
 		packetsIn  int64
 		packetsOut int64
@@ -105,30 +129,14 @@ func BuildStreamTimeseries(
 	buckets := make(map[time.Time]*bucket)
 	rev := flowKey.Reverse()
 
-	for packet := range packetSource.Packets() {
-		select {
-		case <-ctx.Done():
-			return StreamTimeseries{}, ctx.Err()
-		default:
-		}
-
-		if packet == nil {
-			continue
-		}
-		info, ok := parsePacket(packet)
-		if !ok {
-			continue
-		}
-
-		key := flows.FlowKey{
-			Proto:   info.Proto,
-			SrcIP:   info.SrcIP,
-			DstIP:   info.DstIP,
-			SrcPort: info.SrcPort,
-			DstPort: info.DstPort,
-		}
+	add := func(info flows.PacketInfo) {
+		key := packetKey(info)
 		if key != flowKey && key != rev {
-			continue
+			return
+		}
+		// Other connections may reuse the 5-tuple before or after this one.
+		if ts := info.Timestamp.Truncate(time.Microsecond); ts.Before(start) || ts.After(end) {
+			return
 		}
 
 		bucketKey := info.Timestamp.Truncate(granularity)
@@ -147,6 +155,35 @@ func BuildStreamTimeseries(
 		}
 	}
 
+	if index, err := openPacketIndex(indexPath); err == nil {
+		defer index.close()
+		if err := eachIndexedPacket(ctx, index, func(p indexedPacket) { add(p.info()) }); err != nil {
+			return StreamTimeseries{}, err
+		}
+	} else {
+		packetSource, file, err := openPacketSource(path, capture)
+		if err != nil {
+			return StreamTimeseries{}, err
+		}
+		defer file.Close()
+
+		defrag := newIPDefragmenter(nil)
+		for packet := range packetSource.Packets() {
+			select {
+			case <-ctx.Done():
+				return StreamTimeseries{}, ctx.Err()
+			default:
+			}
+
+			if packet == nil {
+				continue
+			}
+			if info, ok := defrag.parse(packet); ok {
+				add(info)
+			}
+		}
+	}
+
 	keys := make([]time.Time, 0, len(buckets))
 	for ts := range buckets {
 		keys = append(keys, ts)
@@ -178,6 +215,30 @@ func BuildStreamTimeseries(
 	}, nil
 }
 
+// eachIndexedPacket calls fn with every indexed frame that completed a
+// packet, in capture order.
+func eachIndexedPacket(ctx context.Context, index *packetIndexReader, fn func(indexedPacket)) error {
+	for {
+		p, err := index.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if p.frame%4096 == 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+		}
+		if p.flow != nil {
+			fn(p)
+		}
+	}
+}
+
 func bucketSeries(buckets map[time.Time]int64) []TimePoint {
 	if len(buckets) == 0 {
 		return []TimePoint{}
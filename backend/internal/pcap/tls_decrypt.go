@@ -0,0 +1,500 @@
+package pcap
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"hash"
+	"time"
+
+	"netsage/internal/flows"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	maxTLSRecordLen     = 16384 + 2048
+	maxTLSHandshakeSize = 256 * 1024
+)
+
+type tlsCipherSuite struct {
+	keyLen int
+	ivLen  int
+	hash   func() hash.Hash
+	aead   func(key []byte) (cipher.AEAD, error)
+}
+
+// tlsCipherSuites lists the AEAD suites the analyzer can decrypt. TLS 1.2
+// AES-GCM suites carry a 4-byte implicit IV; ChaCha20-Poly1305 and all TLS 1.3
+// suites use a 12-byte IV XORed with the record sequence number.
+var tlsCipherSuites = map[uint16]tlsCipherSuite{
+	0x009c: {16, 4, sha256.New, newAESGCM},             // TLS_RSA_WITH_AES_128_GCM_SHA256
+	0x009d: {32, 4, sha512.New384, newAESGCM},          // TLS_RSA_WITH_AES_256_GCM_SHA384
+	0x009e: {16, 4, sha256.New, newAESGCM},             // TLS_DHE_RSA_WITH_AES_128_GCM_SHA256
+	0x009f: {32, 4, sha512.New384, newAESGCM},          // TLS_DHE_RSA_WITH_AES_256_GCM_SHA384
+	0xc02b: {16, 4, sha256.New, newAESGCM},             // TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+	0xc02c: {32, 4, sha512.New384, newAESGCM},          // TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384
+	0xc02f: {16, 4, sha256.New, newAESGCM},             // TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	0xc030: {32, 4, sha512.New384, newAESGCM},          // TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
+	0xcca8: {32, 12, sha256.New, chacha20poly1305.New}, // TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256
+	0xcca9: {32, 12, sha256.New, chacha20poly1305.New}, // TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256
+	0xccaa: {32, 12, sha256.New, chacha20poly1305.New}, // TLS_DHE_RSA_WITH_CHACHA20_POLY1305_SHA256
+	0x1301: {16, 12, sha256.New, newAESGCM},            // TLS_AES_128_GCM_SHA256
+	0x1302: {32, 12, sha512.New384, newAESGCM},         // TLS_AES_256_GCM_SHA384
+	0x1303: {32, 12, sha256.New, chacha20poly1305.New}, // TLS_CHACHA20_POLY1305_SHA256
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// tlsRecordCipher decrypts the records of one direction with the keys in
+// effect for it, tracking the implicit record sequence number.
+type tlsRecordCipher struct {
+	aead     cipher.AEAD
+	iv       []byte
+	seq      uint64
+	explicit bool
+}
+
+func (c *tlsRecordCipher) nonce() []byte {
+	nonce := append([]byte(nil), c.iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(c.seq >> (8 * i))
+	}
+	return nonce
+}
+
+// open12 decrypts a TLS 1.2 AEAD record (RFC 5288, RFC 7905).
+func (c *tlsRecordCipher) open12(header, body []byte) ([]byte, bool) {
+	var nonce []byte
+	if c.explicit {
+		if len(body) < 8 {
+			return nil, false
+		}
+		nonce = append(append([]byte(nil), c.iv...), body[:8]...)
+		body = body[8:]
+	} else {
+		nonce = c.nonce()
+	}
+	if len(body) < c.aead.Overhead() {
+		return nil, false
+	}
+
+	aad := make([]byte, 13)
+	binary.BigEndian.PutUint64(aad[0:8], c.seq)
+	copy(aad[8:11], header[0:3])
+	binary.BigEndian.PutUint16(aad[11:13], uint16(len(body)-c.aead.Overhead()))
+
+	plain, err := c.aead.Open(nil, nonce, body, aad)
+	if err != nil {
+		return nil, false
+	}
+	c.seq++
+	return plain, true
+}
+
+// open13 decrypts a TLS 1.3 record and returns the inner plaintext with its
+// real content type (RFC 8446 section 5.2).
+func (c *tlsRecordCipher) open13(header, body []byte) ([]byte, byte, bool) {
+	plain, err := c.aead.Open(nil, c.nonce(), body, header)
+	if err != nil {
+		return nil, 0, false
+	}
+	c.seq++
+
+	end := len(plain)
+	for end > 0 && plain[end-1] == 0 {
+		end--
+	}
+	if end == 0 {
+		return nil, 0, false
+	}
+	return plain[:end-1], plain[end-1], true
+}
+
+type tlsDirection struct {
+	buf       []byte
+	handshake []byte
+	cipher    *tlsRecordCipher
+	appKeys   bool
+	failed    bool
+}
+
+// tlsSession follows both directions of one TLS connection, reading the
+// plaintext hellos for the randoms and cipher suite and then decrypting
+// records with secrets from the key log. Plaintext only lives in memory for
+// the duration of the record being inspected.
+type tlsSession struct {
+	keys         *KeyLog
+	clientDir    int
+	clientRandom []byte
+	serverRandom []byte
+	suite        uint16
+	tls13        bool
+	decrypted    int64
+	dirs         [2]tlsDirection
+	http         *httpConn
+}
+
+func newTLSSession(keys *KeyLog) *tlsSession {
+	return &tlsSession{keys: keys, clientDir: -1}
+}
+
+// feed adds in-order bytes for one direction and returns the application
+// data of every record it completed.
+func (s *tlsSession) feed(dir int, data []byte) [][]byte {
+	d := &s.dirs[dir]
+	if d.failed {
+		return nil
+	}
+	d.buf = append(d.buf, data...)
+
+	var appData [][]byte
+	consumed := 0
+	for len(d.buf)-consumed >= 5 && !d.failed {
+		header := d.buf[consumed : consumed+5]
+		contentType := header[0]
+		recordLen := int(binary.BigEndian.Uint16(header[3:5]))
+		if header[1] != 3 || contentType < 20 || contentType > 24 || recordLen > maxTLSRecordLen {
+			s.fail(dir)
+			return appData
+		}
+		if len(d.buf)-consumed < 5+recordLen {
+			break
+		}
+		body := d.buf[consumed+5 : consumed+5+recordLen]
+		if plain := s.record(dir, header, body); len(plain) > 0 {
+			appData = append(appData, plain)
+		}
+		consumed += 5 + recordLen
+	}
+	if !d.failed {
+		d.buf = append(d.buf[:0], d.buf[consumed:]...)
+	}
+	return appData
+}
+
+func (s *tlsSession) record(dir int, header, body []byte) []byte {
+	d := &s.dirs[dir]
+	if s.tls13 {
+		return s.record13(dir, header, body)
+	}
+
+	if d.cipher == nil {
+		switch header[0] {
+		case 20:
+			d.cipher = s.cipher12(dir)
+			if d.cipher == nil {
+				s.fail(dir)
+			}
+		case 22:
+			s.readHandshake(dir, body)
+		case 23:
+			s.fail(dir)
+		}
+		return nil
+	}
+
+	plain, ok := d.cipher.open12(header, body)
+	if !ok {
+		s.fail(dir)
+		return nil
+	}
+	s.decrypted++
+	if header[0] == 23 {
+		return plain
+	}
+	return nil
+}
+
+func (s *tlsSession) record13(dir int, header, body []byte) []byte {
+	d := &s.dirs[dir]
+	if header[0] != 23 {
+		// Plaintext hellos and the middlebox-compatibility ChangeCipherSpec.
+		if header[0] == 22 && d.cipher == nil {
+			s.readHandshake(dir, body)
+		}
+		return nil
+	}
+
+	if d.cipher == nil {
+		d.cipher = s.cipher13(dir, false)
+		if d.cipher == nil {
+			d.cipher = s.cipher13(dir, true)
+			d.appKeys = true
+		}
+		if d.cipher == nil {
+			s.fail(dir)
+			return nil
+		}
+	}
+
+	plain, contentType, ok := d.cipher.open13(header, body)
+	if !ok && !d.appKeys {
+		// The handshake secrets may be missing from the log or the Finished
+		// message may have been lost; try the application secrets.
+		if next := s.cipher13(dir, true); next != nil {
+			d.cipher = next
+			d.appKeys = true
+			d.handshake = nil
+			plain, contentType, ok = d.cipher.open13(header, body)
+		}
+	}
+	if !ok {
+		s.fail(dir)
+		return nil
+	}
+	s.decrypted++
+
+	switch contentType {
+	case 22:
+		if !d.appKeys && s.readEncryptedHandshake(dir, plain) {
+			d.cipher = s.cipher13(dir, true)
+			d.appKeys = true
+			d.handshake = nil
+			if d.cipher == nil {
+				s.fail(dir)
+			}
+		}
+	case 23:
+		return plain
+	}
+	return nil
+}
+
+// readHandshake collects the plaintext ClientHello and ServerHello randoms
+// and the negotiated cipher suite.
+func (s *tlsSession) readHandshake(dir int, body []byte) {
+	d := &s.dirs[dir]
+	d.handshake = append(d.handshake, body...)
+	if len(d.handshake) > maxTLSHandshakeSize {
+		s.fail(dir)
+		return
+	}
+	for len(d.handshake) >= 4 {
+		msgType := d.handshake[0]
+		msgLen := int(d.handshake[1])<<16 | int(d.handshake[2])<<8 | int(d.handshake[3])
+		if len(d.handshake) < 4+msgLen {
+			return
+		}
+		msg := d.handshake[4 : 4+msgLen]
+		d.handshake = d.handshake[4+msgLen:]
+		if len(msg) < 34 {
+			continue
+		}
+
+		switch msgType {
+		case 1:
+			s.clientDir = dir
+			s.clientRandom = append([]byte(nil), msg[2:34]...)
+		case 2:
+			s.serverRandom = append([]byte(nil), msg[2:34]...)
+			hello := parseServerHello(msg)
+			if len(hello.ciphers) > 0 {
+				s.suite = hello.ciphers[0]
+			}
+			for _, v := range hello.supportedVersions {
+				if v == 0x0304 {
+					s.tls13 = true
+				}
+			}
+		}
+	}
+}
+
+// readEncryptedHandshake reports whether the TLS 1.3 handshake messages read
+// so far include Finished, after which the sender switches to application
+// traffic keys.
+func (s *tlsSession) readEncryptedHandshake(dir int, plain []byte) bool {
+	d := &s.dirs[dir]
+	d.handshake = append(d.handshake, plain...)
+	if len(d.handshake) > maxTLSHandshakeSize {
+		s.fail(dir)
+		return false
+	}
+	for len(d.handshake) >= 4 {
+		msgType := d.handshake[0]
+		msgLen := int(d.handshake[1])<<16 | int(d.handshake[2])<<8 | int(d.handshake[3])
+		if len(d.handshake) < 4+msgLen {
+			return false
+		}
+		d.handshake = d.handshake[4+msgLen:]
+		if msgType == 20 {
+			return true
+		}
+	}
+	return false
+}
+
+// cipher12 derives the TLS 1.2 key block from the logged master secret
+// (RFC 5246 section 6.3).
+func (s *tlsSession) cipher12(dir int) *tlsRecordCipher {
+	suite, ok := tlsCipherSuites[s.suite]
+	if !ok || s.clientDir < 0 || s.clientRandom == nil || s.serverRandom == nil || s.suite>>8 == 0x13 {
+		return nil
+	}
+	master := s.keys.secret(s.clientRandom, keyLogClientRandom)
+	if len(master) != 48 {
+		return nil
+	}
+
+	seed := append(append([]byte(nil), s.serverRandom...), s.clientRandom...)
+	block := tls12PRF(suite.hash, master, "key expansion", seed, 2*suite.keyLen+2*suite.ivLen)
+	key, iv := block[:suite.keyLen], block[2*suite.keyLen:2*suite.keyLen+suite.ivLen]
+	if dir != s.clientDir {
+		key = block[suite.keyLen : 2*suite.keyLen]
+		iv = block[2*suite.keyLen+suite.ivLen:]
+	}
+	aead, err := suite.aead(key)
+	if err != nil {
+		return nil
+	}
+	return &tlsRecordCipher{aead: aead, iv: iv, explicit: suite.ivLen == 4}
+}
+
+// cipher13 derives the traffic key and IV for one direction from the logged
+// handshake or application traffic secret.
+func (s *tlsSession) cipher13(dir int, app bool) *tlsRecordCipher {
+	suite, ok := tlsCipherSuites[s.suite]
+	if !ok || s.clientDir < 0 || s.clientRandom == nil {
+		return nil
+	}
+	label := keyLogServerHandshakeSecret
+	switch {
+	case dir == s.clientDir && app:
+		label = keyLogClientApplicationSecret
+	case dir == s.clientDir:
+		label = keyLogClientHandshakeSecret
+	case app:
+		label = keyLogServerApplicationSecret
+	}
+	secret := s.keys.secret(s.clientRandom, label)
+	if secret == nil {
+		return nil
+	}
+
+	key := hkdfExpandLabelHash(suite.hash, secret, "key", suite.keyLen)
+	iv := hkdfExpandLabelHash(suite.hash, secret, "iv", 12)
+	aead, err := suite.aead(key)
+	if err != nil {
+		return nil
+	}
+	return &tlsRecordCipher{aead: aead, iv: iv}
+}
+
+func (s *tlsSession) fail(dir int) {
+	d := &s.dirs[dir]
+	d.failed = true
+	d.buf = nil
+	d.handshake = nil
+	d.cipher = nil
+}
+
+func (s *tlsSession) done() bool {
+	return s.dirs[0].failed && s.dirs[1].failed
+}
+
+// tls12PRF is the TLS 1.2 P_hash expansion (RFC 5246 section 5).
+func tls12PRF(h func() hash.Hash, secret []byte, label string, seed []byte, length int) []byte {
+	labelSeed := append([]byte(label), seed...)
+	mac := hmac.New(h, secret)
+	mac.Write(labelSeed)
+	a := mac.Sum(nil)
+
+	out := make([]byte, 0, length+mac.Size())
+	for len(out) < length {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(labelSeed)
+		out = mac.Sum(out)
+
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+	}
+	return out[:length]
+}
+
+// tlsDecryptTracker decrypts TLS connections whose secrets appear in the key
+// log and feeds the HTTP/1.x transactions inside them to the flow.
+type tlsDecryptTracker struct {
+	keys *KeyLog
+	// sessions holds nil for a flow whose session is over or whose stream
+	// did not start with a handshake, so data that happens to start with a
+	// handshake record later is not taken for a new session.
+	sessions map[*flows.FlowAgg]*tlsSession
+}
+
+func newTLSDecryptTracker(keys *KeyLog) *tlsDecryptTracker {
+	return &tlsDecryptTracker{keys: keys, sessions: make(map[*flows.FlowAgg]*tlsSession)}
+}
+
+func (t *tlsDecryptTracker) observe(flow *flows.FlowAgg, chunk streamChunk, ts time.Time) {
+	if t.keys.Len() == 0 {
+		return
+	}
+	session, ok := t.sessions[flow]
+	if !ok {
+		if len(chunk.data) == 0 {
+			return
+		}
+		if chunk.data[0] != 22 {
+			t.sessions[flow] = nil
+			return
+		}
+		session = newTLSSession(t.keys)
+		t.sessions[flow] = session
+	}
+	if session == nil {
+		return
+	}
+	if chunk.gap {
+		session.fail(chunk.dir)
+	}
+
+	for _, plain := range session.feed(chunk.dir, chunk.data) {
+		if session.http == nil {
+			session.http = newHTTPConn(session.clientDir, flow.AddHTTPTransaction)
+		}
+		session.http.feed(chunk.dir, plain, ts, int(flow.PacketCount))
+	}
+	if session.decrypted > 0 {
+		flow.TLSDecrypted = true
+	}
+	if session.done() {
+		if session.http != nil {
+			session.http.flush()
+		}
+		t.sessions[flow] = nil
+	}
+}
+
+// flush records decrypted requests still waiting for a response when the
+// capture ends.
+func (t *tlsDecryptTracker) flush() {
+	for flow, session := range t.sessions {
+		if session != nil && session.http != nil {
+			session.http.flush()
+		}
+		delete(t.sessions, flow)
+	}
+}
+
+// release records the decrypted requests of a flow that is finalized early
+// and stops following it.
+func (t *tlsDecryptTracker) release(flow *flows.FlowAgg) {
+	if session, ok := t.sessions[flow]; ok {
+		if session != nil && session.http != nil {
+			session.http.flush()
+		}
+		delete(t.sessions, flow)
+	}
+}
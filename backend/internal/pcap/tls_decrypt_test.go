@@ -0,0 +1,131 @@
+package pcap
+
+import (
+	"context"
+	"crypto/tls"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"netsage/internal/flows"
+	"netsage/internal/pcap/testutil"
+)
+
+func TestDecryptTLSWithKeyLog(t *testing.T) {
+	cases := []struct {
+		name string
+		opts testutil.TLSSessionOptions
+	}{
+		{"tls12-aes128-gcm", testutil.TLSSessionOptions{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}}},
+		{"tls12-aes256-gcm", testutil.TLSSessionOptions{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}}},
+		{"tls12-chacha20", testutil.TLSSessionOptions{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}}},
+		{"tls13", testutil.TLSSessionOptions{MaxVersion: tls.VersionTLS13}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			pcapPath := filepath.Join(dir, "session.pcap")
+			keyLogPath := filepath.Join(dir, "keys.log")
+			tc.opts.Path = "/api/items?page=2"
+			tc.opts.Status = 503
+			if err := testutil.GenerateTLSPCAP(pcapPath, keyLogPath, tc.opts); err != nil {
+				t.Fatalf("generate capture: %v", err)
+			}
+
+			result, err := AnalyzeFile(context.Background(), pcapPath, Options{KeyLogPath: keyLogPath}, nil)
+			if err != nil {
+				t.Fatalf("analyze: %v", err)
+			}
+			flow := singleFlow(t, result)
+			if !flow.TLSDecrypted {
+				t.Fatalf("expected flow to be decrypted")
+			}
+			if flow.HTTPMethod == nil || *flow.HTTPMethod != "GET" {
+				t.Fatalf("expected GET, got %v", flow.HTTPMethod)
+			}
+			if flow.HTTPPath == nil || *flow.HTTPPath != "/api/items" {
+				t.Fatalf("unexpected path %v", flow.HTTPPath)
+			}
+			if flow.HTTPHost == nil || *flow.HTTPHost != "www.example.test" {
+				t.Fatalf("unexpected host %v", flow.HTTPHost)
+			}
+			if flow.HTTPStatus == nil || *flow.HTTPStatus != 503 {
+				t.Fatalf("expected status 503, got %v", flow.HTTPStatus)
+			}
+			if flow.HTTPResponseMs == nil || *flow.HTTPResponseMs <= 0 {
+				t.Fatalf("expected positive response time, got %v", flow.HTTPResponseMs)
+			}
+		})
+	}
+}
+
+func TestTLSWithoutKeyLogStaysOpaque(t *testing.T) {
+	dir := t.TempDir()
+	pcapPath := filepath.Join(dir, "session.pcap")
+	if err := testutil.GenerateTLSPCAP(pcapPath, filepath.Join(dir, "keys.log"), testutil.TLSSessionOptions{MaxVersion: tls.VersionTLS13}); err != nil {
+		t.Fatalf("generate capture: %v", err)
+	}
+
+	result, err := AnalyzeFile(context.Background(), pcapPath, Options{}, nil)
+	if err != nil {
+		t.Fatalf("analyze: %v", err)
+	}
+	flow := singleFlow(t, result)
+	if flow.TLSDecrypted || flow.HTTPMethod != nil {
+		t.Fatalf("expected no decryption without a key log")
+	}
+}
+
+// A session only starts with the stream's first data and is not started
+// again once over, however later data begins.
+func TestTLSDecryptStartsSessionsAtStreamStart(t *testing.T) {
+	keys, err := ParseKeyLog(strings.NewReader("CLIENT_RANDOM " + strings.Repeat("ab", 32) + " " + strings.Repeat("01", 48) + "\n"))
+	if err != nil {
+		t.Fatalf("key log: %v", err)
+	}
+	tracker := newTLSDecryptTracker(keys)
+	handshake := []byte{22, 3, 1, 0, 0}
+
+	over := &flows.FlowAgg{}
+	tracker.observe(over, streamChunk{dir: 0, data: handshake}, time.Time{})
+	if tracker.sessions[over] == nil {
+		t.Fatalf("expected a session from the stream's first handshake record")
+	}
+	tracker.observe(over, streamChunk{dir: 0, gap: true}, time.Time{})
+	tracker.observe(over, streamChunk{dir: 1, gap: true}, time.Time{})
+	tracker.observe(over, streamChunk{dir: 0, data: handshake}, time.Time{})
+	if session, ok := tracker.sessions[over]; !ok || session != nil {
+		t.Fatalf("expected the finished session to stay finished")
+	}
+
+	midstream := &flows.FlowAgg{}
+	tracker.observe(midstream, streamChunk{dir: 0, data: []byte{23, 3, 3, 0, 0}}, time.Time{})
+	tracker.observe(midstream, streamChunk{dir: 0, data: handshake}, time.Time{})
+	if session, ok := tracker.sessions[midstream]; !ok || session != nil {
+		t.Fatalf("expected no session for a stream that did not start with a handshake")
+	}
+}
+
+func TestParseKeyLogRejectsMalformedLines(t *testing.T) {
+	valid := "# comment\nCLIENT_RANDOM " + strings.Repeat("ab", 32) + " " + strings.Repeat("01", 48) + "\n"
+	keys, err := ParseKeyLog(strings.NewReader(valid))
+	if err != nil || keys.Len() != 1 {
+		t.Fatalf("expected one session, got %d (%v)", keys.Len(), err)
+	}
+	if _, err := ParseKeyLog(strings.NewReader("CLIENT_RANDOM zz 00\n")); err == nil {
+		t.Fatalf("expected error for malformed line")
+	}
+}
+
+func singleFlow(t *testing.T, result *Result) *flows.FlowAgg {
+	t.Helper()
+	if len(result.Flows) != 1 {
+		t.Fatalf("expected one flow, got %d", len(result.Flows))
+	}
+	for _, flow := range result.Flows {
+		return flow
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package pcap
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	tlsExtServerName = 0x0000
+	tlsExtALPN       = 0x0010
+)
+
+// isGREASE reports whether v is one of the reserved GREASE values from
+// RFC 8701, which clients randomise and fingerprints must ignore.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// ja3Fingerprint returns the MD5 of
+// SSLVersion,Ciphers,Extensions,EllipticCurves,EllipticCurvePointFormats.
+func ja3Fingerprint(hello tlsHello) string {
+	if hello.hsType != 1 || hello.legacyVersion == 0 {
+		return ""
+	}
+	points := make([]uint16, 0, len(hello.pointFormats))
+	for _, p := range hello.pointFormats {
+		points = append(points, uint16(p))
+	}
+	raw := strings.Join([]string{
+		strconv.Itoa(int(hello.legacyVersion)),
+		joinDecimal(hello.ciphers),
+		joinDecimal(hello.extensions),
+		joinDecimal(hello.groups),
+		joinDecimal(points),
+	}, ",")
+	sum := md5.Sum([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// ja3sFingerprint returns the MD5 of SSLVersion,Cipher,Extensions for a
+// ServerHello.
+func ja3sFingerprint(hello tlsHello) string {
+	if hello.hsType != 2 || hello.legacyVersion == 0 {
+		return ""
+	}
+	raw := strings.Join([]string{
+		strconv.Itoa(int(hello.legacyVersion)),
+		joinDecimal(hello.ciphers),
+		joinDecimal(hello.extensions),
+	}, ",")
+	sum := md5.Sum([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// ja4Fingerprint returns the JA4 client fingerprint (a_b_c). transport is
+// 't' for TLS over TCP and 'q' for QUIC.
+func ja4Fingerprint(hello tlsHello, transport byte) string {
+	if hello.hsType != 1 || hello.legacyVersion == 0 {
+		return ""
+	}
+
+	version := hello.legacyVersion
+	for _, v := range hello.supportedVersions {
+		if v > version {
+			version = v
+		}
+	}
+	sni := "i"
+	for _, ext := range hello.extensions {
+		if ext == tlsExtServerName {
+			sni = "d"
+			break
+		}
+	}
+	alpn := "00"
+	if hello.alpn != nil {
+		alpn = ja4ALPN(*hello.alpn)
+	}
+	a := fmt.Sprintf("%c%s%s%02d%02d%s", transport, ja4Version(version), sni, min(len(hello.ciphers), 99), min(len(hello.extensions), 99), alpn)
+
+	ciphers := make([]string, 0, len(hello.ciphers))
+	for _, c := range hello.ciphers {
+		ciphers = append(ciphers, fmt.Sprintf("%04x", c))
+	}
+	sort.Strings(ciphers)
+
+	extensions := make([]string, 0, len(hello.extensions))
+	for _, ext := range hello.extensions {
+		if ext == tlsExtServerName || ext == tlsExtALPN {
+			continue
+		}
+		extensions = append(extensions, fmt.Sprintf("%04x", ext))
+	}
+	sort.Strings(extensions)
+	c := strings.Join(extensions, ",")
+	if len(hello.sigAlgs) > 0 {
+		sigAlgs := make([]string, 0, len(hello.sigAlgs))
+		for _, alg := range hello.sigAlgs {
+			sigAlgs = append(sigAlgs, fmt.Sprintf("%04x", alg))
+		}
+		c += "_" + strings.Join(sigAlgs, ",")
+	}
+
+	return a + "_" + ja4Hash(ciphers, strings.Join(ciphers, ",")) + "_" + ja4Hash(extensions, c)
+}
+
+func ja4Version(v uint16) string {
+	switch v {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	default:
+		return "00"
+	}
+}
+
+func ja4ALPN(proto string) string {
+	if proto == "" {
+		return "00"
+	}
+	first, last := proto[0], proto[len(proto)-1]
+	if isAlphanumeric(first) && isAlphanumeric(last) {
+		return string([]byte{first, last})
+	}
+	firstHex := hex.EncodeToString([]byte{first})
+	lastHex := hex.EncodeToString([]byte{last})
+	return firstHex[:1] + lastHex[1:]
+}
+
+func ja4Hash(values []string, raw string) string {
+	if len(values) == 0 {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func isAlphanumeric(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+func joinDecimal(values []uint16) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		parts = append(parts, strconv.Itoa(int(v)))
+	}
+	return strings.Join(parts, "-")
+}
@@ -0,0 +1,80 @@
+package pcap
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+func TestClientHelloFingerprints(t *testing.T) {
+	var ext []byte
+	ext = appendTLSExtension(ext, 0x0a0a, nil)
+	ext = appendTLSExtension(ext, 0x0000, []byte{0x00, 0x0e, 0x00, 0x00, 0x0b, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm'})
+	ext = appendTLSExtension(ext, 0x000a, []byte{0x00, 0x06, 0x1a, 0x1a, 0x00, 0x1d, 0x00, 0x17})
+	ext = appendTLSExtension(ext, 0x000b, []byte{0x01, 0x00})
+	ext = appendTLSExtension(ext, 0x000d, []byte{0x00, 0x04, 0x04, 0x03, 0x08, 0x04})
+	ext = appendTLSExtension(ext, 0x0010, []byte{0x00, 0x03, 0x02, 'h', '2'})
+	ext = appendTLSExtension(ext, 0x002b, []byte{0x06, 0x2a, 0x2a, 0x03, 0x04, 0x03, 0x03})
+
+	body := []byte{0x03, 0x03}
+	body = append(body, make([]byte, 32)...)
+	body = append(body, 0)
+	body = append(body, 0x00, 0x08, 0x0a, 0x0a, 0x13, 0x01, 0x13, 0x02, 0xc0, 0x2b)
+	body = append(body, 0x01, 0x00)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(ext)))
+	body = append(body, ext...)
+
+	result := tlsInfo{payload: tlsRecord(1, body)}.Parse()
+	if !result.clientHello || result.sni == nil || *result.sni != "example.com" {
+		t.Fatalf("expected ClientHello with SNI, got %+v", result)
+	}
+
+	wantJA3 := md5.Sum([]byte("771,4865-4866-49195,0-10-11-13-16-43,29-23,0"))
+	if result.ja3 == nil || *result.ja3 != hex.EncodeToString(wantJA3[:]) {
+		t.Fatalf("unexpected ja3 %v", result.ja3)
+	}
+
+	ciphers := sha256.Sum256([]byte("1301,1302,c02b"))
+	extensions := sha256.Sum256([]byte("000a,000b,000d,002b_0403,0804"))
+	wantJA4 := "t13d0306h2_" + hex.EncodeToString(ciphers[:])[:12] + "_" + hex.EncodeToString(extensions[:])[:12]
+	if result.ja4 == nil || *result.ja4 != wantJA4 {
+		t.Fatalf("expected ja4 %s, got %v", wantJA4, result.ja4)
+	}
+}
+
+func TestServerHelloFingerprint(t *testing.T) {
+	var ext []byte
+	ext = appendTLSExtension(ext, 0x002b, []byte{0x03, 0x04})
+
+	body := []byte{0x03, 0x03}
+	body = append(body, make([]byte, 32)...)
+	body = append(body, 0)
+	body = append(body, 0x13, 0x01, 0x00)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(ext)))
+	body = append(body, ext...)
+
+	result := tlsInfo{payload: tlsRecord(2, body)}.Parse()
+	want := md5.Sum([]byte("771,4865,43"))
+	if !result.serverHello || result.ja3s == nil || *result.ja3s != hex.EncodeToString(want[:]) {
+		t.Fatalf("unexpected ja3s %v", result.ja3s)
+	}
+	if result.ja3 != nil || result.ja4 != nil {
+		t.Fatalf("client fingerprints must not be set from a ServerHello")
+	}
+}
+
+func appendTLSExtension(dst []byte, extType uint16, data []byte) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, extType)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(data)))
+	return append(dst, data...)
+}
+
+func tlsRecord(hsType byte, body []byte) []byte {
+	hs := []byte{hsType, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	hs = append(hs, body...)
+	record := []byte{22, 0x03, 0x01}
+	record = binary.BigEndian.AppendUint16(record, uint16(len(hs)))
+	return append(record, hs...)
+}
@@ -2,20 +2,45 @@ package pcap
 
 import (
 	"encoding/binary"
+
+	"netsage/internal/flows"
 )
 
 type tlsInfo struct {
 	payload []byte
 }
 
-func (t tlsInfo) Parse() (*string, *string, *string, bool, bool, bool, *int) {
-	var sni *string
-	var version *string
-	var alpn *string
-	clientHello := false
-	serverHello := false
-	alert := false
-	var alertCode *int
+type tlsResult struct {
+	sni         *string
+	version     *string
+	alpn        *string
+	clientHello bool
+	serverHello bool
+	alert       bool
+	alertCode   *int
+	ja3         *string
+	ja3s        *string
+	ja4         *string
+}
+
+// tlsHello holds the fields of a ClientHello or ServerHello that feed the
+// JA3, JA3S and JA4 fingerprints. GREASE values are dropped while parsing.
+type tlsHello struct {
+	hsType            int
+	legacyVersion     uint16
+	version           *string
+	sni               *string
+	alpn              *string
+	ciphers           []uint16
+	extensions        []uint16
+	groups            []uint16
+	pointFormats      []uint8
+	sigAlgs           []uint16
+	supportedVersions []uint16
+}
+
+func (t tlsInfo) Parse() tlsResult {
+	result := tlsResult{}
 
 	data := t.payload
 	for len(data) >= 5 {
@@ -28,154 +53,267 @@ func (t tlsInfo) Parse() (*string, *string, *string, bool, bool, bool, *int) {
 		record := data[5 : 5+recordLen]
 
 		if contentType == 21 {
-			alert = true
-			if alertCode == nil && recordLen >= 2 {
+			result.alert = true
+			if result.alertCode == nil && recordLen >= 2 {
 				code := int(record[1])
-				alertCode = &code
+				result.alertCode = &code
 			}
 		}
 
 		if contentType == 22 {
-			hsType, hsVersion, hsSNI, hsALPN := parseHandshake(record)
-			if hsType == 1 {
-				clientHello = true
-				if hsSNI != nil {
-					sni = hsSNI
+			hello := parseHandshake(record)
+			if hello.hsType == 1 {
+				result.clientHello = true
+				if hello.sni != nil {
+					result.sni = hello.sni
 				}
-				if hsALPN != nil {
-					alpn = hsALPN
+				if hello.alpn != nil {
+					result.alpn = hello.alpn
 				}
-				if hsVersion != nil {
-					version = hsVersion
+				if hello.version != nil {
+					result.version = hello.version
 				}
+				result.ja3 = strPtr(ja3Fingerprint(hello))
+				result.ja4 = strPtr(ja4Fingerprint(hello, 't'))
 			}
-			if hsType == 2 {
-				serverHello = true
-				if hsALPN != nil {
-					alpn = hsALPN
+			if hello.hsType == 2 {
+				result.serverHello = true
+				if hello.alpn != nil {
+					result.alpn = hello.alpn
 				}
-				if hsVersion != nil {
-					version = hsVersion
+				if hello.version != nil {
+					result.version = hello.version
 				}
+				result.ja3s = strPtr(ja3sFingerprint(hello))
 			}
-		} else if contentType == 23 && version == nil {
+		} else if contentType == 23 && result.version == nil {
 			v := tlsVersionString(recordVersion)
 			if v != "" {
-				version = &v
+				result.version = &v
 			}
 		}
 
 		data = data[5+recordLen:]
 	}
 
-	return sni, version, alpn, clientHello, serverHello, alert, alertCode
+	return result
+}
+
+// tlsRecordStream cuts complete TLS records out of one direction of an
+// ordered stream so hellos and alerts split across segments are still parsed.
+// Application data bodies are skipped rather than buffered; only their record
+// headers are passed on.
+type tlsRecordStream struct {
+	buf  []byte
+	skip int
+	done bool
+}
+
+// feed consumes in-order bytes and reports the records they completed.
+func (s *tlsRecordStream) feed(data []byte) (tlsResult, bool) {
+	var records []byte
+	for len(data) > 0 && !s.done {
+		if s.skip > 0 {
+			n := min(s.skip, len(data))
+			s.skip -= n
+			data = data[n:]
+			continue
+		}
+
+		need := 5
+		if len(s.buf) >= 5 {
+			need += int(binary.BigEndian.Uint16(s.buf[3:5]))
+		}
+		n := min(need-len(s.buf), len(data))
+		s.buf = append(s.buf, data[:n]...)
+		data = data[n:]
+		if len(s.buf) < 5 {
+			continue
+		}
+
+		recordLen := int(binary.BigEndian.Uint16(s.buf[3:5]))
+		if len(s.buf) == 5 {
+			if s.buf[0] < 20 || s.buf[0] > 24 || s.buf[1] != 3 || recordLen > maxTLSRecordLen {
+				s.stop()
+				break
+			}
+			if s.buf[0] == 23 {
+				records = append(records, s.buf[0], s.buf[1], s.buf[2], 0, 0)
+				s.skip = recordLen
+				s.buf = s.buf[:0]
+				continue
+			}
+		}
+		if len(s.buf) == 5+recordLen {
+			records = append(records, s.buf...)
+			s.buf = s.buf[:0]
+		}
+	}
+	if len(records) == 0 {
+		return tlsResult{}, false
+	}
+	return parseTLS(records), true
+}
+
+func (s *tlsRecordStream) stop() {
+	s.done = true
+	s.buf = nil
+}
+
+// apply copies the parsed record metadata onto the packet that completed it.
+func (r tlsResult) apply(info *flows.PacketInfo) {
+	info.TLSSNI = r.sni
+	info.TLSVersion = r.version
+	info.ALPN = r.alpn
+	info.TLSClientHello = r.clientHello
+	info.TLSServerHello = r.serverHello
+	info.TLSAlert = r.alert
+	info.TLSAlertCode = r.alertCode
+	info.JA3 = r.ja3
+	info.JA3S = r.ja3s
+	info.JA4 = r.ja4
+}
+
+// tlsRecordTracker parses the plaintext TLS records of every TCP flow and
+// annotates the packet that completed each one.
+type tlsRecordTracker struct {
+	streams map[*flows.FlowAgg]*[2]tlsRecordStream
 }
 
-func parseHandshake(record []byte) (int, *string, *string, *string) {
+func newTLSRecordTracker() *tlsRecordTracker {
+	return &tlsRecordTracker{streams: make(map[*flows.FlowAgg]*[2]tlsRecordStream)}
+}
+
+func (t *tlsRecordTracker) observe(flow *flows.FlowAgg, chunk streamChunk, info *flows.PacketInfo) {
+	streams, ok := t.streams[flow]
+	if !ok {
+		if len(chunk.data) == 0 {
+			return
+		}
+		streams = &[2]tlsRecordStream{}
+		t.streams[flow] = streams
+	}
+	if chunk.gap {
+		streams[chunk.dir].stop()
+	}
+	if result, ok := streams[chunk.dir].feed(chunk.data); ok {
+		result.apply(info)
+	}
+}
+
+// release drops the record streams of a flow that is finalized early.
+func (t *tlsRecordTracker) release(flow *flows.FlowAgg) {
+	delete(t.streams, flow)
+}
+
+func parseHandshake(record []byte) tlsHello {
 	if len(record) < 4 {
-		return 0, nil, nil, nil
+		return tlsHello{}
 	}
 	hsType := int(record[0])
 	hsLen := int(record[1])<<16 | int(record[2])<<8 | int(record[3])
 	if len(record) < 4+hsLen {
-		return 0, nil, nil, nil
+		return tlsHello{}
 	}
 
 	body := record[4 : 4+hsLen]
-	if hsType == 1 {
-		sni, alpn, version := parseClientHello(body)
-		return hsType, version, sni, alpn
+	var hello tlsHello
+	switch hsType {
+	case 1:
+		hello = parseClientHello(body)
+	case 2:
+		hello = parseServerHello(body)
 	}
-	if hsType == 2 {
-		alpn, version := parseServerHello(body)
-		return hsType, version, nil, alpn
-	}
-
-	return hsType, nil, nil, nil
+	hello.hsType = hsType
+	return hello
 }
 
-func parseClientHello(body []byte) (*string, *string, *string) {
+func parseClientHello(body []byte) tlsHello {
+	hello := tlsHello{}
 	if len(body) < 34 {
-		return nil, nil, nil
+		return hello
 	}
-	version := tlsVersionString(body[0:2])
+	hello.legacyVersion = binary.BigEndian.Uint16(body[0:2])
+	hello.version = strPtr(tlsVersionString(body[0:2]))
 	idx := 2 + 32
 
 	if len(body) < idx+1 {
-		return nil, nil, strPtr(version)
+		return hello
 	}
 	sessionLen := int(body[idx])
 	idx++
 	if len(body) < idx+sessionLen {
-		return nil, nil, strPtr(version)
+		return hello
 	}
 	idx += sessionLen
 
 	if len(body) < idx+2 {
-		return nil, nil, strPtr(version)
+		return hello
 	}
 	cipherLen := int(binary.BigEndian.Uint16(body[idx : idx+2]))
-	idx += 2 + cipherLen
+	idx += 2
+	if len(body) < idx+cipherLen {
+		return hello
+	}
+	hello.ciphers = parseUint16List(body[idx : idx+cipherLen])
+	idx += cipherLen
 
 	if len(body) < idx+1 {
-		return nil, nil, strPtr(version)
+		return hello
 	}
 	compLen := int(body[idx])
 	idx++
 	idx += compLen
 
 	if len(body) < idx+2 {
-		return nil, nil, strPtr(version)
+		return hello
 	}
 	extLen := int(binary.BigEndian.Uint16(body[idx : idx+2]))
 	idx += 2
 	if len(body) < idx+extLen {
-		return nil, nil, strPtr(version)
+		return hello
 	}
 
-	extData := body[idx : idx+extLen]
-	sni, alpn := parseExtensions(extData)
-
-	return sni, alpn, strPtr(version)
+	parseExtensions(body[idx:idx+extLen], &hello)
+	return hello
 }
 
-func parseServerHello(body []byte) (*string, *string) {
+func parseServerHello(body []byte) tlsHello {
+	hello := tlsHello{}
 	if len(body) < 38 {
-		return nil, nil
+		return hello
 	}
-	version := tlsVersionString(body[0:2])
+	hello.legacyVersion = binary.BigEndian.Uint16(body[0:2])
+	hello.version = strPtr(tlsVersionString(body[0:2]))
 	idx := 2 + 32
 
 	if len(body) < idx+1 {
-		return nil, strPtr(version)
+		return hello
 	}
 	sessionLen := int(body[idx])
 	idx++
 	if len(body) < idx+sessionLen+2+1 {
-		return nil, strPtr(version)
+		return hello
 	}
 	idx += sessionLen
 
+	hello.ciphers = []uint16{binary.BigEndian.Uint16(body[idx : idx+2])}
 	idx += 2
 	idx += 1
 
 	if len(body) < idx+2 {
-		return nil, strPtr(version)
+		return hello
 	}
 	extLen := int(binary.BigEndian.Uint16(body[idx : idx+2]))
 	idx += 2
 	if len(body) < idx+extLen {
-		return nil, strPtr(version)
+		return hello
 	}
-	extData := body[idx : idx+extLen]
-	_, alpn := parseExtensions(extData)
-	return alpn, strPtr(version)
+	parseExtensions(body[idx:idx+extLen], &hello)
+	return hello
 }
 
-func parseExtensions(data []byte) (*string, *string) {
-	var sni *string
-	var alpn *string
-
+func parseExtensions(data []byte, hello *tlsHello) {
 	idx := 0
 	for idx+4 <= len(data) {
 		extType := binary.BigEndian.Uint16(data[idx : idx+2])
@@ -187,23 +325,55 @@ func parseExtensions(data []byte) (*string, *string) {
 		ext := data[idx : idx+extLen]
 		idx += extLen
 
+		if !isGREASE(extType) {
+			hello.extensions = append(hello.extensions, extType)
+		}
+
 		switch extType {
 		case 0x0000:
-			if sni == nil {
+			if hello.sni == nil {
 				if host := parseSNI(ext); host != "" {
-					sni = &host
+					hello.sni = &host
 				}
 			}
+		case 0x000a:
+			if len(ext) >= 2 {
+				hello.groups = parseUint16List(ext[2:])
+			}
+		case 0x000b:
+			if len(ext) >= 1 && len(ext) >= 1+int(ext[0]) {
+				hello.pointFormats = append([]uint8(nil), ext[1:1+int(ext[0])]...)
+			}
+		case 0x000d:
+			if len(ext) >= 2 {
+				hello.sigAlgs = parseUint16List(ext[2:])
+			}
 		case 0x0010:
-			if alpn == nil {
+			if hello.alpn == nil {
 				if proto := parseALPN(ext); proto != "" {
-					alpn = &proto
+					hello.alpn = &proto
 				}
 			}
+		case 0x002b:
+			if len(ext) == 2 {
+				hello.supportedVersions = parseUint16List(ext)
+			} else if len(ext) >= 1 {
+				hello.supportedVersions = parseUint16List(ext[1:])
+			}
 		}
 	}
+}
 
-	return sni, alpn
+// parseUint16List decodes a run of big-endian uint16 values, skipping GREASE.
+func parseUint16List(data []byte) []uint16 {
+	values := make([]uint16, 0, len(data)/2)
+	for i := 0; i+2 <= len(data); i += 2 {
+		v := binary.BigEndian.Uint16(data[i : i+2])
+		if !isGREASE(v) {
+			values = append(values, v)
+		}
+	}
+	return values
 }
 
 func parseSNI(data []byte) string {
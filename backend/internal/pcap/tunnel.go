@@ -0,0 +1,65 @@
+package pcap
+
+import (
+	"netsage/internal/flows"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	tunnelVLAN   = "vlan"
+	tunnelMPLS   = "mpls"
+	tunnelGRE    = "gre"
+	tunnelVXLAN  = "vxlan"
+	tunnelGeneve = "geneve"
+)
+
+// innerLayers is the innermost network layer of a packet, the transport
+// layer directly above it, and the encapsulation closest to it.
+type innerLayers struct {
+	network   gopacket.Layer
+	transport gopacket.Layer
+	tunnel    flows.Tunnel
+}
+
+// decapsulate walks the decoded layers so that a conversation carried in
+// 802.1Q/QinQ, MPLS, GRE, VXLAN or Geneve is keyed on its inner 5-tuple
+// rather than the outer tunnel endpoints. gopacket already decodes through
+// these headers, so everything seen before an encapsulation header is
+// dropped as outer. A tunnelled frame that does not carry IP has no inner
+// network layer and is skipped.
+func decapsulate(ls []gopacket.Layer) innerLayers {
+	var inner innerLayers
+	for _, layer := range ls {
+		switch layer.(type) {
+		case *layers.Dot1Q, *layers.MPLS, *layers.GRE, *layers.VXLAN, *layers.Geneve:
+			inner.network = nil
+			inner.transport = nil
+		}
+
+		switch l := layer.(type) {
+		case *layers.IPv4, *layers.IPv6:
+			inner.network = layer
+			inner.transport = nil
+		case *layers.TCP, *layers.UDP, *layers.ICMPv4, *layers.ICMPv6:
+			if inner.network != nil && inner.transport == nil {
+				inner.transport = layer
+			}
+		case *layers.Dot1Q:
+			inner.tunnel = flows.Tunnel{Type: tunnelVLAN, ID: uint32(l.VLANIdentifier)}
+		case *layers.MPLS:
+			inner.tunnel = flows.Tunnel{Type: tunnelMPLS, ID: l.Label}
+		case *layers.GRE:
+			inner.tunnel = flows.Tunnel{Type: tunnelGRE}
+			if l.KeyPresent {
+				inner.tunnel.ID = l.Key
+			}
+		case *layers.VXLAN:
+			inner.tunnel = flows.Tunnel{Type: tunnelVXLAN, ID: l.VNI}
+		case *layers.Geneve:
+			inner.tunnel = flows.Tunnel{Type: tunnelGeneve, ID: l.VNI}
+		}
+	}
+	return inner
+}
@@ -0,0 +1,133 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"netsage/internal/flows"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestDecapsulatedFlowKey(t *testing.T) {
+	mac := net.HardwareAddr{0x00, 0x0c, 0x29, 0xaa, 0xbb, 0xcc}
+	outerIP := func(proto layers.IPProtocol) *layers.IPv4 {
+		return &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: proto, SrcIP: net.IP{172, 16, 0, 1}, DstIP: net.IP{172, 16, 0, 2}}
+	}
+	innerIP := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IP{192, 168, 1, 10}, DstIP: net.IP{192, 168, 1, 20}}
+	innerTCP := &layers.TCP{SrcPort: 40000, DstPort: 80, Seq: 1, ACK: true, Window: 1024}
+	innerEthernet := serializeLayers(t,
+		&layers.Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: layers.EthernetTypeIPv4},
+		innerIP, innerTCP, gopacket.Payload("hi"),
+	)
+
+	geneve := make([]byte, 8)
+	binary.BigEndian.PutUint16(geneve[2:4], uint16(layers.EthernetTypeTransparentEthernetBridging))
+	geneve[4], geneve[5], geneve[6] = 0, 0, 7
+
+	cases := []struct {
+		name   string
+		frame  []byte
+		tunnel flows.Tunnel
+	}{
+		{
+			name: "vxlan",
+			frame: serializeLayers(t,
+				&layers.Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: layers.EthernetTypeIPv4},
+				outerIP(layers.IPProtocolUDP),
+				&layers.UDP{SrcPort: 50000, DstPort: 4789},
+				&layers.VXLAN{ValidIDFlag: true, VNI: 5001},
+				gopacket.Payload(innerEthernet),
+			),
+			tunnel: flows.Tunnel{Type: "vxlan", ID: 5001},
+		},
+		{
+			name: "geneve",
+			frame: serializeLayers(t,
+				&layers.Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: layers.EthernetTypeIPv4},
+				outerIP(layers.IPProtocolUDP),
+				&layers.UDP{SrcPort: 50000, DstPort: 6081},
+				gopacket.Payload(append(geneve, innerEthernet...)),
+			),
+			tunnel: flows.Tunnel{Type: "geneve", ID: 7},
+		},
+		{
+			name: "gre-key",
+			frame: serializeLayers(t,
+				&layers.Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: layers.EthernetTypeIPv4},
+				outerIP(layers.IPProtocolGRE),
+				&layers.GRE{KeyPresent: true, Key: 42, Protocol: layers.EthernetTypeIPv4},
+				innerIP, innerTCP, gopacket.Payload("hi"),
+			),
+			tunnel: flows.Tunnel{Type: "gre", ID: 42},
+		},
+		{
+			name: "qinq",
+			frame: serializeLayers(t,
+				&layers.Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: layers.EthernetTypeQinQ},
+				&layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeDot1Q},
+				&layers.Dot1Q{VLANIdentifier: 200, Type: layers.EthernetTypeIPv4},
+				innerIP, innerTCP, gopacket.Payload("hi"),
+			),
+			tunnel: flows.Tunnel{Type: "vlan", ID: 200},
+		},
+		{
+			name: "mpls",
+			frame: serializeLayers(t,
+				&layers.Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: layers.EthernetTypeMPLSUnicast},
+				&layers.MPLS{Label: 16, StackBottom: true, TTL: 64},
+				innerIP, innerTCP, gopacket.Payload("hi"),
+			),
+			tunnel: flows.Tunnel{Type: "mpls", ID: 16},
+		},
+		{
+			name: "plain",
+			frame: serializeLayers(t,
+				&layers.Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: layers.EthernetTypeIPv4},
+				innerIP, innerTCP, gopacket.Payload("hi"),
+			),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			packet := gopacket.NewPacket(tc.frame, layers.LinkTypeEthernet, gopacket.Default)
+			info, ok := parsePacket(packet)
+			if !ok {
+				t.Fatalf("expected packet to parse")
+			}
+			if info.Proto != "TCP" || info.SrcIP != "192.168.1.10" || info.DstIP != "192.168.1.20" || info.SrcPort != 40000 || info.DstPort != 80 {
+				t.Fatalf("expected inner 5-tuple, got %s %s:%d -> %s:%d", info.Proto, info.SrcIP, info.SrcPort, info.DstIP, info.DstPort)
+			}
+			if info.Tunnel != tc.tunnel {
+				t.Fatalf("expected tunnel %+v, got %+v", tc.tunnel, info.Tunnel)
+			}
+			if string(info.Payload) != "hi" {
+				t.Fatalf("expected inner payload, got %q", info.Payload)
+			}
+		})
+	}
+}
+
+func TestPacketFilterTunnel(t *testing.T) {
+	filter, err := ParsePacketFilter("tunnel:vxlan tunnel_id:5001")
+	if err != nil {
+		t.Fatalf("parse filter: %v", err)
+	}
+	inside := flows.PacketInfo{Tunnel: flows.Tunnel{Type: "vxlan", ID: 5001}}
+	other := flows.PacketInfo{Tunnel: flows.Tunnel{Type: "vxlan", ID: 5002}}
+	if !filter.Matches(inside, FlowMeta{}) || filter.Matches(other, FlowMeta{}) || filter.Matches(flows.PacketInfo{}, FlowMeta{}) {
+		t.Fatalf("tunnel filter matched the wrong packets")
+	}
+}
+
+func serializeLayers(t testing.TB, ls ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, ls...); err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+	return append([]byte(nil), buf.Bytes()...)
+}
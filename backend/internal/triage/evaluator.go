@@ -2,6 +2,7 @@ package triage
 
 import (
 	"sort"
+	"strings"
 	"text/template"
 	"time"
 
@@ -13,21 +14,7 @@ func Evaluate(flowsMap map[flows.FlowKey]*flows.FlowAgg, rules []Rule) ([]Findin
 	for key := range flowsMap {
 		keys = append(keys, key)
 	}
-	sort.Slice(keys, func(i, j int) bool {
-		if keys[i].Proto != keys[j].Proto {
-			return keys[i].Proto < keys[j].Proto
-		}
-		if keys[i].SrcIP != keys[j].SrcIP {
-			return keys[i].SrcIP < keys[j].SrcIP
-		}
-		if keys[i].DstIP != keys[j].DstIP {
-			return keys[i].DstIP < keys[j].DstIP
-		}
-		if keys[i].SrcPort != keys[j].SrcPort {
-			return keys[i].SrcPort < keys[j].SrcPort
-		}
-		return keys[i].DstPort < keys[j].DstPort
-	})
+	sort.Slice(keys, func(i, j int) bool { return flows.KeyLess(keys[i], keys[j]) })
 
 	rulesSorted := append([]Rule(nil), rules...)
 	sort.Slice(rulesSorted, func(i, j int) bool {
@@ -115,27 +102,78 @@ func (s SeverityRule) Apply(metrics map[string]interface{}) int {
 func MetricsSnapshot(flow *flows.FlowAgg) map[string]interface{} {
 	clientIP, clientPort, serverIP, serverPort := flow.ClientServer()
 	snapshot := map[string]interface{}{
-		"protocol":                flow.Key.Proto,
-		"client_ip":               clientIP,
-		"client_port":             clientPort,
-		"server_ip":               serverIP,
-		"server_port":             serverPort,
-		"packet_count":            flow.PacketCount,
-		"bytes_client_to_server":  flow.BytesClientToServer,
-		"bytes_server_to_client":  flow.BytesServerToClient,
-		"tcp_syn_retransmissions": flow.SynRetransmits,
-		"tcp_retransmissions":     flow.Retransmits,
-		"out_of_order":            flow.OutOfOrder,
-		"dup_acks":                flow.DupAcks,
-		"tls_client_hello_seen":   flow.SawClientHello,
-		"tls_server_hello_seen":   flow.SawServerHello,
-		"tls_alert_seen":          flow.TLSAlert,
-		"tls_alert_code":          flow.TLSAlertCode,
-		"app_bytes":               flow.AppBytes,
+		"protocol":                   flow.Key.Proto,
+		"client_ip":                  clientIP,
+		"client_port":                clientPort,
+		"server_ip":                  serverIP,
+		"server_port":                serverPort,
+		"packet_count":               flow.PacketCount,
+		"bytes_client_to_server":     flow.BytesClientToServer,
+		"bytes_server_to_client":     flow.BytesServerToClient,
+		"tcp_syn_retransmissions":    flow.SynRetransmits,
+		"tcp_retransmissions":        flow.Retransmits,
+		"tcp_retrans_rto":            flow.RetransRTO,
+		"tcp_retrans_fast":           flow.RetransFast,
+		"tcp_retrans_tlp":            flow.RetransTLP,
+		"tcp_retrans_spurious":       flow.RetransSpurious,
+		"tcp_retrans_partial":        flow.RetransPartial,
+		"out_of_order":               flow.OutOfOrder,
+		"dup_acks":                   flow.DupAcks,
+		"rtt_samples":                flow.RTTSampleCount,
+		"sack_permitted":             flow.SACKPermitted,
+		"tcp_timestamps":             flow.TCPTimestamps,
+		"sack_loss_events":           flow.SACKLossEvents,
+		"zero_windows":               flow.ZeroWindows,
+		"zero_window_probes":         flow.ZeroWindowProbes,
+		"window_updates":             flow.WindowUpdates,
+		"window_full":                flow.WindowFull,
+		"client_stall_ms":            flow.ClientStallMs,
+		"server_stall_ms":            flow.ServerStallMs,
+		"receiver_stall_ms":          max(flow.ClientStallMs, flow.ServerStallMs),
+		"tls_client_hello_seen":      flow.SawClientHello,
+		"tls_server_hello_seen":      flow.SawServerHello,
+		"tls_alert_seen":             flow.TLSAlert,
+		"tls_alert_code":             flow.TLSAlertCode,
+		"app_bytes":                  flow.AppBytes,
+		"dns_queries":                flow.DNSQueries,
+		"dns_responses":              flow.DNSResponses,
+		"dns_nxdomain":               flow.DNSNXDomain,
+		"dns_servfail":               flow.DNSServFail,
+		"dns_unanswered":             flow.DNSUnanswered,
+		"quic_client_initials":       flow.QUICClientInitials,
+		"quic_server_packets":        flow.QUICServerPackets,
+		"quic_version_negotiation":   flow.QUICVersionNegotiation,
+		"quic_retry":                 flow.QUICRetry,
+		"quic_connection_close_seen": len(flow.QUICCloseIndexes()) > 0,
+		"icmp_errors":                flow.ICMPErrors,
+		"icmp_unreachable":           flow.ICMPUnreachable,
+		"icmp_frag_needed":           flow.ICMPFragNeeded,
+		"icmp_time_exceeded":         flow.ICMPTimeExceeded,
+		"fragment_count":             flow.FragmentCount,
+		"fragments_reassembled":      flow.Defragmented,
+		"fragment_timeouts":          flow.FragmentTimeouts,
+		"fragment_incomplete":        flow.FragmentIncomplete,
+		"quic_handshake_failed":      flow.QUICHandshakeFailed,
+		"tls_decrypted":              flow.TLSDecrypted,
+		"rst_count":                  flow.RSTCount,
+		"mid_connection":             flow.MidConnection,
+		"http_requests":              flow.HTTPRequests,
+		"http_responses":             flow.HTTPResponses,
+		"http_4xx":                   flow.HTTP4xx,
+		"http_5xx":                   flow.HTTP5xx,
 	}
 	if flow.DurationMs != nil {
 		snapshot["duration_ms"] = *flow.DurationMs
 	}
+	if flow.TCPState != nil {
+		snapshot["tcp_state"] = *flow.TCPState
+	}
+	if flow.CloseInitiator != nil {
+		snapshot["close_initiator"] = *flow.CloseInitiator
+	}
+	if flow.Handshake != nil {
+		snapshot["tcp_handshake"] = *flow.Handshake
+	}
 	if flow.TCPStreamID != nil {
 		snapshot["tcp_stream"] = *flow.TCPStreamID
 	}
@@ -148,9 +186,108 @@ func MetricsSnapshot(flow *flows.FlowAgg) map[string]interface{} {
 	if flow.RTTMs != nil {
 		snapshot["handshake_rtt_ms_estimate"] = *flow.RTTMs
 	}
+	if flow.RTTSampleCount > 0 {
+		snapshot["rtt_min_ms"] = *flow.RTTMinMs
+		snapshot["rtt_avg_ms"] = *flow.RTTAvgMs
+		snapshot["rtt_p95_ms"] = *flow.RTTP95Ms
+		snapshot["rtt_max_ms"] = *flow.RTTMaxMs
+	}
+	if flow.ClientMSS != nil {
+		snapshot["client_mss"] = *flow.ClientMSS
+	}
+	if flow.ServerMSS != nil {
+		snapshot["server_mss"] = *flow.ServerMSS
+	}
+	if flow.ClientWindowScale != nil {
+		snapshot["client_wscale"] = *flow.ClientWindowScale
+	}
+	if flow.ServerWindowScale != nil {
+		snapshot["server_wscale"] = *flow.ServerWindowScale
+	}
+	if flow.RTOMinMs != nil {
+		snapshot["rto_min_ms"] = *flow.RTOMinMs
+	}
+	if flow.RTOAvgMs != nil {
+		snapshot["rto_avg_ms"] = *flow.RTOAvgMs
+	}
+	if flow.RTOMaxMs != nil {
+		snapshot["rto_max_ms"] = *flow.RTOMaxMs
+	}
+	if flow.ClientRwndMin != nil {
+		snapshot["client_rwnd_min"] = *flow.ClientRwndMin
+	}
+	if flow.ClientRwndMax != nil {
+		snapshot["client_rwnd_max"] = *flow.ClientRwndMax
+	}
+	if flow.ServerRwndMin != nil {
+		snapshot["server_rwnd_min"] = *flow.ServerRwndMin
+	}
+	if flow.ServerRwndMax != nil {
+		snapshot["server_rwnd_max"] = *flow.ServerRwndMax
+	}
 	if flow.TLSAlertCode != nil {
 		snapshot["tls_alert_code"] = *flow.TLSAlertCode
 	}
+	if flow.DNSLatencyAvgMs != nil {
+		snapshot["dns_latency_avg_ms"] = *flow.DNSLatencyAvgMs
+	}
+	if flow.DNSLatencyMaxMs != nil {
+		snapshot["dns_latency_max_ms"] = *flow.DNSLatencyMaxMs
+	}
+	if flow.DNSQueryName != nil {
+		snapshot["dns_query_name"] = *flow.DNSQueryName
+	}
+	if flow.ICMPNextHopMTU != nil {
+		snapshot["icmp_next_hop_mtu"] = *flow.ICMPNextHopMTU
+	}
+	if flow.ICMPUnreachableCode != nil {
+		snapshot["icmp_unreachable_code"] = *flow.ICMPUnreachableCode
+	}
+	if frames := flow.ICMPErrorFrames(); len(frames) > 0 {
+		snapshot["icmp_error_frames"] = frames
+	}
+	if flow.JA3 != nil {
+		snapshot["ja3"] = *flow.JA3
+	}
+	if flow.JA3S != nil {
+		snapshot["ja3s"] = *flow.JA3S
+	}
+	if flow.JA4 != nil {
+		snapshot["ja4"] = *flow.JA4
+	}
+	if report := flow.CertReport; report != nil {
+		snapshot["cert_seen"] = true
+		snapshot["cert_subject"] = report.Subject
+		snapshot["cert_issuer"] = report.Issuer
+		snapshot["cert_days_remaining"] = report.DaysRemaining
+		snapshot["cert_expired"] = report.Expired
+		snapshot["cert_hostname_mismatch"] = report.HostnameChecked && !report.HostnameValid
+		snapshot["cert_self_signed"] = report.SelfSigned
+		snapshot["cert_weak_signature"] = report.WeakSignatureAlgo
+		snapshot["cert_chain_length"] = report.ChainLength
+		snapshot["cert_issues"] = strings.Join(report.Issues, ", ")
+	}
+	if flow.QUICVersion != nil {
+		snapshot["quic_version"] = *flow.QUICVersion
+	}
+	if flow.HTTPStatus != nil {
+		snapshot["http_status"] = *flow.HTTPStatus
+	}
+	if flow.HTTPResponseMs != nil {
+		snapshot["http_response_ms"] = *flow.HTTPResponseMs
+	}
+	if flow.HTTPResponses > 0 {
+		snapshot["http_error_rate"] = float64(flow.HTTP4xx+flow.HTTP5xx) / float64(flow.HTTPResponses)
+	}
+	if flow.HTTPTTFBP50Ms != nil {
+		snapshot["http_ttfb_p50_ms"] = *flow.HTTPTTFBP50Ms
+	}
+	if flow.HTTPTTFBP95Ms != nil {
+		snapshot["http_ttfb_p95_ms"] = *flow.HTTPTTFBP95Ms
+	}
+	if flow.HTTPTTFBMaxMs != nil {
+		snapshot["http_ttfb_max_ms"] = *flow.HTTPTTFBMaxMs
+	}
 	return snapshot
 }
 
@@ -179,6 +316,22 @@ func evidenceRange(issueType IssueType, flow *flows.FlowAgg) (int, int) {
 		indexes := append([]int{}, flow.TLSClientHelloIndexes()...)
 		indexes = append(indexes, flow.TLSAlertIndexes()...)
 		return rangeFromIndexes(indexes, int(flow.PacketCount))
+	case IssueDNSFailure:
+		return rangeFromIndexes(flow.DNSErrorIndexes(), int(flow.PacketCount))
+	case IssueQUICHandshakeFailure:
+		indexes := append([]int{}, flow.QUICInitialIndexes()...)
+		indexes = append(indexes, flow.QUICCloseIndexes()...)
+		return rangeFromIndexes(indexes, int(flow.PacketCount))
+	case IssueTLSCertificate:
+		return rangeFromIndexes(flow.CertIndexes(), int(flow.PacketCount))
+	case IssuePMTUDBlackhole:
+		return rangeFromIndexes(flow.RetransmissionIndexes(), int(flow.PacketCount))
+	case IssueHTTPErrors:
+		return rangeFromIndexes(flow.HTTPErrorIndexes(), int(flow.PacketCount))
+	case IssueHTTPSlowResponse:
+		return rangeFromIndexes(flow.HTTPSlowestIndexes(), int(flow.PacketCount))
+	case IssueReceiverStall:
+		return rangeFromIndexes(flow.ZeroWindowIndexes(), int(flow.PacketCount))
 	default:
 		return rangeFromIndexes(nil, int(flow.PacketCount))
 	}
@@ -48,3 +48,131 @@ func TestEvaluateRules(t *testing.T) {
 		t.Fatalf("expected retransmission issue")
 	}
 }
+
+func TestHTTPErrorAndSlowResponseRules(t *testing.T) {
+	rules, err := LoadRules()
+	if err != nil {
+		t.Fatalf("load rules: %v", err)
+	}
+
+	key := flows.FlowKey{Proto: "TCP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: 40000, DstPort: 80}
+	base := time.Now()
+	flow := flows.NewFlowAgg(key, base)
+	flow.PacketCount = 40
+	for i, status := range []int{200, 503, 502, 200, 404} {
+		code := status
+		ttfb := float64(1500 + 100*i)
+		respIndex := 4*i + 4
+		flow.AddHTTPTransaction(flows.HTTPTransaction{
+			Method:        "GET",
+			Path:          "/",
+			Status:        &code,
+			RequestTime:   base,
+			TTFBMs:        &ttfb,
+			RequestIndex:  4*i + 3,
+			ResponseIndex: &respIndex,
+		})
+	}
+	flow.Finalize()
+
+	findings, err := Evaluate(map[flows.FlowKey]*flows.FlowAgg{key: flow}, rules)
+	if err != nil {
+		t.Fatalf("evaluate: %v", err)
+	}
+	var errors, slow *Finding
+	for i := range findings {
+		switch findings[i].IssueType {
+		case IssueHTTPErrors:
+			errors = &findings[i]
+		case IssueHTTPSlowResponse:
+			slow = &findings[i]
+		}
+	}
+	if errors == nil || slow == nil {
+		t.Fatalf("expected HTTP error and slow response findings, got %+v", findings)
+	}
+	if ev := errors.EvidenceList[0]; ev.PacketStartIndex != 8 || ev.PacketEndIndex != 20 {
+		t.Fatalf("unexpected error evidence range %d-%d", ev.PacketStartIndex, ev.PacketEndIndex)
+	}
+	if ev := slow.EvidenceList[0]; ev.PacketStartIndex != 19 || ev.PacketEndIndex != 20 {
+		t.Fatalf("unexpected slow evidence range %d-%d", ev.PacketStartIndex, ev.PacketEndIndex)
+	}
+	if errors.Summary != "Server returned HTTP errors (responses=5, 4xx=1, 5xx=2, error_rate=0.60)." {
+		t.Fatalf("unexpected summary %q", errors.Summary)
+	}
+}
+
+func TestReceiverStallRule(t *testing.T) {
+	rules, err := LoadRules()
+	if err != nil {
+		t.Fatalf("load rules: %v", err)
+	}
+
+	key := flows.FlowKey{Proto: "TCP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: 40000, DstPort: 443}
+	base := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	flow := flows.NewFlowAgg(key, base)
+	at := func(ms int) time.Time { return base.Add(time.Duration(ms) * time.Millisecond) }
+	flow.Update(flows.PacketInfo{Timestamp: at(0), Proto: "TCP", Seq: 1, Ack: 1, PayloadLen: 100, TCPFlags: flows.TCPFlags{ACK: true}, Window: 100}, true)
+	flow.Update(flows.PacketInfo{Timestamp: at(5), Proto: "TCP", Seq: 1, Ack: 101, TCPFlags: flows.TCPFlags{ACK: true}, Window: 0}, false)
+	flow.Update(flows.PacketInfo{Timestamp: at(1505), Proto: "TCP", Seq: 1, Ack: 101, TCPFlags: flows.TCPFlags{ACK: true}, Window: 100}, false)
+	flow.Finalize()
+
+	findings, err := Evaluate(map[flows.FlowKey]*flows.FlowAgg{key: flow}, rules)
+	if err != nil {
+		t.Fatalf("evaluate: %v", err)
+	}
+	var stall *Finding
+	for i := range findings {
+		if findings[i].IssueType == IssueReceiverStall {
+			stall = &findings[i]
+		}
+	}
+	if stall == nil {
+		t.Fatalf("expected receiver stall finding, got %+v", findings)
+	}
+	if stall.Severity != 3 {
+		t.Fatalf("expected severity 3 for a 1.5 s stall, got %d", stall.Severity)
+	}
+	if ev := stall.EvidenceList[0]; ev.PacketStartIndex != 2 || ev.PacketEndIndex != 2 {
+		t.Fatalf("unexpected stall evidence range %d-%d", ev.PacketStartIndex, ev.PacketEndIndex)
+	}
+	if stall.Summary != "A receiver closed its window and held up the sender (zero_windows=1, zero_window_probes=0, client stalled 0 ms, server stalled 1500 ms)." {
+		t.Fatalf("unexpected summary %q", stall.Summary)
+	}
+}
+
+// Flows with the same 5-tuple in different tunnels are reported in tunnel
+// order, not map order.
+func TestEvaluateOrdersFlowsByTunnel(t *testing.T) {
+	rules, err := LoadRules()
+	if err != nil {
+		t.Fatalf("load rules: %v", err)
+	}
+	flowsMap := make(map[flows.FlowKey]*flows.FlowAgg)
+	for id := uint32(8); id > 0; id-- {
+		key := flows.FlowKey{Proto: "TCP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: 1234, DstPort: 443, Tunnel: flows.Tunnel{Type: "vxlan", ID: id}}
+		flow := flows.NewFlowAgg(key, time.Now())
+		flow.PacketCount = 10
+		flow.Retransmits = 5
+		flowsMap[key] = flow
+	}
+
+	findings, err := Evaluate(flowsMap, rules)
+	if err != nil {
+		t.Fatalf("evaluate: %v", err)
+	}
+	last := uint32(0)
+	for _, finding := range findings {
+		if finding.IssueType != IssueRetransmission {
+			continue
+		}
+		if id := finding.PrimaryFlow.Key.Tunnel.ID; id <= last {
+			t.Fatalf("expected findings in tunnel order, got tunnel %d after %d", id, last)
+		} else {
+			last = id
+		}
+	}
+	if last != 8 {
+		t.Fatalf("expected a retransmission finding per tunnel, last was %d", last)
+	}
+}
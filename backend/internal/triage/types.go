@@ -5,9 +5,17 @@ import "netsage/internal/flows"
 type IssueType string
 
 const (
-	IssueLatency             IssueType = "LATENCY"
-	IssueRetransmission      IssueType = "RETRANSMISSION"
-	IssueTLSHandshakeFailure IssueType = "TLS_HANDSHAKE_FAILURE"
+	IssueLatency              IssueType = "LATENCY"
+	IssueRetransmission       IssueType = "RETRANSMISSION"
+	IssueTLSHandshakeFailure  IssueType = "TLS_HANDSHAKE_FAILURE"
+	IssueDNSFailure           IssueType = "DNS_FAILURE"
+	IssueQUICHandshakeFailure IssueType = "QUIC_HANDSHAKE_FAILURE"
+	IssuePMTUDBlackhole       IssueType = "PMTUD_BLACKHOLE"
+	IssueICMPError            IssueType = "ICMP_ERROR"
+	IssueTLSCertificate       IssueType = "TLS_CERTIFICATE"
+	IssueHTTPErrors           IssueType = "HTTP_ERRORS"
+	IssueHTTPSlowResponse     IssueType = "HTTP_SLOW_RESPONSE"
+	IssueReceiverStall        IssueType = "RECEIVER_STALL"
 )
 
 type Rule struct {
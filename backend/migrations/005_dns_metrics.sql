@@ -0,0 +1,21 @@
+-- +goose Up
+ALTER TABLE flows ADD COLUMN dns_queries BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN dns_responses BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN dns_nxdomain BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN dns_servfail BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN dns_unanswered BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN dns_latency_avg_ms DOUBLE PRECISION NULL;
+ALTER TABLE flows ADD COLUMN dns_latency_max_ms DOUBLE PRECISION NULL;
+ALTER TABLE flows ADD COLUMN dns_query_name TEXT NULL;
+ALTER TABLE flows ADD COLUMN dns_query_type TEXT NULL;
+
+-- +goose Down
+ALTER TABLE flows DROP COLUMN IF EXISTS dns_query_type;
+ALTER TABLE flows DROP COLUMN IF EXISTS dns_query_name;
+ALTER TABLE flows DROP COLUMN IF EXISTS dns_latency_max_ms;
+ALTER TABLE flows DROP COLUMN IF EXISTS dns_latency_avg_ms;
+ALTER TABLE flows DROP COLUMN IF EXISTS dns_unanswered;
+ALTER TABLE flows DROP COLUMN IF EXISTS dns_servfail;
+ALTER TABLE flows DROP COLUMN IF EXISTS dns_nxdomain;
+ALTER TABLE flows DROP COLUMN IF EXISTS dns_responses;
+ALTER TABLE flows DROP COLUMN IF EXISTS dns_queries;
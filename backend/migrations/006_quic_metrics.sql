@@ -0,0 +1,19 @@
+-- +goose Up
+ALTER TABLE flows ADD COLUMN quic_version TEXT NULL;
+ALTER TABLE flows ADD COLUMN quic_dcid TEXT NULL;
+ALTER TABLE flows ADD COLUMN quic_scid TEXT NULL;
+ALTER TABLE flows ADD COLUMN quic_client_initials BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN quic_server_packets BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN quic_version_negotiation BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE flows ADD COLUMN quic_retry BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE flows ADD COLUMN quic_handshake_failed BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- +goose Down
+ALTER TABLE flows DROP COLUMN IF EXISTS quic_handshake_failed;
+ALTER TABLE flows DROP COLUMN IF EXISTS quic_retry;
+ALTER TABLE flows DROP COLUMN IF EXISTS quic_version_negotiation;
+ALTER TABLE flows DROP COLUMN IF EXISTS quic_server_packets;
+ALTER TABLE flows DROP COLUMN IF EXISTS quic_client_initials;
+ALTER TABLE flows DROP COLUMN IF EXISTS quic_scid;
+ALTER TABLE flows DROP COLUMN IF EXISTS quic_dcid;
+ALTER TABLE flows DROP COLUMN IF EXISTS quic_version;
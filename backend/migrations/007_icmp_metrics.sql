@@ -0,0 +1,15 @@
+-- +goose Up
+ALTER TABLE flows ADD COLUMN icmp_errors BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN icmp_unreachable BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN icmp_frag_needed BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN icmp_time_exceeded BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN icmp_next_hop_mtu INT NULL;
+ALTER TABLE flows ADD COLUMN icmp_unreachable_code INT NULL;
+
+-- +goose Down
+ALTER TABLE flows DROP COLUMN IF EXISTS icmp_unreachable_code;
+ALTER TABLE flows DROP COLUMN IF EXISTS icmp_next_hop_mtu;
+ALTER TABLE flows DROP COLUMN IF EXISTS icmp_time_exceeded;
+ALTER TABLE flows DROP COLUMN IF EXISTS icmp_frag_needed;
+ALTER TABLE flows DROP COLUMN IF EXISTS icmp_unreachable;
+ALTER TABLE flows DROP COLUMN IF EXISTS icmp_errors;
@@ -0,0 +1,13 @@
+-- +goose Up
+ALTER TABLE flows ADD COLUMN ja3 TEXT NULL;
+ALTER TABLE flows ADD COLUMN ja3s TEXT NULL;
+ALTER TABLE flows ADD COLUMN ja4 TEXT NULL;
+CREATE INDEX IF NOT EXISTS flows_ja3_idx ON flows(pcap_id, ja3);
+CREATE INDEX IF NOT EXISTS flows_ja4_idx ON flows(pcap_id, ja4);
+
+-- +goose Down
+DROP INDEX IF EXISTS flows_ja4_idx;
+DROP INDEX IF EXISTS flows_ja3_idx;
+ALTER TABLE flows DROP COLUMN IF EXISTS ja4;
+ALTER TABLE flows DROP COLUMN IF EXISTS ja3s;
+ALTER TABLE flows DROP COLUMN IF EXISTS ja3;
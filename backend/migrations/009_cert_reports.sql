@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE flows ADD COLUMN cert_report_json JSONB NULL;
+
+-- +goose Down
+ALTER TABLE flows DROP COLUMN IF EXISTS cert_report_json;
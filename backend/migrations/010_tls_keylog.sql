@@ -0,0 +1,15 @@
+-- +goose Up
+ALTER TABLE pcaps ADD COLUMN keylog_path TEXT NULL;
+
+ALTER TABLE flows ADD COLUMN http_path TEXT NULL;
+ALTER TABLE flows ADD COLUMN http_status INT NULL;
+ALTER TABLE flows ADD COLUMN http_response_ms DOUBLE PRECISION NULL;
+ALTER TABLE flows ADD COLUMN tls_decrypted BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- +goose Down
+ALTER TABLE flows DROP COLUMN IF EXISTS tls_decrypted;
+ALTER TABLE flows DROP COLUMN IF EXISTS http_response_ms;
+ALTER TABLE flows DROP COLUMN IF EXISTS http_status;
+ALTER TABLE flows DROP COLUMN IF EXISTS http_path;
+
+ALTER TABLE pcaps DROP COLUMN IF EXISTS keylog_path;
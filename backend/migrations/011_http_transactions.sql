@@ -0,0 +1,38 @@
+-- +goose Up
+ALTER TABLE flows ADD COLUMN http_requests BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN http_responses BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN http_4xx BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN http_5xx BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN http_ttfb_p50_ms DOUBLE PRECISION NULL;
+ALTER TABLE flows ADD COLUMN http_ttfb_p95_ms DOUBLE PRECISION NULL;
+ALTER TABLE flows ADD COLUMN http_ttfb_max_ms DOUBLE PRECISION NULL;
+
+CREATE TABLE http_transactions (
+    id SERIAL PRIMARY KEY,
+    pcap_id INT NOT NULL REFERENCES pcaps(id) ON DELETE CASCADE,
+    flow_id INT NOT NULL REFERENCES flows(id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    method TEXT NOT NULL,
+    path TEXT NOT NULL,
+    host TEXT NULL,
+    status INT NULL,
+    content_length BIGINT NULL,
+    request_ts TIMESTAMP NOT NULL,
+    response_ts TIMESTAMP NULL,
+    ttfb_ms DOUBLE PRECISION NULL,
+    packet_start_index INT NOT NULL,
+    packet_end_index INT NOT NULL
+);
+CREATE INDEX http_transactions_pcap_idx ON http_transactions(pcap_id);
+CREATE INDEX http_transactions_flow_idx ON http_transactions(flow_id);
+
+-- +goose Down
+DROP TABLE IF EXISTS http_transactions;
+
+ALTER TABLE flows DROP COLUMN IF EXISTS http_ttfb_max_ms;
+ALTER TABLE flows DROP COLUMN IF EXISTS http_ttfb_p95_ms;
+ALTER TABLE flows DROP COLUMN IF EXISTS http_ttfb_p50_ms;
+ALTER TABLE flows DROP COLUMN IF EXISTS http_5xx;
+ALTER TABLE flows DROP COLUMN IF EXISTS http_4xx;
+ALTER TABLE flows DROP COLUMN IF EXISTS http_responses;
+ALTER TABLE flows DROP COLUMN IF EXISTS http_requests;
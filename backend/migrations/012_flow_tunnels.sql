@@ -0,0 +1,11 @@
+-- +goose Up
+ALTER TABLE flows ADD COLUMN tunnel_type TEXT NULL;
+ALTER TABLE flows ADD COLUMN tunnel_id BIGINT NULL;
+
+CREATE INDEX IF NOT EXISTS flows_tunnel_idx ON flows(pcap_id, tunnel_type, tunnel_id);
+
+-- +goose Down
+DROP INDEX IF EXISTS flows_tunnel_idx;
+
+ALTER TABLE flows DROP COLUMN IF EXISTS tunnel_id;
+ALTER TABLE flows DROP COLUMN IF EXISTS tunnel_type;
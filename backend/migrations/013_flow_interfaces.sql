@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE flows ADD COLUMN interfaces TEXT NULL;
+
+-- +goose Down
+ALTER TABLE flows DROP COLUMN IF EXISTS interfaces;
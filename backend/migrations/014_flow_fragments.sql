@@ -0,0 +1,9 @@
+-- +goose Up
+ALTER TABLE flows ADD COLUMN fragments_reassembled BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN fragment_timeouts BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN fragment_incomplete BIGINT NOT NULL DEFAULT 0;
+
+-- +goose Down
+ALTER TABLE flows DROP COLUMN IF EXISTS fragment_incomplete;
+ALTER TABLE flows DROP COLUMN IF EXISTS fragment_timeouts;
+ALTER TABLE flows DROP COLUMN IF EXISTS fragments_reassembled;
@@ -0,0 +1,25 @@
+-- +goose Up
+ALTER TABLE flows ADD COLUMN client_mss INT NULL;
+ALTER TABLE flows ADD COLUMN server_mss INT NULL;
+ALTER TABLE flows ADD COLUMN client_wscale INT NULL;
+ALTER TABLE flows ADD COLUMN server_wscale INT NULL;
+ALTER TABLE flows ADD COLUMN client_rwnd_min BIGINT NULL;
+ALTER TABLE flows ADD COLUMN client_rwnd_max BIGINT NULL;
+ALTER TABLE flows ADD COLUMN server_rwnd_min BIGINT NULL;
+ALTER TABLE flows ADD COLUMN server_rwnd_max BIGINT NULL;
+ALTER TABLE flows ADD COLUMN sack_permitted BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE flows ADD COLUMN tcp_timestamps BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE flows ADD COLUMN sack_loss_events BIGINT NOT NULL DEFAULT 0;
+
+-- +goose Down
+ALTER TABLE flows DROP COLUMN IF EXISTS sack_loss_events;
+ALTER TABLE flows DROP COLUMN IF EXISTS tcp_timestamps;
+ALTER TABLE flows DROP COLUMN IF EXISTS sack_permitted;
+ALTER TABLE flows DROP COLUMN IF EXISTS server_rwnd_max;
+ALTER TABLE flows DROP COLUMN IF EXISTS server_rwnd_min;
+ALTER TABLE flows DROP COLUMN IF EXISTS client_rwnd_max;
+ALTER TABLE flows DROP COLUMN IF EXISTS client_rwnd_min;
+ALTER TABLE flows DROP COLUMN IF EXISTS server_wscale;
+ALTER TABLE flows DROP COLUMN IF EXISTS client_wscale;
+ALTER TABLE flows DROP COLUMN IF EXISTS server_mss;
+ALTER TABLE flows DROP COLUMN IF EXISTS client_mss;
@@ -0,0 +1,13 @@
+-- +goose Up
+ALTER TABLE flows ADD COLUMN rtt_min_ms DOUBLE PRECISION NULL;
+ALTER TABLE flows ADD COLUMN rtt_avg_ms DOUBLE PRECISION NULL;
+ALTER TABLE flows ADD COLUMN rtt_p95_ms DOUBLE PRECISION NULL;
+ALTER TABLE flows ADD COLUMN rtt_max_ms DOUBLE PRECISION NULL;
+ALTER TABLE flows ADD COLUMN rtt_samples BIGINT NOT NULL DEFAULT 0;
+
+-- +goose Down
+ALTER TABLE flows DROP COLUMN IF EXISTS rtt_samples;
+ALTER TABLE flows DROP COLUMN IF EXISTS rtt_max_ms;
+ALTER TABLE flows DROP COLUMN IF EXISTS rtt_p95_ms;
+ALTER TABLE flows DROP COLUMN IF EXISTS rtt_avg_ms;
+ALTER TABLE flows DROP COLUMN IF EXISTS rtt_min_ms;
@@ -0,0 +1,15 @@
+-- +goose Up
+ALTER TABLE flows ADD COLUMN zero_windows BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN zero_window_probes BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN window_updates BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN window_full BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN client_stall_ms DOUBLE PRECISION NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN server_stall_ms DOUBLE PRECISION NOT NULL DEFAULT 0;
+
+-- +goose Down
+ALTER TABLE flows DROP COLUMN IF EXISTS server_stall_ms;
+ALTER TABLE flows DROP COLUMN IF EXISTS client_stall_ms;
+ALTER TABLE flows DROP COLUMN IF EXISTS window_full;
+ALTER TABLE flows DROP COLUMN IF EXISTS window_updates;
+ALTER TABLE flows DROP COLUMN IF EXISTS zero_window_probes;
+ALTER TABLE flows DROP COLUMN IF EXISTS zero_windows;
@@ -0,0 +1,19 @@
+-- +goose Up
+ALTER TABLE flows ADD COLUMN tcp_retrans_rto BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN tcp_retrans_fast BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN tcp_retrans_tlp BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN tcp_retrans_spurious BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN tcp_retrans_partial BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE flows ADD COLUMN rto_min_ms DOUBLE PRECISION NULL;
+ALTER TABLE flows ADD COLUMN rto_avg_ms DOUBLE PRECISION NULL;
+ALTER TABLE flows ADD COLUMN rto_max_ms DOUBLE PRECISION NULL;
+
+-- +goose Down
+ALTER TABLE flows DROP COLUMN IF EXISTS rto_max_ms;
+ALTER TABLE flows DROP COLUMN IF EXISTS rto_avg_ms;
+ALTER TABLE flows DROP COLUMN IF EXISTS rto_min_ms;
+ALTER TABLE flows DROP COLUMN IF EXISTS tcp_retrans_partial;
+ALTER TABLE flows DROP COLUMN IF EXISTS tcp_retrans_spurious;
+ALTER TABLE flows DROP COLUMN IF EXISTS tcp_retrans_tlp;
+ALTER TABLE flows DROP COLUMN IF EXISTS tcp_retrans_fast;
+ALTER TABLE flows DROP COLUMN IF EXISTS tcp_retrans_rto;
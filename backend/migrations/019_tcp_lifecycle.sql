@@ -0,0 +1,15 @@
+-- +goose Up
+ALTER TABLE flows ADD COLUMN tcp_state TEXT NULL;
+ALTER TABLE flows ADD COLUMN close_initiator TEXT NULL;
+ALTER TABLE flows ADD COLUMN tcp_handshake TEXT NULL;
+ALTER TABLE flows ADD COLUMN mid_connection BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE INDEX IF NOT EXISTS flows_tcp_state_idx ON flows(pcap_id, tcp_state);
+
+-- +goose Down
+DROP INDEX IF EXISTS flows_tcp_state_idx;
+
+ALTER TABLE flows DROP COLUMN IF EXISTS mid_connection;
+ALTER TABLE flows DROP COLUMN IF EXISTS tcp_handshake;
+ALTER TABLE flows DROP COLUMN IF EXISTS close_initiator;
+ALTER TABLE flows DROP COLUMN IF EXISTS tcp_state;
@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE jobs ADD COLUMN index_path TEXT NULL;
+
+-- +goose Down
+ALTER TABLE jobs DROP COLUMN IF EXISTS index_path;
@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE pcaps ADD COLUMN capture_filter TEXT NULL;
+
+-- +goose Down
+ALTER TABLE pcaps DROP COLUMN IF EXISTS capture_filter;
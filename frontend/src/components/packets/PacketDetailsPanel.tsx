@@ -1,15 +1,71 @@
 import { Panel } from '../Panel'
-import { Packet } from '../../types/viewer'
+import { Packet, PacketField, PacketLayer, PacketPayload } from '../../types/viewer'
 import { usePacketDetails } from '../../hooks/usePacketDetails'
 import { DetailGrid, DetailItem } from '../DetailFields'
 
 type PacketDetailsPanelProps = {
+  jobId?: string
   packet: Packet | null
   isLoading?: boolean
 }
 
-export function PacketDetailsPanel({ packet, isLoading }: PacketDetailsPanelProps) {
-  const { details } = usePacketDetails(packet)
+function FieldTree({ fields }: { fields: PacketField[] }) {
+  return (
+    <ul className="pl-3 space-y-0.5">
+      {fields.map((field, i) => (
+        <li key={`${field.name}-${i}`}>
+          {field.children?.length ? (
+            <details>
+              <summary className="cursor-pointer">
+                {field.name}
+                {field.value ? <span className="text-muted-foreground">: {field.value}</span> : null}
+              </summary>
+              <FieldTree fields={field.children} />
+            </details>
+          ) : (
+            <span>
+              {field.name}
+              {field.value ? <span className="text-muted-foreground">: {field.value}</span> : null}
+            </span>
+          )}
+        </li>
+      ))}
+    </ul>
+  )
+}
+
+function LayerTree({ layers }: { layers: PacketLayer[] }) {
+  return (
+    <div className="space-y-1 font-mono text-[11px]">
+      {layers.map((layer, i) => (
+        <details key={`${layer.name}-${i}`} open={i === layers.length - 1}>
+          <summary className="cursor-pointer font-semibold">
+            {layer.name} <span className="font-normal text-muted-foreground">({layer.length} bytes)</span>
+          </summary>
+          <FieldTree fields={layer.fields} />
+        </details>
+      ))}
+    </div>
+  )
+}
+
+function PayloadHex({ payload }: { payload: PacketPayload }) {
+  const rows: string[] = []
+  for (let i = 0; i < payload.hex.length; i += 32) {
+    rows.push(payload.hex.slice(i, i + 32).replace(/(..)(?!$)/g, '$1 '))
+  }
+  return (
+    <div className="space-y-1">
+      <div className="text-muted-foreground">
+        Payload: {payload.length} bytes{payload.truncated ? `, first ${payload.hex.length / 2} shown` : ''}
+      </div>
+      <pre className="font-mono text-[11px] whitespace-pre-wrap break-all">{rows.join('\n')}</pre>
+    </div>
+  )
+}
+
+export function PacketDetailsPanel({ jobId, packet, isLoading }: PacketDetailsPanelProps) {
+  const { details, layers, payload, isLoading: layersLoading } = usePacketDetails(jobId, packet)
   const formatValue = (value: string | number | undefined | null) => (value === undefined || value === null || value === '' ? '—' : value)
   const formatBool = (value?: boolean) => (value === undefined ? '—' : value ? 'yes' : 'no')
   const formatFlags = (flags?: Packet['tcp_flags']) => {
@@ -52,6 +108,12 @@ export function PacketDetailsPanel({ packet, isLoading }: PacketDetailsPanelProp
               ] as DetailItem[]
             }
           />
+          {layersLoading ? (
+            <div className="text-muted-foreground">Decoding layers…</div>
+          ) : layers.length ? (
+            <LayerTree layers={layers} />
+          ) : null}
+          {payload ? <PayloadHex payload={payload} /> : null}
         </div>
       ) : (
         <div className="text-xs text-muted-foreground">Select a packet to see details.</div>
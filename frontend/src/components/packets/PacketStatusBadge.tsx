@@ -6,7 +6,17 @@ const labelMap: Record<string, string> = {
   tls_alert: 'TLS Alert',
   syn_retransmission: 'SYN Retrans',
   retransmission: 'Retransmission',
-  dup_ack: 'Dup ACK'
+  rto_retransmission: 'RTO',
+  fast_retransmission: 'Fast Retrans',
+  tail_loss_probe: 'TLP',
+  spurious_retransmission: 'Spurious Retrans',
+  partial_retransmission: 'Partial Retrans',
+  dsack: 'D-SACK',
+  dup_ack: 'Dup ACK',
+  zero_window: 'Zero Window',
+  zero_window_probe: 'ZW Probe',
+  window_update: 'Window Update',
+  window_full: 'Window Full'
 }
 
 type PacketStatusBadgeProps = {
@@ -2,6 +2,7 @@ import { useCallback, useEffect, useMemo, useRef, useState } from 'react'
 import { PacketFiltersPanel } from './PacketFiltersPanel'
 import { ActiveFiltersBar } from './ActiveFiltersBar'
 import { StreamSummaryPanel } from './StreamSummaryPanel'
+import { StreamFollowPanel } from './StreamFollowPanel'
 import { PacketsTableContainer } from './PacketsTableContainer'
 import { PacketDetailsPanel } from './PacketDetailsPanel'
 import { Panel } from '../Panel'
@@ -9,6 +10,7 @@ import { Packet } from '../../types/viewer'
 import { PacketFilters, buildPacketSearchParams, clearPacketFilters, getPacketOffset, readPacketFilters } from '../../utils/filters'
 import { usePackets } from '../../hooks/usePackets'
 import { useStreamDetails } from '../../hooks/useStreamDetails'
+import { useStreamFollow } from '../../hooks/useStreamFollow'
 
 type PacketsTabProps = {
   jobId: string
@@ -59,6 +61,7 @@ export function PacketsTab({ jobId, searchParams, setSearchParams }: PacketsTabP
   const activeStreamId = streamFromFilter !== undefined ? streamFromFilter : uniqueStreamId
 
   const { summary: streamSummary, timeseries: streamTimeseries, isLoading: streamLoading } = useStreamDetails(jobId, activeStreamId)
+  const { data: streamFollow, isLoading: followLoading } = useStreamFollow(jobId, activeStreamId)
 
   const applyFilters = useCallback(() => {
     const next = { ...draft }
@@ -159,17 +162,20 @@ export function PacketsTab({ jobId, searchParams, setSearchParams }: PacketsTabP
           <div className="text-xs font-semibold uppercase tracking-wide text-muted-foreground mb-2">Selection</div>
           <div className="space-y-3">
             {activeStreamId !== undefined ? (
-              <StreamSummaryPanel
-                streamNumber={activeStreamId}
-                summary={streamSummary || undefined}
-                timeseries={streamTimeseries}
-                isLoading={streamLoading}
-              />
+              <>
+                <StreamSummaryPanel
+                  streamNumber={activeStreamId}
+                  summary={streamSummary || undefined}
+                  timeseries={streamTimeseries}
+                  isLoading={streamLoading}
+                />
+                <StreamFollowPanel follow={streamFollow} isLoading={followLoading} />
+              </>
             ) : (
               <div className="text-xs text-muted-foreground">Select a stream (or apply a stream filter) to see stream details.</div>
             )}
             <div ref={detailsRef}>
-              <PacketDetailsPanel packet={selectedPacket} />
+              <PacketDetailsPanel jobId={jobId} packet={selectedPacket} />
             </div>
           </div>
         </Panel>
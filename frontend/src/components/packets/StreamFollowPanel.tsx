@@ -0,0 +1,57 @@
+import { Panel } from '../Panel'
+import { Badge } from '../ui/badge'
+import { StreamFollow } from '../../types/viewer'
+import { formatBytes } from '../../utils/format'
+
+type StreamFollowPanelProps = {
+  follow?: StreamFollow
+  isLoading?: boolean
+}
+
+export function StreamFollowPanel({ follow, isLoading }: StreamFollowPanelProps) {
+  return (
+    <Panel className="p-3">
+      <div className="text-xs font-semibold mb-2 uppercase tracking-wide text-muted-foreground">Follow Stream</div>
+      {isLoading ? (
+        <div className="text-xs text-muted-foreground">Reassembling stream…</div>
+      ) : follow ? (
+        <div className="space-y-2 text-xs">
+          <div className="font-mono text-[11px] text-muted-foreground">
+            {follow.client_ip}:{follow.client_port} → {formatBytes(follow.bytes_client_to_server)}, {follow.server_ip}:{follow.server_port} →{' '}
+            {formatBytes(follow.bytes_server_to_client)}
+          </div>
+          {follow.chunks.length === 0 ? (
+            <div className="text-muted-foreground">No application data.</div>
+          ) : (
+            <div className="max-h-[360px] overflow-auto space-y-1 font-mono text-[11px]">
+              {follow.chunks.map((chunk, i) => (
+                <div
+                  key={`${chunk.packet}-${i}`}
+                  className={chunk.direction === 'client_to_server' ? 'border-l-2 border-red-400 pl-2' : 'border-l-2 border-blue-400 pl-2'}
+                >
+                  <div className="flex flex-wrap items-center gap-2 text-muted-foreground">
+                    <span>#{chunk.packet}</span>
+                    <span>{new Date(chunk.timestamp).toLocaleTimeString()}</span>
+                    <span>
+                      offset {chunk.offset}, {chunk.length} bytes
+                    </span>
+                    {chunk.missing ? <Badge variant="med">{chunk.missing} bytes missing</Badge> : null}
+                    {chunk.retransmission ? <Badge variant="low">retransmission</Badge> : null}
+                  </div>
+                  {chunk.preview !== undefined ? <pre className="whitespace-pre-wrap break-all">{chunk.preview}</pre> : null}
+                </div>
+              ))}
+            </div>
+          )}
+          {follow.total_chunks > follow.chunks.length ? (
+            <div className="text-muted-foreground">
+              Showing the first {follow.chunks.length} of {follow.total_chunks} chunks.
+            </div>
+          ) : null}
+        </div>
+      ) : (
+        <div className="text-xs text-muted-foreground">No data to follow.</div>
+      )}
+    </Panel>
+  )
+}
@@ -1,7 +1,17 @@
-import { useMemo } from 'react'
-import { Packet } from '../types/viewer'
+import { useQuery } from '@tanstack/react-query'
+import { api } from '../lib/api'
+import { Packet, PacketDetail } from '../types/viewer'
 
-export function usePacketDetails(packet: Packet | null) {
-  const details = useMemo(() => packet, [packet])
-  return { details, isLoading: false }
+export function usePacketDetails(jobId: string | undefined, packet: Packet | null) {
+  const query = useQuery<PacketDetail>({
+    queryKey: ['jobPacket', jobId, packet?.index],
+    queryFn: ({ signal }) => api.getJobPacket(jobId!, packet!.index, { signal }),
+    enabled: !!jobId && !!packet
+  })
+  return {
+    details: packet,
+    layers: query.data?.layers ?? [],
+    payload: query.data?.payload,
+    isLoading: query.isLoading && !!packet
+  }
 }
@@ -0,0 +1,11 @@
+import { useQuery } from '@tanstack/react-query'
+import { api } from '../lib/api'
+import { StreamFollow } from '../types/viewer'
+
+export function useStreamFollow(jobId?: string, streamId?: number) {
+  return useQuery<StreamFollow>({
+    queryKey: ['streamFollow', jobId, streamId],
+    queryFn: ({ signal }) => api.followJobStream(jobId!, streamId!, { signal }),
+    enabled: !!jobId && streamId !== undefined
+  })
+}
@@ -31,6 +31,25 @@ async function apiFetch<T>(path: string, options: RequestInit = {}): Promise<T>
   return response.json() as Promise<T>
 }
 
+async function downloadFile(path: string) {
+  const token = auth.getToken()
+  const response = await fetch(`${API_URL}${path}`, {
+    headers: token ? { Authorization: `Bearer ${token}` } : undefined
+  })
+  if (!response.ok) {
+    const message = await response.text()
+    throw new Error(message || 'Download failed')
+  }
+  const disposition = response.headers.get('Content-Disposition') || ''
+  const match = disposition.match(/filename="([^"]+)"/)
+  const url = URL.createObjectURL(await response.blob())
+  const link = document.createElement('a')
+  link.href = url
+  link.download = match ? match[1] : 'capture.pcap'
+  link.click()
+  URL.revokeObjectURL(url)
+}
+
 export const api = {
   register(email: string, password: string) {
     return apiFetch<{ token: string }>('/api/auth/register', {
@@ -56,9 +75,11 @@ export const api = {
   deletePcap(id: string) {
     return apiFetch<{ status: string }>(`/api/pcaps/${id}`, { method: 'DELETE' })
   },
-  uploadPcap(file: File) {
+  uploadPcap(file: File, keyLog?: File | null, captureFilter?: string) {
     const form = new FormData()
     form.append('pcap', file)
+    if (keyLog) form.append('keylog', keyLog)
+    if (captureFilter?.trim()) form.append('capture_filter', captureFilter.trim())
     const token = auth.getToken()
     return fetch(`${API_URL}/api/pcaps/upload`, {
       method: 'POST',
@@ -67,7 +88,29 @@ export const api = {
     }).then(async (res) => {
       if (!res.ok) {
         const text = await res.text()
-        throw new Error(text || 'Upload failed')
+        let message = text
+        try {
+          message = JSON.parse(text).error || text
+        } catch {
+          // not JSON; show the body as is
+        }
+        throw new Error(message || 'Upload failed')
+      }
+      return res.json()
+    })
+  },
+  uploadKeyLog(pcapId: string, keyLog: File) {
+    const form = new FormData()
+    form.append('keylog', keyLog)
+    const token = auth.getToken()
+    return fetch(`${API_URL}/api/pcaps/${pcapId}/keylog`, {
+      method: 'POST',
+      headers: token ? { Authorization: `Bearer ${token}` } : undefined,
+      body: form
+    }).then(async (res) => {
+      if (!res.ok) {
+        const text = await res.text()
+        throw new Error(text || 'Key log upload failed')
       }
       return res.json()
     })
@@ -106,6 +149,23 @@ export const api = {
     const qs = search.toString()
     return apiFetch<any>(`/api/jobs/${jobId}/packets${qs ? `?${qs}` : ''}`, { signal: options?.signal })
   },
+  getJobPacket(jobId: string, index: number, options?: { signal?: AbortSignal }) {
+    return apiFetch<any>(`/api/jobs/${jobId}/packets/${index}`, { signal: options?.signal })
+  },
+  followJobStream(jobId: string, stream: number, options?: { signal?: AbortSignal }) {
+    return apiFetch<any>(`/api/jobs/${jobId}/streams/${stream}/follow`, { signal: options?.signal })
+  },
+  listJobHTTP(jobId: string, params?: Record<string, string | number | undefined>) {
+    const search = new URLSearchParams()
+    if (params) {
+      Object.entries(params).forEach(([key, value]) => {
+        if (value === undefined || value === null || value === '') return
+        search.set(key, String(value))
+      })
+    }
+    const qs = search.toString()
+    return apiFetch<any>(`/api/jobs/${jobId}/http${qs ? `?${qs}` : ''}`)
+  },
   getFlow(flowId: string) {
     return apiFetch<any>(`/api/flows/${flowId}`)
   },
@@ -143,5 +203,22 @@ export const api = {
   },
   certInspect(flowId: string) {
     return apiFetch<any>(`/api/flows/${flowId}/cert-inspect`, { method: 'POST' })
+  },
+  downloadFlowCapture(flowId: string) {
+    return downloadFile(`/api/flows/${flowId}/pcap`)
+  },
+  downloadIssueCapture(issueId: string) {
+    return downloadFile(`/api/issues/${issueId}/pcap`)
+  },
+  downloadJobPackets(jobId: string, params?: Record<string, string | number | undefined>) {
+    const search = new URLSearchParams()
+    if (params) {
+      Object.entries(params).forEach(([key, value]) => {
+        if (value === undefined || value === null || value === '') return
+        search.set(key, String(value))
+      })
+    }
+    const qs = search.toString()
+    return downloadFile(`/api/jobs/${jobId}/packets/pcap${qs ? `?${qs}` : ''}`)
   }
 }
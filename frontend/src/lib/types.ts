@@ -1,6 +1,8 @@
 export type Pcap = {
   id: number
   filename: string
+  keylog_path?: string
+  capture_filter?: string
   uploaded_at: string
 }
 
@@ -22,12 +24,20 @@ export type Flow = {
   client_port: number
   server_ip: string
   server_port: number
+  tunnel_type?: string
+  tunnel_id?: number
+  interfaces?: string
   start_ts?: string
   end_ts?: string
   syn_time?: string
   syn_ack_time?: string
   ack_time?: string
   handshake_rtt_ms_estimate?: number
+  rtt_min_ms?: number
+  rtt_avg_ms?: number
+  rtt_p95_ms?: number
+  rtt_max_ms?: number
+  rtt_samples?: number
   bytes_sent: number
   bytes_recv: number
   bytes_client_to_server: number
@@ -45,17 +55,87 @@ export type Flow = {
   tcp_stream?: number
   rst_count?: number
   fragment_count?: number
+  fragments_reassembled?: number
+  fragment_timeouts?: number
+  fragment_incomplete?: number
   tls_sni?: string
   tls_version?: string
   alpn?: string
+  ja3?: string
+  ja3s?: string
+  ja4?: string
   tls_client_hello?: boolean
   tls_server_hello?: boolean
   tls_alert?: boolean
   tls_alert_code?: number
   mss?: number
+  client_mss?: number
+  server_mss?: number
+  client_wscale?: number
+  server_wscale?: number
+  client_rwnd_min?: number
+  client_rwnd_max?: number
+  server_rwnd_min?: number
+  server_rwnd_max?: number
+  sack_permitted?: boolean
+  tcp_timestamps?: boolean
+  sack_loss_events?: number
+  tcp_state?: string
+  close_initiator?: string
+  tcp_handshake?: string
+  mid_connection?: boolean
+  tcp_retrans_rto?: number
+  tcp_retrans_fast?: number
+  tcp_retrans_tlp?: number
+  tcp_retrans_spurious?: number
+  tcp_retrans_partial?: number
+  rto_min_ms?: number
+  rto_avg_ms?: number
+  rto_max_ms?: number
+  zero_windows?: number
+  zero_window_probes?: number
+  window_updates?: number
+  window_full?: number
+  client_stall_ms?: number
+  server_stall_ms?: number
   http_method?: string
   http_host?: string
   http_time?: string
+  http_path?: string
+  http_status?: number
+  http_response_ms?: number
+  tls_decrypted?: boolean
+  http_requests?: number
+  http_responses?: number
+  http_4xx?: number
+  http_5xx?: number
+  http_ttfb_p50_ms?: number
+  http_ttfb_p95_ms?: number
+  http_ttfb_max_ms?: number
+  dns_queries?: number
+  dns_responses?: number
+  dns_nxdomain?: number
+  dns_servfail?: number
+  dns_unanswered?: number
+  dns_latency_avg_ms?: number
+  dns_latency_max_ms?: number
+  dns_query_name?: string
+  dns_query_type?: string
+  quic_version?: string
+  quic_dcid?: string
+  quic_scid?: string
+  quic_client_initials?: number
+  quic_server_packets?: number
+  quic_version_negotiation?: boolean
+  quic_retry?: boolean
+  quic_handshake_failed?: boolean
+  icmp_errors?: number
+  icmp_unreachable?: number
+  icmp_frag_needed?: number
+  icmp_time_exceeded?: number
+  icmp_next_hop_mtu?: number
+  icmp_unreachable_code?: number
+  cert_report_json?: string
 }
 
 export type Issue = {
@@ -107,6 +187,13 @@ export type PacketMeta = {
   tls_alert?: boolean
   tls_alert_code?: number
   tls_sni?: string
+  ja3?: string
+  ja3s?: string
+  ja4?: string
   http_method?: string
   http_host?: string
+  dns_query_name?: string
+  tunnel_type?: string
+  tunnel_id?: number
+  interface?: string
 }
@@ -56,6 +56,8 @@ export default function FlowDetailPage() {
     return 'LOW'
   }
 
+  const rttMs = flow?.handshake_rtt_ms_estimate ?? flow?.rtt_min_ms
+
   const handshakeItems: DetailItem[] =
     flow?.protocol === 'TCP'
       ? [
@@ -66,6 +68,14 @@ export default function FlowDetailPage() {
             label: 'Handshake RTT',
             value: typeof flow?.handshake_rtt_ms_estimate === 'number' ? `${flow.handshake_rtt_ms_estimate.toFixed(1)} ms` : 'n/a'
           },
+          {
+            label: 'RTT min / avg / p95 / max',
+            value:
+              typeof flow?.rtt_min_ms === 'number'
+                ? `${flow.rtt_min_ms.toFixed(1)} / ${flow.rtt_avg_ms?.toFixed(1)} / ${flow.rtt_p95_ms?.toFixed(1)} / ${flow.rtt_max_ms?.toFixed(1)} ms`
+                : 'n/a'
+          },
+          { label: 'RTT samples', value: flow?.rtt_samples ?? 0 },
           { label: 'RSTs', value: flow?.rst_count ?? 0 }
         ]
       : [
@@ -81,7 +91,63 @@ export default function FlowDetailPage() {
     { label: 'TLS Alert', value: flow?.tls_alert ? `yes${flow.tls_alert_code ? ` (${flow.tls_alert_code})` : ''}` : 'no' },
     { label: 'SNI', value: flow?.tls_sni ?? 'n/a' },
     { label: 'ALPN', value: flow?.alpn ?? 'n/a' },
-    { label: 'HTTP', value: flow?.http_method ? `${flow.http_method} ${flow.http_host || ''}`.trim() : 'n/a' }
+    { label: 'JA3', value: flow?.ja3 ?? 'n/a' },
+    { label: 'JA3S', value: flow?.ja3s ?? 'n/a' },
+    { label: 'JA4', value: flow?.ja4 ?? 'n/a' },
+    { label: 'Decrypted', value: flow?.tls_decrypted ? 'yes (key log)' : 'no' },
+    {
+      label: 'HTTP',
+      value: flow?.http_method ? `${flow.http_method} ${flow.http_host || ''}${flow.http_path || ''}`.trim() : 'n/a'
+    },
+    {
+      label: 'HTTP Status',
+      value:
+        flow?.http_status != null
+          ? `${flow.http_status}${flow.http_response_ms != null ? ` in ${flow.http_response_ms.toFixed(1)} ms` : ''}`
+          : 'n/a'
+    },
+    {
+      label: 'HTTP Transactions',
+      value: flow?.http_requests
+        ? `${flow.http_requests} req / ${flow.http_responses ?? 0} resp (${flow.http_4xx ?? 0} 4xx, ${flow.http_5xx ?? 0} 5xx)`
+        : 'n/a'
+    },
+    {
+      label: 'HTTP TTFB',
+      value:
+        flow?.http_ttfb_p50_ms != null
+          ? `p50 ${flow.http_ttfb_p50_ms.toFixed(1)} / p95 ${(flow.http_ttfb_p95_ms ?? 0).toFixed(1)} / max ${(flow.http_ttfb_max_ms ?? 0).toFixed(1)} ms`
+          : 'n/a'
+    }
+  ]
+
+  const hasDNS = (flow?.dns_queries ?? 0) > 0 || (flow?.dns_responses ?? 0) > 0
+  const dnsItems: DetailItem[] = [
+    { label: 'Query', value: flow?.dns_query_name ? `${flow.dns_query_type ?? ''} ${flow.dns_query_name}`.trim() : 'n/a' },
+    { label: 'Queries', value: flow?.dns_queries ?? 0 },
+    { label: 'Responses', value: flow?.dns_responses ?? 0 },
+    { label: 'NXDOMAIN', value: flow?.dns_nxdomain ?? 0 },
+    { label: 'SERVFAIL', value: flow?.dns_servfail ?? 0 },
+    { label: 'Unanswered', value: flow?.dns_unanswered ?? 0 },
+    {
+      label: 'Latency avg/max',
+      value:
+        typeof flow?.dns_latency_avg_ms === 'number'
+          ? `${flow.dns_latency_avg_ms.toFixed(1)} / ${(flow.dns_latency_max_ms ?? flow.dns_latency_avg_ms).toFixed(1)} ms`
+          : 'n/a'
+    }
+  ]
+
+  const hasQUIC = Boolean(flow?.quic_version) || (flow?.quic_client_initials ?? 0) > 0
+  const quicItems: DetailItem[] = [
+    { label: 'Version', value: flow?.quic_version || 'n/a' },
+    { label: 'DCID', value: flow?.quic_dcid || 'n/a' },
+    { label: 'SCID', value: flow?.quic_scid || 'n/a' },
+    { label: 'Client Initials', value: flow?.quic_client_initials ?? 0 },
+    { label: 'Server packets', value: flow?.quic_server_packets ?? 0 },
+    { label: 'Version negotiation', value: flow?.quic_version_negotiation ? 'yes' : 'no' },
+    { label: 'Retry', value: flow?.quic_retry ? 'yes' : 'no' },
+    { label: 'Handshake failed', value: flow?.quic_handshake_failed ? 'yes' : 'no' }
   ]
 
   const metricsItems: DetailItem[] = [
@@ -91,11 +157,33 @@ export default function FlowDetailPage() {
     { label: 'Throughput', value: typeof flow?.throughput_bps === 'number' ? `${Math.round(flow.throughput_bps)} B/s` : 'n/a' },
     { label: 'MSS', value: mss ?? 'n/a' },
     { label: 'Est. MTU (v4/v6)', value: mss ? `${mtuV4} / ${mtuV6}` : 'n/a' },
+    { label: 'MSS (client/server)', value: `${flow?.client_mss ?? 'n/a'} / ${flow?.server_mss ?? 'n/a'}` },
+    { label: 'Window scale (client/server)', value: `${flow?.client_wscale ?? 'n/a'} / ${flow?.server_wscale ?? 'n/a'}` },
+    { label: 'Client rwnd', value: typeof flow?.client_rwnd_max === 'number' ? `${flow.client_rwnd_min} – ${flow.client_rwnd_max} B` : 'n/a' },
+    { label: 'Server rwnd', value: typeof flow?.server_rwnd_max === 'number' ? `${flow.server_rwnd_min} – ${flow.server_rwnd_max} B` : 'n/a' },
+    { label: 'SACK / timestamps', value: `${flow?.sack_permitted ? 'yes' : 'no'} / ${flow?.tcp_timestamps ? 'yes' : 'no'}` },
+    { label: 'SACK loss events', value: flow?.sack_loss_events ?? 0 },
+    { label: 'Zero windows / probes', value: `${flow?.zero_windows ?? 0} / ${flow?.zero_window_probes ?? 0}` },
+    { label: 'Window updates / full', value: `${flow?.window_updates ?? 0} / ${flow?.window_full ?? 0}` },
+    { label: 'Stall (client/server)', value: `${Math.round(flow?.client_stall_ms ?? 0)} / ${Math.round(flow?.server_stall_ms ?? 0)} ms` },
     { label: 'TCP Retransmits', value: flow?.tcp_retransmissions ?? 0 },
+    { label: 'Retrans RTO / fast / TLP', value: `${flow?.tcp_retrans_rto ?? 0} / ${flow?.tcp_retrans_fast ?? 0} / ${flow?.tcp_retrans_tlp ?? 0}` },
+    { label: 'Retrans spurious / partial', value: `${flow?.tcp_retrans_spurious ?? 0} / ${flow?.tcp_retrans_partial ?? 0}` },
+    { label: 'RTO (min/avg/max)', value: typeof flow?.rto_max_ms === 'number' ? `${Math.round(flow.rto_min_ms ?? 0)} / ${Math.round(flow.rto_avg_ms ?? 0)} / ${Math.round(flow.rto_max_ms)} ms` : 'n/a' },
     { label: 'Out-of-Order', value: flow?.out_of_order ?? 0 },
     { label: 'Dup ACKs', value: flow?.dup_acks ?? 0 },
     { label: 'RSTs', value: flow?.rst_count ?? 0 },
-    { label: 'Fragments', value: flow?.fragment_count ?? 0 }
+    { label: 'TCP state', value: flow?.tcp_state ? `${flow.tcp_state}${flow.close_initiator ? ` (by ${flow.close_initiator})` : ''}` : 'n/a' },
+    { label: 'Handshake', value: flow?.tcp_handshake ?? (flow?.mid_connection ? 'not captured' : 'n/a') },
+    { label: 'Fragments', value: flow?.fragment_count ?? 0 },
+    { label: 'Datagrams reassembled', value: flow?.fragments_reassembled ?? 0 },
+    { label: 'Fragment timeouts', value: flow?.fragment_timeouts ?? 0 },
+    { label: 'Fragments incomplete', value: flow?.fragment_incomplete ?? 0 },
+    { label: 'ICMP errors', value: flow?.icmp_errors ?? 0 },
+    { label: 'ICMP unreachable', value: flow?.icmp_unreachable ?? 0 },
+    { label: 'ICMP frag needed', value: flow?.icmp_frag_needed ?? 0 },
+    { label: 'ICMP time exceeded', value: flow?.icmp_time_exceeded ?? 0 },
+    { label: 'ICMP next-hop MTU', value: flow?.icmp_next_hop_mtu ?? 'n/a' }
   ]
 
   return (
@@ -107,17 +195,30 @@ export default function FlowDetailPage() {
               <div className="text-xs uppercase text-muted-foreground">Flow Detail</div>
               <div className="text-sm font-mono text-muted-foreground">{subtitle}</div>
             </div>
-            {flow?.tls_sni && (
-              <Button variant="outline" onClick={inspectCert} size="sm">
-                Cert Inspection
+            <div className="flex gap-2">
+              <Button variant="outline" onClick={() => id && api.downloadFlowCapture(id)} size="sm">
+                Download PCAP
               </Button>
-            )}
+              {flow?.tls_sni && (
+                <Button variant="outline" onClick={inspectCert} size="sm">
+                  Cert Inspection
+                </Button>
+              )}
+            </div>
           </div>
           <div className="flex flex-wrap gap-2 mt-3">
             {flow?.tls_sni && <Badge variant="low">SNI {flow.tls_sni}</Badge>}
             {flow?.tls_version && <Badge variant="low">{flow.tls_version}</Badge>}
             {flow?.alpn && <Badge variant="low">ALPN {flow.alpn}</Badge>}
             {flow?.http_host && <Badge variant="low">HTTP {flow.http_host}</Badge>}
+            {flow?.dns_query_name && <Badge variant="low">DNS {flow.dns_query_name}</Badge>}
+            {flow?.quic_version && <Badge variant="low">{flow.quic_version}</Badge>}
+            {flow?.tunnel_type && (
+              <Badge variant="low">
+                {flow.tunnel_type.toUpperCase()} {flow.tunnel_id ?? ''}
+              </Badge>
+            )}
+            {flow?.interfaces && <Badge variant="low">IF {flow.interfaces}</Badge>}
           </div>
         </Panel>
 
@@ -125,7 +226,7 @@ export default function FlowDetailPage() {
           <Panel className="p-4">
             <div className="text-xs uppercase text-muted-foreground">RTT</div>
             <div className="text-xl font-semibold">
-              {flow ? (typeof flow?.handshake_rtt_ms_estimate === 'number' ? `${flow.handshake_rtt_ms_estimate.toFixed(1)} ms` : 'n/a') : <Skeleton className="h-5 w-16" />}
+              {flow ? (typeof rttMs === 'number' ? `${rttMs.toFixed(1)} ms` : 'n/a') : <Skeleton className="h-5 w-16" />}
             </div>
           </Panel>
           <Panel className="p-4">
@@ -153,6 +254,24 @@ export default function FlowDetailPage() {
           </Panel>
         </div>
 
+        {hasDNS && (
+          <Panel className="p-4">
+            <div className="text-sm font-semibold">DNS</div>
+            <div className="mt-2">
+              <DetailGrid items={dnsItems} />
+            </div>
+          </Panel>
+        )}
+
+        {hasQUIC && (
+          <Panel className="p-4">
+            <div className="text-sm font-semibold">QUIC</div>
+            <div className="mt-2">
+              <DetailGrid items={quicItems} />
+            </div>
+          </Panel>
+        )}
+
         <Panel className="p-4">
           <div className="text-sm font-semibold">Metrics, MSS/MTU, Flags</div>
           <div className="mt-2">
@@ -199,9 +318,11 @@ export default function FlowDetailPage() {
       <AnimatedDialog open={certOpen} onClose={() => setCertOpen(false)} title="Cert Inspection">
         {certReport ? (
           <div className="space-y-2 text-sm">
+            <div>Source: {certReport.source === 'capture' ? 'capture' : 'live connection'}</div>
             <div>Subject: {certReport.subject}</div>
             <div>Issuer: {certReport.issuer}</div>
             <div>Expires: {certReport.not_after ? new Date(certReport.not_after).toLocaleString() : 'n/a'}</div>
+            <div>SANs: {certReport.sans?.join(', ') || 'none'}</div>
             <div>Issues: {certReport.issues?.join(', ') || 'none'}</div>
           </div>
         ) : (
@@ -169,9 +169,14 @@ export default function IssuesPage() {
               <div className="space-y-2 text-sm">
                 <div className="font-semibold">{selectedIssue.title}</div>
                 <div className="text-muted-foreground">{selectedIssue.summary}</div>
-                <Button size="sm" onClick={explain}>
-                  Explain with AI
-                </Button>
+                <div className="flex gap-2">
+                  <Button size="sm" onClick={explain}>
+                    Explain with AI
+                  </Button>
+                  <Button size="sm" variant="outline" onClick={() => api.downloadIssueCapture(String(selectedIssue.id))}>
+                    Download evidence
+                  </Button>
+                </div>
               </div>
             ) : (
               <div className="text-xs text-muted-foreground">Select an issue to view details.</div>
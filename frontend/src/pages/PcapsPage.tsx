@@ -58,6 +58,8 @@ function PcapActionsCell({ pcap, onDelete }: { pcap: any; onDelete: (pcap: any)
 
 export default function PcapsPage() {
   const [file, setFile] = useState<File | null>(null)
+  const [keyLog, setKeyLog] = useState<File | null>(null)
+  const [captureFilter, setCaptureFilter] = useState('')
   const queryClient = useQueryClient()
   const [search, setSearch] = useState('')
   const [deleteTarget, setDeleteTarget] = useState<any | null>(null)
@@ -65,9 +67,11 @@ export default function PcapsPage() {
   const { data: pcaps, isLoading } = useQuery({ queryKey: ['pcaps'], queryFn: api.listPcaps })
 
   const uploadMutation = useMutation({
-    mutationFn: (f: File) => api.uploadPcap(f),
+    mutationFn: (f: File) => api.uploadPcap(f, keyLog, captureFilter),
     onSuccess: () => {
       setFile(null)
+      setKeyLog(null)
+      setCaptureFilter('')
       queryClient.invalidateQueries({ queryKey: ['pcaps'] })
     }
   })
@@ -130,6 +134,22 @@ export default function PcapsPage() {
               <div className="text-sm font-medium">{file ? `Selected: ${file.name}` : 'Drop PCAP or click to browse'}</div>
               <p className="text-xs text-muted-foreground">Supports .pcap files</p>
             </div>
+            <label className="mt-3 flex items-center gap-2 text-xs text-muted-foreground">
+              <span>TLS key log (optional)</span>
+              <input type="file" className="text-xs" onChange={(e) => setKeyLog(e.target.files?.[0] || null)} />
+            </label>
+            <label className="mt-3 flex items-center gap-2 text-xs text-muted-foreground">
+              <span className="shrink-0">Capture filter (optional)</span>
+              <Input
+                placeholder="tcp port 443 and host 10.1.2.3"
+                value={captureFilter}
+                onChange={(e) => setCaptureFilter(e.target.value)}
+                className="font-mono text-xs"
+              />
+            </label>
+            {uploadMutation.isError && (
+              <p className="mt-2 text-xs text-destructive">{(uploadMutation.error as Error).message}</p>
+            )}
           </Panel>
           <Panel className="p-4">
             <div className="text-sm font-semibold mb-2">Workspace</div>
@@ -99,6 +99,57 @@ export type Packet = {
   http_host?: string
 }
 
+export type PacketField = {
+  name: string
+  value?: string
+  children?: PacketField[]
+}
+
+export type PacketLayer = {
+  name: string
+  length: number
+  fields: PacketField[]
+}
+
+export type PacketPayload = {
+  length: number
+  truncated: boolean
+  hex: string
+}
+
+export type PacketDetail = {
+  index: number
+  timestamp: string
+  captured_length: number
+  length: number
+  packet?: Packet
+  layers: PacketLayer[]
+  payload?: PacketPayload
+}
+
+export type StreamChunk = {
+  packet: number
+  timestamp: string
+  direction: 'client_to_server' | 'server_to_client'
+  offset: number
+  length: number
+  missing?: number
+  retransmission: boolean
+  preview?: string
+}
+
+export type StreamFollow = {
+  protocol: string
+  client_ip: string
+  client_port: number
+  server_ip: string
+  server_port: number
+  bytes_client_to_server: number
+  bytes_server_to_client: number
+  chunks: StreamChunk[]
+  total_chunks: number
+}
+
 export type FlowSummary = {
   id: number
   protocol: string